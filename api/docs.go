@@ -23,33 +23,58 @@ const docTemplate = `{
     "host": "{{.Host}}",
     "basePath": "{{.BasePath}}",
     "paths": {
-        "/segments": {
+        "/admin/api-keys": {
             "get": {
-                "description": "Get all segments from the database",
-                "consumes": [
-                    "application/json"
+                "security": [
+                    {
+                        "ApiKeyAuth": []
+                    }
                 ],
+                "description": "Returns all API keys, including the revoked ones, without the keys themselves.",
                 "produces": [
                     "application/json"
                 ],
                 "tags": [
-                    "segments"
+                    "admin"
                 ],
-                "summary": "Get All segments",
+                "summary": "List API keys",
                 "responses": {
                     "200": {
-                        "description": "An array of segments was obtained",
+                        "description": "The keys were obtained",
                         "schema": {
                             "type": "array",
                             "items": {
-                                "$ref": "#/definitions/dto.SegmentResponse"
+                                "$ref": "#/definitions/dto.APIKeyResponse"
                             }
                         }
+                    },
+                    "401": {
+                        "description": "Unauthorized",
+                        "schema": {
+                            "$ref": "#/definitions/response.ErrorResponse"
+                        }
+                    },
+                    "403": {
+                        "description": "Forbidden",
+                        "schema": {
+                            "$ref": "#/definitions/response.ErrorResponse"
+                        }
+                    },
+                    "500": {
+                        "description": "Internal server error",
+                        "schema": {
+                            "$ref": "#/definitions/response.ErrorResponse"
+                        }
                     }
                 }
             },
             "post": {
-                "description": "Creates a segment in the database and returns the instance",
+                "security": [
+                    {
+                        "ApiKeyAuth": []
+                    }
+                ],
+                "description": "Issues an API key with the given scopes: memberships:read, memberships:write, segments:manage,\nusers:manage, reports:read, admin (implies all). The key is returned only once, only its hash is stored.",
                 "consumes": [
                     "application/json"
                 ],
@@ -57,73 +82,139 @@ const docTemplate = `{
                     "application/json"
                 ],
                 "tags": [
-                    "segments"
+                    "admin"
                 ],
-                "summary": "Add segment",
+                "summary": "Create API key",
                 "parameters": [
                     {
-                        "description": "Information about the segment to be added",
-                        "name": "Segment",
+                        "description": "Name and scopes of the key",
+                        "name": "Key",
                         "in": "body",
                         "required": true,
                         "schema": {
-                            "$ref": "#/definitions/dto.SegmentCreateRequest"
+                            "$ref": "#/definitions/dto.APIKeyCreateRequest"
                         }
                     }
                 ],
                 "responses": {
                     "201": {
-                        "description": "The segment has been successfully established",
+                        "description": "The key has been issued",
                         "schema": {
-                            "$ref": "#/definitions/dto.SegmentResponse"
+                            "$ref": "#/definitions/dto.APIKeyResponse"
+                        }
+                    },
+                    "400": {
+                        "description": "Invalid request",
+                        "schema": {
+                            "$ref": "#/definitions/response.ErrorResponse"
+                        }
+                    },
+                    "401": {
+                        "description": "Unauthorized",
+                        "schema": {
+                            "$ref": "#/definitions/response.ErrorResponse"
+                        }
+                    },
+                    "403": {
+                        "description": "Forbidden",
+                        "schema": {
+                            "$ref": "#/definitions/response.ErrorResponse"
+                        }
+                    },
+                    "422": {
+                        "description": "Validation failed",
+                        "schema": {
+                            "$ref": "#/definitions/response.ErrorResponse"
+                        }
+                    },
+                    "500": {
+                        "description": "Internal server error",
+                        "schema": {
+                            "$ref": "#/definitions/response.ErrorResponse"
                         }
                     }
                 }
             }
         },
-        "/segments/{slug}": {
-            "get": {
-                "description": "Get segment by slug",
-                "consumes": [
-                    "application/json"
+        "/admin/api-keys/{id}": {
+            "delete": {
+                "security": [
+                    {
+                        "ApiKeyAuth": []
+                    }
                 ],
+                "description": "Revokes the API key, it stops authenticating at once. Returns the revoked key.",
                 "produces": [
                     "application/json"
                 ],
                 "tags": [
-                    "segments"
+                    "admin"
                 ],
-                "summary": "Get segment",
+                "summary": "Revoke API key",
                 "parameters": [
                     {
-                        "type": "string",
-                        "description": "Segment slug",
-                        "name": "slug",
+                        "type": "integer",
+                        "description": "API key ID",
+                        "name": "id",
                         "in": "path",
                         "required": true
                     }
                 ],
                 "responses": {
                     "200": {
-                        "description": "A segment with such a slogan was obtained",
+                        "description": "The key has been revoked",
                         "schema": {
-                            "$ref": "#/definitions/dto.SegmentResponse"
+                            "$ref": "#/definitions/dto.APIKeyResponse"
+                        }
+                    },
+                    "400": {
+                        "description": "Invalid request",
+                        "schema": {
+                            "$ref": "#/definitions/response.ErrorResponse"
+                        }
+                    },
+                    "401": {
+                        "description": "Unauthorized",
+                        "schema": {
+                            "$ref": "#/definitions/response.ErrorResponse"
+                        }
+                    },
+                    "403": {
+                        "description": "Forbidden",
+                        "schema": {
+                            "$ref": "#/definitions/response.ErrorResponse"
+                        }
+                    },
+                    "404": {
+                        "description": "Not found or already revoked",
+                        "schema": {
+                            "$ref": "#/definitions/response.ErrorResponse"
+                        }
+                    },
+                    "500": {
+                        "description": "Internal server error",
+                        "schema": {
+                            "$ref": "#/definitions/response.ErrorResponse"
                         }
                     }
                 }
-            },
-            "put": {
-                "description": "Updates a segment in the database and returns an instance of it",
-                "consumes": [
-                    "application/json"
+            }
+        },
+        "/admin/segments/{slug}": {
+            "delete": {
+                "security": [
+                    {
+                        "ApiKeyAuth": []
+                    }
                 ],
+                "description": "Irreversibly deletes an archived segment together with its whole history.\nActive segments must be archived with DELETE /segments/{slug} first.",
                 "produces": [
                     "application/json"
                 ],
                 "tags": [
-                    "segments"
+                    "admin"
                 ],
-                "summary": "Update segment",
+                "summary": "Purge segment",
                 "parameters": [
                     {
                         "type": "string",
@@ -131,81 +222,243 @@ const docTemplate = `{
                         "name": "slug",
                         "in": "path",
                         "required": true
+                    }
+                ],
+                "responses": {
+                    "204": {
+                        "description": "The segment and its history have been deleted"
                     },
-                    {
-                        "description": "Segment change information",
-                        "name": "Segment",
-                        "in": "body",
-                        "required": true,
+                    "401": {
+                        "description": "Unauthorized",
                         "schema": {
-                            "$ref": "#/definitions/dto.SegmentUpdateRequest"
+                            "$ref": "#/definitions/response.ErrorResponse"
+                        }
+                    },
+                    "403": {
+                        "description": "Forbidden",
+                        "schema": {
+                            "$ref": "#/definitions/response.ErrorResponse"
+                        }
+                    },
+                    "404": {
+                        "description": "Not found",
+                        "schema": {
+                            "$ref": "#/definitions/response.ErrorResponse"
+                        }
+                    },
+                    "409": {
+                        "description": "Not archived",
+                        "schema": {
+                            "$ref": "#/definitions/response.ErrorResponse"
+                        }
+                    },
+                    "500": {
+                        "description": "Internal server error",
+                        "schema": {
+                            "$ref": "#/definitions/response.ErrorResponse"
                         }
                     }
+                }
+            }
+        },
+        "/healthz": {
+            "get": {
+                "description": "Reports that the process is running. Does not check the dependencies.",
+                "produces": [
+                    "application/json"
                 ],
+                "tags": [
+                    "health"
+                ],
+                "summary": "Liveness probe",
                 "responses": {
                     "200": {
-                        "description": "The segment with this slogan has been changed",
+                        "description": "The process is alive",
                         "schema": {
-                            "$ref": "#/definitions/dto.SegmentResponse"
+                            "$ref": "#/definitions/handlers.HealthStatus"
                         }
                     }
                 }
-            },
-            "delete": {
-                "description": "Deletes a segment from the database",
-                "consumes": [
-                    "application/json"
+            }
+        },
+        "/history": {
+            "get": {
+                "security": [
+                    {
+                        "ApiKeyAuth": []
+                    }
                 ],
+                "description": "Streams a report on the history of segment changes for the period (from and to, or year and month)\nfor the given users or all users, optionally filtered by segment slugs and actions,\nin the format from ?format= or the Accept header: csv (the delimiter is set by ?delimiter=,\n\";\" by default), tsv, json or ndjson. With mode=url a report job is created and the download link\nis returned; if the report is not ready in a few seconds, the job is returned with the status 202.",
                 "produces": [
-                    "application/json"
+                    "text/csv",
+                    "text/tab-separated-values",
+                    "application/json",
+                    "application/x-ndjson"
                 ],
                 "tags": [
-                    "segments"
+                    "user-segments-history"
                 ],
-                "summary": "Delete segment",
+                "summary": "Get a history report",
                 "parameters": [
                     {
                         "type": "string",
-                        "description": "Segment slug",
+                        "description": "Start of the period, inclusive (RFC 3339 or YYYY-MM-DD)",
+                        "name": "from",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "End of the period, exclusive (RFC 3339 or YYYY-MM-DD)",
+                        "name": "to",
+                        "in": "query"
+                    },
+                    {
+                        "type": "integer",
+                        "description": "Year, e.g. 2025",
+                        "name": "year",
+                        "in": "query"
+                    },
+                    {
+                        "type": "integer",
+                        "description": "Month, e.g. 02",
+                        "name": "month",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Time zone of the period and the report, e.g. Europe/Moscow (default UTC)",
+                        "name": "tz",
+                        "in": "query"
+                    },
+                    {
+                        "type": "array",
+                        "items": {
+                            "type": "integer"
+                        },
+                        "collectionFormat": "csv",
+                        "description": "User IDs, all users if not set",
+                        "name": "user_id",
+                        "in": "query"
+                    },
+                    {
+                        "type": "array",
+                        "items": {
+                            "type": "string"
+                        },
+                        "collectionFormat": "csv",
+                        "description": "Segment slugs",
                         "name": "slug",
-                        "in": "path",
-                        "required": true
+                        "in": "query"
+                    },
+                    {
+                        "type": "array",
+                        "items": {
+                            "type": "string"
+                        },
+                        "collectionFormat": "csv",
+                        "description": "Actions: ADD, REMOVE, EXPIRE",
+                        "name": "action",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Report format: csv, tsv, json, ndjson (overrides Accept)",
+                        "name": "format",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Field delimiter of the csv format (default ;)",
+                        "name": "delimiter",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "stream (default) or url",
+                        "name": "mode",
+                        "in": "query"
                     }
                 ],
                 "responses": {
-                    "204": {
-                        "description": "The segment with this slug has been successfully deleted"
+                    "200": {
+                        "description": "The report",
+                        "schema": {
+                            "type": "file"
+                        }
+                    },
+                    "202": {
+                        "description": "mode=url: the report is still being generated",
+                        "schema": {
+                            "$ref": "#/definitions/dto.ReportJobResponse"
+                        }
+                    },
+                    "400": {
+                        "description": "Invalid request",
+                        "schema": {
+                            "$ref": "#/definitions/response.ErrorResponse"
+                        }
+                    },
+                    "401": {
+                        "description": "Unauthorized",
+                        "schema": {
+                            "$ref": "#/definitions/response.ErrorResponse"
+                        }
+                    },
+                    "403": {
+                        "description": "Forbidden",
+                        "schema": {
+                            "$ref": "#/definitions/response.ErrorResponse"
+                        }
+                    },
+                    "422": {
+                        "description": "Validation failed",
+                        "schema": {
+                            "$ref": "#/definitions/response.ErrorResponse"
+                        }
+                    },
+                    "500": {
+                        "description": "Internal server error",
+                        "schema": {
+                            "$ref": "#/definitions/response.ErrorResponse"
+                        }
                     }
                 }
             }
         },
-        "/users": {
+        "/readyz": {
             "get": {
-                "description": "Get all users from the database",
-                "consumes": [
-                    "application/json"
-                ],
+                "description": "Reports whether the instance can serve requests: the database answers and the shutdown has not started.",
                 "produces": [
                     "application/json"
                 ],
                 "tags": [
-                    "users"
+                    "health"
                 ],
-                "summary": "Get All users",
+                "summary": "Readiness probe",
                 "responses": {
                     "200": {
-                        "description": "An array of users was obtained",
+                        "description": "Ready to serve requests",
                         "schema": {
-                            "type": "array",
-                            "items": {
-                                "$ref": "#/definitions/dto.UserResponse"
-                            }
+                            "$ref": "#/definitions/handlers.HealthStatus"
+                        }
+                    },
+                    "503": {
+                        "description": "Shutting down or the database is unavailable",
+                        "schema": {
+                            "$ref": "#/definitions/handlers.HealthStatus"
                         }
                     }
                 }
-            },
+            }
+        },
+        "/reports": {
             "post": {
-                "description": "Creates a user in the database and returns an instance of the user",
+                "security": [
+                    {
+                        "ApiKeyAuth": []
+                    }
+                ],
+                "description": "Creates a job generating a report (csv, tsv, json or ndjson) on the history of segment changes for the period\n(from/to or year/month in the time zone tz), optionally filtered by users, segment slugs and actions.\nPoll the job by the Location header until it is done and download the report by the link.",
                 "consumes": [
                     "application/json"
                 ],
@@ -213,69 +466,1600 @@ const docTemplate = `{
                     "application/json"
                 ],
                 "tags": [
-                    "users"
+                    "user-segments-history"
                 ],
-                "summary": "Add a user",
+                "summary": "Create a history report",
                 "parameters": [
                     {
-                        "description": "Information about the added user",
-                        "name": "User",
+                        "description": "Parameters of the report",
+                        "name": "Report",
                         "in": "body",
                         "required": true,
                         "schema": {
-                            "$ref": "#/definitions/dto.UserCreateRequest"
+                            "$ref": "#/definitions/dto.HistoryParams"
                         }
                     }
                 ],
                 "responses": {
-                    "201": {
-                        "description": "The user was successfully created",
+                    "202": {
+                        "description": "The job has been created",
                         "schema": {
-                            "$ref": "#/definitions/dto.UserResponse"
+                            "$ref": "#/definitions/dto.ReportJobResponse"
+                        }
+                    },
+                    "400": {
+                        "description": "Invalid request",
+                        "schema": {
+                            "$ref": "#/definitions/response.ErrorResponse"
+                        }
+                    },
+                    "401": {
+                        "description": "Unauthorized",
+                        "schema": {
+                            "$ref": "#/definitions/response.ErrorResponse"
+                        }
+                    },
+                    "403": {
+                        "description": "Forbidden",
+                        "schema": {
+                            "$ref": "#/definitions/response.ErrorResponse"
+                        }
+                    },
+                    "422": {
+                        "description": "Validation failed",
+                        "schema": {
+                            "$ref": "#/definitions/response.ErrorResponse"
+                        }
+                    },
+                    "500": {
+                        "description": "Internal server error",
+                        "schema": {
+                            "$ref": "#/definitions/response.ErrorResponse"
                         }
                     }
                 }
             }
         },
-        "/users/{id}": {
+        "/reports/download/{token}": {
             "get": {
-                "description": "Get user by id",
-                "consumes": [
-                    "application/json"
-                ],
+                "description": "Sends the report in the format it was created in; the link stops working when the token expires",
                 "produces": [
-                    "application/json"
+                    "text/csv",
+                    "text/tab-separated-values",
+                    "application/json",
+                    "application/x-ndjson"
                 ],
                 "tags": [
-                    "users"
+                    "user-segments-history"
                 ],
-                "summary": "Get user",
+                "summary": "Download a history report",
                 "parameters": [
                     {
-                        "type": "integer",
-                        "description": "User ID",
-                        "name": "id",
+                        "type": "string",
+                        "description": "Download token",
+                        "name": "token",
                         "in": "path",
                         "required": true
                     }
                 ],
                 "responses": {
                     "200": {
-                        "description": "A user with this id was received",
+                        "description": "Report",
                         "schema": {
-                            "$ref": "#/definitions/dto.UserResponse"
+                            "type": "file"
+                        }
+                    },
+                    "404": {
+                        "description": "Report not found or the link has expired",
+                        "schema": {
+                            "$ref": "#/definitions/response.ErrorResponse"
+                        }
+                    },
+                    "500": {
+                        "description": "Internal server error",
+                        "schema": {
+                            "$ref": "#/definitions/response.ErrorResponse"
                         }
                     }
                 }
-            },
-            "put": {
-                "description": "Updates the user in the database and returns an instance of the user",
-                "consumes": [
-                    "application/json"
-                ],
-                "produces": [
-                    "application/json"
-                ],
+            }
+        },
+        "/reports/{id}": {
+            "get": {
+                "security": [
+                    {
+                        "ApiKeyAuth": []
+                    }
+                ],
+                "description": "Returns the state of the job; a finished job contains the download link while it is valid",
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "user-segments-history"
+                ],
+                "summary": "Get a history report job",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "Job ID",
+                        "name": "id",
+                        "in": "path",
+                        "required": true
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "The job was obtained",
+                        "schema": {
+                            "$ref": "#/definitions/dto.ReportJobResponse"
+                        }
+                    },
+                    "401": {
+                        "description": "Unauthorized",
+                        "schema": {
+                            "$ref": "#/definitions/response.ErrorResponse"
+                        }
+                    },
+                    "403": {
+                        "description": "Forbidden",
+                        "schema": {
+                            "$ref": "#/definitions/response.ErrorResponse"
+                        }
+                    },
+                    "404": {
+                        "description": "Job not found",
+                        "schema": {
+                            "$ref": "#/definitions/response.ErrorResponse"
+                        }
+                    },
+                    "500": {
+                        "description": "Internal server error",
+                        "schema": {
+                            "$ref": "#/definitions/response.ErrorResponse"
+                        }
+                    }
+                }
+            }
+        },
+        "/segments": {
+            "get": {
+                "security": [
+                    {
+                        "ApiKeyAuth": []
+                    }
+                ],
+                "description": "Get a page of segments from the database.\nPagination is keyset-based: pass next_cursor of the previous page as cursor with the same sort.\nThe ETag identifies the content of the page; with a matching If-None-Match the response is 304.",
+                "consumes": [
+                    "application/json"
+                ],
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "segments"
+                ],
+                "summary": "Get All segments",
+                "parameters": [
+                    {
+                        "type": "integer",
+                        "description": "Page size (default 100, max 1000)",
+                        "name": "limit",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Cursor of the next page",
+                        "name": "cursor",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Sort key: id, slug, created_at; '-' prefix for descending order",
+                        "name": "sort",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Filter by slug prefix",
+                        "name": "slug_prefix",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Created at or after (RFC 3339)",
+                        "name": "created_from",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Created before (RFC 3339)",
+                        "name": "created_to",
+                        "in": "query"
+                    },
+                    {
+                        "type": "boolean",
+                        "description": "List archived segments instead of active ones",
+                        "name": "archived",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "ETag of the cached page",
+                        "name": "If-None-Match",
+                        "in": "header"
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "A page of segments was obtained",
+                        "schema": {
+                            "$ref": "#/definitions/dto.SegmentPageResponse"
+                        },
+                        "headers": {
+                            "ETag": {
+                                "type": "string",
+                                "description": "Hash of the page"
+                            }
+                        }
+                    },
+                    "304": {
+                        "description": "The page has not changed"
+                    },
+                    "400": {
+                        "description": "Invalid request",
+                        "schema": {
+                            "$ref": "#/definitions/response.ErrorResponse"
+                        }
+                    },
+                    "401": {
+                        "description": "Unauthorized",
+                        "schema": {
+                            "$ref": "#/definitions/response.ErrorResponse"
+                        }
+                    },
+                    "403": {
+                        "description": "Forbidden",
+                        "schema": {
+                            "$ref": "#/definitions/response.ErrorResponse"
+                        }
+                    },
+                    "422": {
+                        "description": "Validation failed",
+                        "schema": {
+                            "$ref": "#/definitions/response.ErrorResponse"
+                        }
+                    },
+                    "500": {
+                        "description": "Internal server error",
+                        "schema": {
+                            "$ref": "#/definitions/response.ErrorResponse"
+                        }
+                    }
+                }
+            },
+            "post": {
+                "security": [
+                    {
+                        "ApiKeyAuth": []
+                    }
+                ],
+                "description": "Creates a segment in the database and returns the instance.\nIf auto_percent is set, that share of all users (current and future) is enrolled in the segment.",
+                "consumes": [
+                    "application/json"
+                ],
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "segments"
+                ],
+                "summary": "Add segment",
+                "parameters": [
+                    {
+                        "description": "Information about the segment to be added",
+                        "name": "Segment",
+                        "in": "body",
+                        "required": true,
+                        "schema": {
+                            "$ref": "#/definitions/dto.SegmentCreateRequest"
+                        }
+                    }
+                ],
+                "responses": {
+                    "201": {
+                        "description": "The segment has been successfully established",
+                        "schema": {
+                            "$ref": "#/definitions/dto.SegmentResponse"
+                        }
+                    },
+                    "400": {
+                        "description": "Invalid request",
+                        "schema": {
+                            "$ref": "#/definitions/response.ErrorResponse"
+                        }
+                    },
+                    "401": {
+                        "description": "Unauthorized",
+                        "schema": {
+                            "$ref": "#/definitions/response.ErrorResponse"
+                        }
+                    },
+                    "403": {
+                        "description": "Forbidden",
+                        "schema": {
+                            "$ref": "#/definitions/response.ErrorResponse"
+                        }
+                    },
+                    "409": {
+                        "description": "Already exists",
+                        "schema": {
+                            "$ref": "#/definitions/response.ErrorResponse"
+                        }
+                    },
+                    "422": {
+                        "description": "Validation failed",
+                        "schema": {
+                            "$ref": "#/definitions/response.ErrorResponse"
+                        }
+                    },
+                    "500": {
+                        "description": "Internal server error",
+                        "schema": {
+                            "$ref": "#/definitions/response.ErrorResponse"
+                        }
+                    }
+                }
+            }
+        },
+        "/segments/export": {
+            "get": {
+                "security": [
+                    {
+                        "ApiKeyAuth": []
+                    }
+                ],
+                "description": "Streams all segments as NDJSON (one JSON object per line) straight from the database.\nThe response is gzip-compressed if the client sends Accept-Encoding: gzip.",
+                "produces": [
+                    "application/x-ndjson"
+                ],
+                "tags": [
+                    "segments"
+                ],
+                "summary": "Export segments",
+                "responses": {
+                    "200": {
+                        "description": "Segments, one per line",
+                        "schema": {
+                            "$ref": "#/definitions/dto.SegmentResponse"
+                        }
+                    },
+                    "401": {
+                        "description": "Unauthorized",
+                        "schema": {
+                            "$ref": "#/definitions/response.ErrorResponse"
+                        }
+                    },
+                    "403": {
+                        "description": "Forbidden",
+                        "schema": {
+                            "$ref": "#/definitions/response.ErrorResponse"
+                        }
+                    },
+                    "500": {
+                        "description": "Internal server error",
+                        "schema": {
+                            "$ref": "#/definitions/response.ErrorResponse"
+                        }
+                    }
+                }
+            }
+        },
+        "/segments/stats": {
+            "get": {
+                "security": [
+                    {
+                        "ApiKeyAuth": []
+                    }
+                ],
+                "description": "Returns the statistics of every segment ordered by slug, see /segments/{slug}/stats.",
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "segments"
+                ],
+                "summary": "Get statistics of all segments",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "First day of the period, YYYY-MM-DD (default 29 days before to)",
+                        "name": "from",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Last day of the period, inclusive, YYYY-MM-DD (default today)",
+                        "name": "to",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Time zone of the days, e.g. Europe/Moscow (default UTC)",
+                        "name": "tz",
+                        "in": "query"
+                    },
+                    {
+                        "type": "integer",
+                        "description": "Horizon of the members expiring soon (default 7)",
+                        "name": "expiring_within_days",
+                        "in": "query"
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "Statistics of the segments",
+                        "schema": {
+                            "type": "array",
+                            "items": {
+                                "$ref": "#/definitions/dto.SegmentStatsResponse"
+                            }
+                        }
+                    },
+                    "400": {
+                        "description": "Invalid request",
+                        "schema": {
+                            "$ref": "#/definitions/response.ErrorResponse"
+                        }
+                    },
+                    "401": {
+                        "description": "Unauthorized",
+                        "schema": {
+                            "$ref": "#/definitions/response.ErrorResponse"
+                        }
+                    },
+                    "403": {
+                        "description": "Forbidden",
+                        "schema": {
+                            "$ref": "#/definitions/response.ErrorResponse"
+                        }
+                    },
+                    "422": {
+                        "description": "Validation failed",
+                        "schema": {
+                            "$ref": "#/definitions/response.ErrorResponse"
+                        }
+                    },
+                    "500": {
+                        "description": "Internal server error",
+                        "schema": {
+                            "$ref": "#/definitions/response.ErrorResponse"
+                        }
+                    }
+                }
+            }
+        },
+        "/segments/{slug}": {
+            "get": {
+                "security": [
+                    {
+                        "ApiKeyAuth": []
+                    }
+                ],
+                "description": "Get segment by slug. A former slug of a renamed segment resolves to it until the alias expires:\nthe response then has deprecated_alias set and the Deprecation, Sunset and Link headers.\nThe ETag is the version of the segment; with a matching If-None-Match the response is 304.",
+                "consumes": [
+                    "application/json"
+                ],
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "segments"
+                ],
+                "summary": "Get segment",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "Segment slug",
+                        "name": "slug",
+                        "in": "path",
+                        "required": true
+                    },
+                    {
+                        "type": "string",
+                        "description": "ETag of the cached segment",
+                        "name": "If-None-Match",
+                        "in": "header"
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "A segment with such a slogan was obtained",
+                        "schema": {
+                            "$ref": "#/definitions/dto.SegmentResponse"
+                        },
+                        "headers": {
+                            "ETag": {
+                                "type": "string",
+                                "description": "Version of the segment"
+                            }
+                        }
+                    },
+                    "304": {
+                        "description": "The segment has not been modified"
+                    },
+                    "401": {
+                        "description": "Unauthorized",
+                        "schema": {
+                            "$ref": "#/definitions/response.ErrorResponse"
+                        }
+                    },
+                    "403": {
+                        "description": "Forbidden",
+                        "schema": {
+                            "$ref": "#/definitions/response.ErrorResponse"
+                        }
+                    },
+                    "404": {
+                        "description": "Not found",
+                        "schema": {
+                            "$ref": "#/definitions/response.ErrorResponse"
+                        }
+                    },
+                    "500": {
+                        "description": "Internal server error",
+                        "schema": {
+                            "$ref": "#/definitions/response.ErrorResponse"
+                        }
+                    }
+                }
+            },
+            "put": {
+                "security": [
+                    {
+                        "ApiKeyAuth": []
+                    }
+                ],
+                "description": "Updates a segment in the database and returns an instance of it with the new ETag.\nWith If-Match the segment is updated only if it has not been modified since (412 otherwise).",
+                "consumes": [
+                    "application/json"
+                ],
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "segments"
+                ],
+                "summary": "Update segment",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "Segment slug",
+                        "name": "slug",
+                        "in": "path",
+                        "required": true
+                    },
+                    {
+                        "type": "string",
+                        "description": "ETag of the version the change is based on",
+                        "name": "If-Match",
+                        "in": "header"
+                    },
+                    {
+                        "description": "Segment change information",
+                        "name": "Segment",
+                        "in": "body",
+                        "required": true,
+                        "schema": {
+                            "$ref": "#/definitions/dto.SegmentUpdateRequest"
+                        }
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "The segment with this slogan has been changed",
+                        "schema": {
+                            "$ref": "#/definitions/dto.SegmentResponse"
+                        },
+                        "headers": {
+                            "ETag": {
+                                "type": "string",
+                                "description": "Version of the segment"
+                            }
+                        }
+                    },
+                    "400": {
+                        "description": "Invalid request",
+                        "schema": {
+                            "$ref": "#/definitions/response.ErrorResponse"
+                        }
+                    },
+                    "401": {
+                        "description": "Unauthorized",
+                        "schema": {
+                            "$ref": "#/definitions/response.ErrorResponse"
+                        }
+                    },
+                    "403": {
+                        "description": "Forbidden",
+                        "schema": {
+                            "$ref": "#/definitions/response.ErrorResponse"
+                        }
+                    },
+                    "404": {
+                        "description": "Not found",
+                        "schema": {
+                            "$ref": "#/definitions/response.ErrorResponse"
+                        }
+                    },
+                    "412": {
+                        "description": "Modified since the ETag in If-Match",
+                        "schema": {
+                            "$ref": "#/definitions/response.ErrorResponse"
+                        }
+                    },
+                    "428": {
+                        "description": "If-Match is required",
+                        "schema": {
+                            "$ref": "#/definitions/response.ErrorResponse"
+                        }
+                    },
+                    "500": {
+                        "description": "Internal server error",
+                        "schema": {
+                            "$ref": "#/definitions/response.ErrorResponse"
+                        }
+                    }
+                }
+            },
+            "delete": {
+                "security": [
+                    {
+                        "ApiKeyAuth": []
+                    }
+                ],
+                "description": "Archives a segment: the memberships of all users are ended and recorded in the history as REMOVE,\nthe segment disappears from the active lookups, but its history stays reportable.\nThe segment can be restored with POST /segments/{slug}/restore.\nWith If-Match the segment is archived only if it has not been modified since (412 otherwise).",
+                "consumes": [
+                    "application/json"
+                ],
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "segments"
+                ],
+                "summary": "Delete segment",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "Segment slug",
+                        "name": "slug",
+                        "in": "path",
+                        "required": true
+                    },
+                    {
+                        "type": "string",
+                        "description": "ETag of the version the change is based on",
+                        "name": "If-Match",
+                        "in": "header"
+                    }
+                ],
+                "responses": {
+                    "204": {
+                        "description": "The segment with this slug has been successfully archived"
+                    },
+                    "401": {
+                        "description": "Unauthorized",
+                        "schema": {
+                            "$ref": "#/definitions/response.ErrorResponse"
+                        }
+                    },
+                    "403": {
+                        "description": "Forbidden",
+                        "schema": {
+                            "$ref": "#/definitions/response.ErrorResponse"
+                        }
+                    },
+                    "404": {
+                        "description": "Not found",
+                        "schema": {
+                            "$ref": "#/definitions/response.ErrorResponse"
+                        }
+                    },
+                    "409": {
+                        "description": "Already archived",
+                        "schema": {
+                            "$ref": "#/definitions/response.ErrorResponse"
+                        }
+                    },
+                    "412": {
+                        "description": "Modified since the ETag in If-Match",
+                        "schema": {
+                            "$ref": "#/definitions/response.ErrorResponse"
+                        }
+                    },
+                    "428": {
+                        "description": "If-Match is required",
+                        "schema": {
+                            "$ref": "#/definitions/response.ErrorResponse"
+                        }
+                    },
+                    "500": {
+                        "description": "Internal server error",
+                        "schema": {
+                            "$ref": "#/definitions/response.ErrorResponse"
+                        }
+                    }
+                }
+            }
+        },
+        "/segments/{slug}/rename": {
+            "post": {
+                "security": [
+                    {
+                        "ApiKeyAuth": []
+                    }
+                ],
+                "description": "Changes the slug of a segment. The history continues under the new slug, the old slug resolves\nto the segment as a deprecated alias for SEGMENTS_ALIAS_TTL. The rename is recorded in the audit trail.",
+                "consumes": [
+                    "application/json"
+                ],
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "segments"
+                ],
+                "summary": "Rename segment",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "Segment slug",
+                        "name": "slug",
+                        "in": "path",
+                        "required": true
+                    },
+                    {
+                        "description": "New slug",
+                        "name": "Rename",
+                        "in": "body",
+                        "required": true,
+                        "schema": {
+                            "$ref": "#/definitions/dto.SegmentRenameRequest"
+                        }
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "The segment has been renamed",
+                        "schema": {
+                            "$ref": "#/definitions/dto.SegmentRenameResponse"
+                        }
+                    },
+                    "400": {
+                        "description": "Invalid request",
+                        "schema": {
+                            "$ref": "#/definitions/response.ErrorResponse"
+                        }
+                    },
+                    "401": {
+                        "description": "Unauthorized",
+                        "schema": {
+                            "$ref": "#/definitions/response.ErrorResponse"
+                        }
+                    },
+                    "403": {
+                        "description": "Forbidden",
+                        "schema": {
+                            "$ref": "#/definitions/response.ErrorResponse"
+                        }
+                    },
+                    "404": {
+                        "description": "Not found",
+                        "schema": {
+                            "$ref": "#/definitions/response.ErrorResponse"
+                        }
+                    },
+                    "409": {
+                        "description": "The slug is taken",
+                        "schema": {
+                            "$ref": "#/definitions/response.ErrorResponse"
+                        }
+                    },
+                    "422": {
+                        "description": "Validation failed",
+                        "schema": {
+                            "$ref": "#/definitions/response.ErrorResponse"
+                        }
+                    },
+                    "500": {
+                        "description": "Internal server error",
+                        "schema": {
+                            "$ref": "#/definitions/response.ErrorResponse"
+                        }
+                    }
+                }
+            }
+        },
+        "/segments/{slug}/renames": {
+            "get": {
+                "security": [
+                    {
+                        "ApiKeyAuth": []
+                    }
+                ],
+                "description": "Returns the renames of the segment, oldest first. The slug may be a deprecated alias.",
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "segments"
+                ],
+                "summary": "Get segment renames",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "Segment slug",
+                        "name": "slug",
+                        "in": "path",
+                        "required": true
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "The renames of the segment",
+                        "schema": {
+                            "type": "array",
+                            "items": {
+                                "$ref": "#/definitions/dto.SegmentRenameResponse"
+                            }
+                        }
+                    },
+                    "401": {
+                        "description": "Unauthorized",
+                        "schema": {
+                            "$ref": "#/definitions/response.ErrorResponse"
+                        }
+                    },
+                    "403": {
+                        "description": "Forbidden",
+                        "schema": {
+                            "$ref": "#/definitions/response.ErrorResponse"
+                        }
+                    },
+                    "404": {
+                        "description": "Not found",
+                        "schema": {
+                            "$ref": "#/definitions/response.ErrorResponse"
+                        }
+                    },
+                    "500": {
+                        "description": "Internal server error",
+                        "schema": {
+                            "$ref": "#/definitions/response.ErrorResponse"
+                        }
+                    }
+                }
+            }
+        },
+        "/segments/{slug}/restore": {
+            "post": {
+                "security": [
+                    {
+                        "ApiKeyAuth": []
+                    }
+                ],
+                "description": "Makes an archived segment active again and returns it. The memberships ended by the archiving\nare not restored; if auto_percent is set, that share of all users is enrolled in the segment again.",
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "segments"
+                ],
+                "summary": "Restore segment",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "Segment slug",
+                        "name": "slug",
+                        "in": "path",
+                        "required": true
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "The segment has been restored",
+                        "schema": {
+                            "$ref": "#/definitions/dto.SegmentResponse"
+                        }
+                    },
+                    "401": {
+                        "description": "Unauthorized",
+                        "schema": {
+                            "$ref": "#/definitions/response.ErrorResponse"
+                        }
+                    },
+                    "403": {
+                        "description": "Forbidden",
+                        "schema": {
+                            "$ref": "#/definitions/response.ErrorResponse"
+                        }
+                    },
+                    "404": {
+                        "description": "Not found",
+                        "schema": {
+                            "$ref": "#/definitions/response.ErrorResponse"
+                        }
+                    },
+                    "409": {
+                        "description": "Not archived",
+                        "schema": {
+                            "$ref": "#/definitions/response.ErrorResponse"
+                        }
+                    },
+                    "500": {
+                        "description": "Internal server error",
+                        "schema": {
+                            "$ref": "#/definitions/response.ErrorResponse"
+                        }
+                    }
+                }
+            }
+        },
+        "/segments/{slug}/stats": {
+            "get": {
+                "security": [
+                    {
+                        "ApiKeyAuth": []
+                    }
+                ],
+                "description": "Returns the number of active members of the segment, the number of members expiring\nwithin expiring_within_days and the daily numbers of additions, removals and expirations over the period.",
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "segments"
+                ],
+                "summary": "Get segment statistics",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "Segment slug",
+                        "name": "slug",
+                        "in": "path",
+                        "required": true
+                    },
+                    {
+                        "type": "string",
+                        "description": "First day of the period, YYYY-MM-DD (default 29 days before to)",
+                        "name": "from",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Last day of the period, inclusive, YYYY-MM-DD (default today)",
+                        "name": "to",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Time zone of the days, e.g. Europe/Moscow (default UTC)",
+                        "name": "tz",
+                        "in": "query"
+                    },
+                    {
+                        "type": "integer",
+                        "description": "Horizon of the members expiring soon (default 7)",
+                        "name": "expiring_within_days",
+                        "in": "query"
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "Statistics of the segment",
+                        "schema": {
+                            "$ref": "#/definitions/dto.SegmentStatsResponse"
+                        }
+                    },
+                    "400": {
+                        "description": "Invalid request",
+                        "schema": {
+                            "$ref": "#/definitions/response.ErrorResponse"
+                        }
+                    },
+                    "401": {
+                        "description": "Unauthorized",
+                        "schema": {
+                            "$ref": "#/definitions/response.ErrorResponse"
+                        }
+                    },
+                    "403": {
+                        "description": "Forbidden",
+                        "schema": {
+                            "$ref": "#/definitions/response.ErrorResponse"
+                        }
+                    },
+                    "404": {
+                        "description": "Segment not found",
+                        "schema": {
+                            "$ref": "#/definitions/response.ErrorResponse"
+                        }
+                    },
+                    "422": {
+                        "description": "Validation failed",
+                        "schema": {
+                            "$ref": "#/definitions/response.ErrorResponse"
+                        }
+                    },
+                    "500": {
+                        "description": "Internal server error",
+                        "schema": {
+                            "$ref": "#/definitions/response.ErrorResponse"
+                        }
+                    }
+                }
+            }
+        },
+        "/segments/{slug}/users": {
+            "get": {
+                "security": [
+                    {
+                        "ApiKeyAuth": []
+                    }
+                ],
+                "description": "Get a page of users in the segment with their join and expiration times,\nor only their number as {\"count\": 42} with count_only=true.\nPagination is keyset-based: pass next_cursor of the previous page as cursor with the same sort.",
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "segments"
+                ],
+                "summary": "Get segment members",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "Segment slug",
+                        "name": "slug",
+                        "in": "path",
+                        "required": true
+                    },
+                    {
+                        "type": "boolean",
+                        "description": "Include users whose membership has expired but is not removed yet",
+                        "name": "include_expired",
+                        "in": "query"
+                    },
+                    {
+                        "type": "boolean",
+                        "description": "Return only the number of users",
+                        "name": "count_only",
+                        "in": "query"
+                    },
+                    {
+                        "type": "integer",
+                        "description": "Page size (default 100, max 1000)",
+                        "name": "limit",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Cursor of the next page",
+                        "name": "cursor",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Sort key: id, name, joined_at; '-' prefix for descending order",
+                        "name": "sort",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Filter by user name prefix",
+                        "name": "name_prefix",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Joined at or after (RFC 3339)",
+                        "name": "created_from",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Joined before (RFC 3339)",
+                        "name": "created_to",
+                        "in": "query"
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "A page of segment members was obtained",
+                        "schema": {
+                            "$ref": "#/definitions/dto.SegmentMemberPageResponse"
+                        }
+                    },
+                    "400": {
+                        "description": "Invalid request",
+                        "schema": {
+                            "$ref": "#/definitions/response.ErrorResponse"
+                        }
+                    },
+                    "401": {
+                        "description": "Unauthorized",
+                        "schema": {
+                            "$ref": "#/definitions/response.ErrorResponse"
+                        }
+                    },
+                    "403": {
+                        "description": "Forbidden",
+                        "schema": {
+                            "$ref": "#/definitions/response.ErrorResponse"
+                        }
+                    },
+                    "404": {
+                        "description": "Segment not found",
+                        "schema": {
+                            "$ref": "#/definitions/response.ErrorResponse"
+                        }
+                    },
+                    "422": {
+                        "description": "Validation failed",
+                        "schema": {
+                            "$ref": "#/definitions/response.ErrorResponse"
+                        }
+                    },
+                    "500": {
+                        "description": "Internal server error",
+                        "schema": {
+                            "$ref": "#/definitions/response.ErrorResponse"
+                        }
+                    }
+                }
+            }
+        },
+        "/users": {
+            "get": {
+                "security": [
+                    {
+                        "ApiKeyAuth": []
+                    }
+                ],
+                "description": "Get a page of users from the database.\nPagination is keyset-based: pass next_cursor of the previous page as cursor with the same sort.",
+                "consumes": [
+                    "application/json"
+                ],
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "users"
+                ],
+                "summary": "Get All users",
+                "parameters": [
+                    {
+                        "type": "integer",
+                        "description": "Page size (default 100, max 1000)",
+                        "name": "limit",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Cursor of the next page",
+                        "name": "cursor",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Sort key: id, name, created_at; '-' prefix for descending order",
+                        "name": "sort",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Filter by name prefix",
+                        "name": "name_prefix",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Created at or after (RFC 3339)",
+                        "name": "created_from",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Created before (RFC 3339)",
+                        "name": "created_to",
+                        "in": "query"
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "A page of users was obtained",
+                        "schema": {
+                            "$ref": "#/definitions/dto.UserPageResponse"
+                        }
+                    },
+                    "400": {
+                        "description": "Invalid request",
+                        "schema": {
+                            "$ref": "#/definitions/response.ErrorResponse"
+                        }
+                    },
+                    "401": {
+                        "description": "Unauthorized",
+                        "schema": {
+                            "$ref": "#/definitions/response.ErrorResponse"
+                        }
+                    },
+                    "403": {
+                        "description": "Forbidden",
+                        "schema": {
+                            "$ref": "#/definitions/response.ErrorResponse"
+                        }
+                    },
+                    "422": {
+                        "description": "Validation failed",
+                        "schema": {
+                            "$ref": "#/definitions/response.ErrorResponse"
+                        }
+                    },
+                    "500": {
+                        "description": "Internal server error",
+                        "schema": {
+                            "$ref": "#/definitions/response.ErrorResponse"
+                        }
+                    }
+                }
+            },
+            "post": {
+                "security": [
+                    {
+                        "ApiKeyAuth": []
+                    }
+                ],
+                "description": "Creates a user in the database and returns an instance of the user",
+                "consumes": [
+                    "application/json"
+                ],
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "users"
+                ],
+                "summary": "Add a user",
+                "parameters": [
+                    {
+                        "description": "Information about the added user",
+                        "name": "User",
+                        "in": "body",
+                        "required": true,
+                        "schema": {
+                            "$ref": "#/definitions/dto.UserCreateRequest"
+                        }
+                    }
+                ],
+                "responses": {
+                    "201": {
+                        "description": "The user was successfully created",
+                        "schema": {
+                            "$ref": "#/definitions/dto.UserResponse"
+                        }
+                    },
+                    "400": {
+                        "description": "Invalid request",
+                        "schema": {
+                            "$ref": "#/definitions/response.ErrorResponse"
+                        }
+                    },
+                    "401": {
+                        "description": "Unauthorized",
+                        "schema": {
+                            "$ref": "#/definitions/response.ErrorResponse"
+                        }
+                    },
+                    "403": {
+                        "description": "Forbidden",
+                        "schema": {
+                            "$ref": "#/definitions/response.ErrorResponse"
+                        }
+                    },
+                    "422": {
+                        "description": "Validation failed",
+                        "schema": {
+                            "$ref": "#/definitions/response.ErrorResponse"
+                        }
+                    },
+                    "500": {
+                        "description": "Internal server error",
+                        "schema": {
+                            "$ref": "#/definitions/response.ErrorResponse"
+                        }
+                    }
+                }
+            }
+        },
+        "/users/segments/bulk": {
+            "post": {
+                "security": [
+                    {
+                        "ApiKeyAuth": []
+                    }
+                ],
+                "description": "Adds and removes the same segments for every user from the list.\nUsers are processed in batches, each committed separately, the result is reported for each user.\nUsers of a batch that failed or was not processed because the request was cancelled are reported as failed\nand can be retried; the other batches are kept, so the response is 200 even if some users failed.\nThe history records the actor (the API key of the request), the source and the reason of the change.",
+                "consumes": [
+                    "application/json"
+                ],
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "user-segments"
+                ],
+                "summary": "Bulk update user segments",
+                "parameters": [
+                    {
+                        "description": "Users and segment change information",
+                        "name": "Segments",
+                        "in": "body",
+                        "required": true,
+                        "schema": {
+                            "$ref": "#/definitions/handlers.BulkSegmentsRequest"
+                        }
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "Result of the update for each user",
+                        "schema": {
+                            "$ref": "#/definitions/handlers.BulkSegmentsResponse"
+                        }
+                    },
+                    "400": {
+                        "description": "Invalid request",
+                        "schema": {
+                            "$ref": "#/definitions/response.ErrorResponse"
+                        }
+                    },
+                    "401": {
+                        "description": "Unauthorized",
+                        "schema": {
+                            "$ref": "#/definitions/response.ErrorResponse"
+                        }
+                    },
+                    "403": {
+                        "description": "Forbidden",
+                        "schema": {
+                            "$ref": "#/definitions/response.ErrorResponse"
+                        }
+                    },
+                    "422": {
+                        "description": "Validation failed",
+                        "schema": {
+                            "$ref": "#/definitions/response.ErrorResponse"
+                        }
+                    },
+                    "500": {
+                        "description": "Internal server error",
+                        "schema": {
+                            "$ref": "#/definitions/response.ErrorResponse"
+                        }
+                    }
+                }
+            }
+        },
+        "/users/segments/export": {
+            "get": {
+                "security": [
+                    {
+                        "ApiKeyAuth": []
+                    }
+                ],
+                "description": "Streams all active memberships as NDJSON (one JSON object per line) straight from the database.\nThe response is gzip-compressed if the client sends Accept-Encoding: gzip.",
+                "produces": [
+                    "application/x-ndjson"
+                ],
+                "tags": [
+                    "user-segments"
+                ],
+                "summary": "Export user segments",
+                "responses": {
+                    "200": {
+                        "description": "Memberships, one per line",
+                        "schema": {
+                            "$ref": "#/definitions/dto.UserSegmentExport"
+                        }
+                    },
+                    "401": {
+                        "description": "Unauthorized",
+                        "schema": {
+                            "$ref": "#/definitions/response.ErrorResponse"
+                        }
+                    },
+                    "403": {
+                        "description": "Forbidden",
+                        "schema": {
+                            "$ref": "#/definitions/response.ErrorResponse"
+                        }
+                    },
+                    "500": {
+                        "description": "Internal server error",
+                        "schema": {
+                            "$ref": "#/definitions/response.ErrorResponse"
+                        }
+                    }
+                }
+            }
+        },
+        "/users/segments/import": {
+            "post": {
+                "security": [
+                    {
+                        "ApiKeyAuth": []
+                    }
+                ],
+                "description": "Imports rows user_id,slug,expiration_time (CSV with an optional header, or NDJSON) via COPY FROM.\nNew memberships are recorded in the history, existing ones get the new expiration time.\nThe format is taken from the format parameter or the Content-Type (text/csv, application/x-ndjson).\nThe body may be gzip-compressed (Content-Encoding: gzip).",
+                "consumes": [
+                    "text/csv",
+                    "application/x-ndjson"
+                ],
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "user-segments"
+                ],
+                "summary": "Import user segments",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "csv or ndjson",
+                        "name": "format",
+                        "in": "query"
+                    },
+                    {
+                        "type": "boolean",
+                        "description": "Create users with unknown IDs instead of rejecting the rows",
+                        "name": "create_users",
+                        "in": "query"
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "Counts of inserted, updated and rejected rows",
+                        "schema": {
+                            "$ref": "#/definitions/models.ImportResult"
+                        }
+                    },
+                    "400": {
+                        "description": "Invalid request",
+                        "schema": {
+                            "$ref": "#/definitions/response.ErrorResponse"
+                        }
+                    },
+                    "401": {
+                        "description": "Unauthorized",
+                        "schema": {
+                            "$ref": "#/definitions/response.ErrorResponse"
+                        }
+                    },
+                    "403": {
+                        "description": "Forbidden",
+                        "schema": {
+                            "$ref": "#/definitions/response.ErrorResponse"
+                        }
+                    },
+                    "422": {
+                        "description": "Validation failed",
+                        "schema": {
+                            "$ref": "#/definitions/response.ErrorResponse"
+                        }
+                    },
+                    "500": {
+                        "description": "Internal server error",
+                        "schema": {
+                            "$ref": "#/definitions/response.ErrorResponse"
+                        }
+                    }
+                }
+            }
+        },
+        "/users/{id}": {
+            "get": {
+                "security": [
+                    {
+                        "ApiKeyAuth": []
+                    }
+                ],
+                "description": "Get user by id. The ETag is the version of the user; with a matching If-None-Match the response is 304.",
+                "consumes": [
+                    "application/json"
+                ],
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "users"
+                ],
+                "summary": "Get user",
+                "parameters": [
+                    {
+                        "type": "integer",
+                        "description": "User ID",
+                        "name": "id",
+                        "in": "path",
+                        "required": true
+                    },
+                    {
+                        "type": "string",
+                        "description": "ETag of the cached user",
+                        "name": "If-None-Match",
+                        "in": "header"
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "A user with this id was received",
+                        "schema": {
+                            "$ref": "#/definitions/dto.UserResponse"
+                        },
+                        "headers": {
+                            "ETag": {
+                                "type": "string",
+                                "description": "Version of the user"
+                            }
+                        }
+                    },
+                    "304": {
+                        "description": "The user has not been modified"
+                    },
+                    "400": {
+                        "description": "Invalid request",
+                        "schema": {
+                            "$ref": "#/definitions/response.ErrorResponse"
+                        }
+                    },
+                    "401": {
+                        "description": "Unauthorized",
+                        "schema": {
+                            "$ref": "#/definitions/response.ErrorResponse"
+                        }
+                    },
+                    "403": {
+                        "description": "Forbidden",
+                        "schema": {
+                            "$ref": "#/definitions/response.ErrorResponse"
+                        }
+                    },
+                    "404": {
+                        "description": "Not found",
+                        "schema": {
+                            "$ref": "#/definitions/response.ErrorResponse"
+                        }
+                    },
+                    "500": {
+                        "description": "Internal server error",
+                        "schema": {
+                            "$ref": "#/definitions/response.ErrorResponse"
+                        }
+                    }
+                }
+            },
+            "put": {
+                "security": [
+                    {
+                        "ApiKeyAuth": []
+                    }
+                ],
+                "description": "Updates the user in the database and returns an instance of the user with the new ETag.\nWith If-Match the user is updated only if it has not been modified since (412 otherwise).",
+                "consumes": [
+                    "application/json"
+                ],
+                "produces": [
+                    "application/json"
+                ],
                 "tags": [
                     "users"
                 ],
@@ -288,6 +2072,12 @@ const docTemplate = `{
                         "in": "path",
                         "required": true
                     },
+                    {
+                        "type": "string",
+                        "description": "ETag of the version the change is based on",
+                        "name": "If-Match",
+                        "in": "header"
+                    },
                     {
                         "description": "User change information",
                         "name": "User",
@@ -303,12 +2093,71 @@ const docTemplate = `{
                         "description": "A user with this id has been changed",
                         "schema": {
                             "$ref": "#/definitions/dto.UserResponse"
+                        },
+                        "headers": {
+                            "ETag": {
+                                "type": "string",
+                                "description": "Version of the user"
+                            }
+                        }
+                    },
+                    "400": {
+                        "description": "Invalid request",
+                        "schema": {
+                            "$ref": "#/definitions/response.ErrorResponse"
+                        }
+                    },
+                    "401": {
+                        "description": "Unauthorized",
+                        "schema": {
+                            "$ref": "#/definitions/response.ErrorResponse"
+                        }
+                    },
+                    "403": {
+                        "description": "Forbidden",
+                        "schema": {
+                            "$ref": "#/definitions/response.ErrorResponse"
+                        }
+                    },
+                    "404": {
+                        "description": "Not found",
+                        "schema": {
+                            "$ref": "#/definitions/response.ErrorResponse"
+                        }
+                    },
+                    "412": {
+                        "description": "Modified since the ETag in If-Match",
+                        "schema": {
+                            "$ref": "#/definitions/response.ErrorResponse"
+                        }
+                    },
+                    "422": {
+                        "description": "Validation failed",
+                        "schema": {
+                            "$ref": "#/definitions/response.ErrorResponse"
+                        }
+                    },
+                    "428": {
+                        "description": "If-Match is required",
+                        "schema": {
+                            "$ref": "#/definitions/response.ErrorResponse"
+                        }
+                    },
+                    "500": {
+                        "description": "Internal server error",
+                        "schema": {
+                            "$ref": "#/definitions/response.ErrorResponse"
                         }
                     }
                 }
             },
             "delete": {
-                "description": "Deletes a user from the database",
+                "security": [
+                    {
+                        "ApiKeyAuth": []
+                    }
+                ],
+                "description": "Erases the personal data of a user: the name is removed and the user is replaced with\na pseudonymous tombstone, the memberships are ended and recorded in the history as REMOVE.\nThe history is kept, so past reports stay correct. Returns the erasure receipt.\nWith If-Match the user is erased only if it has not been modified since (412 otherwise).",
                 "consumes": [
                     "application/json"
                 ],
@@ -326,18 +2175,144 @@ const docTemplate = `{
                         "name": "id",
                         "in": "path",
                         "required": true
+                    },
+                    {
+                        "type": "string",
+                        "description": "ETag of the version the change is based on",
+                        "name": "If-Match",
+                        "in": "header"
                     }
                 ],
                 "responses": {
-                    "204": {
-                        "description": "The user with this id was successfully deleted"
+                    "200": {
+                        "description": "The user with this id was successfully erased",
+                        "schema": {
+                            "$ref": "#/definitions/dto.ErasureReceiptResponse"
+                        }
+                    },
+                    "400": {
+                        "description": "Invalid request",
+                        "schema": {
+                            "$ref": "#/definitions/response.ErrorResponse"
+                        }
+                    },
+                    "401": {
+                        "description": "Unauthorized",
+                        "schema": {
+                            "$ref": "#/definitions/response.ErrorResponse"
+                        }
+                    },
+                    "403": {
+                        "description": "Forbidden",
+                        "schema": {
+                            "$ref": "#/definitions/response.ErrorResponse"
+                        }
+                    },
+                    "404": {
+                        "description": "Not found",
+                        "schema": {
+                            "$ref": "#/definitions/response.ErrorResponse"
+                        }
+                    },
+                    "409": {
+                        "description": "Already erased",
+                        "schema": {
+                            "$ref": "#/definitions/response.ErrorResponse"
+                        }
+                    },
+                    "412": {
+                        "description": "Modified since the ETag in If-Match",
+                        "schema": {
+                            "$ref": "#/definitions/response.ErrorResponse"
+                        }
+                    },
+                    "428": {
+                        "description": "If-Match is required",
+                        "schema": {
+                            "$ref": "#/definitions/response.ErrorResponse"
+                        }
+                    },
+                    "500": {
+                        "description": "Internal server error",
+                        "schema": {
+                            "$ref": "#/definitions/response.ErrorResponse"
+                        }
+                    }
+                }
+            }
+        },
+        "/users/{id}/erasure": {
+            "get": {
+                "security": [
+                    {
+                        "ApiKeyAuth": []
+                    }
+                ],
+                "description": "Returns the receipt of the erasure of the user's personal data",
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "users"
+                ],
+                "summary": "Get erasure receipt",
+                "parameters": [
+                    {
+                        "type": "integer",
+                        "description": "User ID",
+                        "name": "id",
+                        "in": "path",
+                        "required": true
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "The erasure receipt was obtained",
+                        "schema": {
+                            "$ref": "#/definitions/dto.ErasureReceiptResponse"
+                        }
+                    },
+                    "400": {
+                        "description": "Invalid request",
+                        "schema": {
+                            "$ref": "#/definitions/response.ErrorResponse"
+                        }
+                    },
+                    "401": {
+                        "description": "Unauthorized",
+                        "schema": {
+                            "$ref": "#/definitions/response.ErrorResponse"
+                        }
+                    },
+                    "403": {
+                        "description": "Forbidden",
+                        "schema": {
+                            "$ref": "#/definitions/response.ErrorResponse"
+                        }
+                    },
+                    "404": {
+                        "description": "The user has not been erased",
+                        "schema": {
+                            "$ref": "#/definitions/response.ErrorResponse"
+                        }
+                    },
+                    "500": {
+                        "description": "Internal server error",
+                        "schema": {
+                            "$ref": "#/definitions/response.ErrorResponse"
+                        }
                     }
                 }
             }
         },
         "/users/{id}/segments": {
             "get": {
-                "description": "Gets the active user segments by ID.",
+                "security": [
+                    {
+                        "ApiKeyAuth": []
+                    }
+                ],
+                "description": "Gets the active user segments by ID.\nThe ETag identifies the list; with a matching If-None-Match the response is 304.",
                 "consumes": [
                     "application/json"
                 ],
@@ -355,6 +2330,12 @@ const docTemplate = `{
                         "name": "id",
                         "in": "path",
                         "required": true
+                    },
+                    {
+                        "type": "string",
+                        "description": "ETag of the cached list",
+                        "name": "If-None-Match",
+                        "in": "header"
                     }
                 ],
                 "responses": {
@@ -365,12 +2346,50 @@ const docTemplate = `{
                             "items": {
                                 "$ref": "#/definitions/dto.SegmentResponse"
                             }
+                        },
+                        "headers": {
+                            "ETag": {
+                                "type": "string",
+                                "description": "Hash of the list"
+                            }
+                        }
+                    },
+                    "304": {
+                        "description": "The list has not changed"
+                    },
+                    "400": {
+                        "description": "Invalid request",
+                        "schema": {
+                            "$ref": "#/definitions/response.ErrorResponse"
+                        }
+                    },
+                    "401": {
+                        "description": "Unauthorized",
+                        "schema": {
+                            "$ref": "#/definitions/response.ErrorResponse"
+                        }
+                    },
+                    "403": {
+                        "description": "Forbidden",
+                        "schema": {
+                            "$ref": "#/definitions/response.ErrorResponse"
+                        }
+                    },
+                    "500": {
+                        "description": "Internal server error",
+                        "schema": {
+                            "$ref": "#/definitions/response.ErrorResponse"
                         }
                     }
                 }
             },
             "patch": {
-                "description": "Updates the user in the database and returns an instance of the user",
+                "security": [
+                    {
+                        "ApiKeyAuth": []
+                    }
+                ],
+                "description": "Adds and removes user segments and reports what happened to each slug:\nadded, extended (expiration time updated), removed, unknown or not assigned.\nIn strict mode the update is rejected with 422 if any slug does not exist.\nFormer slugs of renamed segments resolve to them while the aliases last and are listed in deprecated_slugs.\nThe history records the actor (the API key of the request), the source and the reason of the change.\nWith an Idempotency-Key a retry of the same request returns the stored result (Idempotent-Replayed: true)\nwithout changing anything again; the same key with a different request is rejected with 422.",
                 "consumes": [
                     "application/json"
                 ],
@@ -389,6 +2408,12 @@ const docTemplate = `{
                         "in": "path",
                         "required": true
                     },
+                    {
+                        "type": "string",
+                        "description": "Unique key of the request to retry it safely",
+                        "name": "Idempotency-Key",
+                        "in": "header"
+                    },
                     {
                         "description": "User change information",
                         "name": "Segments",
@@ -401,24 +2426,74 @@ const docTemplate = `{
                 ],
                 "responses": {
                     "200": {
-                        "description": "User segments have been successfully changed"
+                        "description": "User segments have been successfully changed",
+                        "schema": {
+                            "$ref": "#/definitions/models.SegmentsUpdateResult"
+                        },
+                        "headers": {
+                            "Idempotent-Replayed": {
+                                "type": "string",
+                                "description": "true if the result is replayed"
+                            }
+                        }
+                    },
+                    "400": {
+                        "description": "Invalid request",
+                        "schema": {
+                            "$ref": "#/definitions/response.ErrorResponse"
+                        }
+                    },
+                    "401": {
+                        "description": "Unauthorized",
+                        "schema": {
+                            "$ref": "#/definitions/response.ErrorResponse"
+                        }
+                    },
+                    "403": {
+                        "description": "Forbidden",
+                        "schema": {
+                            "$ref": "#/definitions/response.ErrorResponse"
+                        }
+                    },
+                    "404": {
+                        "description": "Not found",
+                        "schema": {
+                            "$ref": "#/definitions/response.ErrorResponse"
+                        }
+                    },
+                    "422": {
+                        "description": "Validation failed",
+                        "schema": {
+                            "$ref": "#/definitions/response.ErrorResponse"
+                        }
+                    },
+                    "500": {
+                        "description": "Internal server error",
+                        "schema": {
+                            "$ref": "#/definitions/response.ErrorResponse"
+                        }
                     }
                 }
             }
         },
         "/users/{id}/segments/history": {
             "get": {
-                "description": "Updates the user in the database and returns an instance of the user",
-                "consumes": [
-                    "application/json"
+                "security": [
+                    {
+                        "ApiKeyAuth": []
+                    }
                 ],
+                "description": "Streams a report on the history of segment changes for the user for the period\n(year and month, or from and to) in the format from ?format= or the Accept header:\ncsv (the delimiter is set by ?delimiter=, \";\" by default), tsv, json or ndjson.\nWith mode=url a report job is created and the download link is returned; if the report\nis not ready in a few seconds, the job is returned with the status 202; poll it by the Location header.",
                 "produces": [
-                    "application/json"
+                    "text/csv",
+                    "text/tab-separated-values",
+                    "application/json",
+                    "application/x-ndjson"
                 ],
                 "tags": [
                     "user-segments-history"
                 ],
-                "summary": "Update user segments",
+                "summary": "Get a user history report",
                 "parameters": [
                     {
                         "type": "integer",
@@ -431,38 +2506,350 @@ const docTemplate = `{
                         "type": "integer",
                         "description": "Year, e.g. 2025",
                         "name": "year",
-                        "in": "query",
-                        "required": true
+                        "in": "query"
                     },
                     {
                         "type": "integer",
                         "description": "Month, e.g. 02",
                         "name": "month",
-                        "in": "query",
-                        "required": true
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Start of the period, inclusive (RFC 3339 or YYYY-MM-DD)",
+                        "name": "from",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "End of the period, exclusive (RFC 3339 or YYYY-MM-DD)",
+                        "name": "to",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Time zone of the period and the report, e.g. Europe/Moscow (default UTC)",
+                        "name": "tz",
+                        "in": "query"
+                    },
+                    {
+                        "type": "array",
+                        "items": {
+                            "type": "string"
+                        },
+                        "collectionFormat": "csv",
+                        "description": "Segment slugs",
+                        "name": "slug",
+                        "in": "query"
+                    },
+                    {
+                        "type": "array",
+                        "items": {
+                            "type": "string"
+                        },
+                        "collectionFormat": "csv",
+                        "description": "Actions: ADD, REMOVE, EXPIRE",
+                        "name": "action",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Report format: csv, tsv, json, ndjson (overrides Accept)",
+                        "name": "format",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Field delimiter of the csv format (default ;)",
+                        "name": "delimiter",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "stream (default) or url",
+                        "name": "mode",
+                        "in": "query"
                     }
                 ],
                 "responses": {
                     "200": {
-                        "description": "CSV-history is ready at the link",
+                        "description": "The report",
                         "schema": {
-                            "$ref": "#/definitions/dto.USHResponse"
+                            "type": "file"
                         }
+                    },
+                    "202": {
+                        "description": "mode=url: the report is still being generated",
+                        "schema": {
+                            "$ref": "#/definitions/dto.ReportJobResponse"
+                        }
+                    },
+                    "400": {
+                        "description": "Invalid request",
+                        "schema": {
+                            "$ref": "#/definitions/response.ErrorResponse"
+                        }
+                    },
+                    "401": {
+                        "description": "Unauthorized",
+                        "schema": {
+                            "$ref": "#/definitions/response.ErrorResponse"
+                        }
+                    },
+                    "403": {
+                        "description": "Forbidden",
+                        "schema": {
+                            "$ref": "#/definitions/response.ErrorResponse"
+                        }
+                    },
+                    "422": {
+                        "description": "Validation failed",
+                        "schema": {
+                            "$ref": "#/definitions/response.ErrorResponse"
+                        }
+                    },
+                    "500": {
+                        "description": "Internal server error",
+                        "schema": {
+                            "$ref": "#/definitions/response.ErrorResponse"
+                        }
+                    }
+                }
+            }
+        }
+    },
+    "definitions": {
+        "db.BulkUserResult": {
+            "type": "object",
+            "properties": {
+                "error": {
+                    "type": "string"
+                },
+                "status": {
+                    "description": "\"updated\", \"not_found\" or \"failed\"",
+                    "type": "string"
+                },
+                "user_id": {
+                    "type": "integer"
+                }
+            }
+        },
+        "db.SegmentModification": {
+            "type": "object",
+            "properties": {
+                "expiration_time": {
+                    "description": "required: false",
+                    "type": "string"
+                },
+                "slug": {
+                    "description": "required: true",
+                    "type": "string"
+                }
+            }
+        },
+        "dto.APIKeyCreateRequest": {
+            "description": "API key information at creation",
+            "type": "object",
+            "properties": {
+                "name": {
+                    "description": "required: true",
+                    "type": "string",
+                    "example": "analytics-dashboard"
+                },
+                "scopes": {
+                    "description": "required: true",
+                    "type": "array",
+                    "items": {
+                        "type": "string"
+                    },
+                    "example": [
+                        "memberships:read",
+                        "reports:read"
+                    ]
+                }
+            }
+        },
+        "dto.APIKeyResponse": {
+            "description": "API key information, the key itself is returned only on creation",
+            "type": "object",
+            "properties": {
+                "created_at": {
+                    "description": "read only: true",
+                    "type": "string"
+                },
+                "id": {
+                    "description": "read only: true",
+                    "type": "integer"
+                },
+                "key": {
+                    "description": "Returned only once, when the key is created",
+                    "type": "string"
+                },
+                "name": {
+                    "type": "string"
+                },
+                "prefix": {
+                    "type": "string",
+                    "example": "uss_3q2-7wEv"
+                },
+                "revoked_at": {
+                    "description": "read only: true",
+                    "type": "string"
+                },
+                "scopes": {
+                    "description": "read only: true",
+                    "type": "array",
+                    "items": {
+                        "type": "string"
+                    }
+                }
+            }
+        },
+        "dto.DailySegmentStats": {
+            "description": "Changes of the segment during a day",
+            "type": "object",
+            "properties": {
+                "added": {
+                    "type": "integer"
+                },
+                "date": {
+                    "description": "YYYY-MM-DD in the requested time zone",
+                    "type": "string"
+                },
+                "expired": {
+                    "type": "integer"
+                },
+                "removed": {
+                    "type": "integer"
+                }
+            }
+        },
+        "dto.ErasureReceiptResponse": {
+            "description": "Confirmation that the personal data of the user has been erased",
+            "type": "object",
+            "properties": {
+                "erased_at": {
+                    "type": "string"
+                },
+                "id": {
+                    "type": "string"
+                },
+                "memberships_ended": {
+                    "description": "Number of segment memberships ended by the erasure",
+                    "type": "integer"
+                },
+                "pseudonym": {
+                    "description": "Name of the tombstone that replaced the user in the history",
+                    "type": "string"
+                },
+                "user_id": {
+                    "type": "integer"
+                }
+            }
+        },
+        "dto.HistoryParams": {
+            "description": "Parameters of the history report",
+            "type": "object",
+            "properties": {
+                "actions": {
+                    "description": "ADD, REMOVE or EXPIRE, all actions if empty",
+                    "type": "array",
+                    "items": {
+                        "type": "string"
+                    }
+                },
+                "delimiter": {
+                    "description": "Field delimiter of the csv format, \";\" by default",
+                    "type": "string"
+                },
+                "format": {
+                    "description": "csv (default), tsv, json or ndjson",
+                    "type": "string"
+                },
+                "from": {
+                    "description": "Start of the period, inclusive; set either from/to or year/month",
+                    "type": "string"
+                },
+                "month": {
+                    "type": "integer"
+                },
+                "slugs": {
+                    "description": "Segment slugs, all segments if empty",
+                    "type": "array",
+                    "items": {
+                        "type": "string"
+                    }
+                },
+                "to": {
+                    "description": "End of the period, exclusive",
+                    "type": "string"
+                },
+                "tz": {
+                    "description": "IANA time zone of year/month and the report times, UTC by default",
+                    "type": "string"
+                },
+                "user_id": {
+                    "description": "A single user, merged into user_ids",
+                    "type": "integer"
+                },
+                "user_ids": {
+                    "description": "Users, all users if empty",
+                    "type": "array",
+                    "items": {
+                        "type": "integer"
                     }
+                },
+                "year": {
+                    "type": "integer"
+                }
+            }
+        },
+        "dto.ReportJobResponse": {
+            "description": "State of the report job",
+            "type": "object",
+            "properties": {
+                "created_at": {
+                    "type": "string"
+                },
+                "download_url": {
+                    "description": "Download link, present when the report is done",
+                    "type": "string"
+                },
+                "error": {
+                    "description": "Reason of the failure",
+                    "type": "string"
+                },
+                "expires_at": {
+                    "description": "The download link is valid until this time",
+                    "type": "string"
+                },
+                "finished_at": {
+                    "type": "string"
+                },
+                "id": {
+                    "description": "read only: true",
+                    "type": "string"
+                },
+                "params": {
+                    "$ref": "#/definitions/dto.HistoryParams"
+                },
+                "started_at": {
+                    "type": "string"
+                },
+                "status": {
+                    "description": "pending, running, done or failed",
+                    "type": "string"
                 }
             }
-        }
-    },
-    "definitions": {
-        "db.SegmentModification": {
+        },
+        "dto.SegmentAliasResponse": {
+            "description": "Deprecated former slug the segment was requested by",
             "type": "object",
             "properties": {
-                "expiration_time": {
-                    "description": "required: false",
+                "expires_at": {
                     "type": "string"
                 },
                 "slug": {
-                    "description": "required: true",
                     "type": "string"
                 }
             }
@@ -471,6 +2858,12 @@ const docTemplate = `{
             "description": "Segment information at creation",
             "type": "object",
             "properties": {
+                "auto_percent": {
+                    "description": "required: false",
+                    "type": "integer",
+                    "maximum": 100,
+                    "minimum": 1
+                },
                 "description": {
                     "description": "required: false",
                     "type": "string"
@@ -481,14 +2874,115 @@ const docTemplate = `{
                 }
             }
         },
+        "dto.SegmentMemberPageResponse": {
+            "description": "A page of segment members",
+            "type": "object",
+            "properties": {
+                "items": {
+                    "type": "array",
+                    "items": {
+                        "$ref": "#/definitions/dto.SegmentMemberResponse"
+                    }
+                },
+                "next_cursor": {
+                    "description": "Cursor of the next page, absent on the last page",
+                    "type": "string"
+                }
+            }
+        },
+        "dto.SegmentMemberResponse": {
+            "description": "A user in the segment",
+            "type": "object",
+            "properties": {
+                "expiration_time": {
+                    "type": "string"
+                },
+                "expired": {
+                    "description": "The expiration time has passed, but the user is not removed yet (only with include_expired)",
+                    "type": "boolean"
+                },
+                "joined_at": {
+                    "type": "string"
+                },
+                "user_id": {
+                    "type": "integer"
+                },
+                "user_name": {
+                    "type": "string"
+                }
+            }
+        },
+        "dto.SegmentPageResponse": {
+            "description": "A page of segments",
+            "type": "object",
+            "properties": {
+                "items": {
+                    "type": "array",
+                    "items": {
+                        "$ref": "#/definitions/dto.SegmentResponse"
+                    }
+                },
+                "next_cursor": {
+                    "description": "Cursor of the next page, absent on the last page",
+                    "type": "string"
+                }
+            }
+        },
+        "dto.SegmentRenameRequest": {
+            "description": "New slug of the segment",
+            "type": "object",
+            "properties": {
+                "slug": {
+                    "description": "required: true",
+                    "type": "string"
+                }
+            }
+        },
+        "dto.SegmentRenameResponse": {
+            "description": "Record of the audit trail of segment renames",
+            "type": "object",
+            "properties": {
+                "alias_expires_at": {
+                    "description": "Until when the old slug resolves to the segment, absent if it was not kept as an alias",
+                    "type": "string"
+                },
+                "id": {
+                    "type": "integer"
+                },
+                "new_slug": {
+                    "type": "string"
+                },
+                "old_slug": {
+                    "type": "string"
+                },
+                "renamed_at": {
+                    "type": "string"
+                }
+            }
+        },
         "dto.SegmentResponse": {
             "description": "Segment information when creating/updating a segment",
             "type": "object",
             "properties": {
+                "archived_at": {
+                    "description": "read only: true",
+                    "type": "string"
+                },
+                "auto_percent": {
+                    "type": "integer"
+                },
                 "created_at": {
                     "description": "read only: true",
                     "type": "string"
                 },
+                "deprecated_alias": {
+                    "description": "Set if the segment was requested by a deprecated slug it had before a rename",
+                    "allOf": [
+                        {
+                            "$ref": "#/definitions/dto.SegmentAliasResponse"
+                        }
+                    ]
+                },
                 "description": {
                     "type": "string"
                 },
@@ -501,21 +2995,33 @@ const docTemplate = `{
                 }
             }
         },
-        "dto.SegmentUpdateRequest": {
-            "description": "Segment information when updating",
+        "dto.SegmentStatsResponse": {
+            "description": "Size and growth of the segment",
             "type": "object",
             "properties": {
-                "description": {
-                    "description": "required: true",
+                "active_members": {
+                    "type": "integer"
+                },
+                "daily": {
+                    "type": "array",
+                    "items": {
+                        "$ref": "#/definitions/dto.DailySegmentStats"
+                    }
+                },
+                "expiring_soon": {
+                    "description": "Active members whose membership expires within expiring_within_days",
+                    "type": "integer"
+                },
+                "slug": {
                     "type": "string"
                 }
             }
         },
-        "dto.USHResponse": {
-            "description": "History information",
+        "dto.SegmentUpdateRequest": {
+            "description": "Segment information when updating",
             "type": "object",
             "properties": {
-                "url": {
+                "description": {
                     "description": "required: true",
                     "type": "string"
                 }
@@ -531,6 +3037,22 @@ const docTemplate = `{
                 }
             }
         },
+        "dto.UserPageResponse": {
+            "description": "A page of users",
+            "type": "object",
+            "properties": {
+                "items": {
+                    "type": "array",
+                    "items": {
+                        "$ref": "#/definitions/dto.UserResponse"
+                    }
+                },
+                "next_cursor": {
+                    "description": "Cursor of the next page, absent on the last page",
+                    "type": "string"
+                }
+            }
+        },
         "dto.UserResponse": {
             "description": "User information at creation/update",
             "type": "object",
@@ -548,6 +3070,24 @@ const docTemplate = `{
                 }
             }
         },
+        "dto.UserSegmentExport": {
+            "description": "Active membership of a user in a segment (one line of the export)",
+            "type": "object",
+            "properties": {
+                "created_at": {
+                    "type": "string"
+                },
+                "expiration_time": {
+                    "type": "string"
+                },
+                "slug": {
+                    "type": "string"
+                },
+                "user_id": {
+                    "type": "integer"
+                }
+            }
+        },
         "dto.UserUpdateRequest": {
             "description": "User information when updating",
             "type": "object",
@@ -558,10 +3098,84 @@ const docTemplate = `{
                 }
             }
         },
+        "handlers.BulkSegmentsRequest": {
+            "description": "List of users and segment lists for adding and deleting segments",
+            "type": "object",
+            "properties": {
+                "actor": {
+                    "description": "required: false",
+                    "type": "string"
+                },
+                "add": {
+                    "description": "required: false",
+                    "type": "array",
+                    "items": {
+                        "$ref": "#/definitions/db.SegmentModification"
+                    }
+                },
+                "reason": {
+                    "description": "required: false",
+                    "type": "string"
+                },
+                "remove": {
+                    "description": "required: false",
+                    "type": "array",
+                    "items": {
+                        "type": "string"
+                    }
+                },
+                "source": {
+                    "description": "required: false",
+                    "type": "string"
+                },
+                "user_ids": {
+                    "description": "required: true",
+                    "type": "array",
+                    "items": {
+                        "type": "integer"
+                    }
+                }
+            }
+        },
+        "handlers.BulkSegmentsResponse": {
+            "description": "Outcome of the update for each user and totals by status",
+            "type": "object",
+            "properties": {
+                "failed": {
+                    "type": "integer"
+                },
+                "not_found": {
+                    "type": "integer"
+                },
+                "results": {
+                    "type": "array",
+                    "items": {
+                        "$ref": "#/definitions/db.BulkUserResult"
+                    }
+                },
+                "updated": {
+                    "type": "integer"
+                }
+            }
+        },
+        "handlers.HealthStatus": {
+            "description": "Probe status",
+            "type": "object",
+            "properties": {
+                "status": {
+                    "type": "string",
+                    "example": "ok"
+                }
+            }
+        },
         "handlers.SegmentsRequest": {
             "description": "Segment lists for adding and deleting segments",
             "type": "object",
             "properties": {
+                "actor": {
+                    "description": "required: false",
+                    "type": "string"
+                },
                 "add": {
                     "description": "required: false",
                     "type": "array",
@@ -569,15 +3183,143 @@ const docTemplate = `{
                         "$ref": "#/definitions/db.SegmentModification"
                     }
                 },
+                "reason": {
+                    "description": "required: false",
+                    "type": "string"
+                },
                 "remove": {
                     "description": "required: false",
                     "type": "array",
                     "items": {
                         "type": "string"
                     }
+                },
+                "source": {
+                    "description": "required: false",
+                    "type": "string"
+                },
+                "strict": {
+                    "description": "required: false",
+                    "type": "boolean"
+                }
+            }
+        },
+        "models.ImportRejection": {
+            "type": "object",
+            "properties": {
+                "line": {
+                    "type": "integer"
+                },
+                "reason": {
+                    "type": "string"
+                }
+            }
+        },
+        "models.ImportResult": {
+            "type": "object",
+            "properties": {
+                "inserted": {
+                    "description": "New memberships.",
+                    "type": "integer"
+                },
+                "rejected": {
+                    "description": "Rows that were not imported.",
+                    "type": "integer"
+                },
+                "rejections": {
+                    "description": "Reasons for the first rejected rows, ordered by line.",
+                    "type": "array",
+                    "items": {
+                        "$ref": "#/definitions/models.ImportRejection"
+                    }
+                },
+                "updated": {
+                    "description": "Existing memberships with the expiration time updated.",
+                    "type": "integer"
+                },
+                "users_created": {
+                    "description": "Users created for unknown user IDs (if requested).",
+                    "type": "integer"
+                }
+            }
+        },
+        "models.SegmentsUpdateResult": {
+            "type": "object",
+            "properties": {
+                "added": {
+                    "description": "Segments the user was added to.",
+                    "type": "array",
+                    "items": {
+                        "type": "string"
+                    }
+                },
+                "deprecated_slugs": {
+                    "description": "Deprecated aliases of renamed segments used in the request, with the current slugs.",
+                    "type": "object",
+                    "additionalProperties": {
+                        "type": "string"
+                    }
+                },
+                "extended": {
+                    "description": "Segments the user already had, with the expiration time updated.",
+                    "type": "array",
+                    "items": {
+                        "type": "string"
+                    }
+                },
+                "not_assigned": {
+                    "description": "Segments to remove that the user did not have.",
+                    "type": "array",
+                    "items": {
+                        "type": "string"
+                    }
+                },
+                "removed": {
+                    "description": "Segments the user was removed from.",
+                    "type": "array",
+                    "items": {
+                        "type": "string"
+                    }
+                },
+                "unknown": {
+                    "description": "Slugs of segments that do not exist.",
+                    "type": "array",
+                    "items": {
+                        "type": "string"
+                    }
+                }
+            }
+        },
+        "response.ErrorBody": {
+            "description": "Machine-readable code, human-readable message and optional details",
+            "type": "object",
+            "properties": {
+                "code": {
+                    "type": "string"
+                },
+                "details": {},
+                "message": {
+                    "type": "string"
+                }
+            }
+        },
+        "response.ErrorResponse": {
+            "description": "Error information",
+            "type": "object",
+            "properties": {
+                "error": {
+                    "$ref": "#/definitions/response.ErrorBody"
                 }
             }
         }
+    },
+    "securityDefinitions": {
+        "ApiKeyAuth": {
+            "description": "API key; \"Authorization: Bearer \u003ckey\u003e\" is accepted as well.",
+            "type": "apiKey",
+            "name": "X-API-Key",
+            "in": "header"
+        }
     }
 }`
 
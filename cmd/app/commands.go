@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"user_segmentation_service/internal/config"
+	"user_segmentation_service/internal/db"
+	"user_segmentation_service/internal/models"
+	"user_segmentation_service/internal/modules/user_segments_service"
+)
+
+// runCommand executes a subcommand of the application instead of starting the server.
+func runCommand(ctx context.Context, cfg *config.Config, name string, args []string) error {
+	switch name {
+	case "import":
+		return importCommand(ctx, cfg, args)
+	case "migrate":
+		return migrateCommand(ctx, cfg, args)
+	}
+	return fmt.Errorf("unknown command %q, available commands: import, migrate", name)
+}
+
+// migrateCommand applies, rolls back or lists the schema migrations:
+//
+//	app migrate up          apply all pending migrations
+//	app migrate down [n]    roll back the last n applied migrations (1 by default)
+//	app migrate status      list the migrations and when they were applied
+func migrateCommand(ctx context.Context, cfg *config.Config, args []string) error {
+	const usage = "usage: app migrate up | down [n] | status"
+	if len(args) == 0 || len(args) > 2 || (len(args) == 2 && args[0] != "down") {
+		return errors.New(usage)
+	}
+	steps := 1
+	if len(args) == 2 {
+		n, err := strconv.Atoi(args[1])
+		if err != nil || n < 1 {
+			return fmt.Errorf("invalid number of migrations %q, %s", args[1], usage)
+		}
+		steps = n
+	}
+
+	storage, err := db.NewPostgresPool(ctx, cfg.DB)
+	if err != nil {
+		return err
+	}
+	defer storage.Close()
+
+	switch args[0] {
+	case "up":
+		versions, err := storage.MigrateUp(ctx)
+		if err != nil {
+			return err
+		}
+		slog.Info("Migrations applied", "count", len(versions), "versions", versions)
+	case "down":
+		versions, err := storage.MigrateDown(ctx, steps)
+		if err != nil {
+			return err
+		}
+		slog.Info("Migrations rolled back", "count", len(versions), "versions", versions)
+	case "status":
+		migrations, err := storage.MigrationStatus(ctx)
+		if err != nil {
+			return err
+		}
+		for _, m := range migrations {
+			if m.AppliedAt != nil {
+				slog.Info("Migration", "version", m.Version, "name", m.Name, "applied_at", *m.AppliedAt)
+			} else {
+				slog.Info("Migration", "version", m.Version, "name", m.Name, "applied_at", "pending")
+			}
+		}
+	default:
+		return errors.New(usage)
+	}
+	return nil
+}
+
+// importCommand imports memberships of users in segments from a CSV or NDJSON file:
+//
+//	app import [-format csv|ndjson] [-create-users] [-actor name] [-reason text] <file>
+//
+// The format is guessed from the file extension if not set. "-" reads the file from stdin.
+// The actor and the reason are recorded in the history of the imported memberships.
+func importCommand(ctx context.Context, cfg *config.Config, args []string) error {
+	fs := flag.NewFlagSet("import", flag.ContinueOnError)
+	format := fs.String("format", "", "file format: csv or ndjson (by default, guessed from the extension)")
+	createUsers := fs.Bool("create-users", false, "create users with unknown IDs instead of rejecting the rows")
+	actor := fs.String("actor", "", "who makes the import, recorded in the history")
+	reason := fs.String("reason", "", "why the import is made, recorded in the history")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return errors.New("usage: app import [-format csv|ndjson] [-create-users] [-actor name] [-reason text] <file>")
+	}
+	path := fs.Arg(0)
+	if *format == "" {
+		*format = user_segments_service.ImportFormatCSV
+		if ext := strings.ToLower(filepath.Ext(path)); ext == ".ndjson" || ext == ".jsonl" {
+			*format = user_segments_service.ImportFormatNDJSON
+		}
+	}
+
+	var in io.Reader = os.Stdin
+	if path != "-" {
+		file, err := os.Open(filepath.Clean(path))
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		in = file
+	}
+
+	storage, err := db.NewPostgresPool(ctx, cfg.DB)
+	if err != nil {
+		return err
+	}
+	defer storage.Close()
+
+	uss := user_segments_service.NewUserSegmentationService(storage, cfg.UserSegments)
+	res, err := uss.Import(ctx, in, *format, *createUsers, models.ChangeMeta{Actor: *actor, Reason: *reason})
+	if err != nil {
+		return err
+	}
+	slog.Info("Import finished", "inserted", res.Inserted, "updated", res.Updated,
+		"rejected", res.Rejected, "users_created", res.UsersCreated)
+	for _, rej := range res.Rejections {
+		slog.Warn("Rejected", "line", rej.Line, "reason", rej.Reason)
+	}
+	return nil
+}
@@ -9,6 +9,11 @@
 // @license.name  MIT
 // @license.url   https://opensource.org/licenses/MIT
 
+// @securityDefinitions.apikey  ApiKeyAuth
+// @in                          header
+// @name                        X-API-Key
+// @description                 API key; "Authorization: Bearer <key>" is accepted as well.
+
 // Package main = entry point.
 package main
 
@@ -18,23 +23,23 @@ import (
 	"os"
 	"os/signal"
 	"syscall"
-	"time"
-
-	"github.com/jackc/pgx/v5/pgxpool"
+	_ "time/tzdata" // Time zones of the history reports, the runner image has no tzdata.
 
 	"user_segmentation_service/internal/config"
 	"user_segmentation_service/internal/db"
 	"user_segmentation_service/internal/logger"
+	"user_segmentation_service/internal/metrics"
+	"user_segmentation_service/internal/modules/apikey_service"
+	"user_segmentation_service/internal/modules/change_listener"
+	"user_segmentation_service/internal/modules/report_service"
 	"user_segmentation_service/internal/modules/segment_service"
+	"user_segmentation_service/internal/modules/segments_cache"
+	"user_segmentation_service/internal/modules/ttl_sweeper"
 	"user_segmentation_service/internal/modules/user_segments_service"
 	"user_segmentation_service/internal/modules/user_service"
 	"user_segmentation_service/internal/server"
 )
 
-var (
-	storage *pgxpool.Pool
-)
-
 // main - entry point.
 func main() {
 	cfg := config.MustLoad()
@@ -43,41 +48,89 @@ func main() {
 
 	ctx, ctxCancel := context.WithCancel(context.Background())
 
+	if len(os.Args) > 1 {
+		err := runCommand(ctx, cfg, os.Args[1], os.Args[2:])
+		ctxCancel()
+		if err != nil {
+			logg.Error("runCommand", "command", os.Args[1], "err", err)
+			os.Exit(1)
+		}
+		return
+	}
+
 	storage, err := db.NewPostgresPool(ctx, cfg.DB)
 	if err != nil {
 		logg.Error("db.NewPostgresPool", "err", err)
 		os.Exit(1)
 	}
-	uu := user_service.NewUserService(storage)
-	ss := segment_service.NewSegmentService(storage)
-	uss := user_segments_service.NewUserSegmentationService(storage)
-	serv := server.New(ctx, cfg.APIServer, uu, ss, uss)
+	if cfg.DB.MigrateOnStart {
+		if _, err = storage.MigrateUp(ctx); err != nil {
+			logg.Error("storage.MigrateUp", "err", err)
+			storage.Close()
+			os.Exit(1)
+		}
+	}
+	metrics.RegisterPool(storage.PoolStat)
+
+	// The services changing memberships go through the cache of active segments to invalidate it.
+	cached := segments_cache.NewStore(storage, cfg.Cache)
+	uu := user_service.NewUserService(cached)
+	ss := segment_service.NewSegmentService(cached, cfg.Segments)
+	uss := user_segments_service.NewUserSegmentationService(cached, cfg.UserSegments)
+	rs := report_service.NewReportService(storage, uss, cfg.Reports)
+	ks := apikey_service.NewAPIKeyService(storage, cfg.Auth)
+	if cfg.Auth.Enabled && cfg.Auth.BootstrapKey == "" {
+		logg.Warn("AUTH_BOOTSTRAP_KEY is not set, API keys can only be created with an existing admin key")
+	}
+	serv := server.New(ctx, cfg.APIServer, uu, ss, uss, rs, ks, storage)
 
+	// Changes made by other instances reach the local state through the notifications.
+	listener := change_listener.New(storage, cfg.Listener)
+	if cache := cached.Cache(); cache != nil {
+		listener.Subscribe(cache.HandleChange)
+	}
+
+	sweeper := ttl_sweeper.New(storage, cfg.Sweeper)
+	go sweeper.Run(ctx)
+	go rs.Run(ctx)
+	go listener.Run(ctx)
+
+	serveErr := make(chan error, 1)
 	go func() {
-		if err := serv.Start(); err != nil {
-			logg.Error("serv.Start", "err", err)
-		}
+		serveErr <- serv.Start()
 	}()
 
-	gracefulShutdown(ctxCancel)
+	gracefulShutdown(serv, serveErr, ctxCancel, storage, sweeper.Done(), rs.Done(), listener.Done())
 }
 
-// gracefulShutdown listens for interrupt signals (e.g., SIGTERM, os.Interrupt)
-// to initiate a graceful shutdown.
-func gracefulShutdown(ctxCancel context.CancelFunc) {
+// gracefulShutdown waits for an interrupt signal (e.g., SIGTERM, os.Interrupt) or the failure
+// of the HTTP server and shuts the application down in order: the server stops accepting requests
+// and drains the ones in flight, then the context is cancelled and the background workers are waited for,
+// and only then the database connections are closed.
+func gracefulShutdown(serv *server.APIServer, serveErr <-chan error, ctxCancel context.CancelFunc,
+	storage *db.Store, workers ...<-chan struct{}) {
 	// Channel for processing the completion signal.
 	signalChan := make(chan os.Signal, 1)
 	signal.Notify(signalChan, os.Interrupt, syscall.SIGTERM)
-	<-signalChan
+	defer signal.Stop(signalChan)
 
-	slog.Debug("Shutting down gracefully...")
-	ctxCancel()
+	select {
+	case sig := <-signalChan:
+		slog.Info("Shutting down gracefully...", "signal", sig.String())
+		if err := serv.Shutdown(context.Background()); err != nil {
+			slog.Error("serv.Shutdown", "err", err)
+		}
+	case err := <-serveErr:
+		if err != nil {
+			slog.Error("serv.Start", "err", err)
+		}
+	}
 
-	if storage != nil {
-		storage.Close()
+	ctxCancel()
+	for _, done := range workers {
+		<-done
 	}
 
-	time.Sleep(1 * time.Second)
+	storage.Close()
 	slog.Info("Application Stopped!")
-	close(signalChan)
 }
@@ -7,14 +7,28 @@ import (
 
 	"user_segmentation_service/internal/db"
 	"user_segmentation_service/internal/logger"
+	"user_segmentation_service/internal/modules/apikey_service"
+	"user_segmentation_service/internal/modules/change_listener"
+	"user_segmentation_service/internal/modules/report_service"
+	"user_segmentation_service/internal/modules/segment_service"
+	"user_segmentation_service/internal/modules/segments_cache"
+	"user_segmentation_service/internal/modules/ttl_sweeper"
+	"user_segmentation_service/internal/modules/user_segments_service"
 	"user_segmentation_service/internal/server"
 )
 
 // Config holds the entire application configuration.
 type Config struct {
-	Log       logger.Config `envconfig:"LOG" required:"true"`
-	DB        db.Config     `envconfig:"DB" required:"true"`
-	APIServer server.Config `envconfig:"HTTP" required:"true"`
+	Log          logger.Config                `envconfig:"LOG" required:"true"`
+	DB           db.Config                    `envconfig:"DB" required:"true"`
+	APIServer    server.Config                `envconfig:"HTTP" required:"true"`
+	Sweeper      ttl_sweeper.Config           `envconfig:"SWEEPER"`
+	Reports      report_service.Config        `envconfig:"REPORTS"`
+	Segments     segment_service.Config       `envconfig:"SEGMENTS"`
+	UserSegments user_segments_service.Config `envconfig:"USER_SEGMENTS"`
+	Cache        segments_cache.Config        `envconfig:"CACHE"`
+	Listener     change_listener.Config       `envconfig:"LISTENER"`
+	Auth         apikey_service.Config        `envconfig:"AUTH"`
 }
 
 // MustLoad is a function that loads environment variables from a `.env` file and
@@ -0,0 +1,66 @@
+// Package db provides functionality for interacting with the PostgreSQL database.
+package db
+
+import (
+	"context"
+
+	"github.com/jackc/pgx/v5"
+
+	"user_segmentation_service/internal/models"
+)
+
+const (
+	apiKeyColumns = `id, name, prefix, scopes, created_at, revoked_at`
+	createAPIKey  = `
+		INSERT INTO api_keys (name, prefix, key_hash, scopes)
+		VALUES ($1, $2, $3, $4)
+		RETURNING id, created_at;`
+	getAPIKeyByHash = `SELECT ` + apiKeyColumns + ` FROM api_keys WHERE key_hash = $1 AND revoked_at IS NULL;`
+	getAllAPIKeys   = `SELECT ` + apiKeyColumns + ` FROM api_keys ORDER BY id;`
+	revokeAPIKey    = `
+		UPDATE api_keys SET revoked_at = NOW()
+		WHERE id = $1 AND revoked_at IS NULL
+		RETURNING ` + apiKeyColumns + `;`
+)
+
+// CreateAPIKey stores a new API key by the hash of the key.
+// On successful execution, the ID and CreatedAt fields are populated into the key structure.
+func (s *Store) CreateAPIKey(ctx context.Context, key *models.APIKey, hash []byte) error {
+	return s.pool.QueryRow(ctx, createAPIKey, key.Name, key.Prefix, hash, key.Scopes).Scan(&key.ID, &key.CreatedAt)
+}
+
+// GetAPIKeyByHash returns the active (not revoked) API key with the given hash.
+// Returns pgx.ErrNoRows if there is no such key.
+func (s *Store) GetAPIKeyByHash(ctx context.Context, hash []byte) (*models.APIKey, error) {
+	rows, err := s.pool.Query(ctx, getAPIKeyByHash, hash)
+	if err != nil {
+		return nil, err
+	}
+	return pgx.CollectExactlyOneRow(rows, scanAPIKey)
+}
+
+// GetAllAPIKeys returns all API keys, including the revoked ones, ordered by id.
+func (s *Store) GetAllAPIKeys(ctx context.Context) ([]*models.APIKey, error) {
+	rows, err := s.pool.Query(ctx, getAllAPIKeys)
+	if err != nil {
+		return nil, err
+	}
+	return pgx.CollectRows(rows, scanAPIKey)
+}
+
+// RevokeAPIKey revokes the API key by id and returns it.
+// Returns pgx.ErrNoRows if there is no such active key.
+func (s *Store) RevokeAPIKey(ctx context.Context, id int) (*models.APIKey, error) {
+	rows, err := s.pool.Query(ctx, revokeAPIKey, id)
+	if err != nil {
+		return nil, err
+	}
+	return pgx.CollectExactlyOneRow(rows, scanAPIKey)
+}
+
+// scanAPIKey scans a row of apiKeyColumns.
+func scanAPIKey(row pgx.CollectableRow) (*models.APIKey, error) {
+	key := &models.APIKey{}
+	err := row.Scan(&key.ID, &key.Name, &key.Prefix, &key.Scopes, &key.CreatedAt, &key.RevokedAt)
+	return key, err
+}
@@ -0,0 +1,15 @@
+// Package db_errors defines the sentinel errors of the database layer that the domain errors are mapped from.
+// It has no dependencies, so the service packages can check them without importing the database layer.
+package db_errors
+
+import "errors"
+
+// Errors of the list parameters.
+var (
+	ErrInvalidCursor = errors.New("invalid cursor")
+	ErrInvalidSort   = errors.New("invalid sort")
+)
+
+// ErrVersionMismatch is returned by conditional updates if the version of the entity
+// is not one of the expected versions (If-Match).
+var ErrVersionMismatch = errors.New("version mismatch")
@@ -0,0 +1,77 @@
+// Package db provides functionality for interacting with the PostgreSQL database.
+package db
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/jackc/pgx/v5"
+
+	"user_segmentation_service/internal/models"
+)
+
+const (
+	// Занимает ключ идемпотентности в транзакции запроса; истёкший ключ занимается заново.
+	// Если ключ занят незавершённой транзакцией, вставка ждёт её завершения.
+	// Не возвращает строк, если ключ уже занят действующим запросом.
+	claimIdempotencyKey = `
+		INSERT INTO idempotency_keys (owner, key, request_hash, expires_at)
+		VALUES ($1, $2, $3, NOW() + $4::INTERVAL)
+		ON CONFLICT (owner, key) DO UPDATE
+			SET request_hash = excluded.request_hash,
+				response     = NULL,
+				created_at   = NOW(),
+				expires_at   = excluded.expires_at
+			WHERE idempotency_keys.expires_at <= NOW()
+		RETURNING TRUE;`
+	getIdempotencyKey        = `SELECT request_hash, response FROM idempotency_keys WHERE owner = $1 AND key = $2;`
+	saveIdempotentResponse   = `UPDATE idempotency_keys SET response = $3 WHERE owner = $1 AND key = $2;`
+	deleteExpiredIdempotency = `DELETE FROM idempotency_keys WHERE expires_at <= NOW();`
+)
+
+// ErrIdempotencyKeyReused is returned if the idempotency key was already used with another payload.
+var ErrIdempotencyKeyReused = errors.New("idempotency key reused with another payload")
+
+// claimIdempotency takes the idempotency key in the transaction of the request.
+// If the key is taken by an earlier request with the same payload, its stored response is returned
+// and the request must not be executed; if the payload differs, ErrIdempotencyKeyReused is returned.
+// A nil response means the key is taken by this transaction.
+func claimIdempotency(ctx context.Context, tx pgx.Tx, key *models.IdempotencyKey) ([]byte, error) {
+	var claimed bool
+	err := tx.QueryRow(ctx, claimIdempotencyKey, key.Owner, key.Key, key.RequestHash, key.TTL).Scan(&claimed)
+	if err == nil {
+		return nil, nil
+	}
+	if !errors.Is(err, pgx.ErrNoRows) {
+		return nil, fmt.Errorf("error claim idempotency key: %w", err)
+	}
+
+	var hash, response []byte
+	if err = tx.QueryRow(ctx, getIdempotencyKey, key.Owner, key.Key).Scan(&hash, &response); err != nil {
+		return nil, fmt.Errorf("error get idempotency key: %w", err)
+	}
+	if !bytes.Equal(hash, key.RequestHash) {
+		return nil, ErrIdempotencyKeyReused
+	}
+	return response, nil
+}
+
+// saveIdempotency stores the response to the request under the idempotency key taken by claimIdempotency.
+func saveIdempotency(ctx context.Context, tx pgx.Tx, key *models.IdempotencyKey, response []byte) error {
+	if _, err := tx.Exec(ctx, saveIdempotentResponse, key.Owner, key.Key, response); err != nil {
+		return fmt.Errorf("error save idempotent response: %w", err)
+	}
+	return nil
+}
+
+// DeleteExpiredIdempotencyKeys deletes the idempotency keys whose window has passed
+// and returns the number of deleted keys.
+func (s *Store) DeleteExpiredIdempotencyKeys(ctx context.Context) (int64, error) {
+	tag, err := s.pool.Exec(ctx, deleteExpiredIdempotency)
+	if err != nil {
+		return 0, fmt.Errorf("error delete expired idempotency keys: %w", err)
+	}
+	return tag.RowsAffected(), nil
+}
@@ -0,0 +1,214 @@
+// Package db provides functionality for interacting with the PostgreSQL database.
+package db
+
+import (
+	"context"
+	"embed"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"regexp"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// migrationFiles contains the versioned schema migrations: NNNN_name.up.sql and NNNN_name.down.sql.
+//
+//go:embed migrations/*.sql
+var migrationFiles embed.FS
+
+// migrationFileName describes the name of a migration file: version, name and direction.
+var migrationFileName = regexp.MustCompile(`^(\d+)_(\w+)\.(up|down)\.sql$`)
+
+// migrationLockKey is the key of the advisory lock that prevents concurrent migration runners.
+const migrationLockKey = 7_211_946_523
+
+const (
+	createMigrationsTable = `
+		CREATE TABLE IF NOT EXISTS schema_migrations
+		(
+			version    BIGINT PRIMARY KEY,
+			name       TEXT NOT NULL,
+			applied_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+		);`
+	getAppliedMigrations = `SELECT version, applied_at FROM schema_migrations ORDER BY version;`
+	insertMigration      = `INSERT INTO schema_migrations (version, name) VALUES ($1, $2);`
+	deleteMigration      = `DELETE FROM schema_migrations WHERE version = $1;`
+	lockMigrations       = `SELECT pg_advisory_lock($1);`
+	unlockMigrations     = `SELECT pg_advisory_unlock($1);`
+)
+
+// Migration describes a schema migration and its state in the database.
+type Migration struct {
+	Version   int        `json:"version"`
+	Name      string     `json:"name"`
+	AppliedAt *time.Time `json:"applied_at,omitempty"` // nil if the migration is not applied.
+	up        string
+	down      string
+}
+
+// loadMigrations reads the embedded migrations ordered by version.
+// Every migration must have an up file, the down file is optional.
+func loadMigrations() ([]*Migration, error) {
+	entries, err := fs.ReadDir(migrationFiles, "migrations")
+	if err != nil {
+		return nil, err
+	}
+
+	byVersion := make(map[int]*Migration, len(entries)/2)
+	for _, entry := range entries {
+		m := migrationFileName.FindStringSubmatch(entry.Name())
+		if m == nil {
+			return nil, fmt.Errorf("invalid migration file name %q", entry.Name())
+		}
+		version, _ := strconv.Atoi(m[1])
+		data, err := migrationFiles.ReadFile("migrations/" + entry.Name())
+		if err != nil {
+			return nil, err
+		}
+
+		mig, ok := byVersion[version]
+		if !ok {
+			mig = &Migration{Version: version, Name: m[2]}
+			byVersion[version] = mig
+		} else if mig.Name != m[2] {
+			return nil, fmt.Errorf("migration %d has different names: %q and %q", version, mig.Name, m[2])
+		}
+		if m[3] == "up" {
+			mig.up = string(data)
+		} else {
+			mig.down = string(data)
+		}
+	}
+
+	migrations := make([]*Migration, 0, len(byVersion))
+	for _, mig := range byVersion {
+		if mig.up == "" {
+			return nil, fmt.Errorf("migration %d_%s has no up file", mig.Version, mig.Name)
+		}
+		migrations = append(migrations, mig)
+	}
+	slices.SortFunc(migrations, func(a, b *Migration) int { return a.Version - b.Version })
+	return migrations, nil
+}
+
+// withMigrationLock runs fn on a dedicated connection holding the migration advisory lock,
+// so that several instances starting at the same time apply the migrations only once.
+func (s *Store) withMigrationLock(ctx context.Context, fn func(conn *pgxpool.Conn, migrations []*Migration) error) error {
+	migrations, err := loadMigrations()
+	if err != nil {
+		return fmt.Errorf("load migrations: %w", err)
+	}
+
+	conn, err := s.pool.Acquire(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Release()
+
+	if _, err = conn.Exec(ctx, lockMigrations, migrationLockKey); err != nil {
+		return fmt.Errorf("acquire migration lock: %w", err)
+	}
+	defer func() {
+		// The context may be cancelled, but the lock must be released before the connection returns to the pool.
+		_, _ = conn.Exec(context.WithoutCancel(ctx), unlockMigrations, migrationLockKey)
+	}()
+
+	if _, err = conn.Exec(ctx, createMigrationsTable); err != nil {
+		return fmt.Errorf("create migrations table: %w", err)
+	}
+	rows, err := conn.Query(ctx, getAppliedMigrations)
+	if err != nil {
+		return fmt.Errorf("get applied migrations: %w", err)
+	}
+	applied := make(map[int]time.Time)
+	var (
+		version   int
+		appliedAt time.Time
+	)
+	_, err = pgx.ForEachRow(rows, []any{&version, &appliedAt}, func() error {
+		applied[version] = appliedAt
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("get applied migrations: %w", err)
+	}
+	for _, mig := range migrations {
+		if t, ok := applied[mig.Version]; ok {
+			mig.AppliedAt = &t
+		}
+	}
+	return fn(conn, migrations)
+}
+
+// MigrateUp applies all pending migrations in order, each in its own transaction.
+// Returns the versions of the applied migrations.
+func (s *Store) MigrateUp(ctx context.Context) ([]int, error) {
+	var done []int
+	err := s.withMigrationLock(ctx, func(conn *pgxpool.Conn, migrations []*Migration) error {
+		for _, mig := range migrations {
+			if mig.AppliedAt != nil {
+				continue
+			}
+			err := pgx.BeginFunc(ctx, conn, func(tx pgx.Tx) error {
+				if _, err := tx.Exec(ctx, mig.up); err != nil {
+					return err
+				}
+				_, err := tx.Exec(ctx, insertMigration, mig.Version, mig.Name)
+				return err
+			})
+			if err != nil {
+				return fmt.Errorf("apply migration %d_%s: %w", mig.Version, mig.Name, err)
+			}
+			slog.Info("Migration applied", "version", mig.Version, "name", mig.Name)
+			done = append(done, mig.Version)
+		}
+		return nil
+	})
+	return done, err
+}
+
+// MigrateDown rolls back the given number of the latest applied migrations, each in its own transaction.
+// Returns the versions of the rolled back migrations.
+func (s *Store) MigrateDown(ctx context.Context, steps int) ([]int, error) {
+	var done []int
+	err := s.withMigrationLock(ctx, func(conn *pgxpool.Conn, migrations []*Migration) error {
+		for i := len(migrations) - 1; i >= 0 && len(done) < steps; i-- {
+			mig := migrations[i]
+			if mig.AppliedAt == nil {
+				continue
+			}
+			if mig.down == "" {
+				return fmt.Errorf("migration %d_%s cannot be rolled back: no down file", mig.Version, mig.Name)
+			}
+			err := pgx.BeginFunc(ctx, conn, func(tx pgx.Tx) error {
+				if _, err := tx.Exec(ctx, mig.down); err != nil {
+					return err
+				}
+				_, err := tx.Exec(ctx, deleteMigration, mig.Version)
+				return err
+			})
+			if err != nil {
+				return fmt.Errorf("roll back migration %d_%s: %w", mig.Version, mig.Name, err)
+			}
+			slog.Info("Migration rolled back", "version", mig.Version, "name", mig.Name)
+			done = append(done, mig.Version)
+		}
+		return nil
+	})
+	return done, err
+}
+
+// MigrationStatus returns all known migrations with the time they were applied.
+func (s *Store) MigrationStatus(ctx context.Context) ([]*Migration, error) {
+	var res []*Migration
+	err := s.withMigrationLock(ctx, func(_ *pgxpool.Conn, migrations []*Migration) error {
+		res = migrations
+		return nil
+	})
+	return res, err
+}
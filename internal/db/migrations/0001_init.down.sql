@@ -0,0 +1,4 @@
+DROP TABLE IF EXISTS user_segments_history;
+DROP TABLE IF EXISTS user_segments;
+DROP TABLE IF EXISTS segments;
+DROP TABLE IF EXISTS users;
@@ -0,0 +1,18 @@
+-- Асинхронная генерация отчётов по истории сегментов
+CREATE TABLE IF NOT EXISTS report_jobs
+(
+    id               UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    params           JSONB       NOT NULL,
+    status           VARCHAR(10) NOT NULL DEFAULT 'pending'
+        CHECK (status IN ('pending', 'running', 'done', 'failed')),
+    error            TEXT,
+    file_name        TEXT,
+    token            TEXT UNIQUE,                   -- токен для скачивания готового отчёта
+    token_expires_at TIMESTAMP,
+    created_at       TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    started_at       TIMESTAMP,
+    finished_at      TIMESTAMP
+);
+
+-- Для выбора очередной задачи воркером
+CREATE INDEX IF NOT EXISTS report_jobs_pending_idx ON report_jobs (created_at) WHERE status = 'pending';
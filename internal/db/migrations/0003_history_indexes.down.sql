@@ -0,0 +1,2 @@
+DROP INDEX IF EXISTS user_segments_history_user_id_created_at_idx;
+DROP INDEX IF EXISTS user_segments_history_created_at_idx;
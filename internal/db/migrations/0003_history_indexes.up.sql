@@ -0,0 +1,3 @@
+-- Для отчётов по истории за произвольный период: по всем пользователям и по выбранным
+CREATE INDEX IF NOT EXISTS user_segments_history_created_at_idx ON user_segments_history (created_at);
+CREATE INDEX IF NOT EXISTS user_segments_history_user_id_created_at_idx ON user_segments_history (user_id, created_at);
@@ -0,0 +1,2 @@
+-- Удаление сегмента переводит его в архив: история изменений сохраняется
+ALTER TABLE segments ADD COLUMN IF NOT EXISTS archived_at TIMESTAMP;
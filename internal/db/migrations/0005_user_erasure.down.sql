@@ -0,0 +1,3 @@
+DROP TABLE IF EXISTS erasure_receipts;
+ALTER TABLE users DROP COLUMN IF EXISTS pseudonym;
+ALTER TABLE users DROP COLUMN IF EXISTS erased_at;
@@ -0,0 +1,14 @@
+-- Стирание пользователя: персональные данные удаляются, строка остаётся псевдонимным «надгробием»,
+-- чтобы история и отчёты по ней не менялись
+ALTER TABLE users ADD COLUMN IF NOT EXISTS erased_at TIMESTAMP;
+ALTER TABLE users ADD COLUMN IF NOT EXISTS pseudonym VARCHAR(64) UNIQUE;
+
+-- Квитанции о стирании; не ссылаются на users, чтобы пережить любые изменения пользователей
+CREATE TABLE IF NOT EXISTS erasure_receipts
+(
+    id                UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    user_id           INT         NOT NULL UNIQUE,
+    pseudonym         VARCHAR(64) NOT NULL,
+    memberships_ended INT         NOT NULL,
+    erased_at         TIMESTAMP   NOT NULL
+);
@@ -0,0 +1,2 @@
+DROP TABLE IF EXISTS segment_renames;
+DROP TABLE IF EXISTS segment_aliases;
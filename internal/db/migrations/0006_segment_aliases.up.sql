@@ -0,0 +1,23 @@
+-- Прежние slug'и переименованных сегментов, которые ещё какое-то время разрешаются в сегмент
+CREATE TABLE IF NOT EXISTS segment_aliases
+(
+    slug       VARCHAR(255) PRIMARY KEY,
+    segment_id INT       NOT NULL,
+    expires_at TIMESTAMP NOT NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY (segment_id) REFERENCES segments (id) ON DELETE CASCADE
+);
+
+-- Журнал переименований сегментов
+CREATE TABLE IF NOT EXISTS segment_renames
+(
+    id               SERIAL PRIMARY KEY,
+    segment_id       INT          NOT NULL,
+    old_slug         VARCHAR(255) NOT NULL,
+    new_slug         VARCHAR(255) NOT NULL,
+    alias_expires_at TIMESTAMP,
+    renamed_at       TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY (segment_id) REFERENCES segments (id) ON DELETE CASCADE
+);
+
+CREATE INDEX IF NOT EXISTS segment_renames_segment_id_idx ON segment_renames (segment_id, renamed_at);
@@ -0,0 +1,11 @@
+-- Ключи API: хранится только SHA-256 ключа, сам ключ показывается один раз при создании
+CREATE TABLE IF NOT EXISTS api_keys
+(
+    id         SERIAL PRIMARY KEY,
+    name       VARCHAR(150) NOT NULL,
+    prefix     VARCHAR(16)  NOT NULL, -- начало ключа, чтобы его можно было узнать в списке
+    key_hash   BYTEA        NOT NULL UNIQUE,
+    scopes     TEXT[]       NOT NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    revoked_at TIMESTAMP
+);
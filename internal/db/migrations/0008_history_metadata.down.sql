@@ -0,0 +1,3 @@
+ALTER TABLE user_segments_history DROP COLUMN IF EXISTS reason;
+ALTER TABLE user_segments_history DROP COLUMN IF EXISTS source;
+ALTER TABLE user_segments_history DROP COLUMN IF EXISTS actor;
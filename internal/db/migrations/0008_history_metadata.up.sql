@@ -0,0 +1,4 @@
+-- Кто (actor), откуда (source) и почему (reason) изменил членство; у старых записей не заполнены
+ALTER TABLE user_segments_history ADD COLUMN IF NOT EXISTS actor VARCHAR(150);
+ALTER TABLE user_segments_history ADD COLUMN IF NOT EXISTS source VARCHAR(64);
+ALTER TABLE user_segments_history ADD COLUMN IF NOT EXISTS reason TEXT;
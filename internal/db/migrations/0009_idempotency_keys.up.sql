@@ -0,0 +1,15 @@
+-- Ключи идемпотентности запросов на изменение членств: хеш запроса и сохранённый ответ.
+-- Ключ занимается в транзакции самого изменения, поэтому response заполнен у всех зафиксированных строк.
+CREATE TABLE IF NOT EXISTS idempotency_keys
+(
+    owner        VARCHAR(150) NOT NULL, -- actor запроса: ключи разных клиентов не пересекаются
+    key          VARCHAR(255) NOT NULL,
+    request_hash BYTEA        NOT NULL,
+    response     JSONB,
+    created_at   TIMESTAMP    NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    expires_at   TIMESTAMP    NOT NULL,
+    PRIMARY KEY (owner, key)
+);
+
+-- Для фонового удаления истёкших ключей
+CREATE INDEX IF NOT EXISTS idempotency_keys_expires_at_idx ON idempotency_keys (expires_at);
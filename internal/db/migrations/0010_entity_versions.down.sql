@@ -0,0 +1,2 @@
+ALTER TABLE users DROP COLUMN IF EXISTS version;
+ALTER TABLE segments DROP COLUMN IF EXISTS version;
@@ -0,0 +1,4 @@
+-- Версии сегментов и пользователей для оптимистичной блокировки (ETag / If-Match):
+-- каждое изменение строки увеличивает версию на единицу
+ALTER TABLE segments ADD COLUMN IF NOT EXISTS version INT NOT NULL DEFAULT 1;
+ALTER TABLE users ADD COLUMN IF NOT EXISTS version INT NOT NULL DEFAULT 1;
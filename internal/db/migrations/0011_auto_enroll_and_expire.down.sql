@@ -0,0 +1,9 @@
+DROP INDEX IF EXISTS user_segments_expiration_time_idx;
+
+-- Истечения записываются как удаления, иначе исходное ограничение не выполняется.
+UPDATE user_segments_history SET action = 'REMOVE' WHERE action = 'EXPIRE';
+ALTER TABLE user_segments_history DROP CONSTRAINT IF EXISTS user_segments_history_action_check;
+ALTER TABLE user_segments_history
+    ADD CONSTRAINT user_segments_history_action_check CHECK (action IN ('ADD', 'REMOVE'));
+
+ALTER TABLE segments DROP COLUMN IF EXISTS auto_percent;
@@ -0,0 +1,11 @@
+-- Схема, созданная из исходного sql/init.sql, не содержит изменений, сделанных позже в init.sql:
+-- автоматического распределения пользователей, действия 'EXPIRE' и индекса для фонового удаления.
+-- Все изменения идемпотентны, поэтому безопасны и для баз, где они уже есть.
+ALTER TABLE segments ADD COLUMN IF NOT EXISTS auto_percent SMALLINT CHECK (auto_percent BETWEEN 1 AND 100);
+
+ALTER TABLE user_segments_history DROP CONSTRAINT IF EXISTS user_segments_history_action_check;
+ALTER TABLE user_segments_history
+    ADD CONSTRAINT user_segments_history_action_check CHECK (action IN ('ADD', 'REMOVE', 'EXPIRE'));
+
+-- Для фонового удаления записей с истёкшим TTL
+CREATE INDEX IF NOT EXISTS user_segments_expiration_time_idx ON user_segments (expiration_time);
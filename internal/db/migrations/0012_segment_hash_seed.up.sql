@@ -0,0 +1,14 @@
+-- Неизменяемая основа «корзины» auto_percent: исходный slug сегмента.
+-- Переименование меняет slug, но не состав корзин.
+ALTER TABLE segments ADD COLUMN IF NOT EXISTS hash_seed VARCHAR(255);
+
+-- Для уже переименованных сегментов исходный slug - первый старый slug из журнала переименований.
+UPDATE segments s
+SET hash_seed = COALESCE((SELECT r.old_slug
+                          FROM segment_renames r
+                          WHERE r.segment_id = s.id
+                          ORDER BY r.renamed_at, r.id
+                          LIMIT 1), s.slug)
+WHERE hash_seed IS NULL;
+
+ALTER TABLE segments ALTER COLUMN hash_seed SET NOT NULL;
@@ -0,0 +1,87 @@
+// Package db provides functionality for interacting with the PostgreSQL database.
+package db
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+
+	"user_segmentation_service/internal/models"
+)
+
+// ChangesChannel is the channel of the notifications about changes of memberships and segments.
+const ChangesChannel = "user_segments_changes"
+
+// maxNotifiedUsers is the maximum number of users in one notification; the payload is limited to 8000 bytes.
+const maxNotifiedUsers = 500
+
+// closeTimeout is the maximum time of closing the listening connection, which may be broken.
+const closeTimeout = 5 * time.Second
+
+// Отправляет уведомление; оно доставляется слушателям только после фиксации транзакции.
+const notifyChange = `SELECT pg_notify($1, $2);`
+
+// notifyUsersChanged notifies the instances that the memberships of the users changed.
+// Called within the transaction of the change, so the notification is sent only if it commits.
+func notifyUsersChanged(ctx context.Context, tx pgx.Tx, userIDs []int) error {
+	for start := 0; start < len(userIDs); start += maxNotifiedUsers {
+		users := userIDs[start:min(start+maxNotifiedUsers, len(userIDs))]
+		if err := notify(ctx, tx, models.Change{Users: users}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// notify sends the change to the instances within the transaction.
+func notify(ctx context.Context, tx pgx.Tx, change models.Change) error {
+	payload, err := json.Marshal(change)
+	if err != nil {
+		return fmt.Errorf("error encode change notification: %w", err)
+	}
+	if _, err = tx.Exec(ctx, notifyChange, ChangesChannel, string(payload)); err != nil {
+		return fmt.Errorf("error notify change: %w", err)
+	}
+	return nil
+}
+
+// ListenChanges holds a dedicated connection of the pool listening for the change notifications
+// and passes each of them to fn until the context is cancelled or the connection fails.
+// listening is called once the connection listens, so that the caller can resynchronize
+// with the changes it may have missed before. Notifications that cannot be decoded are skipped.
+// Returns the error of the connection, or the error of the context once it is cancelled.
+func (s *Store) ListenChanges(ctx context.Context, listening func(), fn func(models.Change)) error {
+	conn, err := s.pool.Acquire(ctx)
+	if err != nil {
+		return fmt.Errorf("error acquire connection: %w", err)
+	}
+	// The connection is in the LISTEN state or broken, it must not return to the pool.
+	listener := conn.Hijack()
+	defer func() {
+		closeCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), closeTimeout)
+		defer cancel()
+		_ = listener.Close(closeCtx)
+	}()
+
+	if _, err = listener.Exec(ctx, "LISTEN "+pgx.Identifier{ChangesChannel}.Sanitize()); err != nil {
+		return fmt.Errorf("error listen %s: %w", ChangesChannel, err)
+	}
+	listening()
+
+	for {
+		n, err := listener.WaitForNotification(ctx)
+		if err != nil {
+			return err
+		}
+		var change models.Change
+		if err = json.Unmarshal([]byte(n.Payload), &change); err != nil {
+			slog.Error("db.ListenChanges", "payload", n.Payload, "err", err)
+			continue
+		}
+		fn(change)
+	}
+}
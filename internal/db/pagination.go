@@ -0,0 +1,174 @@
+// Package db provides functionality for interacting with the PostgreSQL database.
+package db
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"user_segmentation_service/internal/db/db_errors"
+)
+
+// Errors of the list parameters, see package db_errors.
+var (
+	ErrInvalidCursor = db_errors.ErrInvalidCursor
+	ErrInvalidSort   = db_errors.ErrInvalidSort
+)
+
+// ListParams describes filtering, sorting and keyset pagination of a list query.
+type ListParams struct {
+	Prefix      string     // Name prefix for users, slug prefix for segments.
+	CreatedFrom *time.Time // Inclusive lower bound of created_at.
+	CreatedTo   *time.Time // Exclusive upper bound of created_at.
+	Sort        string     // Sort key, "-" prefix for descending order, e.g. "-created_at". Default is "id".
+	Limit       int        // Maximum number of items on the page, DefaultListLimit if not set.
+	Cursor      string     // Opaque cursor returned with the previous page.
+}
+
+// Page size limits of the list queries.
+const (
+	DefaultListLimit = 100
+	MaxListLimit     = 1000
+)
+
+// normalize applies the default page size and caps it at MaxListLimit.
+func (p *ListParams) normalize() {
+	switch {
+	case p.Limit <= 0:
+		p.Limit = DefaultListLimit
+	case p.Limit > MaxListLimit:
+		p.Limit = MaxListLimit
+	}
+}
+
+// cursor is the position after which the next page starts:
+// the value of the sort key and the id of the last item on the previous page.
+type cursor struct {
+	Sort  string `json:"s"`
+	Value string `json:"v,omitempty"`
+	ID    int    `json:"id"`
+}
+
+// encode returns the opaque text representation of the cursor.
+func (c cursor) encode() string {
+	data, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// decodeCursor parses the cursor and checks that it was issued for the same sort order.
+func decodeCursor(s, sort string) (*cursor, error) {
+	data, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, ErrInvalidCursor
+	}
+	c := &cursor{}
+	if err = json.Unmarshal(data, c); err != nil || c.Sort != sort {
+		return nil, ErrInvalidCursor
+	}
+	return c, nil
+}
+
+// sortKey describes a column that a list can be sorted by.
+type sortKey struct {
+	expr string                   // SQL expression of the key.
+	arg  func(string) (any, bool) // Converts the cursor value to the query argument, nil for the id key.
+	val  func(item any) string    // Extracts the cursor value from the last item, nil for the id key.
+}
+
+// textArg converts the cursor value of a text key.
+func textArg(v string) (any, bool) { return v, true }
+
+// timeArg converts the cursor value of a timestamp key.
+func timeArg(v string) (any, bool) {
+	t, err := time.Parse(time.RFC3339Nano, v)
+	return t, err == nil
+}
+
+// keysetQuery builds a list query with filters, keyset condition, order and limit.
+// base is "SELECT ... FROM table", prefixExpr is the column filtered by ListParams.Prefix.
+// baseArgs are the arguments of placeholders used in base ($1, $2, ...), the rest are numbered after them.
+// One more row than the limit is requested to find out if there is a next page.
+func keysetQuery(base, prefixExpr string, keys map[string]sortKey, p ListParams, baseArgs ...any) (string, []any, error) {
+	sort, desc := strings.CutPrefix(p.Sort, "-")
+	if sort == "" {
+		sort = "id"
+	}
+	key, ok := keys[sort]
+	if !ok {
+		return "", nil, fmt.Errorf("%w: %s", ErrInvalidSort, p.Sort)
+	}
+
+	var (
+		where []string
+		args  = baseArgs
+	)
+	arg := func(v any) string {
+		args = append(args, v)
+		return "$" + strconv.Itoa(len(args))
+	}
+	if p.Prefix != "" {
+		where = append(where, "STARTS_WITH("+prefixExpr+", "+arg(p.Prefix)+")")
+	}
+	if p.CreatedFrom != nil {
+		where = append(where, "created_at >= "+arg(p.CreatedFrom.UTC()))
+	}
+	if p.CreatedTo != nil {
+		where = append(where, "created_at < "+arg(p.CreatedTo.UTC()))
+	}
+
+	cmp, dir := ">", "ASC"
+	if desc {
+		cmp, dir = "<", "DESC"
+	}
+	if p.Cursor != "" {
+		c, err := decodeCursor(p.Cursor, p.Sort)
+		if err != nil {
+			return "", nil, err
+		}
+		if key.arg == nil {
+			where = append(where, "id "+cmp+" "+arg(c.ID))
+		} else {
+			v, ok := key.arg(c.Value)
+			if !ok {
+				return "", nil, ErrInvalidCursor
+			}
+			where = append(where, "("+key.expr+", id) "+cmp+" ("+arg(v)+", "+arg(c.ID)+")")
+		}
+	}
+
+	var b strings.Builder
+	b.WriteString(base)
+	if len(where) > 0 {
+		b.WriteString(" WHERE " + strings.Join(where, " AND "))
+	}
+	if key.arg == nil {
+		b.WriteString(" ORDER BY id " + dir)
+	} else {
+		b.WriteString(" ORDER BY " + key.expr + " " + dir + ", id " + dir)
+	}
+	b.WriteString(" LIMIT " + arg(p.Limit+1) + ";")
+	return b.String(), args, nil
+}
+
+// nextCursor trims the extra item requested by keysetQuery and returns the cursor of the next page,
+// or an empty string if this page is the last one.
+func nextCursor[T any](items []T, p ListParams, keys map[string]sortKey, id func(T) int) ([]T, string) {
+	if len(items) <= p.Limit {
+		return items, ""
+	}
+	items = items[:p.Limit]
+	last := items[len(items)-1]
+
+	sort, _ := strings.CutPrefix(p.Sort, "-")
+	if sort == "" {
+		sort = "id"
+	}
+	c := cursor{Sort: p.Sort, ID: id(last)}
+	if key := keys[sort]; key.val != nil {
+		c.Value = key.val(last)
+	}
+	return items, c.encode()
+}
@@ -0,0 +1,215 @@
+package db
+
+import (
+	"encoding/base64"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// testSortKeys - keys of a list of test items.
+var testSortKeys = map[string]sortKey{
+	"id": {expr: "id"},
+	"name": {
+		expr: "COALESCE(name, '')",
+		arg:  textArg,
+		val:  func(item any) string { return item.(testItem).name },
+	},
+	"created_at": {
+		expr: "created_at",
+		arg:  timeArg,
+		val:  func(item any) string { return item.(testItem).createdAt.Format(time.RFC3339Nano) },
+	},
+}
+
+type testItem struct {
+	id        int
+	name      string
+	createdAt time.Time
+}
+
+func TestCursorRoundTrip(t *testing.T) {
+	tests := []cursor{
+		{Sort: "id", ID: 42},
+		{Sort: "-name", Value: "Иван, \"Петров\"", ID: 7},
+		{Sort: "created_at", Value: "2024-01-02T03:04:05.123456Z", ID: 1},
+	}
+	for _, c := range tests {
+		t.Run(c.Sort, func(t *testing.T) {
+			got, err := decodeCursor(c.encode(), c.Sort)
+			if err != nil {
+				t.Fatalf("decodeCursor() error = %v", err)
+			}
+			if *got != c {
+				t.Errorf("decodeCursor() = %+v, want %+v", *got, c)
+			}
+		})
+	}
+}
+
+func TestDecodeCursorInvalid(t *testing.T) {
+	tests := []struct {
+		name   string
+		cursor string
+		sort   string
+	}{
+		{"not base64", "!!!", "id"},
+		{"padded base64", base64.URLEncoding.EncodeToString([]byte(`{"s":"id","id":1}`)), "id"},
+		{"not JSON", base64.RawURLEncoding.EncodeToString([]byte("id=1")), "id"},
+		{"wrong type", base64.RawURLEncoding.EncodeToString([]byte(`{"s":"id","id":"1"}`)), "id"},
+		{"other sort key", cursor{Sort: "name", Value: "a", ID: 1}.encode(), "id"},
+		{"other direction", cursor{Sort: "name", Value: "a", ID: 1}.encode(), "-name"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := decodeCursor(tt.cursor, tt.sort); !errors.Is(err, ErrInvalidCursor) {
+				t.Errorf("decodeCursor() error = %v, want ErrInvalidCursor", err)
+			}
+		})
+	}
+}
+
+func TestKeysetQuery(t *testing.T) {
+	const base = "SELECT id, name, created_at FROM users"
+	from := time.Date(2024, 1, 1, 3, 0, 0, 0, time.FixedZone("MSK", 3*60*60))
+	to := time.Date(2024, 2, 1, 0, 0, 0, 0, time.UTC)
+	createdAt := time.Date(2024, 1, 15, 12, 0, 0, 500, time.UTC)
+
+	tests := []struct {
+		name     string
+		p        ListParams
+		baseArgs []any
+		wantSQL  string
+		wantArgs []any
+	}{
+		{
+			name:     "default sort",
+			p:        ListParams{Limit: 10},
+			wantSQL:  base + " ORDER BY id ASC LIMIT $1;",
+			wantArgs: []any{11},
+		},
+		{
+			name:     "descending id",
+			p:        ListParams{Sort: "-id", Limit: 10},
+			wantSQL:  base + " ORDER BY id DESC LIMIT $1;",
+			wantArgs: []any{11},
+		},
+		{
+			name:     "text key",
+			p:        ListParams{Sort: "name", Limit: 10},
+			wantSQL:  base + " ORDER BY COALESCE(name, '') ASC, id ASC LIMIT $1;",
+			wantArgs: []any{11},
+		},
+		{
+			name:     "filters after base arguments",
+			p:        ListParams{Prefix: "Ив", CreatedFrom: &from, CreatedTo: &to, Limit: 10},
+			baseArgs: []any{"AVITO_TEST"},
+			wantSQL: base + " WHERE STARTS_WITH(name, $2) AND created_at >= $3 AND created_at < $4" +
+				" ORDER BY id ASC LIMIT $5;",
+			wantArgs: []any{"AVITO_TEST", "Ив", from.UTC(), to, 11},
+		},
+		{
+			name:     "id cursor",
+			p:        ListParams{Limit: 10, Cursor: cursor{Sort: "", ID: 5}.encode()},
+			wantSQL:  base + " WHERE id > $1 ORDER BY id ASC LIMIT $2;",
+			wantArgs: []any{5, 11},
+		},
+		{
+			name:     "descending id cursor",
+			p:        ListParams{Sort: "-id", Limit: 10, Cursor: cursor{Sort: "-id", ID: 5}.encode()},
+			wantSQL:  base + " WHERE id < $1 ORDER BY id DESC LIMIT $2;",
+			wantArgs: []any{5, 11},
+		},
+		{
+			name:     "text cursor",
+			p:        ListParams{Sort: "name", Limit: 10, Cursor: cursor{Sort: "name", Value: "Иван", ID: 5}.encode()},
+			wantSQL:  base + " WHERE (COALESCE(name, ''), id) > ($1, $2) ORDER BY COALESCE(name, '') ASC, id ASC LIMIT $3;",
+			wantArgs: []any{"Иван", 5, 11},
+		},
+		{
+			name: "descending time cursor with a filter",
+			p: ListParams{Prefix: "Ив", Sort: "-created_at", Limit: 10,
+				Cursor: cursor{Sort: "-created_at", Value: createdAt.Format(time.RFC3339Nano), ID: 5}.encode()},
+			wantSQL: base + " WHERE STARTS_WITH(name, $1) AND (created_at, id) < ($2, $3)" +
+				" ORDER BY created_at DESC, id DESC LIMIT $4;",
+			wantArgs: []any{"Ив", createdAt, 5, 11},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sql, args, err := keysetQuery(base, "name", testSortKeys, tt.p, tt.baseArgs...)
+			if err != nil {
+				t.Fatalf("keysetQuery() error = %v", err)
+			}
+			if sql != tt.wantSQL {
+				t.Errorf("keysetQuery() sql =\n%s\nwant\n%s", sql, tt.wantSQL)
+			}
+			if !reflect.DeepEqual(args, tt.wantArgs) {
+				t.Errorf("keysetQuery() args = %v, want %v", args, tt.wantArgs)
+			}
+		})
+	}
+}
+
+func TestKeysetQueryInvalid(t *testing.T) {
+	tests := []struct {
+		name string
+		p    ListParams
+		want error
+	}{
+		{"unknown sort key", ListParams{Sort: "password"}, ErrInvalidSort},
+		{"unknown descending sort key", ListParams{Sort: "-password"}, ErrInvalidSort},
+		{"malformed cursor", ListParams{Cursor: "!!!"}, ErrInvalidCursor},
+		{"cursor of another sort", ListParams{Sort: "-id", Cursor: cursor{Sort: "id", ID: 5}.encode()}, ErrInvalidCursor},
+		{"invalid time value", ListParams{Sort: "created_at",
+			Cursor: cursor{Sort: "created_at", Value: "yesterday", ID: 5}.encode()}, ErrInvalidCursor},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, _, err := keysetQuery("SELECT id FROM users", "name", testSortKeys, tt.p); !errors.Is(err, tt.want) {
+				t.Errorf("keysetQuery() error = %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestNextCursor(t *testing.T) {
+	createdAt := time.Date(2024, 1, 15, 12, 0, 0, 500, time.UTC)
+	items := []testItem{{1, "a", createdAt}, {2, "b", createdAt}, {3, "c", createdAt}}
+	id := func(i testItem) int { return i.id }
+
+	tests := []struct {
+		name      string
+		p         ListParams
+		wantItems int
+		want      *cursor
+	}{
+		{"last page", ListParams{Limit: 3}, 3, nil},
+		{"id", ListParams{Limit: 2}, 2, &cursor{ID: 2}},
+		{"text key", ListParams{Sort: "-name", Limit: 2}, 2, &cursor{Sort: "-name", Value: "b", ID: 2}},
+		{"time key", ListParams{Sort: "created_at", Limit: 1}, 1,
+			&cursor{Sort: "created_at", Value: createdAt.Format(time.RFC3339Nano), ID: 1}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			page, next := nextCursor(items, tt.p, testSortKeys, id)
+			if len(page) != tt.wantItems {
+				t.Errorf("nextCursor() returned %d items, want %d", len(page), tt.wantItems)
+			}
+			if tt.want == nil {
+				if next != "" {
+					t.Errorf("nextCursor() = %q, want no cursor", next)
+				}
+				return
+			}
+			c, err := decodeCursor(next, tt.p.Sort)
+			if err != nil {
+				t.Fatalf("decodeCursor() error = %v", err)
+			}
+			if *c != *tt.want {
+				t.Errorf("nextCursor() = %+v, want %+v", *c, *tt.want)
+			}
+		})
+	}
+}
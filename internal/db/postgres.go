@@ -17,6 +17,8 @@ type Config struct {
 	Name     string `envconfig:"NAME" default:"demo_db"`
 	User     string `envconfig:"USER" default:"demo_user"`
 	Password string `envconfig:"PASSWORD" default:"demo_password"`
+	// MigrateOnStart applies pending schema migrations when the server starts.
+	MigrateOnStart bool `envconfig:"MIGRATE_ON_START" default:"true"`
 }
 
 // Store - connections store with basic methods of working with the database.
@@ -67,6 +69,16 @@ func NewPostgresPool(ctx context.Context, cfg Config) (*Store, error) {
 	return &Store{pool}, nil
 }
 
+// Ping checks that the database answers.
+func (s *Store) Ping(ctx context.Context) error {
+	return s.pool.Ping(ctx)
+}
+
+// PoolStat returns the current statistics of the connection pool.
+func (s *Store) PoolStat() *pgxpool.Stat {
+	return s.pool.Stat()
+}
+
 // Close closes the database connection pool if it's open, logging the closure.
 func (s *Store) Close() {
 	if s.pool != nil {
@@ -0,0 +1,132 @@
+// Package db provides functionality for interacting with the PostgreSQL database.
+package db
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+
+	"user_segmentation_service/internal/models"
+)
+
+const (
+	reportJobColumns = `id::TEXT, params, status, COALESCE(error, ''), COALESCE(file_name, ''), COALESCE(token, ''),
+		token_expires_at, created_at, started_at, finished_at`
+	createReportJob = `INSERT INTO report_jobs (params) VALUES ($1) RETURNING ` + reportJobColumns + `;`
+	getReportJob    = `SELECT ` + reportJobColumns + ` FROM report_jobs WHERE id = $1;`
+	// Готовый отчёт доступен по токену только до истечения срока его действия.
+	getReportJobByToken = `
+		SELECT ` + reportJobColumns + `
+		FROM report_jobs
+		WHERE token = $1
+			AND status = 'done'
+			AND token_expires_at > NOW();`
+	// Забирает самую старую ожидающую задачу; SKIP LOCKED позволяет
+	// нескольким воркерам (и экземплярам сервиса) не брать одну задачу дважды.
+	claimReportJob = `
+		UPDATE report_jobs
+		SET status = 'running', started_at = NOW()
+		WHERE id = (SELECT id
+					FROM report_jobs
+					WHERE status = 'pending'
+					ORDER BY created_at
+					LIMIT 1 FOR UPDATE SKIP LOCKED)
+		RETURNING ` + reportJobColumns + `;`
+	finishReportJob = `
+		UPDATE report_jobs
+		SET status = 'done', file_name = $2, token = $3, token_expires_at = NOW() + $4::INTERVAL, finished_at = NOW()
+		WHERE id = $1 AND status = 'running';`
+	failReportJob = `UPDATE report_jobs SET status = 'failed', error = $2, finished_at = NOW() WHERE id = $1 AND status = 'running';`
+	// Задачи, которые выполняются дольше таймаута (например, экземпляр сервиса упал), считаются проваленными.
+	failStaleReportJobs = `
+		UPDATE report_jobs
+		SET status = 'failed', error = 'timed out', finished_at = NOW()
+		WHERE status = 'running'
+			AND started_at < NOW() - $1::INTERVAL;`
+	// Удаляет завершённые задачи старше срока хранения и возвращает имена их файлов.
+	deleteOldReportJobs = `
+		WITH deleted AS (
+				DELETE FROM report_jobs
+				WHERE status IN ('done', 'failed')
+					AND finished_at < NOW() - $1::INTERVAL
+				RETURNING file_name)
+		SELECT COALESCE(ARRAY_AGG(file_name) FILTER (WHERE file_name IS NOT NULL), '{}') FROM deleted;`
+)
+
+// scanReportJob scans a row of reportJobColumns.
+func scanReportJob(row pgx.Row) (*models.ReportJob, error) {
+	job := &models.ReportJob{}
+	err := row.Scan(&job.ID, &job.Params, &job.Status, &job.Error, &job.FileName, &job.Token,
+		&job.ExpiresAt, &job.CreatedAt, &job.StartedAt, &job.FinishedAt)
+	if err != nil {
+		return nil, err
+	}
+	return job, nil
+}
+
+// CreateReportJob creates a pending job generating the report with the given parameters.
+func (s *Store) CreateReportJob(ctx context.Context, params models.HistoryParams) (*models.ReportJob, error) {
+	job, err := scanReportJob(s.pool.QueryRow(ctx, createReportJob, params))
+	if err != nil {
+		return nil, fmt.Errorf("error create report job: %w", err)
+	}
+	return job, nil
+}
+
+// GetReportJob returns the report job by ID.
+func (s *Store) GetReportJob(ctx context.Context, id string) (*models.ReportJob, error) {
+	return scanReportJob(s.pool.QueryRow(ctx, getReportJob, id))
+}
+
+// GetReportJobByToken returns the finished report job by its download token,
+// or pgx.ErrNoRows if there is no such job or the token has expired.
+func (s *Store) GetReportJobByToken(ctx context.Context, token string) (*models.ReportJob, error) {
+	return scanReportJob(s.pool.QueryRow(ctx, getReportJobByToken, token))
+}
+
+// ClaimReportJob marks the oldest pending job as running and returns it,
+// or pgx.ErrNoRows if there are no pending jobs.
+func (s *Store) ClaimReportJob(ctx context.Context) (*models.ReportJob, error) {
+	return scanReportJob(s.pool.QueryRow(ctx, claimReportJob))
+}
+
+// FinishReportJob marks the job as done: the report is stored in fileName
+// and can be downloaded with token during tokenTTL. Returns pgx.ErrNoRows if the job
+// is no longer running (e.g. it was failed as stale by another instance).
+func (s *Store) FinishReportJob(ctx context.Context, id, fileName, token string, tokenTTL time.Duration) error {
+	tag, err := s.pool.Exec(ctx, finishReportJob, id, fileName, token, tokenTTL)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return pgx.ErrNoRows
+	}
+	return nil
+}
+
+// FailReportJob marks the running job as failed with the given reason.
+func (s *Store) FailReportJob(ctx context.Context, id, reason string) error {
+	_, err := s.pool.Exec(ctx, failReportJob, id, reason)
+	return err
+}
+
+// FailStaleReportJobs marks the jobs running for longer than timeout as failed.
+func (s *Store) FailStaleReportJobs(ctx context.Context, timeout time.Duration) (int64, error) {
+	tag, err := s.pool.Exec(ctx, failStaleReportJobs, timeout)
+	if err != nil {
+		return 0, err
+	}
+	return tag.RowsAffected(), nil
+}
+
+// DeleteOldReportJobs deletes the jobs finished earlier than retention ago
+// and returns the names of their report files.
+func (s *Store) DeleteOldReportJobs(ctx context.Context, retention time.Duration) ([]string, error) {
+	var files []string
+	if err := s.pool.QueryRow(ctx, deleteOldReportJobs, retention).Scan(&files); err != nil {
+		return nil, err
+	}
+	return files, nil
+}
@@ -2,89 +2,381 @@
 package db
 
 import (
-	"bytes"
 	"context"
+	"errors"
+	"fmt"
 	"io"
+	"time"
+
+	"github.com/jackc/pgx/v5"
 
 	"user_segmentation_service/internal/models"
 )
 
 const (
-	createSegment    = `INSERT INTO segments (slug, description) VALUES ($1, $2) RETURNING id, created_at;`
-	deleteSegment    = `DELETE FROM segments WHERE slug = $1;`
-	updateSegment    = `UPDATE segments SET description = $1 WHERE slug = $2 RETURNING id, created_at;`
-	getSegmentBySlug = `SELECT id, slug, description, created_at FROM segments WHERE slug = $1;`
-	getAllSegments   = `SELECT * FROM segments;`
+	// Slug, который ещё служит псевдонимом переименованного сегмента, занять нельзя.
+	createSegment = `
+		INSERT INTO segments (slug, description, auto_percent, hash_seed)
+		SELECT $1, $2, $3, $1
+		WHERE NOT EXISTS (SELECT 1 FROM segment_aliases WHERE slug = $1 AND expires_at > NOW())
+		RETURNING id, created_at, version;`
+	// $3 - версии, при которых возможно изменение (If-Match), NULL - при любой.
+	updateSegment = `
+		UPDATE segments SET description = $1, version = version + 1
+		WHERE slug = $2 AND archived_at IS NULL
+			AND ($3::INT[] IS NULL OR version = ANY ($3))
+		RETURNING id, auto_percent, created_at, version;`
+	getSegmentBySlug = `
+		SELECT id, slug, description, auto_percent, created_at, version
+		FROM segments
+		WHERE slug = $1 AND archived_at IS NULL;`
+	// $1 - выбирать архивные сегменты вместо активных.
+	getAllSegments = `
+		SELECT id, slug, description, auto_percent, created_at, archived_at, version
+		FROM (SELECT * FROM segments WHERE (archived_at IS NOT NULL) = $1) s`
+	// Используем row_to_json, чтобы получить каждую строку в виде JSON.
+	exportSegments = `
+		SELECT row_to_json(s)
+		FROM (SELECT id, slug, description, auto_percent, created_at FROM segments WHERE archived_at IS NULL) s`
+	// Блокировка строки сегмента ждёт завершения транзакций, которые добавляют в него пользователей
+	// (они берут FOR SHARE), поэтому после архивации в сегменте не остаётся участников.
+	// $2 - версии, при которых возможна архивация (If-Match), NULL - при любой.
+	archiveSegment = `
+		UPDATE segments SET archived_at = NOW(), version = version + 1
+		WHERE slug = $1 AND archived_at IS NULL
+			AND ($2::INT[] IS NULL OR version = ANY ($2))
+		RETURNING id;`
+	// Записывает завершённые членства (CTE deleted_segments) в историю: истёкшие, но ещё не удалённые
+	// фоновым процессом - как 'EXPIRE' с фактическим временем истечения, остальные - как 'REMOVE'.
+	// $2, $3, $4 - actor, source и reason изменения.
+	endedMembershipsHistory = `
+		INSERT INTO user_segments_history (user_id, segment_id, action, actor, source, reason, created_at)
+		SELECT user_id, segment_id,
+			CASE WHEN expiration_time <= NOW() THEN 'EXPIRE' ELSE 'REMOVE' END,
+			NULLIF($2, ''), NULLIF($3, ''), NULLIF($4, ''),
+			CASE WHEN expiration_time <= NOW() THEN expiration_time ELSE NOW() END
+		FROM deleted_segments;`
+	// Завершает все членства в сегменте.
+	endSegmentMemberships = `
+		WITH deleted_segments AS (
+				DELETE FROM user_segments
+				WHERE segment_id = $1
+				RETURNING user_id, segment_id, expiration_time)` + endedMembershipsHistory
+	restoreSegment = `
+		UPDATE segments SET archived_at = NULL, version = version + 1
+		WHERE slug = $1 AND archived_at IS NOT NULL
+		RETURNING id, slug, description, auto_percent, created_at, version;`
+	// Окончательное удаление возможно только для архивного сегмента; история удаляется каскадно.
+	purgeSegment        = `DELETE FROM segments WHERE slug = $1 AND archived_at IS NOT NULL;`
+	segmentExists       = `SELECT EXISTS (SELECT 1 FROM segments WHERE slug = $1);`
+	activeSegmentExists = `SELECT EXISTS (SELECT 1 FROM segments WHERE slug = $1 AND archived_at IS NULL);`
+	// Стабильная «корзина» пользователя (0..99) для сегмента: первые 32 бита md5(user_id:hash_seed),
+	// где hash_seed - исходный slug, не меняющийся при переименовании. Один и тот же пользователь
+	// всегда либо попадает в сегмент, либо нет, независимо от того, когда он был создан
+	// и как сегмент назывался в тот момент. Ожидает алиасы u (users) и s (segments).
+	autoPercentBucket = `(('x' || LEFT(MD5(u.id::TEXT || ':' || s.hash_seed), 8))::BIT(32)::BIGINT % 100)`
+	// Зачисляет в новый сегмент заданную долю всех существующих пользователей
+	// и записывает каждое зачисление в историю как обычный 'ADD' с actor $3 и source $4.
+	// FOR SHARE OF u не даёт параллельному EraseUser стереть пользователя между выборкой и вставкой:
+	// стирание дождётся зачисления и завершит его членство, а уже стёртый пользователь не будет выбран.
+	autoEnrollSegment = `
+		WITH inserted_segments AS (
+				INSERT INTO user_segments (user_id, segment_id, expiration_time)
+				SELECT u.id, s.id, $2
+				FROM users u
+					CROSS JOIN segments s
+				WHERE s.id = $1
+					AND s.archived_at IS NULL
+					AND s.auto_percent IS NOT NULL
+					AND u.erased_at IS NULL
+					AND ` + autoPercentBucket + ` < s.auto_percent
+				FOR SHARE OF u
+				ON CONFLICT (user_id, segment_id) DO NOTHING
+				RETURNING user_id, segment_id, created_at)
+		INSERT INTO user_segments_history (user_id, segment_id, action, actor, source, created_at)
+		SELECT user_id, segment_id, 'ADD', $3, $4, created_at
+		FROM inserted_segments;`
+)
+
+// Errors of the segment state.
+var (
+	ErrSegmentArchived    = errors.New("segment is archived")
+	ErrSegmentNotArchived = errors.New("segment is not archived")
 )
 
-// CreateSegment creates a new segment in the database.
+// segmentSortKeys - keys the list of segments can be sorted by.
+var segmentSortKeys = map[string]sortKey{
+	"id": {expr: "id"},
+	"slug": {
+		expr: "slug",
+		arg:  textArg,
+		val:  func(item any) string { return item.(*models.Segment).Slug },
+	},
+	"created_at": {
+		expr: "created_at",
+		arg:  timeArg,
+		val:  func(item any) string { return item.(*models.Segment).CreatedAt.Format(time.RFC3339Nano) },
+	},
+}
+
+// CreateSegment creates a new segment in the database (transaction).
 // On successful execution, the ID and CreatedAt fields are populated into the seg structure.
-func (s *Store) CreateSegment(ctx context.Context, seg *models.Segment) error {
-	return s.pool.QueryRow(ctx, createSegment, seg.Slug, seg.Description).Scan(&seg.ID, &seg.CreatedAt)
+// If AutoPercent is set, the corresponding share of all existing users is enrolled in the segment;
+// the number of enrolled users is returned.
+// Returns ErrSlugAliased if the slug is still an alias of a renamed segment.
+func (s *Store) CreateSegment(ctx context.Context, seg *models.Segment) (enrolled int64, err error) {
+	tx, err := s.pool.Begin(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("the beginning of the transaction: %w", err)
+	}
+	defer func() {
+		if err != nil {
+			_ = tx.Rollback(ctx)
+		} else {
+			err = tx.Commit(ctx)
+		}
+	}()
+
+	err = tx.QueryRow(ctx, createSegment, seg.Slug, seg.Description, seg.AutoPercent).Scan(&seg.ID, &seg.CreatedAt, &seg.Version)
+	if errors.Is(err, pgx.ErrNoRows) {
+		err = ErrSlugAliased
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	if seg.AutoPercent == nil {
+		return 0, nil
+	}
+	tag, err := tx.Exec(ctx, autoEnrollSegment, seg.ID, defaultExpiration(), models.ActorSystem, models.SourceAutoEnroll)
+	if err != nil {
+		return 0, fmt.Errorf("error auto-enrolling users in segment %s: %w", seg.Slug, err)
+	}
+	// The cached lists of other instances change only if somebody became a member.
+	if enrolled = tag.RowsAffected(); enrolled > 0 {
+		if err = notify(ctx, tx, models.Change{Segment: seg.Slug}); err != nil {
+			return 0, err
+		}
+	}
+	return enrolled, nil
+}
+
+// ArchiveSegment archives the active segment with the given slug (transaction): the segment is marked
+// as archived, all its memberships are ended and recorded in the history with the actor, source and reason
+// from meta, the history itself is kept. Returns the number of ended memberships.
+// If ifMatch is not nil, the segment is archived only if its version is in the list.
+// Returns pgx.ErrNoRows if there is no such segment, ErrSegmentArchived if it is already archived
+// and ErrVersionMismatch if the version does not match.
+func (s *Store) ArchiveSegment(ctx context.Context, slug string, ifMatch []int,
+	meta models.ChangeMeta) (ended int64, err error) {
+	tx, err := s.pool.Begin(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("the beginning of the transaction: %w", err)
+	}
+	defer func() {
+		if err != nil {
+			_ = tx.Rollback(ctx)
+		} else {
+			err = tx.Commit(ctx)
+		}
+	}()
+
+	var id int
+	if err = tx.QueryRow(ctx, archiveSegment, slug, ifMatch).Scan(&id); err != nil {
+		if errors.Is(err, pgx.ErrNoRows) && ifMatch != nil {
+			err = versionStateError(ctx, tx, activeSegmentExists, slug)
+		}
+		if errors.Is(err, pgx.ErrNoRows) {
+			err = segmentStateError(ctx, tx, slug, ErrSegmentArchived)
+		}
+		return 0, err
+	}
+	tag, err := tx.Exec(ctx, endSegmentMemberships, id, meta.Actor, meta.Source, meta.Reason)
+	if err != nil {
+		return 0, fmt.Errorf("error end memberships of segment %s: %w", slug, err)
+	}
+	if err = notify(ctx, tx, models.Change{Segment: slug}); err != nil {
+		return 0, err
+	}
+	return tag.RowsAffected(), nil
+}
+
+// RestoreSegment makes the archived segment with the given slug active again (transaction).
+// The memberships ended by the archiving are not restored, but if AutoPercent is set,
+// the corresponding share of all users is enrolled in the segment again; the number of enrolled users is returned.
+// Returns pgx.ErrNoRows if there is no such segment and ErrSegmentNotArchived if it is active.
+func (s *Store) RestoreSegment(ctx context.Context, slug string) (seg *models.Segment, enrolled int64, err error) {
+	tx, err := s.pool.Begin(ctx)
+	if err != nil {
+		return nil, 0, fmt.Errorf("the beginning of the transaction: %w", err)
+	}
+	defer func() {
+		if err != nil {
+			_ = tx.Rollback(ctx)
+		} else {
+			err = tx.Commit(ctx)
+		}
+	}()
+
+	seg = &models.Segment{}
+	err = tx.QueryRow(ctx, restoreSegment, slug).Scan(&seg.ID, &seg.Slug, &seg.Description, &seg.AutoPercent, &seg.CreatedAt,
+		&seg.Version)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			err = segmentStateError(ctx, tx, slug, ErrSegmentNotArchived)
+		}
+		return nil, 0, err
+	}
+	if seg.AutoPercent == nil {
+		return seg, 0, nil
+	}
+	tag, err := tx.Exec(ctx, autoEnrollSegment, seg.ID, defaultExpiration(), models.ActorSystem, models.SourceAutoEnroll)
+	if err != nil {
+		return nil, 0, fmt.Errorf("error auto-enrolling users in segment %s: %w", seg.Slug, err)
+	}
+	if enrolled = tag.RowsAffected(); enrolled > 0 {
+		if err = notify(ctx, tx, models.Change{Segment: seg.Slug}); err != nil {
+			return nil, 0, err
+		}
+	}
+	return seg, enrolled, nil
 }
 
-// DeleteSegment deletes a segment from the database by slug.
-func (s *Store) DeleteSegment(ctx context.Context, slug string) error {
-	_, err := s.pool.Exec(ctx, deleteSegment, slug)
+// PurgeSegment irreversibly deletes the archived segment with the given slug together with its history.
+// Returns pgx.ErrNoRows if there is no such segment and ErrSegmentNotArchived if it is active:
+// a segment must be archived before it can be purged.
+func (s *Store) PurgeSegment(ctx context.Context, slug string) (err error) {
+	tx, err := s.pool.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("the beginning of the transaction: %w", err)
+	}
+	defer func() {
+		if err != nil {
+			_ = tx.Rollback(ctx)
+		} else {
+			err = tx.Commit(ctx)
+		}
+	}()
+
+	tag, err := tx.Exec(ctx, purgeSegment, slug)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		err = segmentStateError(ctx, tx, slug, ErrSegmentNotArchived)
+	}
 	return err
 }
 
+// segmentStateError explains why a segment was not affected by a statement:
+// returns pgx.ErrNoRows if the segment does not exist, otherwise stateErr.
+func segmentStateError(ctx context.Context, tx pgx.Tx, slug string, stateErr error) error {
+	var exists bool
+	if err := tx.QueryRow(ctx, segmentExists, slug).Scan(&exists); err != nil {
+		return err
+	}
+	if !exists {
+		return pgx.ErrNoRows
+	}
+	return stateErr
+}
+
 // UpdateSegment changes the segment data (e.g., description) by slug.
 // Here only the description field is updated, but others can be added if necessary.
-func (s *Store) UpdateSegment(ctx context.Context, seg *models.Segment) error {
-	return s.pool.QueryRow(ctx, updateSegment, seg.Description, seg.Slug).Scan(&seg.ID, &seg.CreatedAt)
+// Archived segments cannot be updated: pgx.ErrNoRows is returned for them.
+// If ifMatch is not nil, the segment is updated only if its version is in the list,
+// otherwise ErrVersionMismatch is returned. The version is incremented.
+func (s *Store) UpdateSegment(ctx context.Context, seg *models.Segment, ifMatch []int) (err error) {
+	tx, err := s.pool.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("the beginning of the transaction: %w", err)
+	}
+	defer func() {
+		if err != nil {
+			_ = tx.Rollback(ctx)
+		} else {
+			err = tx.Commit(ctx)
+		}
+	}()
+
+	err = tx.QueryRow(ctx, updateSegment, seg.Description, seg.Slug, ifMatch).
+		Scan(&seg.ID, &seg.AutoPercent, &seg.CreatedAt, &seg.Version)
+	if errors.Is(err, pgx.ErrNoRows) && ifMatch != nil {
+		err = versionStateError(ctx, tx, activeSegmentExists, seg.Slug)
+	}
+	if err != nil {
+		return err
+	}
+	// The description is part of the active segments of the members.
+	err = notify(ctx, tx, models.Change{Segment: seg.Slug})
+	return err
 }
 
-// GetSegmentBySlug gets the segment by slug.
+// GetSegmentBySlug gets the active segment by slug. Archived segments are not returned.
+// If the slug is an active alias of a renamed segment, that segment is returned with the Alias set.
 func (s *Store) GetSegmentBySlug(ctx context.Context, slug string) (*models.Segment, error) {
 	seg := &models.Segment{}
 	err := s.pool.QueryRow(ctx, getSegmentBySlug, slug).
-		Scan(&seg.ID, &seg.Slug, &seg.Description, &seg.CreatedAt)
+		Scan(&seg.ID, &seg.Slug, &seg.Description, &seg.AutoPercent, &seg.CreatedAt, &seg.Version)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return s.getSegmentByAliasSlug(ctx, slug)
+	}
 	if err != nil {
 		return nil, err
 	}
 	return seg, nil
 }
 
-// GetAllSegments returns a list of all segments.
-func (s *Store) GetAllSegments(ctx context.Context) ([]*models.Segment, error) {
-	rows, err := s.pool.Query(ctx, getAllSegments)
+// GetAllSegments returns a page of active segments or, if archived is set, of archived ones
+// matching the filters (slug prefix, creation time range), sorted by the given key.
+// Returns ErrInvalidSort or ErrInvalidCursor for invalid parameters.
+func (s *Store) GetAllSegments(ctx context.Context, archived bool, p ListParams) (*models.Page[*models.Segment], error) {
+	p.normalize()
+	query, args, err := keysetQuery(getAllSegments, "slug", segmentSortKeys, p, archived)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := s.pool.Query(ctx, query, args...)
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
 
-	segments := make([]*models.Segment, 0, 16)
+	segments := make([]*models.Segment, 0, p.Limit+1)
 	for rows.Next() {
 		seg := &models.Segment{}
-		if err := rows.Scan(&seg.ID, &seg.Slug, &seg.Description, &seg.CreatedAt); err != nil {
+		if err := rows.Scan(&seg.ID, &seg.Slug, &seg.Description, &seg.AutoPercent, &seg.CreatedAt,
+			&seg.ArchivedAt, &seg.Version); err != nil {
 			return nil, err
 		}
 		segments = append(segments, seg)
 	}
-	return segments, nil
-}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
 
-// GetAllSegmentsViaCopy retrieves all segments using COPY.
-func (s *Store) GetAllSegmentsViaCopy(ctx context.Context) (io.Reader, error) {
-	// Form a SQL request for Copy.
-	// Use row_to_json to get each row as JSON.
-	query := `COPY (SELECT row_to_json(s) FROM (SELECT id, slug, description, created_at FROM segments) s) TO STDOUT`
+	page := &models.Page[*models.Segment]{}
+	page.Items, page.NextCursor = nextCursor(segments, p, segmentSortKeys, func(s *models.Segment) int { return s.ID })
+	return page, nil
+}
 
-	// Buffer for data retrieval.
-	var buf bytes.Buffer
+// GetAllSegmentsViaCopy streams all active segments to w as NDJSON (one JSON object per line) using COPY.
+// The rows are written as they arrive from the database, without buffering the whole result.
+func (s *Store) GetAllSegmentsViaCopy(ctx context.Context, w io.Writer) error {
+	return s.copyJSONTo(ctx, w, exportSegments)
+}
 
-	// Execute the COPY command and transfer the result to the buffer.
+// copyJSONTo runs COPY for a query returning one JSON value per row and writes the rows to w.
+// The CSV format with control characters as delimiter and quote is used, because they never appear
+// unescaped in JSON: unlike the text format, the JSON is written as is, without escaping backslashes.
+func (s *Store) copyJSONTo(ctx context.Context, w io.Writer, query string) error {
 	conn, err := s.pool.Acquire(ctx)
 	if err != nil {
-		return nil, err
+		return err
 	}
 	defer conn.Release()
 
-	_, err = conn.Conn().PgConn().CopyTo(ctx, &buf, query)
-	if err != nil {
-		return nil, err
-	}
-
-	return &buf, nil
+	sql := `COPY (` + query + `) TO STDOUT WITH (FORMAT csv, DELIMITER E'\x02', QUOTE E'\x01')`
+	_, err = conn.Conn().PgConn().CopyTo(ctx, w, sql)
+	return err
 }
@@ -0,0 +1,198 @@
+// Package db provides functionality for interacting with the PostgreSQL database.
+package db
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+
+	"user_segmentation_service/internal/models"
+)
+
+const (
+	lockActiveSegment = `SELECT id FROM segments WHERE slug = $1 AND archived_at IS NULL FOR UPDATE;`
+	// Сегмент, которому принадлежит действующий псевдоним.
+	getAliasOwner = `SELECT segment_id FROM segment_aliases WHERE slug = $1 AND expires_at > NOW();`
+	renameSegment = `UPDATE segments SET slug = $2, version = version + 1 WHERE id = $1;`
+	// Новый slug перестаёт быть псевдонимом (например, при возврате прежнего имени).
+	deleteAlias = `DELETE FROM segment_aliases WHERE slug = $1;`
+	// Прежний slug становится псевдонимом сегмента; просроченный псевдоним с тем же slug'ом заменяется.
+	upsertAlias = `
+		INSERT INTO segment_aliases (slug, segment_id, expires_at)
+		VALUES ($1, $2, NOW() + $3::INTERVAL)
+		ON CONFLICT (slug) DO UPDATE
+			SET segment_id = excluded.segment_id, expires_at = excluded.expires_at, created_at = CURRENT_TIMESTAMP
+		RETURNING expires_at;`
+	recordSegmentRename = `
+		INSERT INTO segment_renames (segment_id, old_slug, new_slug, alias_expires_at)
+		VALUES ($1, $2, $3, $4)
+		RETURNING id, renamed_at;`
+	getSegmentRenames = `
+		SELECT id, old_slug, new_slug, alias_expires_at, renamed_at
+		FROM segment_renames
+		WHERE segment_id = $1
+		ORDER BY renamed_at, id;`
+	getSegmentByAlias = `
+		SELECT s.id, s.slug, s.description, s.auto_percent, s.created_at, s.version, a.expires_at
+		FROM segment_aliases a
+			JOIN segments s ON a.segment_id = s.id
+		WHERE a.slug = $1
+			AND a.expires_at > NOW()
+			AND s.archived_at IS NULL;`
+	// Действующие псевдонимы из списка и текущие slug'и их сегментов.
+	resolveSegmentAliases = `
+		SELECT a.slug, s.slug
+		FROM segment_aliases a
+			JOIN segments s ON a.segment_id = s.id
+		WHERE a.slug = ANY ($1)
+			AND a.expires_at > NOW()
+			AND s.archived_at IS NULL;`
+)
+
+// ErrSlugAliased is returned if a slug is requested for a segment while it is an alias of another segment.
+var ErrSlugAliased = errors.New("slug is an alias of another segment")
+
+// RenameSegment changes the slug of the active segment (transaction). If aliasTTL is positive,
+// the old slug stays an alias of the segment for that long; the rename is recorded in the audit trail.
+// The history refers to the segment by id, so it continues under the new slug.
+// Returns pgx.ErrNoRows if there is no such active segment and ErrSlugAliased
+// if the new slug is an alias of another segment.
+func (s *Store) RenameSegment(ctx context.Context, slug, newSlug string, aliasTTL time.Duration) (rename *models.SegmentRename, err error) {
+	tx, err := s.pool.Begin(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("the beginning of the transaction: %w", err)
+	}
+	defer func() {
+		if err != nil {
+			_ = tx.Rollback(ctx)
+		} else {
+			err = tx.Commit(ctx)
+		}
+	}()
+
+	var id, owner int
+	if err = tx.QueryRow(ctx, lockActiveSegment, slug).Scan(&id); err != nil {
+		return nil, err
+	}
+	err = tx.QueryRow(ctx, getAliasOwner, newSlug).Scan(&owner)
+	switch {
+	case err == nil && owner != id:
+		return nil, ErrSlugAliased
+	case err != nil && !errors.Is(err, pgx.ErrNoRows):
+		return nil, err
+	}
+
+	if _, err = tx.Exec(ctx, renameSegment, id, newSlug); err != nil {
+		return nil, err
+	}
+	if _, err = tx.Exec(ctx, deleteAlias, newSlug); err != nil {
+		return nil, fmt.Errorf("error delete alias %s: %w", newSlug, err)
+	}
+
+	rename = &models.SegmentRename{OldSlug: slug, NewSlug: newSlug}
+	if aliasTTL > 0 {
+		var expiresAt time.Time
+		if err = tx.QueryRow(ctx, upsertAlias, slug, id, aliasTTL).Scan(&expiresAt); err != nil {
+			return nil, fmt.Errorf("error create alias %s: %w", slug, err)
+		}
+		rename.AliasExpiresAt = &expiresAt
+	}
+	err = tx.QueryRow(ctx, recordSegmentRename, id, slug, newSlug, rename.AliasExpiresAt).
+		Scan(&rename.ID, &rename.RenamedAt)
+	if err != nil {
+		return nil, fmt.Errorf("error record rename of segment %s: %w", slug, err)
+	}
+	if err = notify(ctx, tx, models.Change{Segment: slug}); err != nil {
+		return nil, err
+	}
+	return rename, nil
+}
+
+// GetSegmentRenames returns the audit trail of the renames of the active segment, oldest first.
+// The slug may be an active alias. Returns pgx.ErrNoRows if there is no such active segment.
+func (s *Store) GetSegmentRenames(ctx context.Context, slug string) ([]*models.SegmentRename, error) {
+	seg, err := s.GetSegmentBySlug(ctx, slug)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := s.pool.Query(ctx, getSegmentRenames, seg.ID)
+	if err != nil {
+		return nil, err
+	}
+	renames := make([]*models.SegmentRename, 0)
+	var rename models.SegmentRename
+	_, err = pgx.ForEachRow(rows,
+		[]any{&rename.ID, &rename.OldSlug, &rename.NewSlug, &rename.AliasExpiresAt, &rename.RenamedAt},
+		func() error {
+			r := rename
+			renames = append(renames, &r)
+			return nil
+		})
+	if err != nil {
+		return nil, err
+	}
+	return renames, nil
+}
+
+// getSegmentByAliasSlug returns the active segment the slug is an alias of,
+// with the alias set as the deprecation marker.
+func (s *Store) getSegmentByAliasSlug(ctx context.Context, slug string) (*models.Segment, error) {
+	seg := &models.Segment{Alias: &models.SegmentAlias{Slug: slug}}
+	err := s.pool.QueryRow(ctx, getSegmentByAlias, slug).
+		Scan(&seg.ID, &seg.Slug, &seg.Description, &seg.AutoPercent, &seg.CreatedAt, &seg.Version,
+			&seg.Alias.ExpiresAt)
+	if err != nil {
+		return nil, err
+	}
+	return seg, nil
+}
+
+// resolveAliases replaces the active aliases of renamed segments in add and remove with the current slugs.
+// The slices are copied, not modified. The returned map lists the replaced aliases with their current slugs.
+func resolveAliases(ctx context.Context, tx pgx.Tx, add []SegmentModification,
+	remove []string) ([]SegmentModification, []string, map[string]string, error) {
+	slugs := make([]string, 0, len(add)+len(remove))
+	for _, mod := range add {
+		slugs = append(slugs, mod.Slug)
+	}
+	slugs = append(slugs, remove...)
+	if len(slugs) == 0 {
+		return add, remove, nil, nil
+	}
+
+	rows, err := tx.Query(ctx, resolveSegmentAliases, slugs)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("error resolve segment aliases: %w", err)
+	}
+	var alias, current string
+	aliases := make(map[string]string)
+	_, err = pgx.ForEachRow(rows, []any{&alias, &current}, func() error {
+		aliases[alias] = current
+		return nil
+	})
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("error resolve segment aliases: %w", err)
+	}
+	if len(aliases) == 0 {
+		return add, remove, nil, nil
+	}
+
+	resolvedAdd := make([]SegmentModification, len(add))
+	for i, mod := range add {
+		if current, ok := aliases[mod.Slug]; ok {
+			mod.Slug = current
+		}
+		resolvedAdd[i] = mod
+	}
+	resolvedRemove := make([]string, len(remove))
+	for i, slug := range remove {
+		if current, ok := aliases[slug]; ok {
+			slug = current
+		}
+		resolvedRemove[i] = slug
+	}
+	return resolvedAdd, resolvedRemove, aliases, nil
+}
@@ -0,0 +1,96 @@
+// Package db provides functionality for interacting with the PostgreSQL database.
+package db
+
+import (
+	"context"
+	"time"
+
+	"user_segmentation_service/internal/models"
+)
+
+const (
+	getSegmentID = `SELECT id FROM segments WHERE slug = $1 AND archived_at IS NULL;`
+	// Участники сегмента: $1 - id сегмента, $2 - включать ли участников с истёкшим TTL,
+	// которых фоновый процесс ещё не удалил.
+	getSegmentMembers = `
+		SELECT id, name, expiration_time, created_at, expired
+		FROM (SELECT us.user_id AS id, COALESCE(u.name, '') AS name, us.expiration_time, us.created_at,
+					COALESCE(us.expiration_time <= NOW(), FALSE) AS expired
+				FROM user_segments us
+					JOIN users u ON us.user_id = u.id
+				WHERE us.segment_id = $1
+					AND ($2 OR us.expiration_time IS NULL OR us.expiration_time > NOW())) m`
+	countSegmentMembers = `
+		SELECT COUNT(*)
+		FROM user_segments us
+		WHERE us.segment_id = $1
+			AND ($2 OR us.expiration_time IS NULL OR us.expiration_time > NOW());`
+)
+
+// segmentMemberSortKeys - keys the list of segment members can be sorted by.
+var segmentMemberSortKeys = map[string]sortKey{
+	"id": {expr: "id"},
+	"joined_at": {
+		expr: "created_at",
+		arg:  timeArg,
+		val:  func(item any) string { return item.(*models.SegmentMember).JoinedAt.Format(time.RFC3339Nano) },
+	},
+	"name": {
+		expr: "name",
+		arg:  textArg,
+		val:  func(item any) string { return item.(*models.SegmentMember).UserName },
+	},
+}
+
+// GetSegmentMembers returns a page of users in the segment with their join and expiration times.
+// Users whose membership has expired are included only if includeExpired is set.
+// ListParams.Prefix filters by user name, CreatedFrom/CreatedTo by the join time.
+// Returns pgx.ErrNoRows if there is no such segment.
+func (s *Store) GetSegmentMembers(ctx context.Context, slug string, includeExpired bool,
+	p ListParams) (*models.Page[*models.SegmentMember], error) {
+	var segmentID int
+	if err := s.pool.QueryRow(ctx, getSegmentID, slug).Scan(&segmentID); err != nil {
+		return nil, err
+	}
+
+	p.normalize()
+	query, args, err := keysetQuery(getSegmentMembers, "name", segmentMemberSortKeys, p, segmentID, includeExpired)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := s.pool.Query(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	members := make([]*models.SegmentMember, 0, p.Limit+1)
+	for rows.Next() {
+		m := &models.SegmentMember{}
+		if err := rows.Scan(&m.UserID, &m.UserName, &m.ExpirationTime, &m.JoinedAt, &m.Expired); err != nil {
+			return nil, err
+		}
+		members = append(members, m)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	page := &models.Page[*models.SegmentMember]{}
+	page.Items, page.NextCursor = nextCursor(members, p, segmentMemberSortKeys,
+		func(m *models.SegmentMember) int { return m.UserID })
+	return page, nil
+}
+
+// CountSegmentMembers returns the number of users in the segment.
+// Users whose membership has expired are counted only if includeExpired is set.
+// Returns pgx.ErrNoRows if there is no such segment.
+func (s *Store) CountSegmentMembers(ctx context.Context, slug string, includeExpired bool) (int64, error) {
+	var segmentID int
+	if err := s.pool.QueryRow(ctx, getSegmentID, slug).Scan(&segmentID); err != nil {
+		return 0, err
+	}
+	var count int64
+	err := s.pool.QueryRow(ctx, countSegmentMembers, segmentID, includeExpired).Scan(&count)
+	return count, err
+}
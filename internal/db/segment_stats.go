@@ -0,0 +1,128 @@
+// Package db provides functionality for interacting with the PostgreSQL database.
+package db
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+
+	"user_segmentation_service/internal/models"
+)
+
+const (
+	// Размер активных сегментов: $1 - slug (NULL для всех сегментов), $2 - горизонт «скоро истекающих» участников.
+	getSegmentSizes = `
+		SELECT s.slug,
+			COUNT(us.user_id) FILTER (WHERE us.expiration_time IS NULL OR us.expiration_time > NOW()),
+			COUNT(us.user_id) FILTER (WHERE us.expiration_time > NOW() AND us.expiration_time <= NOW() + $2::INTERVAL)
+		FROM segments s
+			LEFT JOIN user_segments us ON us.segment_id = s.id
+		WHERE s.archived_at IS NULL
+			AND ($1::TEXT IS NULL OR s.slug = $1)
+		GROUP BY s.id, s.slug
+		ORDER BY s.slug;`
+	// Изменения сегментов по дням: $1 - slug (NULL для всех сегментов), $2, $3 - границы периода (UTC),
+	// $4 - часовой пояс дней, $5, $6 - первый и последний день. Дни без изменений возвращаются с нулями.
+	getSegmentDailyStats = `
+		WITH counts AS (
+				SELECT h.segment_id,
+					(h.created_at AT TIME ZONE 'UTC' AT TIME ZONE $4)::DATE AS day,
+					COUNT(*) FILTER (WHERE h.action = 'ADD')    AS added,
+					COUNT(*) FILTER (WHERE h.action = 'REMOVE') AS removed,
+					COUNT(*) FILTER (WHERE h.action = 'EXPIRE') AS expired
+				FROM user_segments_history h
+				WHERE h.created_at >= $2
+					AND h.created_at < $3
+				GROUP BY 1, 2)
+		SELECT s.slug, TO_CHAR(d.day, 'YYYY-MM-DD'),
+			COALESCE(c.added, 0), COALESCE(c.removed, 0), COALESCE(c.expired, 0)
+		FROM segments s
+			CROSS JOIN GENERATE_SERIES($5::DATE, $6::DATE, INTERVAL '1 day') AS d(day)
+			LEFT JOIN counts c ON c.segment_id = s.id AND c.day = d.day::DATE
+		WHERE s.archived_at IS NULL
+			AND ($1::TEXT IS NULL OR s.slug = $1)
+		ORDER BY s.slug, d.day;`
+)
+
+// StatsParams describes the period and the horizon of segment statistics.
+type StatsParams struct {
+	From           time.Time     // First day of the period (only the date is used).
+	To             time.Time     // Last day of the period, inclusive (only the date is used).
+	TimeZone       string        // IANA time zone the days are counted in.
+	ExpiringWithin time.Duration // Horizon of the members expiring soon.
+}
+
+// GetSegmentStats returns the statistics of the segment with the given slug or, if slug is empty,
+// of all active segments ordered by slug: the number of active members, the number of members expiring
+// within p.ExpiringWithin and the daily numbers of additions, removals and expirations over the period.
+// Returns pgx.ErrNoRows if the slug is set and there is no such active segment.
+func (s *Store) GetSegmentStats(ctx context.Context, slug string, p StatsParams) (stats []*models.SegmentStats, err error) {
+	loc, err := time.LoadLocation(p.TimeZone)
+	if err != nil {
+		return nil, err
+	}
+	start := time.Date(p.From.Year(), p.From.Month(), p.From.Day(), 0, 0, 0, 0, loc)
+	end := time.Date(p.To.Year(), p.To.Month(), p.To.Day()+1, 0, 0, 0, 0, loc)
+	firstDay := time.Date(p.From.Year(), p.From.Month(), p.From.Day(), 0, 0, 0, 0, time.UTC)
+	lastDay := time.Date(p.To.Year(), p.To.Month(), p.To.Day(), 0, 0, 0, 0, time.UTC)
+	var slugArg *string
+	if slug != "" {
+		slugArg = &slug
+	}
+
+	// Both queries see the same snapshot, so the sizes agree with the daily changes.
+	tx, err := s.pool.BeginTx(ctx, pgx.TxOptions{IsoLevel: pgx.RepeatableRead, AccessMode: pgx.ReadOnly})
+	if err != nil {
+		return nil, fmt.Errorf("the beginning of the transaction: %w", err)
+	}
+	defer func() {
+		if err != nil {
+			_ = tx.Rollback(ctx)
+		} else {
+			err = tx.Commit(ctx)
+		}
+	}()
+
+	rows, err := tx.Query(ctx, getSegmentSizes, slugArg, p.ExpiringWithin)
+	if err != nil {
+		return nil, fmt.Errorf("error get segment sizes: %w", err)
+	}
+	stats = make([]*models.SegmentStats, 0)
+	bySlug := make(map[string]*models.SegmentStats)
+	var size models.SegmentStats
+	_, err = pgx.ForEachRow(rows, []any{&size.Slug, &size.ActiveMembers, &size.ExpiringSoon}, func() error {
+		st := size
+		st.Daily = make([]*models.DailySegmentStats, 0, int(lastDay.Sub(firstDay).Hours()/24)+1)
+		stats = append(stats, &st)
+		bySlug[st.Slug] = &st
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error get segment sizes: %w", err)
+	}
+	if slug != "" && len(stats) == 0 {
+		return nil, pgx.ErrNoRows
+	}
+
+	rows, err = tx.Query(ctx, getSegmentDailyStats, slugArg, start.UTC(), end.UTC(), p.TimeZone, firstDay, lastDay)
+	if err != nil {
+		return nil, fmt.Errorf("error get segment daily stats: %w", err)
+	}
+	var (
+		daySlug string
+		day     models.DailySegmentStats
+	)
+	_, err = pgx.ForEachRow(rows, []any{&daySlug, &day.Date, &day.Added, &day.Removed, &day.Expired}, func() error {
+		if st, ok := bySlug[daySlug]; ok {
+			d := day
+			st.Daily = append(st.Daily, &d)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error get segment daily stats: %w", err)
+	}
+	return stats, nil
+}
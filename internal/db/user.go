@@ -3,61 +3,252 @@ package db
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/jackc/pgx/v5"
 
 	"user_segmentation_service/internal/models"
 )
 
 const (
-	createUser  = `INSERT INTO users (name) VALUES ($1) RETURNING id, created_at;`
-	deleteUser  = `DELETE FROM users WHERE id = $1;`
-	updateUser  = `UPDATE users SET name = $1 WHERE id = $2 RETURNING created_at;`
-	getUserByID = `SELECT id, name, created_at FROM users WHERE id = $1;`
-	getAllUsers = `SELECT * FROM users;`
+	createUser = `INSERT INTO users (name) VALUES ($1) RETURNING id, created_at, version;`
+	// $3 - версии, при которых возможно изменение (If-Match), NULL - при любой.
+	updateUser = `
+		UPDATE users SET name = $1, version = version + 1
+		WHERE id = $2 AND erased_at IS NULL
+			AND ($3::INT[] IS NULL OR version = ANY ($3))
+		RETURNING created_at, version;`
+	// Пользователи, созданные импортом, не имеют имени.
+	getUserByID = `SELECT id, COALESCE(name, ''), created_at, version FROM users WHERE id = $1 AND erased_at IS NULL;`
+	getAllUsers = `SELECT id, name, created_at, version FROM (SELECT * FROM users WHERE erased_at IS NULL) u`
+	// Удаляет персональные данные пользователя, оставляя строку с псевдонимом: история по-прежнему
+	// ссылается на неё, поэтому отчёты за прошлые периоды не меняются. Псевдоним случаен
+	// и не выводится ни из id, ни из имени.
+	// $2 - версии, при которых возможно стирание (If-Match), NULL - при любой.
+	eraseUser = `
+		UPDATE users
+		SET name = NULL,
+			erased_at = NOW(),
+			pseudonym = 'erased-' || REPLACE(gen_random_uuid()::TEXT, '-', ''),
+			version = version + 1
+		WHERE id = $1 AND erased_at IS NULL
+			AND ($2::INT[] IS NULL OR version = ANY ($2))
+		RETURNING pseudonym, erased_at;`
+	// Завершает все членства пользователя.
+	endUserMemberships = `
+		WITH deleted_segments AS (
+				DELETE FROM user_segments
+				WHERE user_id = $1
+				RETURNING user_id, segment_id, expiration_time)` + endedMembershipsHistory
+	createErasureReceipt = `
+		INSERT INTO erasure_receipts (user_id, pseudonym, memberships_ended, erased_at)
+		VALUES ($1, $2, $3, $4)
+		RETURNING id::TEXT;`
+	getErasureReceipt = `
+		SELECT id::TEXT, user_id, pseudonym, memberships_ended, erased_at
+		FROM erasure_receipts
+		WHERE user_id = $1;`
+	userExists       = `SELECT EXISTS (SELECT 1 FROM users WHERE id = $1);`
+	activeUserExists = `SELECT EXISTS (SELECT 1 FROM users WHERE id = $1 AND erased_at IS NULL);`
+	// Зачисляет новых пользователей во все сегменты с auto_percent,
+	// в «корзину» которых они попадают, и записывает зачисления в историю как 'ADD' с actor $3 и source $4.
+	autoEnrollUsers = `
+		WITH inserted_segments AS (
+				INSERT INTO user_segments (user_id, segment_id, expiration_time)
+				SELECT u.id, s.id, $2
+				FROM users u
+					CROSS JOIN segments s
+				WHERE u.id = ANY ($1)
+					AND s.archived_at IS NULL
+					AND s.auto_percent IS NOT NULL
+					AND ` + autoPercentBucket + ` < s.auto_percent
+				FOR SHARE OF s
+				ON CONFLICT (user_id, segment_id) DO NOTHING
+				RETURNING user_id, segment_id, created_at)
+		INSERT INTO user_segments_history (user_id, segment_id, action, actor, source, created_at)
+		SELECT user_id, segment_id, 'ADD', $3, $4, created_at
+		FROM inserted_segments;`
 )
 
-// CreateUser creates a new user in the database.
+// ErrUserErased is returned by EraseUser if the user has already been erased.
+var ErrUserErased = errors.New("user is already erased")
+
+// userSortKeys - keys the list of users can be sorted by.
+var userSortKeys = map[string]sortKey{
+	"id": {expr: "id"},
+	"name": {
+		expr: "COALESCE(name, '')",
+		arg:  textArg,
+		val:  func(item any) string { return item.(*models.User).Name },
+	},
+	"created_at": {
+		expr: "created_at",
+		arg:  timeArg,
+		val:  func(item any) string { return item.(*models.User).CreatedAt.Format(time.RFC3339Nano) },
+	},
+}
+
+// CreateUser creates a new user in the database (transaction).
 // On successful execution, the ID and CreatedAt fields are populated into the user structure.
-func (s *Store) CreateUser(ctx context.Context, user *models.User) error {
-	return s.pool.QueryRow(ctx, createUser, user.Name).Scan(&user.ID, &user.CreatedAt)
+// The user is also enrolled in every segment with AutoPercent whose share the user falls into;
+// the number of these memberships is returned.
+func (s *Store) CreateUser(ctx context.Context, user *models.User) (enrolled int64, err error) {
+	tx, err := s.pool.Begin(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("the beginning of the transaction: %w", err)
+	}
+	defer func() {
+		if err != nil {
+			_ = tx.Rollback(ctx)
+		} else {
+			err = tx.Commit(ctx)
+		}
+	}()
+
+	err = tx.QueryRow(ctx, createUser, user.Name).Scan(&user.ID, &user.CreatedAt, &user.Version)
+	if err != nil {
+		return 0, err
+	}
+
+	tag, err := tx.Exec(ctx, autoEnrollUsers, []int{user.ID}, defaultExpiration(), models.ActorSystem, models.SourceAutoEnroll)
+	if err != nil {
+		return 0, fmt.Errorf("error auto-enrolling user %d: %w", user.ID, err)
+	}
+	if err = notifyUsersChanged(ctx, tx, []int{user.ID}); err != nil {
+		return 0, err
+	}
+	return tag.RowsAffected(), nil
 }
 
-// DeleteUser deletes a user by ID.
-func (s *Store) DeleteUser(ctx context.Context, userID int) error {
-	_, err := s.pool.Exec(ctx, deleteUser, userID)
-	return err
+// EraseUser erases the personal data of a user (transaction): the name is removed and the user
+// is replaced with a pseudonymous tombstone, all memberships are ended and recorded in the history
+// with the actor, source and reason from meta; the history itself is kept, so past reports stay correct.
+// Returns the erasure receipt.
+// If ifMatch is not nil, the user is erased only if its version is in the list.
+// Returns pgx.ErrNoRows if there is no such user, ErrUserErased if the user is already erased
+// and ErrVersionMismatch if the version does not match.
+func (s *Store) EraseUser(ctx context.Context, userID int, ifMatch []int,
+	meta models.ChangeMeta) (receipt *models.ErasureReceipt, err error) {
+	tx, err := s.pool.Begin(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("the beginning of the transaction: %w", err)
+	}
+	defer func() {
+		if err != nil {
+			_ = tx.Rollback(ctx)
+		} else {
+			err = tx.Commit(ctx)
+		}
+	}()
+
+	receipt = &models.ErasureReceipt{UserID: userID}
+	if err = tx.QueryRow(ctx, eraseUser, userID, ifMatch).Scan(&receipt.Pseudonym, &receipt.ErasedAt); err != nil {
+		if errors.Is(err, pgx.ErrNoRows) && ifMatch != nil {
+			err = versionStateError(ctx, tx, activeUserExists, userID)
+		}
+		if errors.Is(err, pgx.ErrNoRows) {
+			err = userStateError(ctx, tx, userID)
+		}
+		return nil, err
+	}
+
+	tag, err := tx.Exec(ctx, endUserMemberships, userID, meta.Actor, meta.Source, meta.Reason)
+	if err != nil {
+		return nil, fmt.Errorf("error end memberships of user %d: %w", userID, err)
+	}
+	receipt.MembershipsEnded = tag.RowsAffected()
+
+	err = tx.QueryRow(ctx, createErasureReceipt, receipt.UserID, receipt.Pseudonym, receipt.MembershipsEnded,
+		receipt.ErasedAt).Scan(&receipt.ID)
+	if err != nil {
+		return nil, fmt.Errorf("error create erasure receipt: %w", err)
+	}
+	if err = notifyUsersChanged(ctx, tx, []int{userID}); err != nil {
+		return nil, err
+	}
+	return receipt, nil
+}
+
+// userStateError explains why a user was not affected by a statement that skips erased users:
+// returns pgx.ErrNoRows if the user does not exist, otherwise ErrUserErased.
+func userStateError(ctx context.Context, tx pgx.Tx, userID int) error {
+	var exists bool
+	if err := tx.QueryRow(ctx, userExists, userID).Scan(&exists); err != nil {
+		return err
+	}
+	if !exists {
+		return pgx.ErrNoRows
+	}
+	return ErrUserErased
+}
+
+// GetErasureReceipt returns the erasure receipt of the user.
+// Returns pgx.ErrNoRows if the user has not been erased.
+func (s *Store) GetErasureReceipt(ctx context.Context, userID int) (*models.ErasureReceipt, error) {
+	receipt := &models.ErasureReceipt{}
+	err := s.pool.QueryRow(ctx, getErasureReceipt, userID).
+		Scan(&receipt.ID, &receipt.UserID, &receipt.Pseudonym, &receipt.MembershipsEnded, &receipt.ErasedAt)
+	if err != nil {
+		return nil, err
+	}
+	return receipt, nil
 }
 
-// UpdateUser changes the user data (e.g. name) by id.
-func (s *Store) UpdateUser(ctx context.Context, user *models.User) error {
-	return s.pool.QueryRow(ctx, updateUser, user.Name, user.ID).Scan(&user.CreatedAt)
+// UpdateUser changes the user data (e.g. name) by id. Erased users cannot be updated.
+// If ifMatch is not nil, the user is updated only if its version is in the list,
+// otherwise ErrVersionMismatch is returned. The version is incremented.
+func (s *Store) UpdateUser(ctx context.Context, user *models.User, ifMatch []int) error {
+	err := s.pool.QueryRow(ctx, updateUser, user.Name, user.ID, ifMatch).Scan(&user.CreatedAt, &user.Version)
+	if errors.Is(err, pgx.ErrNoRows) && ifMatch != nil {
+		return versionStateError(ctx, s.pool, activeUserExists, user.ID)
+	}
+	return err
 }
 
-// GetUserByID returns the user by ID.
+// GetUserByID returns the user by ID. Erased users are not returned.
 func (s *Store) GetUserByID(ctx context.Context, userID int) (*models.User, error) {
 	user := &models.User{}
 	err := s.pool.QueryRow(ctx, getUserByID, userID).
-		Scan(&user.ID, &user.Name, &user.CreatedAt)
+		Scan(&user.ID, &user.Name, &user.CreatedAt, &user.Version)
 	if err != nil {
 		return nil, err
 	}
 	return user, nil
 }
 
-// GetAllUsers returns all users.
-func (s *Store) GetAllUsers(ctx context.Context) ([]*models.User, error) {
-	rows, err := s.pool.Query(ctx, getAllUsers)
+// GetAllUsers returns a page of users (except the erased ones) matching the filters (name prefix, creation time range),
+// sorted by the given key. Returns ErrInvalidSort or ErrInvalidCursor for invalid parameters.
+func (s *Store) GetAllUsers(ctx context.Context, p ListParams) (*models.Page[*models.User], error) {
+	p.normalize()
+	query, args, err := keysetQuery(getAllUsers, "name", userSortKeys, p)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := s.pool.Query(ctx, query, args...)
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
 
-	users := make([]*models.User, 0, 16)
+	users := make([]*models.User, 0, p.Limit+1)
 	for rows.Next() {
 		user := &models.User{}
-		if err := rows.Scan(&user.ID, &user.Name, &user.CreatedAt); err != nil {
+		var name *string
+		if err := rows.Scan(&user.ID, &name, &user.CreatedAt, &user.Version); err != nil {
 			return nil, err
 		}
+		if name != nil {
+			user.Name = *name
+		}
 		users = append(users, user)
 	}
-	return users, nil
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	page := &models.Page[*models.User]{}
+	page.Items, page.NextCursor = nextCursor(users, p, userSortKeys, func(u *models.User) int { return u.ID })
+	return page, nil
 }
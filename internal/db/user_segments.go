@@ -3,63 +3,131 @@ package db
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"time"
 
+	"github.com/jackc/pgx/v5"
+
 	"user_segmentation_service/internal/models"
 )
 
 const (
 	getActiveSegmentsForUser = `
-		SELECT s.id, s.slug, s.description, s.created_at
+		SELECT s.id, s.slug, s.description, s.created_at, s.version, us.expiration_time
 		FROM segments s
 		JOIN user_segments us ON s.id = us.segment_id
 		WHERE us.user_id = $1 AND us.expiration_time > NOW()`
-	// Удаляет записи из user_segments для заданного user_id и списка slug'ов,
+	// Удаляет записи из user_segments для заданных user_id и списка slug'ов,
 	// возвращая удалённые данные (user_id, segment_id, created_at).
 	// Затем сразу же записывает эти данные в user_segments_history с пометкой 'REMOVE'.
 	// Используем CTE (WITH deleted_segments) для объединения удаления и логирования в один запрос.
-	removingSegmentsForUser = `
+	// $3, $4, $5 - actor, source и reason изменения (пустые строки записываются как NULL).
+	// Возвращает slug'и удалённых сегментов.
+	removingSegmentsForUsers = `
 		WITH deleted_segments AS (
             DELETE FROM user_segments
-            WHERE user_id = $1
+            WHERE user_id = ANY ($1)
 				AND segment_id IN (SELECT id
 									FROM segments
 									WHERE slug = ANY ($2))
-            RETURNING user_id, segment_id, created_at)
-		INSERT INTO user_segments_history (user_id, segment_id, action, created_at)
-		SELECT user_id, segment_id, 'REMOVE', created_at
-		FROM deleted_segments;`
+            RETURNING user_id, segment_id, created_at),
+			history AS (
+				INSERT INTO user_segments_history (user_id, segment_id, action, actor, source, reason, created_at)
+				SELECT user_id, segment_id, 'REMOVE', NULLIF($3, ''), NULLIF($4, ''), NULLIF($5, ''), created_at
+				FROM deleted_segments)
+		SELECT s.slug
+		FROM deleted_segments d
+			JOIN segments s ON d.segment_id = s.id;`
 	// Массовое добавление или обновление записей в user_segments с записью в историю.
 	// 1. Преобразуем массивы slug и expiration_time в таблицу (segments_data).
-	// 2. Находим segment_id по slug'ам (segment_ids).
-	// 3. Вставляем новые или обновляем существующие записи в user_segments (inserted_segments).
-	// 4. Фиксируем успешные операции в user_segments_history.
-	addingSegmentsForUser = `
+	// 2. Находим segment_id по slug'ам активных сегментов (segment_ids);
+	//    FOR SHARE не даёт архивировать сегмент до конца транзакции.
+	// 3. Вставляем новые или обновляем существующие записи в user_segments
+	//    для каждого пользователя из $3 (inserted_segments).
+	//    xmax = 0 только у вставленных строк, у обновлённых (продлённых) он заполнен.
+	// 4. Фиксируем успешные операции в user_segments_history вместе с actor, source и reason ($4, $5, $6).
+	// 5. Возвращаем slug и признак вставки для каждой затронутой записи.
+	addingSegmentsForUsers = `
 		WITH segments_data AS (SELECT UNNEST($1::TEXT[]) AS slug,
 									UNNEST($2::TIMESTAMP[]) AS expiration_time),
 			segment_ids AS (SELECT sd.slug,
 								sd.expiration_time,
 								s.id AS segment_id
 							FROM segments_data sd
-								JOIN segments s ON sd.slug = s.slug),
+								JOIN segments s ON sd.slug = s.slug
+							WHERE s.archived_at IS NULL
+							FOR SHARE OF s),
 			inserted_segments AS (
 				INSERT INTO user_segments (user_id, segment_id, expiration_time)
-				SELECT $3 AS user_id, si.segment_id, si.expiration_time
-				FROM segment_ids si
+				SELECT u.user_id, si.segment_id, si.expiration_time
+				FROM UNNEST($3::INT[]) AS u(user_id)
+					CROSS JOIN segment_ids si
 				ON CONFLICT (user_id, segment_id)
 				DO UPDATE SET expiration_time = excluded.expiration_time
-                RETURNING user_id, segment_id, created_at)
-		INSERT INTO user_segments_history (user_id, segment_id, action, created_at)
-		SELECT user_id, segment_id, 'ADD' AS action, created_at
+                RETURNING user_id, segment_id, created_at, (xmax = 0) AS inserted),
+			history AS (
+				INSERT INTO user_segments_history (user_id, segment_id, action, actor, source, reason, created_at)
+				SELECT user_id, segment_id, 'ADD' AS action, NULLIF($4, ''), NULLIF($5, ''), NULLIF($6, ''), created_at
+				FROM inserted_segments i
+				WHERE NOT EXISTS (
+					SELECT 1 FROM user_segments_history h
+					WHERE h.user_id = i.user_id
+						AND h.segment_id = i.segment_id
+						AND h.action = 'ADD'
+						AND h.created_at = i.created_at
+				))
+		SELECT s.slug, i.inserted
 		FROM inserted_segments i
-		WHERE NOT EXISTS (
-            SELECT 1 FROM user_segments_history h
-            WHERE h.user_id = i.user_id
-                AND h.segment_id = i.segment_id
-                AND h.action = 'ADD'
-                AND h.created_at = i.created_at
-		);`
+			JOIN segments s ON i.segment_id = s.id;`
+	// Удаляет пачку записей с истёкшим TTL и записывает их в историю с пометкой 'EXPIRE'
+	// от имени actor $2 с source $3 и фактическим временем истечения. SKIP LOCKED позволяет нескольким экземплярам
+	// сервиса чистить таблицу параллельно, не блокируя друг друга.
+	deletingExpiredSegments = `
+		WITH expired AS (
+				SELECT user_id, segment_id
+				FROM user_segments
+				WHERE expiration_time <= NOW()
+				ORDER BY expiration_time
+				LIMIT $1
+				FOR UPDATE SKIP LOCKED),
+			deleted_segments AS (
+				DELETE FROM user_segments us
+				USING expired e
+				WHERE us.user_id = e.user_id
+					AND us.segment_id = e.segment_id
+				RETURNING us.user_id, us.segment_id, us.expiration_time)
+		INSERT INTO user_segments_history (user_id, segment_id, action, actor, source, created_at)
+		SELECT user_id, segment_id, 'EXPIRE', $2, $3, expiration_time
+		FROM deleted_segments;`
+	// Активные членства пользователей в сегментах, по одному JSON-объекту на строку.
+	exportUserSegments = `
+		SELECT row_to_json(m)
+		FROM (SELECT us.user_id, s.slug, us.expiration_time, us.created_at
+				FROM user_segments us
+					JOIN segments s ON us.segment_id = s.id
+				WHERE us.expiration_time > NOW()
+				ORDER BY us.user_id, s.slug) m`
+	// Возвращает те slug'и из списка, для которых существуют активные сегменты.
+	getExistingSlugs = `SELECT slug FROM segments WHERE slug = ANY ($1) AND archived_at IS NULL;`
+	// Блокирует существующих (не стёртых) пользователей пачки от удаления и стирания до конца транзакции.
+	lockExistingUsers = `SELECT id FROM users WHERE id = ANY ($1) AND erased_at IS NULL FOR SHARE;`
+)
+
+// ErrUnknownSegments is returned by UpdateUserSegments in strict mode
+// if some of the requested slugs do not exist; the transaction is rolled back.
+var ErrUnknownSegments = errors.New("unknown segments")
+
+// bulkBatchSize is the maximum number of users updated in a single transaction by UpdateUsersSegments.
+const bulkBatchSize = 1000
+
+// Statuses of a single user in the result of a bulk segment update.
+const (
+	BulkStatusUpdated  = "updated"
+	BulkStatusNotFound = "not_found"
+	BulkStatusFailed   = "failed"
 )
 
 // SegmentModification describes the data for adding a segment to a user.
@@ -75,33 +143,238 @@ func defaultExpiration() time.Time {
 	return time.Now().Add(100 * 365 * 24 * time.Hour) // Approximately 100 years
 }
 
+// BulkUserResult describes the outcome of a bulk segment update for one user.
+type BulkUserResult struct {
+	UserID int    `json:"user_id"`
+	Status string `json:"status"` // "updated", "not_found" or "failed"
+	Error  string `json:"error,omitempty"`
+}
+
 // UpdateUserSegments updates user segments (transaction): adds and deletes segments.
 // For each added segment, a record is inserted into the user_segments table and recorded in the history.
 // For each segment to be deleted, the connection is deleted and the deletion is recorded in the history.
-// TODO: Разделить на маленькие функции.
-func (s *Store) UpdateUserSegments(ctx context.Context, userID int, add []SegmentModification, remove []string) error {
+// Active aliases of renamed segments are replaced with the current slugs and listed in DeprecatedSlugs.
+// The result lists which slugs were added, extended, removed, unknown or not assigned to the user.
+// Returns pgx.ErrNoRows if there is no such user or the user is erased.
+// In strict mode, if any slug is unknown, nothing is changed and ErrUnknownSegments is returned with the result.
+// Every history entry of the update is recorded with the actor, source and reason from meta.
+// If idem is set, the result is stored under the idempotency key in the same transaction; a retry
+// with the same key returns the stored result with Replayed set and changes nothing,
+// the same key with another payload gets ErrIdempotencyKeyReused.
+func (s *Store) UpdateUserSegments(ctx context.Context, userID int, add []SegmentModification, remove []string,
+	strict bool, meta models.ChangeMeta, idem *models.IdempotencyKey) (_ *models.SegmentsUpdateResult, err error) {
 	tx, err := s.pool.Begin(ctx)
 	if err != nil {
-		return fmt.Errorf("the beginning of the transaction: %w", err)
+		return nil, fmt.Errorf("the beginning of the transaction: %w", err)
 	}
 	defer func() {
 		if err != nil {
 			_ = tx.Rollback(ctx)
 		} else {
-			_ = tx.Commit(ctx)
+			err = tx.Commit(ctx)
 		}
 	}()
 
-	// TODO: добавьте использование batch-запросов или COPY FROM если len(add/remove) > 10k+
-	// Removing segments
-	_, err = tx.Exec(ctx, removingSegmentsForUser, userID, remove)
+	if idem != nil {
+		var stored []byte
+		if stored, err = claimIdempotency(ctx, tx, idem); err != nil {
+			return nil, err
+		}
+		if stored != nil {
+			replay := &models.SegmentsUpdateResult{Replayed: true}
+			if err = json.Unmarshal(stored, replay); err != nil {
+				return nil, fmt.Errorf("error decode idempotent response: %w", err)
+			}
+			return replay, nil
+		}
+	}
+
+	var locked int
+	if err = tx.QueryRow(ctx, lockExistingUsers, []int{userID}).Scan(&locked); err != nil {
+		return nil, err
+	}
+	var aliases map[string]string
+	if add, remove, aliases, err = resolveAliases(ctx, tx, add, remove); err != nil {
+		return nil, err
+	}
+
+	requested := make([]string, 0, len(add)+len(remove))
+	for _, mod := range add {
+		requested = append(requested, mod.Slug)
+	}
+	requested = append(requested, remove...)
+	var rows pgx.Rows
+	rows, err = tx.Query(ctx, getExistingSlugs, requested)
+	if err != nil {
+		return nil, fmt.Errorf("error get existing segments: %w", err)
+	}
+	var existing []string
+	existing, err = pgx.CollectRows(rows, pgx.RowTo[string])
+	if err != nil {
+		return nil, fmt.Errorf("error get existing segments: %w", err)
+	}
+
+	res := &models.SegmentsUpdateResult{Unknown: difference(requested, existing), DeprecatedSlugs: aliases}
+	if strict && len(res.Unknown) > 0 {
+		err = ErrUnknownSegments
+		return res, err
+	}
+
+	var changes *models.SegmentsUpdateResult
+	if changes, _, err = modifySegments(ctx, tx, []int{userID}, add, remove, meta); err != nil {
+		return nil, fmt.Errorf("user %d: %w", userID, err)
+	}
+	res.Added, res.Extended, res.Removed = changes.Added, changes.Extended, changes.Removed
+	res.NotAssigned = difference(difference(remove, res.Unknown), res.Removed)
+	if len(res.Added)+len(res.Extended)+len(res.Removed) > 0 {
+		if err = notifyUsersChanged(ctx, tx, []int{userID}); err != nil {
+			return nil, err
+		}
+	}
+
+	if idem != nil {
+		var response []byte
+		if response, err = json.Marshal(res); err != nil {
+			return nil, fmt.Errorf("error encode idempotent response: %w", err)
+		}
+		if err = saveIdempotency(ctx, tx, idem, response); err != nil {
+			return nil, err
+		}
+	}
+	return res, nil
+}
+
+// UpdateUsersSegments adds and deletes the same segments for many users.
+// Users are processed in batches of bulkBatchSize, each batch in its own transaction,
+// so a failed batch does not roll back the ones already committed.
+// If ctx is done, the remaining batches are not processed and their users are reported as "failed".
+// Users that do not exist or are erased are skipped and reported as "not_found".
+// Active aliases of renamed segments are replaced with the current slugs.
+// Every history entry is recorded with the actor, source and reason from meta.
+// The result contains exactly one entry per distinct user ID, in the order of the first occurrence,
+// and the numbers of memberships added and removed by the committed batches.
+func (s *Store) UpdateUsersSegments(ctx context.Context, userIDs []int, add []SegmentModification, remove []string,
+	meta models.ChangeMeta) ([]BulkUserResult, MembershipCounts) {
+	ids := make([]int, 0, len(userIDs))
+	seen := make(map[int]struct{}, len(userIDs))
+	for _, id := range userIDs {
+		if _, ok := seen[id]; ok {
+			continue
+		}
+		seen[id] = struct{}{}
+		ids = append(ids, id)
+	}
+
+	var (
+		results = make([]BulkUserResult, 0, len(ids))
+		total   MembershipCounts
+	)
+	for start := 0; start < len(ids); start += bulkBatchSize {
+		batch := ids[start:min(start+bulkBatchSize, len(ids))]
+		var (
+			existing map[int]bool
+			counts   MembershipCounts
+			err      = ctx.Err()
+		)
+		if err != nil {
+			err = fmt.Errorf("not processed: %w", err)
+		} else if existing, counts, err = s.updateSegmentsBatch(ctx, batch, add, remove, meta); err == nil {
+			total.Added += counts.Added
+			total.Removed += counts.Removed
+		}
+		for _, id := range batch {
+			res := BulkUserResult{UserID: id, Status: BulkStatusUpdated}
+			switch {
+			case err != nil:
+				res.Status, res.Error = BulkStatusFailed, err.Error()
+			case !existing[id]:
+				res.Status = BulkStatusNotFound
+			}
+			results = append(results, res)
+		}
+	}
+	return results, total
+}
+
+// updateSegmentsBatch applies the modification to one batch of users in a single transaction
+// and returns the set of users from the batch that exist and the numbers of changed memberships.
+func (s *Store) updateSegmentsBatch(ctx context.Context, userIDs []int, add []SegmentModification, remove []string,
+	meta models.ChangeMeta) (existing map[int]bool, counts MembershipCounts, err error) {
+	tx, err := s.pool.Begin(ctx)
+	if err != nil {
+		return nil, counts, fmt.Errorf("the beginning of the transaction: %w", err)
+	}
+	defer func() {
+		if err != nil {
+			_ = tx.Rollback(ctx)
+		} else {
+			err = tx.Commit(ctx)
+		}
+	}()
+
+	var rows pgx.Rows
+	rows, err = tx.Query(ctx, lockExistingUsers, userIDs)
 	if err != nil {
-		return fmt.Errorf("error delete segments for user %d: %w", userID, err)
+		return nil, counts, fmt.Errorf("error lock users: %w", err)
+	}
+	var found []int
+	found, err = pgx.CollectRows(rows, pgx.RowTo[int])
+	if err != nil {
+		return nil, counts, fmt.Errorf("error lock users: %w", err)
+	}
+
+	existing = make(map[int]bool, len(found))
+	for _, id := range found {
+		existing[id] = true
+	}
+	if len(found) == 0 {
+		return existing, counts, nil
+	}
+
+	if add, remove, _, err = resolveAliases(ctx, tx, add, remove); err != nil {
+		return nil, counts, err
+	}
+	var modified MembershipCounts
+	if _, modified, err = modifySegments(ctx, tx, found, add, remove, meta); err != nil {
+		return nil, counts, err
+	}
+	if err = notifyUsersChanged(ctx, tx, found); err != nil {
+		return nil, counts, err
+	}
+	return existing, modified, nil
+}
+
+// MembershipCounts - numbers of memberships added and removed by a modification.
+type MembershipCounts struct {
+	Added   int64
+	Removed int64
+}
+
+// modifySegments removes and then adds segments for the given users within the transaction,
+// recording every change in the history with the metadata. The result lists the distinct slugs
+// that were added, extended (expiration time updated) and removed; counts are the numbers of memberships.
+func modifySegments(ctx context.Context, tx pgx.Tx, userIDs []int, add []SegmentModification,
+	remove []string, meta models.ChangeMeta) (*models.SegmentsUpdateResult, MembershipCounts, error) {
+	res := &models.SegmentsUpdateResult{}
+	var counts MembershipCounts
+
+	// Removing segments
+	if len(remove) > 0 {
+		rows, err := tx.Query(ctx, removingSegmentsForUsers, userIDs, remove, meta.Actor, meta.Source, meta.Reason)
+		if err != nil {
+			return nil, counts, fmt.Errorf("error delete segments: %w", err)
+		}
+		removed, err := pgx.CollectRows(rows, pgx.RowTo[string])
+		if err != nil {
+			return nil, counts, fmt.Errorf("error delete segments: %w", err)
+		}
+		res.Removed = unique(removed)
+		counts.Removed = int64(len(removed))
 	}
 
 	// Adding segments
 	if len(add) == 0 {
-		return nil
+		return res, counts, nil
 	}
 	// Data preparation for request
 	slugs := make([]string, len(add))
@@ -116,29 +389,108 @@ func (s *Store) UpdateUserSegments(ctx context.Context, userID int, add []Segmen
 		}
 	}
 	// Request
-	_, err = tx.Exec(ctx, addingSegmentsForUser, slugs, expTimes, userID)
+	rows, err := tx.Query(ctx, addingSegmentsForUsers, slugs, expTimes, userIDs, meta.Actor, meta.Source, meta.Reason)
+	if err != nil {
+		return nil, counts, fmt.Errorf("error adding segments: %w", err)
+	}
+	var (
+		slug     string
+		inserted bool
+		added    []string
+		extended []string
+	)
+	_, err = pgx.ForEachRow(rows, []any{&slug, &inserted}, func() error {
+		if inserted {
+			added = append(added, slug)
+			counts.Added++
+		} else {
+			extended = append(extended, slug)
+		}
+		return nil
+	})
 	if err != nil {
-		return fmt.Errorf("error adding segments for user %d: %w", userID, err)
+		return nil, counts, fmt.Errorf("error adding segments: %w", err)
+	}
+	res.Added, res.Extended = unique(added), unique(extended)
+	return res, counts, nil
+}
+
+// unique returns the distinct values of the list in the order of the first occurrence.
+// The result is never nil.
+func unique(list []string) []string {
+	return difference(list, nil)
+}
+
+// difference returns the distinct values of the list that are not in exclude,
+// in the order of the first occurrence. The result is never nil.
+func difference(list, exclude []string) []string {
+	seen := make(map[string]struct{}, len(list)+len(exclude))
+	for _, v := range exclude {
+		seen[v] = struct{}{}
+	}
+	res := make([]string, 0, len(list))
+	for _, v := range list {
+		if _, ok := seen[v]; ok {
+			continue
+		}
+		seen[v] = struct{}{}
+		res = append(res, v)
 	}
-	return nil
+	return res
 }
 
 // GetActiveSegmentsForUser returns active user segments.
 // Segments with an expiration time greater than the current time are considered active.
 func (s *Store) GetActiveSegmentsForUser(ctx context.Context, userID int) ([]*models.Segment, error) {
+	segments, _, err := s.GetActiveSegmentsWithExpiration(ctx, userID)
+	return segments, err
+}
+
+// GetActiveSegmentsWithExpiration returns active user segments like GetActiveSegmentsForUser
+// and the earliest expiration time among them, after which the list is no longer valid.
+// The expiration time is zero if the user has no active segments.
+func (s *Store) GetActiveSegmentsWithExpiration(ctx context.Context, userID int) ([]*models.Segment, time.Time, error) {
 	rows, err := s.pool.Query(ctx, getActiveSegmentsForUser, userID)
 	if err != nil {
-		return nil, err
+		return nil, time.Time{}, err
 	}
 	defer rows.Close()
 
+	var (
+		earliest   time.Time
+		expiration time.Time
+	)
 	segments := make([]*models.Segment, 0, 16)
 	for rows.Next() {
 		seg := &models.Segment{}
-		if err := rows.Scan(&seg.ID, &seg.Slug, &seg.Description, &seg.CreatedAt); err != nil {
-			return nil, err
+		if err := rows.Scan(&seg.ID, &seg.Slug, &seg.Description, &seg.CreatedAt, &seg.Version, &expiration); err != nil {
+			return nil, time.Time{}, err
+		}
+		if earliest.IsZero() || expiration.Before(earliest) {
+			earliest = expiration
 		}
 		segments = append(segments, seg)
 	}
-	return segments, nil
+	if err = rows.Err(); err != nil {
+		return nil, time.Time{}, err
+	}
+	return segments, earliest, nil
+}
+
+// GetAllUserSegmentsViaCopy streams all active user segments to w as NDJSON
+// (user_id, slug, expiration_time, created_at) using COPY.
+func (s *Store) GetAllUserSegmentsViaCopy(ctx context.Context, w io.Writer) error {
+	return s.copyJSONTo(ctx, w, exportUserSegments)
+}
+
+// DeleteExpiredUserSegments deletes at most batchSize user segments whose expiration time has passed,
+// recording each of them in the history as 'EXPIRE' with the actual expiration time
+// by the "system" actor from the "ttl" source.
+// Returns the number of deleted records.
+func (s *Store) DeleteExpiredUserSegments(ctx context.Context, batchSize int) (int64, error) {
+	tag, err := s.pool.Exec(ctx, deletingExpiredSegments, batchSize, models.ActorSystem, models.SourceTTL)
+	if err != nil {
+		return 0, fmt.Errorf("error delete expired segments: %w", err)
+	}
+	return tag.RowsAffected(), nil
 }
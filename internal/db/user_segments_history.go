@@ -4,37 +4,68 @@ package db
 import (
 	"context"
 	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/jackc/pgx/v5"
 
 	"user_segmentation_service/internal/models"
 )
 
 const (
+	// Вместо имени стёртого пользователя выводится его псевдоним.
+	// Условия по пользователям, сегментам и действиям добавляются только при наличии фильтров,
+	// чтобы планировщик мог использовать индексы по (user_id, created_at) и created_at.
 	getUserSegmentHistory = `
-		SELECT ush.user_id, u.name, s.slug, s.description, ush.action, ush.created_at
+		SELECT ush.user_id, COALESCE(u.name, u.pseudonym, ''), s.slug, COALESCE(s.description, ''), ush.action,
+			COALESCE(ush.actor, ''), COALESCE(ush.source, ''), COALESCE(ush.reason, ''), ush.created_at
 		FROM user_segments_history ush
 		JOIN users u ON ush.user_id = u.id
 		JOIN segments s ON ush.segment_id = s.id
-		WHERE ush.user_id = $1 
-		  AND EXTRACT(YEAR FROM ush.created_at) = $2
-		  AND EXTRACT(MONTH FROM ush.created_at) = $3
-		ORDER BY ush.created_at;`
+		WHERE ush.created_at >= $1
+		  AND ush.created_at < $2`
 )
 
-// GetUserSegmentHistory receives a story for a given user and the period.
-func (s *Store) GetUserSegmentHistory(ctx context.Context, userID, year, month int) ([]*models.HistoryRecord, error) {
-	rows, err := s.pool.Query(ctx, getUserSegmentHistory, userID, year, month)
+// historyQuery builds the history query for the given parameters.
+func historyQuery(p models.HistoryParams) (string, []any) {
+	var b strings.Builder
+	b.WriteString(getUserSegmentHistory)
+	args := []any{p.From.UTC(), p.To.UTC()}
+	arg := func(v any) string {
+		args = append(args, v)
+		return "$" + strconv.Itoa(len(args))
+	}
+	if len(p.UserIDs) > 0 {
+		b.WriteString(" AND ush.user_id = ANY (" + arg(p.UserIDs) + ")")
+	}
+	if len(p.Slugs) > 0 {
+		b.WriteString(" AND s.slug = ANY (" + arg(p.Slugs) + ")")
+	}
+	if len(p.Actions) > 0 {
+		b.WriteString(" AND ush.action = ANY (" + arg(p.Actions) + ")")
+	}
+	b.WriteString(" ORDER BY ush.created_at, ush.id;")
+	return b.String(), args
+}
+
+// StreamUserSegmentHistory passes the history records matching the parameters to fn one by one,
+// ordered by time, without loading the whole history into memory. The record passed to fn is reused.
+// The period is p.From (inclusive) to p.To (exclusive), empty filters match everything.
+func (s *Store) StreamUserSegmentHistory(ctx context.Context, p models.HistoryParams,
+	fn func(rec *models.HistoryRecord) error) error {
+	query, args := historyQuery(p)
+	rows, err := s.pool.Query(ctx, query, args...)
 	if err != nil {
-		return nil, fmt.Errorf("query history: %w", err)
+		return fmt.Errorf("query history: %w", err)
 	}
-	defer rows.Close()
 
-	records := make([]*models.HistoryRecord, 0, 32)
-	for rows.Next() {
-		rec := &models.HistoryRecord{}
-		if err := rows.Scan(&rec.UserID, &rec.UserName, &rec.SegmentSlug, &rec.SegmentDescription, &rec.Action, &rec.CreatedAt); err != nil {
-			return nil, fmt.Errorf("scan history record: %w", err)
-		}
-		records = append(records, rec)
+	rec := &models.HistoryRecord{}
+	_, err = pgx.ForEachRow(rows,
+		[]any{&rec.UserID, &rec.UserName, &rec.SegmentSlug, &rec.SegmentDescription, &rec.Action,
+			&rec.Actor, &rec.Source, &rec.Reason, &rec.CreatedAt},
+		func() error { return fn(rec) })
+	if err != nil {
+		return fmt.Errorf("scan history record: %w", err)
 	}
-	return records, nil
+	return nil
 }
@@ -0,0 +1,235 @@
+// Package db provides functionality for interacting with the PostgreSQL database.
+package db
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+
+	"user_segmentation_service/internal/models"
+)
+
+const (
+	// Временная таблица для загрузки строк через COPY FROM, удаляется в конце транзакции.
+	createImportTable = `
+		CREATE TEMP TABLE import_user_segments
+		(
+			line            INT  NOT NULL,
+			user_id         INT  NOT NULL,
+			slug            TEXT NOT NULL,
+			expiration_time TIMESTAMP,
+			reject_reason   TEXT
+		) ON COMMIT DROP;`
+	analyzeImportTable = `ANALYZE import_user_segments;`
+	// Создаёт пользователей для неизвестных user_id и сдвигает последовательность,
+	// чтобы новые пользователи не получили уже занятые id.
+	createImportedUsers = `
+		WITH created_users AS (
+				INSERT INTO users (id)
+				SELECT DISTINCT i.user_id
+				FROM import_user_segments i
+				WHERE NOT EXISTS (SELECT 1 FROM users u WHERE u.id = i.user_id)
+				ON CONFLICT (id) DO NOTHING
+				RETURNING id)
+		SELECT COALESCE(ARRAY_AGG(id), '{}') FROM created_users;`
+	syncUsersSequence = `SELECT SETVAL(PG_GET_SERIAL_SEQUENCE('users', 'id'), GREATEST((SELECT MAX(id) FROM users), 1));`
+	// Блокирует не стёртых пользователей из файла до конца транзакции, как lockExistingUsers:
+	// ключевая блокировка внешнего ключа при вставке не мешает параллельному EraseUser.
+	lockImportedUsers = `
+		SELECT id FROM users
+		WHERE id IN (SELECT user_id FROM import_user_segments) AND erased_at IS NULL
+		ORDER BY id
+		FOR SHARE;`
+	// Помечает строки, которые нельзя импортировать. $1 - заблокированные пользователи (lockImportedUsers):
+	// существующий, но не заблокированный пользователь стёрт.
+	rejectInvalidImportRows = `
+		UPDATE import_user_segments i
+		SET reject_reason = CASE
+				WHEN NOT EXISTS (SELECT 1 FROM users u WHERE u.id = i.user_id) THEN 'unknown user'
+				WHEN i.user_id <> ALL ($1::INT[]) THEN 'erased user'
+				WHEN NOT EXISTS (SELECT 1 FROM segments s WHERE s.slug = i.slug) THEN 'unknown segment'
+				WHEN EXISTS (SELECT 1 FROM segments s WHERE s.slug = i.slug AND s.archived_at IS NOT NULL)
+					THEN 'archived segment'
+				WHEN i.expiration_time <= NOW() THEN 'expiration_time is in the past'
+			END;`
+	// Из нескольких строк для одной пары (user_id, slug) остаётся последняя.
+	rejectDuplicateImportRows = `
+		UPDATE import_user_segments i
+		SET reject_reason = 'duplicate, overridden by line ' || d.last_line
+		FROM (SELECT line, MAX(line) OVER (PARTITION BY user_id, slug) AS last_line
+				FROM import_user_segments
+				WHERE reject_reason IS NULL) d
+		WHERE i.line = d.line
+			AND d.line < d.last_line;`
+	// Переносит корректные строки в user_segments так же, как addingSegmentsForUsers:
+	// новые записи вставляются, у существующих обновляется expiration_time,
+	// вставки фиксируются в user_segments_history как 'ADD' с actor $2 и source $3.
+	mergeImportedSegments = `
+		WITH inserted_segments AS (
+				INSERT INTO user_segments (user_id, segment_id, expiration_time)
+				SELECT i.user_id, s.id, COALESCE(i.expiration_time, $1)
+				FROM import_user_segments i
+					JOIN segments s ON i.slug = s.slug
+				WHERE i.reject_reason IS NULL
+					AND s.archived_at IS NULL
+				FOR SHARE OF s
+				ON CONFLICT (user_id, segment_id)
+				DO UPDATE SET expiration_time = excluded.expiration_time
+				RETURNING user_id, segment_id, created_at, (xmax = 0) AS inserted),
+			history AS (
+				INSERT INTO user_segments_history (user_id, segment_id, action, actor, source, reason, created_at)
+				SELECT user_id, segment_id, 'ADD' AS action, NULLIF($2, ''), NULLIF($3, ''), NULLIF($4, ''), created_at
+				FROM inserted_segments i
+				WHERE NOT EXISTS (
+					SELECT 1 FROM user_segments_history h
+					WHERE h.user_id = i.user_id
+						AND h.segment_id = i.segment_id
+						AND h.action = 'ADD'
+						AND h.created_at = i.created_at
+				))
+		SELECT COUNT(*) FILTER (WHERE inserted), COUNT(*) FILTER (WHERE NOT inserted)
+		FROM inserted_segments;`
+	countRejectedImportRows = `SELECT COUNT(*) FROM import_user_segments WHERE reject_reason IS NOT NULL;`
+	getRejectedImportRows   = `
+		SELECT line, reject_reason
+		FROM import_user_segments
+		WHERE reject_reason IS NOT NULL
+		ORDER BY line
+		LIMIT $1;`
+)
+
+// ImportRow describes a membership of a user in a segment to import.
+type ImportRow struct {
+	Line           int        // Line of the source file, used in rejections.
+	UserID         int        // User ID.
+	Slug           string     // Segment slug.
+	ExpirationTime *time.Time // Optionally, if nil, the default value is used.
+}
+
+// ImportSource is an iterator over the rows to import.
+type ImportSource interface {
+	// Next advances to the next row, returns false when there are no more rows or an error occurred.
+	Next() bool
+	// Row returns the current row.
+	Row() ImportRow
+	// Err returns the error that stopped the iteration, if any.
+	Err() error
+}
+
+// importCopySource adapts ImportSource to pgx.CopyFromSource.
+type importCopySource struct {
+	src ImportSource
+}
+
+// Next implements pgx.CopyFromSource.
+func (c importCopySource) Next() bool { return c.src.Next() }
+
+// Values implements pgx.CopyFromSource.
+func (c importCopySource) Values() ([]any, error) {
+	row := c.src.Row()
+	return []any{row.Line, row.UserID, row.Slug, row.ExpirationTime}, nil
+}
+
+// Err implements pgx.CopyFromSource.
+func (c importCopySource) Err() error { return c.src.Err() }
+
+// ImportUserSegments imports memberships of users in segments (transaction).
+// The rows are staged with COPY FROM into a temporary table and then merged into user_segments:
+// new memberships are inserted and recorded in the history, existing ones get the new expiration time.
+// The users of the rows are locked against a concurrent erasure until the end of the transaction.
+// Rows with unknown or erased users, unknown segments, expired rows and duplicates are rejected;
+// at most maxRejections of them are listed in the result with the reason.
+// If createUsers is set, users with unknown IDs are created (without a name) instead of being rejected.
+// The inserted memberships are recorded in the history with the actor, source and reason from meta.
+func (s *Store) ImportUserSegments(ctx context.Context, src ImportSource, createUsers bool,
+	maxRejections int, meta models.ChangeMeta) (res *models.ImportResult, err error) {
+	tx, err := s.pool.Begin(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("the beginning of the transaction: %w", err)
+	}
+	defer func() {
+		if err != nil {
+			_ = tx.Rollback(ctx)
+		} else {
+			err = tx.Commit(ctx)
+		}
+	}()
+
+	res = &models.ImportResult{}
+	if err = stageImport(ctx, tx, src); err != nil {
+		return nil, err
+	}
+
+	if createUsers {
+		var created []int
+		if err = tx.QueryRow(ctx, createImportedUsers).Scan(&created); err != nil {
+			return nil, fmt.Errorf("error create imported users: %w", err)
+		}
+		if len(created) > 0 {
+			if _, err = tx.Exec(ctx, syncUsersSequence); err != nil {
+				return nil, fmt.Errorf("error sync users sequence: %w", err)
+			}
+			var tag pgconn.CommandTag
+			if tag, err = tx.Exec(ctx, autoEnrollUsers, created, defaultExpiration(), models.ActorSystem, models.SourceAutoEnroll); err != nil {
+				return nil, fmt.Errorf("error auto-enrolling imported users: %w", err)
+			}
+			res.UsersEnrolled = tag.RowsAffected()
+		}
+		res.UsersCreated = int64(len(created))
+	}
+
+	var rows pgx.Rows
+	if rows, err = tx.Query(ctx, lockImportedUsers); err != nil {
+		return nil, fmt.Errorf("error lock imported users: %w", err)
+	}
+	var locked []int
+	if locked, err = pgx.CollectRows(rows, pgx.RowTo[int]); err != nil {
+		return nil, fmt.Errorf("error lock imported users: %w", err)
+	}
+	if _, err = tx.Exec(ctx, rejectInvalidImportRows, locked); err != nil {
+		return nil, fmt.Errorf("error reject invalid rows: %w", err)
+	}
+	if _, err = tx.Exec(ctx, rejectDuplicateImportRows); err != nil {
+		return nil, fmt.Errorf("error reject duplicate rows: %w", err)
+	}
+	if err = tx.QueryRow(ctx, mergeImportedSegments, defaultExpiration(), meta.Actor, meta.Source, meta.Reason).Scan(&res.Inserted, &res.Updated); err != nil {
+		return nil, fmt.Errorf("error merge imported rows: %w", err)
+	}
+
+	if err = notify(ctx, tx, models.Change{All: true}); err != nil {
+		return nil, err
+	}
+
+	if err = tx.QueryRow(ctx, countRejectedImportRows).Scan(&res.Rejected); err != nil {
+		return nil, fmt.Errorf("error count rejected rows: %w", err)
+	}
+	if rows, err = tx.Query(ctx, getRejectedImportRows, maxRejections); err != nil {
+		return nil, fmt.Errorf("error get rejected rows: %w", err)
+	}
+	if res.Rejections, err = pgx.CollectRows(rows, pgx.RowToStructByPos[models.ImportRejection]); err != nil {
+		return nil, fmt.Errorf("error get rejected rows: %w", err)
+	}
+	return res, nil
+}
+
+// stageImport creates the temporary import table and loads the rows into it with COPY FROM.
+func stageImport(ctx context.Context, tx pgx.Tx, src ImportSource) error {
+	if _, err := tx.Exec(ctx, createImportTable); err != nil {
+		return fmt.Errorf("error create import table: %w", err)
+	}
+	_, err := tx.CopyFrom(ctx,
+		pgx.Identifier{"import_user_segments"},
+		[]string{"line", "user_id", "slug", "expiration_time"},
+		importCopySource{src: src},
+	)
+	if err != nil {
+		return fmt.Errorf("error copy import rows: %w", err)
+	}
+	if _, err = tx.Exec(ctx, analyzeImportTable); err != nil {
+		return fmt.Errorf("error analyze import table: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,91 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/kelseyhightower/envconfig"
+
+	"user_segmentation_service/internal/models"
+)
+
+// testStore connects to the test database configured by the TEST_DB_* variables
+// (the same as DB_*, e.g. TEST_DB_HOST=localhost) and applies the migrations.
+// The test is skipped if TEST_DB_HOST is not set.
+func testStore(t *testing.T) *Store {
+	t.Helper()
+	if os.Getenv("TEST_DB_HOST") == "" {
+		t.Skip("TEST_DB_HOST is not set")
+	}
+	var cfg Config
+	if err := envconfig.Process("TEST_DB", &cfg); err != nil {
+		t.Fatalf("envconfig.Process() error = %v", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	s, err := NewPostgresPool(ctx, cfg)
+	if err != nil {
+		t.Fatalf("NewPostgresPool() error = %v", err)
+	}
+	t.Cleanup(s.Close)
+	if _, err = s.MigrateUp(ctx); err != nil {
+		t.Fatalf("MigrateUp() error = %v", err)
+	}
+	return s
+}
+
+// sliceImportSource is an ImportSource over a slice of rows.
+type sliceImportSource struct {
+	rows []ImportRow
+	pos  int
+}
+
+func (s *sliceImportSource) Next() bool {
+	s.pos++
+	return s.pos <= len(s.rows)
+}
+
+func (s *sliceImportSource) Row() ImportRow { return s.rows[s.pos-1] }
+
+func (s *sliceImportSource) Err() error { return nil }
+
+func TestImportCreatesReadableUsers(t *testing.T) {
+	s := testStore(t)
+	ctx := context.Background()
+
+	seg := &models.Segment{Slug: fmt.Sprintf("TEST_IMPORT_%d", time.Now().UnixNano())}
+	if _, err := s.CreateSegment(ctx, seg); err != nil {
+		t.Fatalf("CreateSegment() error = %v", err)
+	}
+	var userID int
+	if err := s.pool.QueryRow(ctx, `SELECT COALESCE(MAX(id), 0) + 1000 FROM users;`).Scan(&userID); err != nil {
+		t.Fatalf("next user id: %v", err)
+	}
+	t.Cleanup(func() {
+		_, _ = s.pool.Exec(ctx, `DELETE FROM user_segments_history WHERE user_id = $1;`, userID)
+		_, _ = s.pool.Exec(ctx, `DELETE FROM user_segments WHERE user_id = $1;`, userID)
+		_, _ = s.pool.Exec(ctx, `DELETE FROM users WHERE id = $1;`, userID)
+		_, _ = s.pool.Exec(ctx, `DELETE FROM segments WHERE id = $1;`, seg.ID)
+	})
+
+	src := &sliceImportSource{rows: []ImportRow{{Line: 1, UserID: userID, Slug: seg.Slug}}}
+	res, err := s.ImportUserSegments(ctx, src, true, 10, models.ChangeMeta{Source: models.SourceImport})
+	if err != nil {
+		t.Fatalf("ImportUserSegments() error = %v", err)
+	}
+	if res.UsersCreated != 1 || res.Inserted != 1 {
+		t.Fatalf("ImportUserSegments() = %+v, want 1 user created and 1 membership inserted", res)
+	}
+
+	user, err := s.GetUserByID(ctx, userID)
+	if err != nil {
+		t.Fatalf("GetUserByID() error = %v", err)
+	}
+	if user.ID != userID || user.Name != "" {
+		t.Errorf("GetUserByID() = %+v, want user %d without a name", user, userID)
+	}
+}
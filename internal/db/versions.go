@@ -0,0 +1,32 @@
+// Package db provides functionality for interacting with the PostgreSQL database.
+package db
+
+import (
+	"context"
+
+	"github.com/jackc/pgx/v5"
+
+	"user_segmentation_service/internal/db/db_errors"
+)
+
+// ErrVersionMismatch is returned by conditional updates if the version of the entity
+// is not one of the expected versions (If-Match), see package db_errors.
+var ErrVersionMismatch = db_errors.ErrVersionMismatch
+
+// queryRower runs a query returning a single row; implemented by both the pool and a transaction.
+type queryRower interface {
+	QueryRow(ctx context.Context, sql string, args ...any) pgx.Row
+}
+
+// versionStateError explains why a conditional statement did not affect an entity: returns ErrVersionMismatch
+// if the active entity exists according to existsQuery, so only its version did not match, otherwise pgx.ErrNoRows.
+func versionStateError(ctx context.Context, q queryRower, existsQuery string, key any) error {
+	var exists bool
+	if err := q.QueryRow(ctx, existsQuery, key).Scan(&exists); err != nil {
+		return err
+	}
+	if exists {
+		return ErrVersionMismatch
+	}
+	return pgx.ErrNoRows
+}
@@ -0,0 +1,93 @@
+// Package metrics provides the Prometheus metrics of the application.
+package metrics
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// namespace - prefix of the metric names.
+const namespace = "user_segmentation"
+
+var (
+	httpRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "http_requests_total",
+		Help:      "Number of HTTP requests by route pattern and status code.",
+	}, []string{"method", "route", "code"})
+
+	httpRequestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "http_request_duration_seconds",
+		Help:      "Duration of HTTP requests by route pattern and status code.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"method", "route", "code"})
+
+	membershipChanges = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "membership_changes_total",
+		Help:      "Number of memberships added, removed and expired, by the source of the change.",
+	}, []string{"action", "source"})
+
+	reportDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "report_generation_duration_seconds",
+		Help:      "Duration of generating history reports by format and status.",
+		Buckets:   []float64{0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 120, 300, 600},
+	}, []string{"format", "status"})
+
+	cacheLookups = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "active_segments_cache_lookups_total",
+		Help:      "Lookups of the active user segments in the cache by result (hit or miss).",
+	}, []string{"result"})
+)
+
+// Handler returns the handler serving the metrics in the Prometheus text exposition format.
+func Handler() http.Handler {
+	return promhttp.Handler()
+}
+
+// ObserveRequest records a served HTTP request. The route is the pattern the request matched,
+// not its path, so that IDs in paths do not create new series.
+func ObserveRequest(method, route string, code int, duration time.Duration) {
+	labels := prometheus.Labels{"method": method, "route": route, "code": strconv.Itoa(code)}
+	httpRequests.With(labels).Inc()
+	httpRequestDuration.With(labels).Observe(duration.Seconds())
+}
+
+// CountMemberships records n memberships changed with the history action (ADD, REMOVE, EXPIRE)
+// from the source of the change.
+func CountMemberships(action, source string, n int64) {
+	if n > 0 {
+		membershipChanges.WithLabelValues(action, source).Add(float64(n))
+	}
+}
+
+// CountCacheLookup records a lookup of the active user segments in the cache.
+func CountCacheLookup(hit bool) {
+	result := "miss"
+	if hit {
+		result = "hit"
+	}
+	cacheLookups.WithLabelValues(result).Inc()
+}
+
+// RegisterCacheSize registers the number of users in the cache of active segments returned by size.
+func RegisterCacheSize(size func() int) {
+	promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "active_segments_cache_entries",
+		Help:      "Number of users whose active segments are cached.",
+	}, func() float64 { return float64(size()) })
+}
+
+// ObserveReport records the generation of a history report with the status it ended with (done or failed).
+func ObserveReport(format, status string, duration time.Duration) {
+	reportDuration.WithLabelValues(format, status).Observe(duration.Seconds())
+}
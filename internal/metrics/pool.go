@@ -0,0 +1,64 @@
+// Package metrics provides the Prometheus metrics of the application.
+package metrics
+
+import (
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// poolCollector exports the statistics of the database connection pool, collected at scrape time.
+type poolCollector struct {
+	stat func() *pgxpool.Stat
+
+	acquired      *prometheus.Desc
+	idle          *prometheus.Desc
+	total         *prometheus.Desc
+	max           *prometheus.Desc
+	acquires      *prometheus.Desc
+	emptyAcquires *prometheus.Desc
+	canceled      *prometheus.Desc
+	waitDuration  *prometheus.Desc
+}
+
+// RegisterPool registers the statistics of the database connection pool returned by stat.
+func RegisterPool(stat func() *pgxpool.Stat) {
+	desc := func(name, help string) *prometheus.Desc {
+		return prometheus.NewDesc(prometheus.BuildFQName(namespace, "db_pool", name), help, nil, nil)
+	}
+	prometheus.MustRegister(&poolCollector{
+		stat:          stat,
+		acquired:      desc("acquired_connections", "Number of connections currently in use."),
+		idle:          desc("idle_connections", "Number of idle connections."),
+		total:         desc("total_connections", "Number of open connections."),
+		max:           desc("max_connections", "Maximum size of the pool."),
+		acquires:      desc("acquires_total", "Number of successful acquires of a connection."),
+		emptyAcquires: desc("empty_acquires_total", "Number of acquires that had to wait for a connection."),
+		canceled:      desc("canceled_acquires_total", "Number of acquires canceled by the context."),
+		waitDuration:  desc("acquire_wait_seconds_total", "Total time spent waiting for a connection."),
+	})
+}
+
+// Describe implements prometheus.Collector.
+func (c *poolCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.acquired
+	ch <- c.idle
+	ch <- c.total
+	ch <- c.max
+	ch <- c.acquires
+	ch <- c.emptyAcquires
+	ch <- c.canceled
+	ch <- c.waitDuration
+}
+
+// Collect implements prometheus.Collector.
+func (c *poolCollector) Collect(ch chan<- prometheus.Metric) {
+	s := c.stat()
+	ch <- prometheus.MustNewConstMetric(c.acquired, prometheus.GaugeValue, float64(s.AcquiredConns()))
+	ch <- prometheus.MustNewConstMetric(c.idle, prometheus.GaugeValue, float64(s.IdleConns()))
+	ch <- prometheus.MustNewConstMetric(c.total, prometheus.GaugeValue, float64(s.TotalConns()))
+	ch <- prometheus.MustNewConstMetric(c.max, prometheus.GaugeValue, float64(s.MaxConns()))
+	ch <- prometheus.MustNewConstMetric(c.acquires, prometheus.CounterValue, float64(s.AcquireCount()))
+	ch <- prometheus.MustNewConstMetric(c.emptyAcquires, prometheus.CounterValue, float64(s.EmptyAcquireCount()))
+	ch <- prometheus.MustNewConstMetric(c.canceled, prometheus.CounterValue, float64(s.CanceledAcquireCount()))
+	ch <- prometheus.MustNewConstMetric(c.waitDuration, prometheus.CounterValue, s.AcquireDuration().Seconds())
+}
@@ -0,0 +1,47 @@
+// Package models defines data structures for the application.
+package models
+
+import (
+	"slices"
+	"time"
+)
+
+// Scopes of API keys.
+const (
+	ScopeMembershipsRead  = "memberships:read"  // Read segments, their members and user memberships.
+	ScopeMembershipsWrite = "memberships:write" // Add and remove users to and from segments.
+	ScopeSegmentsManage   = "segments:manage"   // Create, update, rename, archive and restore segments.
+	ScopeUsersManage      = "users:manage"      // Create, read, update and erase users.
+	ScopeReportsRead      = "reports:read"      // Read the history, reports and statistics.
+	ScopeAdmin            = "admin"             // Manage API keys and purge segments; implies all other scopes.
+)
+
+// Scopes lists all scopes an API key can carry.
+var Scopes = []string{
+	ScopeMembershipsRead, ScopeMembershipsWrite, ScopeSegmentsManage, ScopeUsersManage, ScopeReportsRead, ScopeAdmin,
+}
+
+// APIKey is a key clients authenticate with. Only the hash of the key is stored.
+type APIKey struct {
+	ID        int        `json:"id"`
+	Name      string     `json:"name"`
+	Prefix    string     `json:"prefix"` // Beginning of the key to recognise it by.
+	Scopes    []string   `json:"scopes"`
+	CreatedAt time.Time  `json:"created_at"`
+	RevokedAt *time.Time `json:"revoked_at,omitempty"`
+	Key       string     `json:"key,omitempty"` // The key itself, returned only once on creation.
+}
+
+// HasScope reports whether the key grants the scope. The admin scope grants all scopes.
+func (k *APIKey) HasScope(scope string) bool {
+	return slices.Contains(k.Scopes, scope) || slices.Contains(k.Scopes, ScopeAdmin)
+}
+
+// Actor returns the name the changes made with the key are recorded under in the history:
+// the name and the prefix of an issued key, the name of a key from the configuration.
+func (k *APIKey) Actor() string {
+	if k.ID == 0 {
+		return k.Name
+	}
+	return k.Name + " (" + k.Prefix + ")"
+}
@@ -0,0 +1,12 @@
+// Package models defines data structures for the application.
+package models
+
+// Change describes a committed change of memberships or segments that the instances are notified of,
+// so that they can drop the state derived from them, e.g. cached active segments.
+type Change struct {
+	Users []int `json:"users,omitempty"` // Users whose memberships changed.
+	// Slug of the changed segment (the old one for a rename); memberships of any user may have changed.
+	Segment string `json:"segment,omitempty"`
+	// Anything may have changed: set for imports and, locally, after the notifications may have been lost.
+	All bool `json:"all,omitempty"`
+}
@@ -0,0 +1,13 @@
+// Package models defines data structures for the application.
+package models
+
+import "time"
+
+// IdempotencyKey identifies a request that may be retried. A retry with the same key and payload
+// gets the stored response instead of repeating the change.
+type IdempotencyKey struct {
+	Owner       string        // Who sent the request; the keys of different callers do not collide.
+	Key         string        // Value of the Idempotency-Key header.
+	RequestHash []byte        // Hash of the payload; the same key with another payload is rejected.
+	TTL         time.Duration // How long the response is kept.
+}
@@ -0,0 +1,52 @@
+// Package models defines data structures for the application.
+package models
+
+import "time"
+
+// Statuses of a report job.
+const (
+	ReportPending = "pending" // The job is waiting for a worker.
+	ReportRunning = "running" // The report is being generated.
+	ReportDone    = "done"    // The report is ready for download.
+	ReportFailed  = "failed"  // The report could not be generated, see Error.
+)
+
+// Formats of the history report.
+const (
+	ReportCSV    = "csv"    // Delimiter-separated values, ";" by default.
+	ReportTSV    = "tsv"    // Tab-separated values.
+	ReportJSON   = "json"   // A JSON array of records.
+	ReportNDJSON = "ndjson" // A JSON record per line.
+)
+
+// HistoryParams describes the user segments history to report on.
+// The period is either From/To or, for compatibility, Year/Month of the time zone.
+type HistoryParams struct {
+	UserIDs  []int     `json:"user_ids,omitempty"` // Empty means all users.
+	UserID   int       `json:"user_id,omitempty"`  // A single user, merged into UserIDs.
+	From     time.Time `json:"from"`               // Inclusive.
+	To       time.Time `json:"to"`                 // Exclusive.
+	Year     int       `json:"year,omitempty"`
+	Month    int       `json:"month,omitempty"`
+	TimeZone string    `json:"tz,omitempty"`      // IANA time zone of the month and the report times, UTC by default.
+	Slugs    []string  `json:"slugs,omitempty"`   // Empty means all segments.
+	Actions  []string  `json:"actions,omitempty"` // Empty means all actions.
+	// Output of the report.
+	Format    string `json:"format,omitempty"`    // One of the report formats, csv by default.
+	Delimiter string `json:"delimiter,omitempty"` // Field delimiter of the csv format.
+}
+
+// ReportJob describes an asynchronous generation of a history report.
+type ReportJob struct {
+	ID          string        `json:"id"`
+	Status      string        `json:"status"` // "pending", "running", "done" или "failed"
+	Params      HistoryParams `json:"params"`
+	Error       string        `json:"error,omitempty"`
+	DownloadURL string        `json:"download_url,omitempty"` // Set when the report is done and not expired.
+	ExpiresAt   *time.Time    `json:"expires_at,omitempty"`   // The download link is valid until this time.
+	CreatedAt   time.Time     `json:"created_at"`
+	StartedAt   *time.Time    `json:"started_at,omitempty"`
+	FinishedAt  *time.Time    `json:"finished_at,omitempty"`
+	Token       string        `json:"-"` // Unguessable download token.
+	FileName    string        `json:"-"` // Name of the report file in the reports directory.
+}
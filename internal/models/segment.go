@@ -5,8 +5,56 @@ import "time"
 
 // Segment represents a user segment with metadata.
 type Segment struct {
-	ID          int       `json:"id,omitempty" db:"id"`
-	Slug        string    `json:"slug,omitempty" db:"slug"`
-	Description string    `json:"description,omitempty" db:"description"`
+	ID          int    `json:"id,omitempty" db:"id"`
+	Slug        string `json:"slug,omitempty" db:"slug"`
+	Description string `json:"description,omitempty" db:"description"`
+	// AutoPercent is the share of users (1-100) automatically enrolled in the segment, nil if disabled.
+	AutoPercent *int      `json:"auto_percent,omitempty" db:"auto_percent"`
 	CreatedAt   time.Time `json:"created_at,omitempty" db:"created_at"`
+	// Version is incremented on every change of the segment; it is the ETag of the segment.
+	Version int `json:"version,omitempty" db:"version"`
+	// ArchivedAt is the time the segment was archived (deleted), nil for active segments.
+	ArchivedAt *time.Time `json:"archived_at,omitempty" db:"archived_at"`
+	// Alias is set if the segment was found by a deprecated slug it had before a rename.
+	Alias *SegmentAlias `json:"deprecated_alias,omitempty" db:"-"`
+}
+
+// SegmentAlias is a former slug of a renamed segment that still resolves to it until ExpiresAt.
+type SegmentAlias struct {
+	Slug      string    `json:"slug"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// SegmentRename is a record of the audit trail of segment renames.
+type SegmentRename struct {
+	ID             int        `json:"id"`
+	OldSlug        string     `json:"old_slug"`
+	NewSlug        string     `json:"new_slug"`
+	AliasExpiresAt *time.Time `json:"alias_expires_at,omitempty"` // Nil if the old slug was not kept as an alias.
+	RenamedAt      time.Time  `json:"renamed_at"`
+}
+
+// SegmentMember describes a user in a segment.
+type SegmentMember struct {
+	UserID         int        `json:"user_id"`
+	UserName       string     `json:"user_name,omitempty"`
+	ExpirationTime *time.Time `json:"expiration_time,omitempty"`
+	JoinedAt       time.Time  `json:"joined_at"`
+	Expired        bool       `json:"expired,omitempty"` // The expiration time has passed, but the sweeper has not removed the user yet.
+}
+
+// SegmentStats describes the size and the growth of a segment.
+type SegmentStats struct {
+	Slug          string               `json:"slug"`
+	ActiveMembers int64                `json:"active_members"`
+	ExpiringSoon  int64                `json:"expiring_soon"` // Active members whose membership expires within the requested number of days.
+	Daily         []*DailySegmentStats `json:"daily"`
+}
+
+// DailySegmentStats describes the changes of a segment during a day.
+type DailySegmentStats struct {
+	Date    string `json:"date"` // YYYY-MM-DD in the requested time zone.
+	Added   int64  `json:"added"`
+	Removed int64  `json:"removed"`
+	Expired int64  `json:"expired"`
 }
@@ -8,4 +8,20 @@ type User struct {
 	ID        int       `json:"id,omitempty" db:"id"`
 	Name      string    `json:"name,omitempty" db:"name"`
 	CreatedAt time.Time `json:"created_at,omitempty" db:"created_at"`
+	Version   int       `json:"version,omitempty" db:"version"` // Incremented on every change, the ETag of the user.
+}
+
+// ErasureReceipt confirms that the personal data of a user has been erased.
+type ErasureReceipt struct {
+	ID               string    `json:"id"`
+	UserID           int       `json:"user_id"`
+	Pseudonym        string    `json:"pseudonym"`         // Name of the tombstone that replaced the user in the history.
+	MembershipsEnded int64     `json:"memberships_ended"` // Number of segment memberships ended by the erasure.
+	ErasedAt         time.Time `json:"erased_at"`
+}
+
+// Page is a page of a list with the cursor of the next page.
+type Page[T any] struct {
+	Items      []T    `json:"items"`
+	NextCursor string `json:"next_cursor,omitempty"` // Empty on the last page.
 }
@@ -10,3 +10,32 @@ type UserSegment struct {
 	ExpirationTime time.Time `json:"expiration_time" db:"expiration_time"`
 	CreatedAt      time.Time `json:"created_at" db:"created_at"`
 }
+
+// SegmentsUpdateResult describes the outcome of a user segments update for each requested slug.
+type SegmentsUpdateResult struct {
+	Added       []string `json:"added"`        // Segments the user was added to.
+	Extended    []string `json:"extended"`     // Segments the user already had, with the expiration time updated.
+	Removed     []string `json:"removed"`      // Segments the user was removed from.
+	Unknown     []string `json:"unknown"`      // Slugs of segments that do not exist.
+	NotAssigned []string `json:"not_assigned"` // Segments to remove that the user did not have.
+	// Deprecated aliases of renamed segments used in the request, with the current slugs.
+	DeprecatedSlugs map[string]string `json:"deprecated_slugs,omitempty"`
+	// Set if the result is the stored response to an earlier request with the same idempotency key.
+	Replayed bool `json:"-"`
+}
+
+// ImportRejection describes a row rejected during the import of user segments.
+type ImportRejection struct {
+	Line   int    `json:"line"`
+	Reason string `json:"reason"`
+}
+
+// ImportResult describes the outcome of the import of user segments.
+type ImportResult struct {
+	Inserted      int64             `json:"inserted"`      // New memberships.
+	Updated       int64             `json:"updated"`       // Existing memberships with the expiration time updated.
+	Rejected      int64             `json:"rejected"`      // Rows that were not imported.
+	UsersCreated  int64             `json:"users_created"` // Users created for unknown user IDs (if requested).
+	UsersEnrolled int64             `json:"-"`             // Memberships of the created users in segments with auto_percent.
+	Rejections    []ImportRejection `json:"rejections"`    // Reasons for the first rejected rows, ordered by line.
+}
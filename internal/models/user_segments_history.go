@@ -3,12 +3,43 @@ package models
 
 import "time"
 
+// Actions recorded in the user segments history.
+const (
+	ActionAdd    = "ADD"    // The user was added to the segment.
+	ActionRemove = "REMOVE" // The user was removed from the segment.
+	ActionExpire = "EXPIRE" // The membership expired (TTL) and was removed by the sweeper.
+)
+
+// Sources of the changes recorded in the user segments history.
+const (
+	SourceAPI            = "api"             // Default for changes made through the API.
+	SourceImport         = "import"          // Import of memberships from a file.
+	SourceAutoEnroll     = "auto_enroll"     // Automatic enrollment into segments with auto_percent.
+	SourceTTL            = "ttl"             // Removal of expired memberships by the sweeper.
+	SourceSegmentArchive = "segment_archive" // Archiving of a segment.
+	SourceUserErasure    = "user_erasure"    // Erasure of a user.
+)
+
+// ActorSystem is the actor of the changes made by the service itself.
+const ActorSystem = "system"
+
+// ChangeMeta describes who made a change of memberships, through what and why.
+// It is recorded with every history entry of the change; empty fields are stored as NULL.
+type ChangeMeta struct {
+	Actor  string `json:"actor,omitempty"`  // Who made the change: the API key or the person.
+	Source string `json:"source,omitempty"` // The service or channel the change came from.
+	Reason string `json:"reason,omitempty"` // Free-text reason of the change.
+}
+
 // UserSegmentHistory stores historical records of user-segment actions.
 type UserSegmentHistory struct {
 	ID        int       `json:"id" db:"id"`
 	UserID    int       `json:"user_id" db:"user_id"`
 	SegmentID int       `json:"segment_id" db:"segment_id"`
-	Action    string    `json:"action" db:"action"` // "ADD" или "REMOVE"
+	Action    string    `json:"action" db:"action"` // "ADD", "REMOVE" или "EXPIRE"
+	Actor     *string   `json:"actor,omitempty" db:"actor"`
+	Source    *string   `json:"source,omitempty" db:"source"`
+	Reason    *string   `json:"reason,omitempty" db:"reason"`
 	CreatedAt time.Time `json:"created_at" db:"created_at"`
 }
 
@@ -19,5 +50,8 @@ type HistoryRecord struct {
 	SegmentSlug        string    `json:"segment_slug"`
 	SegmentDescription string    `json:"segment_description,omitempty"`
 	Action             string    `json:"action"`
+	Actor              string    `json:"actor,omitempty"`
+	Source             string    `json:"source,omitempty"`
+	Reason             string    `json:"reason,omitempty"`
 	CreatedAt          time.Time `json:"created_at"`
 }
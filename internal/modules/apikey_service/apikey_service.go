@@ -0,0 +1,140 @@
+// Package apikey_service provides business logic for API keys: issuing, revoking and authenticating them.
+package apikey_service
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/jackc/pgx/v5"
+
+	"user_segmentation_service/internal/models"
+	"user_segmentation_service/internal/modules/service_errors"
+)
+
+// Config holds the settings of the API key authentication.
+type Config struct {
+	Enabled      bool   `envconfig:"ENABLED" default:"true"` // If false, every request is allowed with all scopes.
+	BootstrapKey string `envconfig:"BOOTSTRAP_KEY"`          // Key with the admin scope to create the first keys with.
+}
+
+// DB defines the required database operations for API keys.
+type DB interface {
+	CreateAPIKey(ctx context.Context, key *models.APIKey, hash []byte) error
+	GetAPIKeyByHash(ctx context.Context, hash []byte) (*models.APIKey, error)
+	GetAllAPIKeys(ctx context.Context) ([]*models.APIKey, error)
+	RevokeAPIKey(ctx context.Context, id int) (*models.APIKey, error)
+}
+
+// ErrInvalidKey is returned by Authenticate if the key is missing, unknown or revoked.
+var ErrInvalidKey = errors.New("invalid API key")
+
+// entity is the name of the managed entity in domain errors.
+const entity = "api_key"
+
+// Format of the issued keys: keyPrefix followed by keyBytes random bytes in base64url.
+const (
+	keyPrefix     = "uss_"
+	keyBytes      = 32
+	displayPrefix = len(keyPrefix) + 8 // Length of the beginning of the key kept to recognise it.
+	// The name with the prefix is the actor of the changes made with the key, which is at most 150 characters.
+	maxNameLength = 100
+)
+
+// APIKeyService handles operations related to API keys.
+type APIKeyService struct {
+	store     DB
+	cfg       Config
+	bootstrap *models.APIKey
+	anonymous *models.APIKey // Key of all requests if authentication is disabled, identifies no one.
+}
+
+// NewAPIKeyService creates a new instance of APIKeyService.
+func NewAPIKeyService(store DB, cfg Config) *APIKeyService {
+	return &APIKeyService{
+		store: store,
+		cfg:   cfg,
+		bootstrap: &models.APIKey{
+			Name:   "bootstrap",
+			Prefix: "bootstrap",
+			Scopes: []string{models.ScopeAdmin},
+		},
+		anonymous: &models.APIKey{Scopes: []string{models.ScopeAdmin}},
+	}
+}
+
+// Create issues a new API key with the given scopes. The key itself is returned only this once,
+// only its SHA-256 hash is stored.
+func (s *APIKeyService) Create(ctx context.Context, key *models.APIKey) error {
+	if n := utf8.RuneCountInString(key.Name); n == 0 || n > maxNameLength {
+		return service_errors.Validation("invalid_name", fmt.Sprintf("name must be 1-%d characters long", maxNameLength))
+	}
+	if len(key.Scopes) == 0 {
+		return service_errors.Validation("invalid_scopes", "at least one scope is required")
+	}
+	for _, scope := range key.Scopes {
+		if !slices.Contains(models.Scopes, scope) {
+			return service_errors.Validation("invalid_scopes",
+				fmt.Sprintf("unknown scope %q, expected one of %s", scope, strings.Join(models.Scopes, ", ")))
+		}
+	}
+	slices.Sort(key.Scopes)
+	key.Scopes = slices.Compact(key.Scopes)
+
+	secret := make([]byte, keyBytes)
+	if _, err := rand.Read(secret); err != nil {
+		return err
+	}
+	key.Key = keyPrefix + base64.RawURLEncoding.EncodeToString(secret)
+	key.Prefix = key.Key[:displayPrefix]
+	key.RevokedAt = nil
+	return service_errors.FromDB(s.store.CreateAPIKey(ctx, key, hashKey(key.Key)), entity)
+}
+
+// GetAll returns all API keys, including the revoked ones, without the keys themselves.
+func (s *APIKeyService) GetAll(ctx context.Context) ([]*models.APIKey, error) {
+	keys, err := s.store.GetAllAPIKeys(ctx)
+	return keys, service_errors.FromDB(err, entity)
+}
+
+// Revoke revokes the API key by id, the key stops authenticating at once.
+func (s *APIKeyService) Revoke(ctx context.Context, id int) (*models.APIKey, error) {
+	key, err := s.store.RevokeAPIKey(ctx, id)
+	return key, service_errors.FromDB(err, entity)
+}
+
+// Authenticate returns the active API key matching the raw key, or the bootstrap key from the configuration.
+// Returns ErrInvalidKey if the key is missing, unknown or revoked. If authentication is disabled,
+// every request is authenticated with an anonymous key with the admin scope.
+func (s *APIKeyService) Authenticate(ctx context.Context, raw string) (*models.APIKey, error) {
+	if !s.cfg.Enabled {
+		return s.anonymous, nil
+	}
+	if raw == "" {
+		return nil, ErrInvalidKey
+	}
+	if s.cfg.BootstrapKey != "" && subtle.ConstantTimeCompare([]byte(raw), []byte(s.cfg.BootstrapKey)) == 1 {
+		return s.bootstrap, nil
+	}
+	if !strings.HasPrefix(raw, keyPrefix) {
+		return nil, ErrInvalidKey
+	}
+	key, err := s.store.GetAPIKeyByHash(ctx, hashKey(raw))
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, ErrInvalidKey
+	}
+	return key, err
+}
+
+// hashKey returns the SHA-256 hash of the key. The keys are random, so a fast hash is enough.
+func hashKey(key string) []byte {
+	sum := sha256.Sum256([]byte(key))
+	return sum[:]
+}
@@ -0,0 +1,113 @@
+// Package change_listener provides a background worker that receives the notifications about changes
+// of memberships and segments made by any instance and fans them out to the subscribers.
+package change_listener
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"time"
+
+	"user_segmentation_service/internal/models"
+)
+
+// Config - configuration for the listener.
+type Config struct {
+	Enabled          bool          `envconfig:"ENABLED" default:"true"`
+	RetryInterval    time.Duration `envconfig:"RETRY_INTERVAL" default:"1s"`      // First delay before reconnecting.
+	MaxRetryInterval time.Duration `envconfig:"MAX_RETRY_INTERVAL" default:"30s"` // The delay doubles up to this value.
+}
+
+// DB defines the required database operations for listening to the changes.
+type DB interface {
+	ListenChanges(ctx context.Context, listening func(), fn func(models.Change)) error
+}
+
+// Listener holds the LISTEN connection and passes every change to the subscribers.
+// Whenever the connection starts listening, including after it was lost, the subscribers get
+// a change with All set, since the notifications sent in between are lost.
+type Listener struct {
+	store DB
+	cfg   Config
+	mu    sync.RWMutex
+	subs  []func(models.Change)
+	done  chan struct{}
+}
+
+// New creates a new instance of Listener.
+func New(store DB, cfg Config) *Listener {
+	return &Listener{
+		store: store,
+		cfg:   cfg,
+		done:  make(chan struct{}),
+	}
+}
+
+// Subscribe adds a subscriber to the changes. The subscribers are called one by one
+// from the goroutine of the listener, so they must not block.
+func (l *Listener) Subscribe(fn func(models.Change)) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.subs = append(l.subs, fn)
+}
+
+// Run listens to the changes until the context is cancelled, reconnecting after failures.
+// Without subscribers it returns at once, so that no connection is held for nothing.
+// It blocks, so it is usually started in a separate goroutine.
+func (l *Listener) Run(ctx context.Context) {
+	const fn = "change_listener.Run"
+
+	defer close(l.done)
+	l.mu.RLock()
+	subscribers := len(l.subs)
+	l.mu.RUnlock()
+	if !l.cfg.Enabled || subscribers == 0 {
+		slog.Info("Change listener is disabled", "subscribers", subscribers)
+		return
+	}
+	if l.cfg.RetryInterval <= 0 {
+		l.cfg.RetryInterval = time.Second
+	}
+	l.cfg.MaxRetryInterval = max(l.cfg.MaxRetryInterval, l.cfg.RetryInterval)
+
+	slog.Info("Change listener started", "subscribers", subscribers)
+	retry := l.cfg.RetryInterval
+	reconnecting := false
+	for {
+		err := l.store.ListenChanges(ctx, func() {
+			if reconnecting {
+				slog.Info("Change listener reconnected, resynchronizing")
+			}
+			l.publish(models.Change{All: true})
+			retry = l.cfg.RetryInterval
+		}, l.publish)
+		if ctx.Err() != nil {
+			slog.Info("Change listener stopped")
+			return
+		}
+		slog.Error(fn, "err", err, "retry_in", retry)
+		reconnecting = true
+
+		select {
+		case <-ctx.Done():
+			slog.Info("Change listener stopped")
+			return
+		case <-time.After(retry):
+		}
+		retry = min(2*retry, l.cfg.MaxRetryInterval)
+	}
+}
+
+// Done returns a channel that is closed when Run returns.
+func (l *Listener) Done() <-chan struct{} {
+	return l.done
+}
+
+// publish passes the change to every subscriber.
+func (l *Listener) publish(change models.Change) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	for _, fn := range l.subs {
+		fn(change)
+	}
+}
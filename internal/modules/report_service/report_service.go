@@ -0,0 +1,350 @@
+// Package report_service provides asynchronous generation of the user segments history reports.
+package report_service
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+
+	"user_segmentation_service/internal/metrics"
+	"user_segmentation_service/internal/models"
+	"user_segmentation_service/internal/modules/service_errors"
+)
+
+// Config - configuration for the report jobs.
+type Config struct {
+	Dir             string        `envconfig:"DIR" default:"reports"`         // Directory of the report files.
+	Workers         int           `envconfig:"WORKERS" default:"2"`           // Number of jobs generated at the same time.
+	PollInterval    time.Duration `envconfig:"POLL_INTERVAL" default:"5s"`    // How often the workers look for jobs created by other instances.
+	JobTimeout      time.Duration `envconfig:"JOB_TIMEOUT" default:"10m"`     // Maximum time of generating a report.
+	TokenTTL        time.Duration `envconfig:"TOKEN_TTL" default:"24h"`       // How long the download link is valid.
+	Retention       time.Duration `envconfig:"RETENTION" default:"168h"`      // How long finished jobs and their files are kept.
+	CleanupInterval time.Duration `envconfig:"CLEANUP_INTERVAL" default:"1h"` // How often old reports are deleted.
+	WaitTimeout     time.Duration `envconfig:"WAIT_TIMEOUT" default:"5s"`     // How long the synchronous history request waits for the report.
+}
+
+// DB defines the required database operations for report jobs.
+type DB interface {
+	CreateReportJob(ctx context.Context, params models.HistoryParams) (*models.ReportJob, error)
+	GetReportJob(ctx context.Context, id string) (*models.ReportJob, error)
+	GetReportJobByToken(ctx context.Context, token string) (*models.ReportJob, error)
+	ClaimReportJob(ctx context.Context) (*models.ReportJob, error)
+	FinishReportJob(ctx context.Context, id, fileName, token string, tokenTTL time.Duration) error
+	FailReportJob(ctx context.Context, id, reason string) error
+	FailStaleReportJobs(ctx context.Context, timeout time.Duration) (int64, error)
+	DeleteOldReportJobs(ctx context.Context, retention time.Duration) ([]string, error)
+}
+
+// HistoryWriter generates the content of the history report.
+type HistoryWriter interface {
+	ValidateHistory(p *models.HistoryParams) error
+	WriteHistory(ctx context.Context, w io.Writer, p models.HistoryParams) error
+}
+
+// entity is the name of the managed entity, used in domain errors.
+const entity = "report"
+
+// failTimeout limits marking a job as failed, which runs on its own context,
+// because the job may have failed exactly because JobTimeout expired.
+const failTimeout = 10 * time.Second
+
+// waitPollInterval is how often Wait checks the status of the job.
+const waitPollInterval = 200 * time.Millisecond
+
+// jobIDPattern - format of the job ID (UUID), other IDs are reported as not found without querying the database.
+var jobIDPattern = regexp.MustCompile(`^[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}$`)
+
+// ReportService creates report jobs and runs the workers that generate the reports.
+type ReportService struct {
+	store   DB
+	history HistoryWriter
+	cfg     Config
+	wake    chan struct{} // Wakes up a worker when a job is created by this instance.
+	done    chan struct{}
+}
+
+// NewReportService creates a new instance of ReportService.
+func NewReportService(store DB, history HistoryWriter, cfg Config) *ReportService {
+	return &ReportService{
+		store:   store,
+		history: history,
+		cfg:     cfg,
+		wake:    make(chan struct{}, 1),
+		done:    make(chan struct{}),
+	}
+}
+
+// Create validates the parameters and creates a pending report job.
+func (s *ReportService) Create(ctx context.Context, p models.HistoryParams) (*models.ReportJob, error) {
+	if err := s.history.ValidateHistory(&p); err != nil {
+		return nil, err
+	}
+	job, err := s.store.CreateReportJob(ctx, p)
+	if err != nil {
+		return nil, err
+	}
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+	return job, nil
+}
+
+// Get returns the report job by ID.
+func (s *ReportService) Get(ctx context.Context, id string) (*models.ReportJob, error) {
+	if !jobIDPattern.MatchString(id) {
+		return nil, service_errors.NotFound(entity+"_not_found", entity+" not found")
+	}
+	job, err := s.store.GetReportJob(ctx, id)
+	if err != nil {
+		return nil, service_errors.FromDB(err, entity)
+	}
+	return job, nil
+}
+
+// Wait waits until the job is finished or the context is done, and returns the last known state of the job.
+func (s *ReportService) Wait(ctx context.Context, id string) (*models.ReportJob, error) {
+	ticker := time.NewTicker(waitPollInterval)
+	defer ticker.Stop()
+	for {
+		job, err := s.Get(ctx, id)
+		if err != nil {
+			return nil, err
+		}
+		if job.Status == models.ReportDone || job.Status == models.ReportFailed {
+			return job, nil
+		}
+		select {
+		case <-ctx.Done():
+			return job, nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// Generate creates a report job and waits for it at most WaitTimeout.
+// The job may still be pending or running when it is returned.
+func (s *ReportService) Generate(ctx context.Context, p models.HistoryParams) (*models.ReportJob, error) {
+	job, err := s.Create(ctx, p)
+	if err != nil {
+		return nil, err
+	}
+	waitCtx, cancel := context.WithTimeout(ctx, s.cfg.WaitTimeout)
+	defer cancel()
+	return s.Wait(waitCtx, job.ID)
+}
+
+// Validate checks the parameters of the report and brings them to the canonical form.
+func (s *ReportService) Validate(p *models.HistoryParams) error {
+	return s.history.ValidateHistory(p)
+}
+
+// Stream writes the report straight to w without creating a job.
+func (s *ReportService) Stream(ctx context.Context, w io.Writer, p models.HistoryParams) error {
+	return s.history.WriteHistory(ctx, w, p)
+}
+
+// Open returns the finished report by its download token. The caller must close the file.
+func (s *ReportService) Open(ctx context.Context, token string) (*os.File, *models.ReportJob, error) {
+	job, err := s.store.GetReportJobByToken(ctx, token)
+	if err != nil {
+		return nil, nil, service_errors.FromDB(err, entity)
+	}
+	file, err := os.Open(s.path(job.FileName))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil, service_errors.NotFound(entity+"_not_found", entity+" not found")
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	return file, job, nil
+}
+
+// Run starts the workers and the cleanup of old reports and blocks until the context is cancelled
+// and the jobs in progress are finished.
+func (s *ReportService) Run(ctx context.Context) {
+	defer close(s.done)
+	if err := os.MkdirAll(s.cfg.Dir, 0750); err != nil {
+		slog.Error("report_service.Run", "err", err)
+		return
+	}
+
+	if s.cfg.PollInterval <= 0 {
+		s.cfg.PollInterval = time.Second
+	}
+	slog.Info("Report workers started", "workers", s.cfg.Workers, "dir", s.cfg.Dir)
+	var wg sync.WaitGroup
+	for range max(s.cfg.Workers, 1) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.work(ctx)
+		}()
+	}
+	s.cleanupLoop(ctx)
+	wg.Wait()
+	slog.Info("Report workers stopped")
+}
+
+// Done returns a channel that is closed when Run returns.
+func (s *ReportService) Done() <-chan struct{} {
+	return s.done
+}
+
+// work generates the reports one by one until the context is cancelled.
+func (s *ReportService) work(ctx context.Context) {
+	const fn = "report_service.work"
+
+	ticker := time.NewTicker(s.cfg.PollInterval)
+	defer ticker.Stop()
+	for ctx.Err() == nil {
+		job, err := s.store.ClaimReportJob(ctx)
+		if err == nil {
+			s.process(ctx, job)
+			continue
+		}
+		if !errors.Is(err, pgx.ErrNoRows) && ctx.Err() == nil {
+			slog.Error(fn, "err", err)
+		}
+		select {
+		case <-ctx.Done():
+		case <-s.wake:
+		case <-ticker.C:
+		}
+	}
+}
+
+// process generates the report of the claimed job into a file and marks the job as done or failed.
+func (s *ReportService) process(ctx context.Context, job *models.ReportJob) {
+	const fn = "report_service.process"
+
+	// The job in progress is finished even if the application is stopping, but no longer than JobTimeout.
+	jobCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), s.cfg.JobTimeout)
+	defer cancel()
+
+	started := time.Now()
+	format := job.Params.Format
+	if format == "" {
+		format = models.ReportCSV
+	}
+	fileName := job.ID + "." + format
+	err := s.writeFile(jobCtx, fileName, job.Params)
+	if err == nil {
+		var token string
+		if token, err = newToken(); err == nil {
+			err = s.store.FinishReportJob(jobCtx, job.ID, fileName, token, s.cfg.TokenTTL)
+		}
+	}
+	if errors.Is(err, pgx.ErrNoRows) {
+		// The job was failed as stale while the report was generated: nobody can download the file.
+		slog.Warn(fn, "job", job.ID, "reason", "the job is no longer running")
+		_ = os.Remove(s.path(fileName))
+		return
+	}
+	if err != nil {
+		metrics.ObserveReport(format, models.ReportFailed, time.Since(started))
+		slog.Error(fn, "job", job.ID, "err", err)
+		_ = os.Remove(s.path(fileName))
+		failCtx, cancelFail := context.WithTimeout(context.WithoutCancel(ctx), failTimeout)
+		defer cancelFail()
+		if err = s.store.FailReportJob(failCtx, job.ID, err.Error()); err != nil {
+			slog.Error(fn, "job", job.ID, "err", err)
+		}
+		return
+	}
+	metrics.ObserveReport(format, models.ReportDone, time.Since(started))
+	slog.Info(fn, "job", job.ID, "duration", time.Since(started))
+}
+
+// writeFile writes the report to a temporary file and renames it, so that a partial report is never served.
+func (s *ReportService) writeFile(ctx context.Context, fileName string, p models.HistoryParams) error {
+	file, err := os.CreateTemp(s.cfg.Dir, fileName+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = file.Close()
+		_ = os.Remove(file.Name())
+	}()
+
+	if err = s.history.WriteHistory(ctx, file, p); err != nil {
+		return err
+	}
+	if err = file.Close(); err != nil {
+		return err
+	}
+	return os.Rename(file.Name(), s.path(fileName))
+}
+
+// cleanupLoop deletes old reports and fails stale jobs every CleanupInterval until the context is cancelled.
+func (s *ReportService) cleanupLoop(ctx context.Context) {
+	if s.cfg.CleanupInterval <= 0 {
+		<-ctx.Done()
+		return
+	}
+	ticker := time.NewTicker(s.cfg.CleanupInterval)
+	defer ticker.Stop()
+	for {
+		s.cleanup(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// cleanup fails the jobs that have been running for too long (e.g. the instance crashed)
+// and deletes the jobs and files older than the retention period.
+func (s *ReportService) cleanup(ctx context.Context) {
+	const fn = "report_service.cleanup"
+
+	// Twice the timeout, so that a job that is about to finish is not failed.
+	stale, err := s.store.FailStaleReportJobs(ctx, 2*s.cfg.JobTimeout)
+	if err != nil {
+		if ctx.Err() == nil {
+			slog.Error(fn, "err", err)
+		}
+		return
+	}
+	files, err := s.store.DeleteOldReportJobs(ctx, s.cfg.Retention)
+	if err != nil {
+		if ctx.Err() == nil {
+			slog.Error(fn, "err", err)
+		}
+		return
+	}
+	for _, name := range files {
+		if err = os.Remove(s.path(name)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			slog.Error(fn, "file", name, "err", err)
+		}
+	}
+	if stale > 0 || len(files) > 0 {
+		slog.Info(fn, "stale", stale, "deleted", len(files))
+	}
+}
+
+// path returns the path of the report file; the name is generated by the service, never taken from the client.
+func (s *ReportService) path(fileName string) string {
+	return filepath.Join(s.cfg.Dir, filepath.Base(fileName))
+}
+
+// newToken generates an unguessable download token.
+func newToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("generate token: %w", err)
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
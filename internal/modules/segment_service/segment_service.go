@@ -3,50 +3,258 @@ package segment_service
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"time"
 
+	"user_segmentation_service/internal/db"
+	"user_segmentation_service/internal/metrics"
 	"user_segmentation_service/internal/models"
+	"user_segmentation_service/internal/modules/service_errors"
 )
 
 // DB defines the required database operations for segment management.
 type DB interface {
-	CreateSegment(ctx context.Context, seg *models.Segment) error
-	DeleteSegment(ctx context.Context, slug string) error
-	UpdateSegment(ctx context.Context, seg *models.Segment) error
+	CreateSegment(ctx context.Context, seg *models.Segment) (int64, error)
+	ArchiveSegment(ctx context.Context, slug string, ifMatch []int, meta models.ChangeMeta) (int64, error)
+	RestoreSegment(ctx context.Context, slug string) (*models.Segment, int64, error)
+	PurgeSegment(ctx context.Context, slug string) error
+	UpdateSegment(ctx context.Context, seg *models.Segment, ifMatch []int) error
 	GetSegmentBySlug(ctx context.Context, slug string) (*models.Segment, error)
-	GetAllSegments(ctx context.Context) ([]*models.Segment, error)
+	GetAllSegments(ctx context.Context, archived bool, p db.ListParams) (*models.Page[*models.Segment], error)
+	GetAllSegmentsViaCopy(ctx context.Context, w io.Writer) error
+	GetSegmentMembers(ctx context.Context, slug string, includeExpired bool, p db.ListParams) (*models.Page[*models.SegmentMember], error)
+	CountSegmentMembers(ctx context.Context, slug string, includeExpired bool) (int64, error)
+	GetSegmentStats(ctx context.Context, slug string, p db.StatsParams) ([]*models.SegmentStats, error)
+	RenameSegment(ctx context.Context, slug, newSlug string, aliasTTL time.Duration) (*models.SegmentRename, error)
+	GetSegmentRenames(ctx context.Context, slug string) ([]*models.SegmentRename, error)
+}
+
+// Config holds the settings of the segment service.
+type Config struct {
+	AliasTTL time.Duration `envconfig:"ALIAS_TTL" default:"720h"` // How long the old slug of a renamed segment resolves to it, 0 to drop it at once.
+}
+
+// entity is the name of the managed entity in domain errors.
+const entity = "segment"
+
+// slugPattern describes a valid slug: latin letters, digits, '_' and '-', up to 255 characters,
+// starting with a letter or digit (e.g. AVITO_VOICE_MESSAGES).
+var slugPattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_-]{0,254}$`)
+
+// reservedSlugs cannot be used as slugs, because they clash with the fixed routes under /segments/.
+var reservedSlugs = map[string]struct{}{
+	"export": {},
+	"stats":  {},
 }
 
 // SegmentService handles operations related to user segments.
 type SegmentService struct {
 	store DB
+	cfg   Config
 }
 
 // NewSegmentService creates a new instance of SegmentService.
-func NewSegmentService(store DB) *SegmentService {
-	return &SegmentService{store: store}
+func NewSegmentService(store DB, cfg Config) *SegmentService {
+	return &SegmentService{store: store, cfg: cfg}
 }
 
-// Create adds a new segment to the database.
+// Create adds a new segment to the database. The slugs of archived segments stay taken until they are purged.
+// If AutoPercent is set, that share of users is enrolled in the segment automatically.
 func (s *SegmentService) Create(ctx context.Context, seg *models.Segment) error {
-	return s.store.CreateSegment(ctx, seg)
+	if err := validateSlug(seg.Slug); err != nil {
+		return err
+	}
+	if seg.AutoPercent != nil && (*seg.AutoPercent < 1 || *seg.AutoPercent > 100) {
+		return service_errors.Validation("invalid_auto_percent", "auto_percent must be between 1 and 100")
+	}
+	enrolled, err := s.store.CreateSegment(ctx, seg)
+	if err != nil {
+		return fromStateError(err)
+	}
+	metrics.CountMemberships(models.ActionAdd, models.SourceAutoEnroll, enrolled)
+	return nil
+}
+
+// Delete archives a segment by its slug: its memberships are ended and recorded in the history,
+// the segment disappears from the active lookups, but its history stays reportable.
+// If ifMatch is not nil, the segment is archived only if its version is in the list.
+// The ended memberships are recorded in the history with the actor and reason from meta.
+func (s *SegmentService) Delete(ctx context.Context, slug string, ifMatch []int, meta models.ChangeMeta) error {
+	meta.Source = models.SourceSegmentArchive
+	ended, err := s.store.ArchiveSegment(ctx, slug, ifMatch, meta)
+	if err != nil {
+		return fromStateError(err)
+	}
+	metrics.CountMemberships(models.ActionRemove, meta.Source, ended)
+	return nil
 }
 
-// Delete removes a segment by its slug.
-func (s *SegmentService) Delete(ctx context.Context, slug string) error {
-	return s.store.DeleteSegment(ctx, slug)
+// Restore makes an archived segment active again and returns it.
+func (s *SegmentService) Restore(ctx context.Context, slug string) (*models.Segment, error) {
+	seg, enrolled, err := s.store.RestoreSegment(ctx, slug)
+	if err != nil {
+		return nil, fromStateError(err)
+	}
+	metrics.CountMemberships(models.ActionAdd, models.SourceAutoEnroll, enrolled)
+	return seg, nil
 }
 
-// Update modifies an existing segment.
-func (s *SegmentService) Update(ctx context.Context, seg *models.Segment) error {
-	return s.store.UpdateSegment(ctx, seg)
+// Purge irreversibly deletes an archived segment together with its history.
+func (s *SegmentService) Purge(ctx context.Context, slug string) error {
+	return fromStateError(s.store.PurgeSegment(ctx, slug))
 }
 
-// GetBySlug retrieves a segment by its slug.
+// fromStateError translates the errors of the segment state and of the slug into domain errors.
+func fromStateError(err error) error {
+	switch {
+	case errors.Is(err, db.ErrSegmentArchived):
+		svcErr := service_errors.Conflict("segment_archived", "segment is already archived")
+		svcErr.Err = err
+		return svcErr
+	case errors.Is(err, db.ErrSegmentNotArchived):
+		svcErr := service_errors.Conflict("segment_not_archived", "segment is not archived, delete it first")
+		svcErr.Err = err
+		return svcErr
+	case errors.Is(err, db.ErrSlugAliased):
+		svcErr := service_errors.Conflict("slug_aliased", "slug is still an alias of a renamed segment")
+		svcErr.Err = err
+		return svcErr
+	}
+	return service_errors.FromDB(err, entity)
+}
+
+// Update modifies an existing segment. If ifMatch is not nil, the segment is updated only if its version is in the list.
+func (s *SegmentService) Update(ctx context.Context, seg *models.Segment, ifMatch []int) error {
+	return service_errors.FromDB(s.store.UpdateSegment(ctx, seg, ifMatch), entity)
+}
+
+// Rename changes the slug of a segment. The old slug resolves to the segment as a deprecated alias
+// for the configured period; the rename is recorded in the audit trail.
+func (s *SegmentService) Rename(ctx context.Context, slug, newSlug string) (*models.SegmentRename, error) {
+	if err := validateSlug(newSlug); err != nil {
+		return nil, err
+	}
+	if newSlug == slug {
+		return nil, service_errors.Validation("same_slug", "the new slug must differ from the current one")
+	}
+	rename, err := s.store.RenameSegment(ctx, slug, newSlug, s.cfg.AliasTTL)
+	return rename, fromStateError(err)
+}
+
+// Renames returns the audit trail of the renames of a segment, oldest first.
+func (s *SegmentService) Renames(ctx context.Context, slug string) ([]*models.SegmentRename, error) {
+	renames, err := s.store.GetSegmentRenames(ctx, slug)
+	return renames, service_errors.FromDB(err, entity)
+}
+
+// GetBySlug retrieves a segment by its slug or by a deprecated alias, in which case Alias is set.
 func (s *SegmentService) GetBySlug(ctx context.Context, slug string) (*models.Segment, error) {
-	return s.store.GetSegmentBySlug(ctx, slug)
+	seg, err := s.store.GetSegmentBySlug(ctx, slug)
+	return seg, service_errors.FromDB(err, entity)
+}
+
+// GetAll returns a page of active segments or, if archived is set, of archived ones,
+// filtered by slug prefix and creation time, sorted by the given key.
+func (s *SegmentService) GetAll(ctx context.Context, archived bool, p db.ListParams) (*models.Page[*models.Segment], error) {
+	page, err := s.store.GetAllSegments(ctx, archived, p)
+	return page, service_errors.FromDB(err, entity)
+}
+
+// Export streams all segments to w as NDJSON.
+func (s *SegmentService) Export(ctx context.Context, w io.Writer) error {
+	return s.store.GetAllSegmentsViaCopy(ctx, w)
+}
+
+// GetMembers returns a page of users in the segment filtered by name prefix and join time, sorted by the given key.
+// Users whose membership has expired are included only if includeExpired is set.
+func (s *SegmentService) GetMembers(ctx context.Context, slug string, includeExpired bool,
+	p db.ListParams) (*models.Page[*models.SegmentMember], error) {
+	page, err := s.store.GetSegmentMembers(ctx, slug, includeExpired, p)
+	return page, service_errors.FromDB(err, entity)
+}
+
+// CountMembers returns the number of users in the segment.
+// Users whose membership has expired are counted only if includeExpired is set.
+func (s *SegmentService) CountMembers(ctx context.Context, slug string, includeExpired bool) (int64, error) {
+	count, err := s.store.CountSegmentMembers(ctx, slug, includeExpired)
+	return count, service_errors.FromDB(err, entity)
+}
+
+// Limits of the segment statistics.
+const (
+	defaultStatsDays    = 30  // Length of the period if From is not set.
+	maxStatsDays        = 366 // Maximum length of the period.
+	defaultExpiringDays = 7   // Horizon of the members expiring soon if not set.
+)
+
+// Stats returns the statistics of the segment: its size, the members expiring soon and the daily changes.
+func (s *SegmentService) Stats(ctx context.Context, slug string, p db.StatsParams) (*models.SegmentStats, error) {
+	if err := validateStatsParams(&p); err != nil {
+		return nil, err
+	}
+	stats, err := s.store.GetSegmentStats(ctx, slug, p)
+	if err != nil {
+		return nil, service_errors.FromDB(err, entity)
+	}
+	return stats[0], nil
+}
+
+// AllStats returns the statistics of all segments ordered by slug.
+func (s *SegmentService) AllStats(ctx context.Context, p db.StatsParams) ([]*models.SegmentStats, error) {
+	if err := validateStatsParams(&p); err != nil {
+		return nil, err
+	}
+	stats, err := s.store.GetSegmentStats(ctx, "", p)
+	return stats, service_errors.FromDB(err, entity)
+}
+
+// validateStatsParams checks the period of the statistics and applies the defaults:
+// the time zone is UTC, the period is the last 30 days including today, the horizon is 7 days.
+func validateStatsParams(p *db.StatsParams) error {
+	if p.TimeZone == "" {
+		p.TimeZone = "UTC"
+	}
+	loc, err := time.LoadLocation(p.TimeZone)
+	if err != nil || p.TimeZone == "Local" {
+		return service_errors.Validation("invalid_time_zone", fmt.Sprintf("unknown time zone %q", p.TimeZone))
+	}
+
+	if p.To.IsZero() {
+		p.To = time.Now().In(loc)
+	}
+	to := time.Date(p.To.Year(), p.To.Month(), p.To.Day(), 0, 0, 0, 0, time.UTC)
+	if p.From.IsZero() {
+		p.From = to.AddDate(0, 0, 1-defaultStatsDays)
+	}
+	from := time.Date(p.From.Year(), p.From.Month(), p.From.Day(), 0, 0, 0, 0, time.UTC)
+	switch days := int(to.Sub(from).Hours()/24) + 1; {
+	case days < 1:
+		return service_errors.Validation("invalid_period", "from must not be after to")
+	case days > maxStatsDays:
+		return service_errors.Validation("invalid_period", fmt.Sprintf("the period must not exceed %d days", maxStatsDays))
+	}
+	p.From, p.To = from, to
+
+	switch {
+	case p.ExpiringWithin == 0:
+		p.ExpiringWithin = defaultExpiringDays * 24 * time.Hour
+	case p.ExpiringWithin < 0:
+		return service_errors.Validation("invalid_expiring_within", "expiring_within_days must not be negative")
+	}
+	return nil
 }
 
-// GetAll returns all segments from the database.
-func (s *SegmentService) GetAll(ctx context.Context) ([]*models.Segment, error) {
-	return s.store.GetAllSegments(ctx)
+// validateSlug checks the format of the slug and that it is not reserved.
+func validateSlug(slug string) error {
+	if !slugPattern.MatchString(slug) {
+		return service_errors.Validation("invalid_slug",
+			"slug must be 1-255 characters long and contain only latin letters, digits, '_' and '-'")
+	}
+	if _, ok := reservedSlugs[slug]; ok {
+		return service_errors.Validation("reserved_slug", "slug "+slug+" is reserved")
+	}
+	return nil
 }
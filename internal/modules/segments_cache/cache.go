@@ -0,0 +1,142 @@
+// Package segments_cache provides an in-process cache of the active segments of users.
+package segments_cache
+
+import (
+	"container/list"
+	"sync"
+	"time"
+
+	"user_segmentation_service/internal/models"
+)
+
+// Config - configuration for the cache of active user segments.
+type Config struct {
+	Enabled bool          `envconfig:"ENABLED" default:"false"`
+	Size    int           `envconfig:"SIZE" default:"10000"` // Maximum number of users whose segments are cached.
+	TTL     time.Duration `envconfig:"TTL" default:"30s"`    // How long a cached list is used at most.
+}
+
+// entry is the cached list of the active segments of a user.
+type entry struct {
+	userID    int
+	segments  []*models.Segment
+	expiresAt time.Time // The earlier of the TTL and the first expiration of a membership.
+}
+
+// Cache is a bounded LRU cache of the active segments of users.
+// Every invalidation increments the generation, and a list read from the database is stored only
+// if the generation has not changed since the lookup, so that a list read before a change
+// but stored after its invalidation is never used.
+type Cache struct {
+	mu      sync.Mutex
+	size    int
+	ttl     time.Duration
+	order   *list.List // Entries from the most to the least recently used.
+	entries map[int]*list.Element
+	gen     uint64
+	now     func() time.Time // The clock, replaced in tests.
+}
+
+// NewCache creates a new cache holding at most size users for at most ttl.
+func NewCache(size int, ttl time.Duration) *Cache {
+	return &Cache{
+		size:    size,
+		ttl:     ttl,
+		order:   list.New(),
+		entries: make(map[int]*list.Element, size),
+		now:     time.Now,
+	}
+}
+
+// Get returns the cached active segments of the user. On a miss it returns the generation
+// to be passed to Set with the list read from the database.
+// The returned segments are shared and must not be modified.
+func (c *Cache) Get(userID int) ([]*models.Segment, uint64, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	elem, ok := c.entries[userID]
+	if !ok {
+		return nil, c.gen, false
+	}
+	e := elem.Value.(*entry)
+	if !c.now().Before(e.expiresAt) {
+		c.remove(elem)
+		return nil, c.gen, false
+	}
+	c.order.MoveToFront(elem)
+	return e.segments, 0, true
+}
+
+// Set caches the active segments of the user read after the lookup of generation gen.
+// expiresAt is the earliest expiration time of the memberships (zero if there are none):
+// the entry is dropped before any of the segments expires.
+func (c *Cache) Set(userID int, gen uint64, segments []*models.Segment, expiresAt time.Time) {
+	deadline := c.now().Add(c.ttl)
+	if !expiresAt.IsZero() && expiresAt.Before(deadline) {
+		deadline = expiresAt
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if gen != c.gen || c.size <= 0 {
+		return
+	}
+	if elem, ok := c.entries[userID]; ok {
+		e := elem.Value.(*entry)
+		e.segments, e.expiresAt = segments, deadline
+		c.order.MoveToFront(elem)
+		return
+	}
+	c.entries[userID] = c.order.PushFront(&entry{userID: userID, segments: segments, expiresAt: deadline})
+	for c.order.Len() > c.size {
+		c.remove(c.order.Back())
+	}
+}
+
+// InvalidateUsers drops the cached segments of the users.
+func (c *Cache) InvalidateUsers(userIDs ...int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.gen++
+	for _, id := range userIDs {
+		if elem, ok := c.entries[id]; ok {
+			c.remove(elem)
+		}
+	}
+}
+
+// InvalidateAll drops the cached segments of all users, e.g. when a segment is changed.
+func (c *Cache) InvalidateAll() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.gen++
+	c.order.Init()
+	clear(c.entries)
+}
+
+// HandleChange drops the cached segments affected by a change notified by any instance:
+// the users whose memberships changed, or all users if a segment changed.
+func (c *Cache) HandleChange(change models.Change) {
+	if change.All || change.Segment != "" {
+		c.InvalidateAll()
+		return
+	}
+	c.InvalidateUsers(change.Users...)
+}
+
+// Len returns the number of cached users.
+func (c *Cache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.order.Len()
+}
+
+// remove drops the entry; the caller holds the lock.
+func (c *Cache) remove(elem *list.Element) {
+	c.order.Remove(elem)
+	delete(c.entries, elem.Value.(*entry).userID)
+}
@@ -0,0 +1,139 @@
+package segments_cache
+
+import (
+	"testing"
+	"time"
+
+	"user_segmentation_service/internal/models"
+)
+
+// clock is a manually advanced time source for the cache.
+type clock struct{ t time.Time }
+
+func (c *clock) now() time.Time { return c.t }
+
+func newTestCache(size int, ttl time.Duration) (*Cache, *clock) {
+	clk := &clock{t: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}
+	c := NewCache(size, ttl)
+	c.now = clk.now
+	return c, clk
+}
+
+func segments(slugs ...string) []*models.Segment {
+	segs := make([]*models.Segment, 0, len(slugs))
+	for _, slug := range slugs {
+		segs = append(segs, &models.Segment{Slug: slug})
+	}
+	return segs
+}
+
+func TestCacheSetAfterInvalidationIsDropped(t *testing.T) {
+	tests := []struct {
+		name       string
+		invalidate func(c *Cache)
+	}{
+		{"invalidate the user", func(c *Cache) { c.InvalidateUsers(1) }},
+		{"invalidate another user", func(c *Cache) { c.InvalidateUsers(2) }},
+		{"invalidate all", func(c *Cache) { c.InvalidateAll() }},
+		{"segment change", func(c *Cache) { c.HandleChange(models.Change{Segment: "AVITO_TEST"}) }},
+		{"users change", func(c *Cache) { c.HandleChange(models.Change{Users: []int{1}}) }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, _ := newTestCache(10, time.Minute)
+
+			_, gen, ok := c.Get(1)
+			if ok {
+				t.Fatal("Get on an empty cache: got a hit")
+			}
+			tt.invalidate(c)
+			c.Set(1, gen, segments("AVITO_TEST"), time.Time{})
+
+			if _, _, ok = c.Get(1); ok {
+				t.Error("Get after a stale Set: got a hit, want a miss")
+			}
+			if c.Len() != 0 {
+				t.Errorf("Len = %d, want 0", c.Len())
+			}
+
+			_, gen, _ = c.Get(1)
+			c.Set(1, gen, segments("AVITO_TEST"), time.Time{})
+			if _, _, ok = c.Get(1); !ok {
+				t.Error("Get after a fresh Set: got a miss, want a hit")
+			}
+		})
+	}
+}
+
+func TestCacheEntryExpiresAtEarliestDeadline(t *testing.T) {
+	const ttl = time.Minute
+	tests := []struct {
+		name      string
+		expiresAt time.Duration // After now; 0 means no membership expires.
+		want      time.Duration // When the entry is dropped.
+	}{
+		{"no expiring memberships", 0, ttl},
+		{"membership expires before the TTL", 10 * time.Second, 10 * time.Second},
+		{"membership expires after the TTL", time.Hour, ttl},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, clk := newTestCache(10, ttl)
+			start := clk.t
+
+			var expiresAt time.Time
+			if tt.expiresAt != 0 {
+				expiresAt = start.Add(tt.expiresAt)
+			}
+			_, gen, _ := c.Get(1)
+			c.Set(1, gen, segments("AVITO_TEST"), expiresAt)
+
+			clk.t = start.Add(tt.want - time.Nanosecond)
+			if _, _, ok := c.Get(1); !ok {
+				t.Fatalf("Get just before %v: got a miss, want a hit", tt.want)
+			}
+			clk.t = start.Add(tt.want)
+			if _, _, ok := c.Get(1); ok {
+				t.Fatalf("Get at %v: got a hit, want a miss", tt.want)
+			}
+			if c.Len() != 0 {
+				t.Errorf("Len = %d, want 0", c.Len())
+			}
+		})
+	}
+}
+
+func TestCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	const size = 3
+	c, _ := newTestCache(size, time.Minute)
+
+	for id := 1; id <= size; id++ {
+		_, gen, _ := c.Get(id)
+		c.Set(id, gen, segments("AVITO_TEST"), time.Time{})
+	}
+	// User 1 becomes the most recently used, so user 2 is the least recently used one.
+	if _, _, ok := c.Get(1); !ok {
+		t.Fatal("Get(1): got a miss, want a hit")
+	}
+	_, gen, _ := c.Get(size + 1)
+	c.Set(size+1, gen, segments("AVITO_TEST"), time.Time{})
+
+	if c.Len() != size {
+		t.Errorf("Len = %d, want %d", c.Len(), size)
+	}
+	for id, want := range map[int]bool{1: true, 2: false, 3: true, 4: true} {
+		if _, _, ok := c.Get(id); ok != want {
+			t.Errorf("Get(%d): hit = %v, want %v", id, ok, want)
+		}
+	}
+}
+
+func TestCacheDisabledWithZeroSize(t *testing.T) {
+	c, _ := newTestCache(0, time.Minute)
+
+	_, gen, _ := c.Get(1)
+	c.Set(1, gen, segments("AVITO_TEST"), time.Time{})
+	if _, _, ok := c.Get(1); ok {
+		t.Error("Get: got a hit, want a miss")
+	}
+}
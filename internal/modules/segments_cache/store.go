@@ -0,0 +1,164 @@
+// Package segments_cache provides an in-process cache of the active segments of users.
+package segments_cache
+
+import (
+	"context"
+	"time"
+
+	"user_segmentation_service/internal/db"
+	"user_segmentation_service/internal/metrics"
+	"user_segmentation_service/internal/models"
+)
+
+// Store serves the active segments of users from the cache in front of db.Store
+// and invalidates the cache whenever a change committed through it may affect them.
+// All the other methods are those of db.Store.
+type Store struct {
+	*db.Store
+	cache *Cache // Nil if the cache is disabled.
+}
+
+// NewStore creates a new instance of Store. If the cache is disabled, the store only passes the calls through.
+func NewStore(store *db.Store, cfg Config) *Store {
+	s := &Store{Store: store}
+	if cfg.Enabled {
+		s.cache = NewCache(cfg.Size, cfg.TTL)
+		metrics.RegisterCacheSize(s.cache.Len)
+	}
+	return s
+}
+
+// Cache returns the cache of active segments, nil if it is disabled.
+func (s *Store) Cache() *Cache {
+	return s.cache
+}
+
+// GetActiveSegmentsForUser returns active user segments from the cache, reading them from the database on a miss.
+func (s *Store) GetActiveSegmentsForUser(ctx context.Context, userID int) ([]*models.Segment, error) {
+	if s.cache == nil {
+		return s.Store.GetActiveSegmentsForUser(ctx, userID)
+	}
+	segments, gen, ok := s.cache.Get(userID)
+	metrics.CountCacheLookup(ok)
+	if ok {
+		return segments, nil
+	}
+
+	segments, expiresAt, err := s.Store.GetActiveSegmentsWithExpiration(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	s.cache.Set(userID, gen, segments, expiresAt)
+	return segments, nil
+}
+
+// UpdateUserSegments updates user segments, see db.Store.UpdateUserSegments.
+func (s *Store) UpdateUserSegments(ctx context.Context, userID int, add []db.SegmentModification, remove []string,
+	strict bool, meta models.ChangeMeta, idem *models.IdempotencyKey) (*models.SegmentsUpdateResult, error) {
+	res, err := s.Store.UpdateUserSegments(ctx, userID, add, remove, strict, meta, idem)
+	if err == nil {
+		s.invalidateUsers(userID)
+	}
+	return res, err
+}
+
+// UpdateUsersSegments updates the segments of many users, see db.Store.UpdateUsersSegments.
+// The batches are committed separately, so the users are invalidated even if a batch failed.
+func (s *Store) UpdateUsersSegments(ctx context.Context, userIDs []int, add []db.SegmentModification, remove []string,
+	meta models.ChangeMeta) ([]db.BulkUserResult, db.MembershipCounts) {
+	results, counts := s.Store.UpdateUsersSegments(ctx, userIDs, add, remove, meta)
+	s.invalidateUsers(userIDs...)
+	return results, counts
+}
+
+// ImportUserSegments imports memberships of users in segments, see db.Store.ImportUserSegments.
+func (s *Store) ImportUserSegments(ctx context.Context, src db.ImportSource, createUsers bool,
+	maxRejections int, meta models.ChangeMeta) (*models.ImportResult, error) {
+	res, err := s.Store.ImportUserSegments(ctx, src, createUsers, maxRejections, meta)
+	if err == nil {
+		s.invalidateAll()
+	}
+	return res, err
+}
+
+// CreateUser creates a new user, see db.Store.CreateUser.
+// The user may be enrolled in segments automatically.
+func (s *Store) CreateUser(ctx context.Context, user *models.User) (int64, error) {
+	enrolled, err := s.Store.CreateUser(ctx, user)
+	if err == nil {
+		s.invalidateUsers(user.ID)
+	}
+	return enrolled, err
+}
+
+// EraseUser erases the personal data of a user and ends the memberships, see db.Store.EraseUser.
+func (s *Store) EraseUser(ctx context.Context, userID int, ifMatch []int,
+	meta models.ChangeMeta) (*models.ErasureReceipt, error) {
+	receipt, err := s.Store.EraseUser(ctx, userID, ifMatch, meta)
+	if err == nil {
+		s.invalidateUsers(userID)
+	}
+	return receipt, err
+}
+
+// CreateSegment creates a new segment, see db.Store.CreateSegment.
+// Only a segment with AutoPercent that enrolled somebody has members at once.
+func (s *Store) CreateSegment(ctx context.Context, seg *models.Segment) (int64, error) {
+	enrolled, err := s.Store.CreateSegment(ctx, seg)
+	if err == nil && enrolled > 0 {
+		s.invalidateAll()
+	}
+	return enrolled, err
+}
+
+// UpdateSegment changes the segment data, see db.Store.UpdateSegment.
+// The description is part of the cached lists.
+func (s *Store) UpdateSegment(ctx context.Context, seg *models.Segment, ifMatch []int) error {
+	err := s.Store.UpdateSegment(ctx, seg, ifMatch)
+	if err == nil {
+		s.invalidateAll()
+	}
+	return err
+}
+
+// ArchiveSegment archives the segment and ends its memberships, see db.Store.ArchiveSegment.
+func (s *Store) ArchiveSegment(ctx context.Context, slug string, ifMatch []int, meta models.ChangeMeta) (int64, error) {
+	ended, err := s.Store.ArchiveSegment(ctx, slug, ifMatch, meta)
+	if err == nil {
+		s.invalidateAll()
+	}
+	return ended, err
+}
+
+// RestoreSegment makes the archived segment active again, see db.Store.RestoreSegment.
+// Only a segment with AutoPercent that enrolled somebody gets members back.
+func (s *Store) RestoreSegment(ctx context.Context, slug string) (*models.Segment, int64, error) {
+	seg, enrolled, err := s.Store.RestoreSegment(ctx, slug)
+	if err == nil && enrolled > 0 {
+		s.invalidateAll()
+	}
+	return seg, enrolled, err
+}
+
+// RenameSegment renames the segment, see db.Store.RenameSegment. The slug is part of the cached lists.
+func (s *Store) RenameSegment(ctx context.Context, slug, newSlug string, aliasTTL time.Duration) (*models.SegmentRename, error) {
+	rename, err := s.Store.RenameSegment(ctx, slug, newSlug, aliasTTL)
+	if err == nil {
+		s.invalidateAll()
+	}
+	return rename, err
+}
+
+// invalidateUsers drops the cached segments of the users if the cache is enabled.
+func (s *Store) invalidateUsers(userIDs ...int) {
+	if s.cache != nil {
+		s.cache.InvalidateUsers(userIDs...)
+	}
+}
+
+// invalidateAll drops all cached segments if the cache is enabled.
+func (s *Store) invalidateAll() {
+	if s.cache != nil {
+		s.cache.InvalidateAll()
+	}
+}
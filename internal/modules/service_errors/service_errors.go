@@ -0,0 +1,97 @@
+// Package service_errors defines the domain errors returned by the service packages.
+// Handlers map the kind of the error to an HTTP status and pass the code to the client.
+package service_errors
+
+import (
+	"errors"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+
+	"user_segmentation_service/internal/db/db_errors"
+)
+
+// Kinds of domain errors. Check them with errors.Is.
+var (
+	ErrNotFound           = errors.New("not found")
+	ErrConflict           = errors.New("conflict")
+	ErrValidation         = errors.New("validation failed")
+	ErrPreconditionFailed = errors.New("precondition failed")
+)
+
+// PostgreSQL error codes translated into domain errors.
+const (
+	pgForeignKeyViolation = "23503"
+	pgUniqueViolation     = "23505"
+	pgCheckViolation      = "23514"
+)
+
+// Error is a domain error with a machine-readable code.
+type Error struct {
+	Kind    error  // One of ErrNotFound, ErrConflict, ErrValidation, ErrPreconditionFailed.
+	Code    string // Machine-readable code, e.g. "segment_not_found".
+	Message string // Human-readable description.
+	Details any    // Optional details for the client.
+	Err     error  // Underlying cause, if any.
+}
+
+// Error implements the error interface.
+func (e *Error) Error() string {
+	return e.Message
+}
+
+// Unwrap allows errors.Is/As to match both the kind and the underlying cause.
+func (e *Error) Unwrap() []error {
+	return []error{e.Kind, e.Err}
+}
+
+// NotFound creates an error for a missing entity.
+func NotFound(code, message string) *Error {
+	return &Error{Kind: ErrNotFound, Code: code, Message: message}
+}
+
+// Conflict creates an error for a conflict with the current state (e.g. duplicate).
+func Conflict(code, message string) *Error {
+	return &Error{Kind: ErrConflict, Code: code, Message: message}
+}
+
+// Validation creates an error for invalid input data.
+func Validation(code, message string) *Error {
+	return &Error{Kind: ErrValidation, Code: code, Message: message}
+}
+
+// FromDB translates a database error for the given entity (e.g. "user", "segment") into a domain error:
+// no rows and foreign key violations become ErrNotFound, unique violations become ErrConflict,
+// check violations and invalid list parameters become ErrValidation,
+// version mismatches of conditional updates become ErrPreconditionFailed. Other errors are returned unchanged.
+func FromDB(err error, entity string) error {
+	if err == nil {
+		return nil
+	}
+	switch {
+	case errors.Is(err, db_errors.ErrInvalidCursor):
+		return &Error{Kind: ErrValidation, Code: "invalid_cursor", Message: "invalid cursor", Err: err}
+	case errors.Is(err, db_errors.ErrInvalidSort):
+		return &Error{Kind: ErrValidation, Code: "invalid_sort", Message: err.Error(), Err: err}
+	case errors.Is(err, db_errors.ErrVersionMismatch):
+		return &Error{Kind: ErrPreconditionFailed, Code: entity + "_modified",
+			Message: entity + " has been modified, fetch it again", Err: err}
+	}
+	if errors.Is(err, pgx.ErrNoRows) {
+		return &Error{Kind: ErrNotFound, Code: entity + "_not_found", Message: entity + " not found", Err: err}
+	}
+
+	var pgErr *pgconn.PgError
+	if !errors.As(err, &pgErr) {
+		return err
+	}
+	switch pgErr.Code {
+	case pgForeignKeyViolation:
+		return &Error{Kind: ErrNotFound, Code: entity + "_not_found", Message: entity + " not found", Err: err}
+	case pgUniqueViolation:
+		return &Error{Kind: ErrConflict, Code: entity + "_already_exists", Message: entity + " already exists", Err: err}
+	case pgCheckViolation:
+		return &Error{Kind: ErrValidation, Code: "invalid_" + entity, Message: pgErr.Message, Err: err}
+	}
+	return err
+}
@@ -0,0 +1,109 @@
+// Package ttl_sweeper provides a background worker that removes expired user segments and idempotency keys.
+package ttl_sweeper
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	"user_segmentation_service/internal/metrics"
+	"user_segmentation_service/internal/models"
+)
+
+// Config - configuration for the sweeper.
+type Config struct {
+	Enabled   bool          `envconfig:"ENABLED" default:"true"`
+	Interval  time.Duration `envconfig:"INTERVAL" default:"1m"`
+	BatchSize int           `envconfig:"BATCH_SIZE" default:"1000"`
+}
+
+// DB defines the required database operations for removing expired user segments.
+type DB interface {
+	DeleteExpiredUserSegments(ctx context.Context, batchSize int) (int64, error)
+	DeleteExpiredIdempotencyKeys(ctx context.Context) (int64, error)
+}
+
+// Sweeper periodically deletes expired user segments in batches,
+// so that the history records the moment the user actually left the segment.
+type Sweeper struct {
+	store DB
+	cfg   Config
+	done  chan struct{}
+}
+
+// New creates a new instance of Sweeper.
+func New(store DB, cfg Config) *Sweeper {
+	return &Sweeper{
+		store: store,
+		cfg:   cfg,
+		done:  make(chan struct{}),
+	}
+}
+
+// Run sweeps expired user segments every Interval until the context is cancelled.
+// It blocks, so it is usually started in a separate goroutine.
+func (s *Sweeper) Run(ctx context.Context) {
+	defer close(s.done)
+	if !s.cfg.Enabled || s.cfg.Interval <= 0 || s.cfg.BatchSize <= 0 {
+		slog.Info("TTL sweeper is disabled")
+		return
+	}
+
+	slog.Info("TTL sweeper started", "interval", s.cfg.Interval, "batch_size", s.cfg.BatchSize)
+	ticker := time.NewTicker(s.cfg.Interval)
+	defer ticker.Stop()
+
+	for {
+		s.sweep(ctx)
+		select {
+		case <-ctx.Done():
+			slog.Info("TTL sweeper stopped")
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Done returns a channel that is closed when Run returns.
+func (s *Sweeper) Done() <-chan struct{} {
+	return s.done
+}
+
+// sweep deletes expired user segments batch by batch until there are none left
+// or the context is cancelled, then deletes the expired idempotency keys.
+func (s *Sweeper) sweep(ctx context.Context) {
+	const fn = "ttl_sweeper.sweep"
+
+	var total int64
+	for ctx.Err() == nil {
+		deleted, err := s.store.DeleteExpiredUserSegments(ctx, s.cfg.BatchSize)
+		if err != nil {
+			if ctx.Err() == nil {
+				slog.Error(fn, "err", err)
+			}
+			break
+		}
+		metrics.CountMemberships(models.ActionExpire, models.SourceTTL, deleted)
+		total += deleted
+		if deleted < int64(s.cfg.BatchSize) {
+			break
+		}
+	}
+	if total > 0 {
+		slog.Info(fn, "expired", total)
+	}
+
+	if ctx.Err() != nil {
+		return
+	}
+	keys, err := s.store.DeleteExpiredIdempotencyKeys(ctx)
+	if err != nil {
+		if ctx.Err() == nil {
+			slog.Error(fn, "err", err)
+		}
+		return
+	}
+	if keys > 0 {
+		slog.Info(fn, "idempotency_keys_expired", keys)
+	}
+}
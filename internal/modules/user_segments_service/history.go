@@ -0,0 +1,205 @@
+// Package user_segments_service provides business logic for managing user segments.
+package user_segments_service
+
+import (
+	"bufio"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"user_segmentation_service/internal/models"
+	"user_segmentation_service/internal/modules/service_errors"
+)
+
+// historyActions - actions the history can be filtered by.
+var historyActions = []string{models.ActionAdd, models.ActionRemove, models.ActionExpire}
+
+// reportFormats - formats the history report can be written in.
+var reportFormats = []string{models.ReportCSV, models.ReportTSV, models.ReportJSON, models.ReportNDJSON}
+
+// defaultCSVDelimiter is the field delimiter of the csv format if none is set.
+const defaultCSVDelimiter = ";"
+
+// historyHeader - columns of the csv and tsv formats.
+var historyHeader = []string{"user_id", "user_name", "segment_slug", "segment_description", "action", "actor", "source",
+	"reason", "created_at"}
+
+// ValidateHistory checks the parameters of the history report and brings them to the canonical form:
+// Year/Month become From/To in the time zone, UserID is merged into UserIDs, duplicates are removed,
+// actions are upper-cased, the time zone defaults to UTC and the format to csv with the ";" delimiter.
+func (s *UserSegmentationService) ValidateHistory(p *models.HistoryParams) error {
+	if p.TimeZone == "" {
+		p.TimeZone = "UTC"
+	}
+	loc, err := time.LoadLocation(p.TimeZone)
+	if err != nil {
+		return service_errors.Validation("invalid_time_zone", fmt.Sprintf("unknown time zone %q", p.TimeZone))
+	}
+
+	switch {
+	case p.Year != 0 || p.Month != 0:
+		if !p.From.IsZero() || !p.To.IsZero() {
+			return service_errors.Validation("invalid_period", "either year and month or from and to must be set, not both")
+		}
+		if p.Year < 1 || p.Month < 1 || p.Month > 12 {
+			return service_errors.Validation("invalid_period", "year must be positive and month must be between 1 and 12")
+		}
+		p.From = time.Date(p.Year, time.Month(p.Month), 1, 0, 0, 0, 0, loc)
+		p.To = p.From.AddDate(0, 1, 0)
+		p.Year, p.Month = 0, 0
+	case p.From.IsZero() || p.To.IsZero():
+		return service_errors.Validation("invalid_period", "from and to (or year and month) must be set")
+	case !p.From.Before(p.To):
+		return service_errors.Validation("invalid_period", "from must be before to")
+	}
+
+	if p.UserID != 0 {
+		p.UserIDs = append(p.UserIDs, p.UserID)
+		p.UserID = 0
+	}
+	for _, id := range p.UserIDs {
+		if id < 1 {
+			return service_errors.Validation("invalid_user_id", fmt.Sprintf("invalid user id %d", id))
+		}
+	}
+	slices.Sort(p.UserIDs)
+	p.UserIDs = slices.Compact(p.UserIDs)
+
+	for _, slug := range p.Slugs {
+		if slug == "" {
+			return service_errors.Validation("invalid_slug", "slug must not be empty")
+		}
+	}
+	slices.Sort(p.Slugs)
+	p.Slugs = slices.Compact(p.Slugs)
+
+	for i, action := range p.Actions {
+		p.Actions[i] = strings.ToUpper(action)
+		if !slices.Contains(historyActions, p.Actions[i]) {
+			return service_errors.Validation("invalid_action",
+				fmt.Sprintf("unknown action %q, expected one of %s", action, strings.Join(historyActions, ", ")))
+		}
+	}
+	slices.Sort(p.Actions)
+	p.Actions = slices.Compact(p.Actions)
+
+	return validateFormat(p)
+}
+
+// validateFormat checks the format of the report and its delimiter.
+func validateFormat(p *models.HistoryParams) error {
+	p.Format = strings.ToLower(p.Format)
+	switch p.Format {
+	case "":
+		p.Format = models.ReportCSV
+	case models.ReportTSV:
+		p.Delimiter = "\t"
+	case models.ReportCSV:
+	default:
+		if !slices.Contains(reportFormats, p.Format) {
+			return service_errors.Validation("invalid_format",
+				fmt.Sprintf("unknown format %q, expected one of %s", p.Format, strings.Join(reportFormats, ", ")))
+		}
+		p.Delimiter = ""
+		return nil
+	}
+
+	if p.Delimiter == "" {
+		p.Delimiter = defaultCSVDelimiter
+	}
+	d, size := utf8.DecodeRuneInString(p.Delimiter)
+	if size != len(p.Delimiter) || d == 0 || d == utf8.RuneError || d == '"' || d == '\r' || d == '\n' {
+		return service_errors.Validation("invalid_delimiter", fmt.Sprintf("invalid delimiter %q, expected a single character", p.Delimiter))
+	}
+	return nil
+}
+
+// WriteHistory writes a report on the history of segment changes to w in the format of the parameters.
+// The records are streamed from the database, so the report may be of any size.
+// Times are written in the time zone of the parameters.
+func (s *UserSegmentationService) WriteHistory(ctx context.Context, w io.Writer, p models.HistoryParams) error {
+	if err := s.ValidateHistory(&p); err != nil {
+		return err
+	}
+	loc, _ := time.LoadLocation(p.TimeZone)
+
+	switch p.Format {
+	case models.ReportJSON:
+		return s.writeHistoryJSON(ctx, w, p, loc, true)
+	case models.ReportNDJSON:
+		return s.writeHistoryJSON(ctx, w, p, loc, false)
+	}
+	return s.writeHistoryCSV(ctx, w, p, loc)
+}
+
+// writeHistoryCSV writes the report as delimiter-separated values with a header line.
+func (s *UserSegmentationService) writeHistoryCSV(ctx context.Context, w io.Writer, p models.HistoryParams,
+	loc *time.Location) error {
+	writer := csv.NewWriter(w)
+	writer.Comma, _ = utf8.DecodeRuneInString(p.Delimiter)
+	// Record the title
+	if err := writer.Write(historyHeader); err != nil {
+		return err
+	}
+
+	// Record the data
+	err := s.store.StreamUserSegmentHistory(ctx, p, func(rec *models.HistoryRecord) error {
+		return writer.Write([]string{
+			strconv.Itoa(rec.UserID),
+			rec.UserName,
+			rec.SegmentSlug,
+			rec.SegmentDescription,
+			rec.Action,
+			rec.Actor,
+			rec.Source,
+			rec.Reason,
+			rec.CreatedAt.In(loc).Format(time.RFC3339),
+		})
+	})
+	if err != nil {
+		return err
+	}
+	writer.Flush()
+	return writer.Error()
+}
+
+// writeHistoryJSON writes the report as a JSON array of records or, if array is false, as NDJSON.
+func (s *UserSegmentationService) writeHistoryJSON(ctx context.Context, w io.Writer, p models.HistoryParams,
+	loc *time.Location, array bool) error {
+	bw := bufio.NewWriter(w)
+	enc := json.NewEncoder(bw)
+	sep := "[\n"
+
+	err := s.store.StreamUserSegmentHistory(ctx, p, func(rec *models.HistoryRecord) error {
+		if array {
+			if _, err := bw.WriteString(sep); err != nil {
+				return err
+			}
+			sep = ","
+		}
+		rec.CreatedAt = rec.CreatedAt.In(loc).Truncate(time.Second)
+		return enc.Encode(rec) // Encode ends the record with a newline.
+	})
+	if err != nil {
+		return err
+	}
+	if array {
+		if sep != "," {
+			_, err = bw.WriteString(sep) // No records: "[\n".
+		}
+		if err == nil {
+			_, err = bw.WriteString("]\n")
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return bw.Flush()
+}
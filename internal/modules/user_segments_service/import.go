@@ -0,0 +1,225 @@
+// Package user_segments_service provides business logic for managing user segments.
+package user_segments_service
+
+import (
+	"bufio"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"user_segmentation_service/internal/db"
+	"user_segmentation_service/internal/metrics"
+	"user_segmentation_service/internal/models"
+	"user_segmentation_service/internal/modules/service_errors"
+)
+
+// Formats of the import file.
+const (
+	ImportFormatCSV    = "csv"    // user_id,slug,expiration_time; the header line is optional.
+	ImportFormatNDJSON = "ndjson" // {"user_id": 1, "slug": "AVITO_VOICE_MESSAGES", "expiration_time": "..."} per line.
+)
+
+// maxImportRejections is the maximum number of rejected rows listed in the import result.
+const maxImportRejections = 1000
+
+// maxNDJSONLineSize is the maximum size of a line of the NDJSON import file.
+const maxNDJSONLineSize = 64 * 1024
+
+// importReader parses the import file row by row and implements db.ImportSource.
+// Rows that cannot be parsed are skipped and remembered as rejections.
+type importReader struct {
+	next       func() (db.ImportRow, error) // Returns io.EOF at the end of the file.
+	row        db.ImportRow
+	err        error
+	rejected   int64
+	rejections []models.ImportRejection
+}
+
+// Next implements db.ImportSource.
+func (r *importReader) Next() bool {
+	for {
+		row, err := r.next()
+		var rowErr *rowError
+		switch {
+		case err == nil:
+			r.row = row
+			return true
+		case errors.As(err, &rowErr):
+			r.reject(rowErr.line, rowErr.reason)
+		case errors.Is(err, io.EOF):
+			return false
+		default:
+			r.err = err
+			return false
+		}
+	}
+}
+
+// Row implements db.ImportSource.
+func (r *importReader) Row() db.ImportRow { return r.row }
+
+// Err implements db.ImportSource.
+func (r *importReader) Err() error { return r.err }
+
+// reject remembers the row that cannot be parsed.
+func (r *importReader) reject(line int, reason string) {
+	r.rejected++
+	if len(r.rejections) < maxImportRejections {
+		r.rejections = append(r.rejections, models.ImportRejection{Line: line, Reason: reason})
+	}
+}
+
+// rowError is returned by the parsers for a row that cannot be parsed; the import goes on.
+type rowError struct {
+	line   int
+	reason string
+}
+
+// Error implements the error interface.
+func (e *rowError) Error() string {
+	return fmt.Sprintf("line %d: %s", e.line, e.reason)
+}
+
+// newImportReader creates a reader of the import file in the given format.
+func newImportReader(r io.Reader, format string) (*importReader, error) {
+	switch format {
+	case ImportFormatCSV:
+		return &importReader{next: csvRows(r)}, nil
+	case ImportFormatNDJSON:
+		return &importReader{next: ndjsonRows(r)}, nil
+	}
+	return nil, service_errors.Validation("invalid_format",
+		fmt.Sprintf("unknown import format %q, expected %s or %s", format, ImportFormatCSV, ImportFormatNDJSON))
+}
+
+// csvRows returns a parser of CSV rows user_id,slug[,expiration_time].
+func csvRows(r io.Reader) func() (db.ImportRow, error) {
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = -1
+	cr.ReuseRecord = true
+	cr.TrimLeadingSpace = true
+	first := true
+
+	return func() (db.ImportRow, error) {
+		for {
+			record, err := cr.Read()
+			if err != nil {
+				var parseErr *csv.ParseError
+				if errors.As(err, &parseErr) {
+					return db.ImportRow{}, &rowError{line: parseErr.Line, reason: parseErr.Err.Error()}
+				}
+				return db.ImportRow{}, err
+			}
+			line, _ := cr.FieldPos(0)
+			if first {
+				first = false
+				if strings.EqualFold(strings.TrimSpace(record[0]), "user_id") {
+					continue // header
+				}
+			}
+			if len(record) < 2 || len(record) > 3 {
+				return db.ImportRow{}, &rowError{line: line, reason: "expected user_id,slug[,expiration_time]"}
+			}
+			var expiration string
+			if len(record) == 3 {
+				expiration = record[2]
+			}
+			return parseImportRow(line, record[0], record[1], expiration)
+		}
+	}
+}
+
+// ndjsonRows returns a parser of NDJSON rows, empty lines are skipped.
+func ndjsonRows(r io.Reader) func() (db.ImportRow, error) {
+	sc := bufio.NewScanner(r)
+	sc.Buffer(make([]byte, 0, 4096), maxNDJSONLineSize)
+	line := 0
+
+	return func() (db.ImportRow, error) {
+		for sc.Scan() {
+			line++
+			data := strings.TrimSpace(sc.Text())
+			if data == "" {
+				continue
+			}
+			var raw struct {
+				UserID         json.Number `json:"user_id"`
+				Slug           string      `json:"slug"`
+				ExpirationTime string      `json:"expiration_time"`
+			}
+			if err := json.Unmarshal([]byte(data), &raw); err != nil {
+				return db.ImportRow{}, &rowError{line: line, reason: "invalid JSON: " + err.Error()}
+			}
+			return parseImportRow(line, raw.UserID.String(), raw.Slug, raw.ExpirationTime)
+		}
+		if err := sc.Err(); err != nil {
+			return db.ImportRow{}, fmt.Errorf("line %d: %w", line+1, err)
+		}
+		return db.ImportRow{}, io.EOF
+	}
+}
+
+// parseImportRow validates the fields of a row. The expiration time is optional (RFC 3339).
+func parseImportRow(line int, userID, slug, expiration string) (db.ImportRow, error) {
+	row := db.ImportRow{Line: line, Slug: strings.TrimSpace(slug)}
+
+	id, err := strconv.Atoi(strings.TrimSpace(userID))
+	if err != nil || id < 1 {
+		return row, &rowError{line: line, reason: fmt.Sprintf("invalid user_id %q", userID)}
+	}
+	row.UserID = id
+	if row.Slug == "" {
+		return row, &rowError{line: line, reason: "empty slug"}
+	}
+	if expiration = strings.TrimSpace(expiration); expiration != "" {
+		t, err := time.Parse(time.RFC3339, expiration)
+		if err != nil {
+			return row, &rowError{line: line, reason: fmt.Sprintf("invalid expiration_time %q, expected RFC 3339", expiration)}
+		}
+		t = t.UTC()
+		row.ExpirationTime = &t
+	}
+	return row, nil
+}
+
+// Import loads memberships of users in segments from r in the given format (csv or ndjson).
+// Rows that cannot be parsed or refer to unknown users or segments are rejected, the rest are imported
+// in a single transaction. If createUsers is set, users with unknown IDs are created.
+// The imported memberships are recorded in the history with the actor and reason from meta.
+func (s *UserSegmentationService) Import(ctx context.Context, r io.Reader, format string,
+	createUsers bool, meta models.ChangeMeta) (*models.ImportResult, error) {
+	meta.Source = models.SourceImport
+	if err := validateMeta(&meta); err != nil {
+		return nil, err
+	}
+	src, err := newImportReader(r, format)
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := s.store.ImportUserSegments(ctx, src, createUsers, maxImportRejections, meta)
+	if err != nil {
+		if src.Err() != nil {
+			return nil, service_errors.Validation("invalid_import_file", src.Err().Error())
+		}
+		return nil, err
+	}
+
+	metrics.CountMemberships(models.ActionAdd, models.SourceAutoEnroll, res.UsersEnrolled)
+	metrics.CountMemberships(models.ActionAdd, meta.Source, res.Inserted)
+
+	res.Rejected += src.rejected
+	res.Rejections = append(res.Rejections, src.rejections...)
+	slices.SortFunc(res.Rejections, func(a, b models.ImportRejection) int { return a.Line - b.Line })
+	if len(res.Rejections) > maxImportRejections {
+		res.Rejections = res.Rejections[:maxImportRejections]
+	}
+	return res, nil
+}
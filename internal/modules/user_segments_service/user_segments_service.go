@@ -3,42 +3,138 @@ package user_segments_service
 
 import (
 	"context"
-	"encoding/csv"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
 	"fmt"
-	"os"
-	"path/filepath"
-	"strconv"
+	"io"
 	"strings"
 	"time"
+	"unicode/utf8"
 
 	"user_segmentation_service/internal/db"
+	"user_segmentation_service/internal/metrics"
 	"user_segmentation_service/internal/models"
+	"user_segmentation_service/internal/modules/service_errors"
 )
 
 // DB defines the required database operations for user management.
 type DB interface {
-	UpdateUserSegments(ctx context.Context, userID int, add []db.SegmentModification, remove []string) error
+	UpdateUserSegments(ctx context.Context, userID int, add []db.SegmentModification, remove []string,
+		strict bool, meta models.ChangeMeta, idem *models.IdempotencyKey) (*models.SegmentsUpdateResult, error)
+	UpdateUsersSegments(ctx context.Context, userIDs []int, add []db.SegmentModification, remove []string,
+		meta models.ChangeMeta) ([]db.BulkUserResult, db.MembershipCounts)
 	GetActiveSegmentsForUser(ctx context.Context, userID int) ([]*models.Segment, error)
-	GetUserSegmentHistory(ctx context.Context, userID, year, month int) ([]*models.HistoryRecord, error)
+	GetAllUserSegmentsViaCopy(ctx context.Context, w io.Writer) error
+	ImportUserSegments(ctx context.Context, src db.ImportSource, createUsers bool, maxRejections int,
+		meta models.ChangeMeta) (*models.ImportResult, error)
+	StreamUserSegmentHistory(ctx context.Context, p models.HistoryParams, fn func(rec *models.HistoryRecord) error) error
 }
 
+// Config holds the settings of the user segments service.
+type Config struct {
+	IdempotencyTTL time.Duration `envconfig:"IDEMPOTENCY_TTL" default:"24h"` // How long responses to idempotency keys are kept.
+}
+
+// entity is the name of the entity whose segments are managed, used in domain errors.
+const entity = "user"
+
+// maxIdempotencyKeyLength is the maximum length of the Idempotency-Key, as in the schema.
+const maxIdempotencyKeyLength = 255
+
+// Maximum lengths of the change metadata; the actor and the source are limited by the history schema.
+const (
+	maxActorLength  = 150
+	maxSourceLength = 64
+	maxReasonLength = 1000
+)
+
 // UserSegmentationService encapsulates the business logic for handling user segmentation.
 type UserSegmentationService struct {
 	store DB
+	cfg   Config
 }
 
 // NewUserSegmentationService creates a new service instance to handle user segmentation.
-func NewUserSegmentationService(store DB) *UserSegmentationService {
+func NewUserSegmentationService(store DB, cfg Config) *UserSegmentationService {
 	return &UserSegmentationService{
 		store: store,
+		cfg:   cfg,
 	}
 }
 
 // Update updates user segments by adding and removing segments.
 // add - list of segments to add (with optional TTL),
-// remove - list of slug segments to remove.
-func (s *UserSegmentationService) Update(ctx context.Context, userID int, add []db.SegmentModification, remove []string) error {
-	return s.store.UpdateUserSegments(ctx, userID, add, remove)
+// remove - list of slug segments to remove,
+// strict - reject the whole update if any slug does not exist,
+// meta - who made the update, through what and why, recorded in the history (the source defaults to "api"),
+// idempotencyKey - optional key of the request: within IdempotencyTTL a retry with the same key and payload
+// gets the stored result and changes nothing, the same key with another payload is rejected.
+// The result lists what happened to each slug.
+func (s *UserSegmentationService) Update(ctx context.Context, userID int, add []db.SegmentModification, remove []string,
+	strict bool, meta models.ChangeMeta, idempotencyKey string) (*models.SegmentsUpdateResult, error) {
+	if err := validateModifications(add); err != nil {
+		return nil, err
+	}
+	if err := validateMeta(&meta); err != nil {
+		return nil, err
+	}
+	var idem *models.IdempotencyKey
+	if idempotencyKey != "" {
+		var err error
+		payload := struct {
+			UserID int                      `json:"user_id"`
+			Add    []db.SegmentModification `json:"add"`
+			Remove []string                 `json:"remove"`
+			Strict bool                     `json:"strict"`
+			Meta   models.ChangeMeta        `json:"meta"`
+		}{userID, add, remove, strict, meta}
+		if idem, err = s.idempotencyKey(idempotencyKey, meta.Actor, payload); err != nil {
+			return nil, err
+		}
+	}
+
+	res, err := s.store.UpdateUserSegments(ctx, userID, add, remove, strict, meta, idem)
+	if errors.Is(err, db.ErrIdempotencyKeyReused) {
+		svcErr := service_errors.Validation("idempotency_key_reused",
+			"the idempotency key has already been used with a different request")
+		svcErr.Err = err
+		return nil, svcErr
+	}
+	if errors.Is(err, db.ErrUnknownSegments) {
+		svcErr := service_errors.Validation("unknown_segments", "some segments do not exist, nothing was changed")
+		svcErr.Details, svcErr.Err = map[string][]string{"unknown": res.Unknown}, err
+		return nil, svcErr
+	}
+	if err != nil {
+		return nil, service_errors.FromDB(err, entity)
+	}
+	if !res.Replayed {
+		// A single user has at most one membership per slug.
+		metrics.CountMemberships(models.ActionAdd, meta.Source, int64(len(res.Added)))
+		metrics.CountMemberships(models.ActionRemove, meta.Source, int64(len(res.Removed)))
+	}
+	return res, nil
+}
+
+// BulkUpdate adds and removes the same segments for a list of users, recording meta in the history.
+// The result contains the outcome of the update for each user: if the request is interrupted,
+// the batches already committed stay and the users that were not processed are reported as failed.
+func (s *UserSegmentationService) BulkUpdate(ctx context.Context, userIDs []int, add []db.SegmentModification, remove []string,
+	meta models.ChangeMeta) ([]db.BulkUserResult, error) {
+	if len(userIDs) == 0 {
+		return nil, service_errors.Validation("empty_user_ids", "user_ids must not be empty")
+	}
+	if err := validateModifications(add); err != nil {
+		return nil, err
+	}
+	if err := validateMeta(&meta); err != nil {
+		return nil, err
+	}
+	results, counts := s.store.UpdateUsersSegments(ctx, userIDs, add, remove, meta)
+	metrics.CountMemberships(models.ActionAdd, meta.Source, counts.Added)
+	metrics.CountMemberships(models.ActionRemove, meta.Source, counts.Removed)
+	return results, nil
 }
 
 // GetActive returns the list of active user segments.
@@ -47,66 +143,67 @@ func (s *UserSegmentationService) GetActive(ctx context.Context, userID int) ([]
 	return s.store.GetActiveSegmentsForUser(ctx, userID)
 }
 
-// GetHistoryCSV generates a CSV report on the history of segment changes for the user
-// for the specified year and month. The CSV file is saved in the "reports" directory, and the download URL is returned.
-// TODO: Перенести в отдельный сервис.
-func (s *UserSegmentationService) GetHistoryCSV(ctx context.Context, userID, year, month int) (string, error) {
-	records, err := s.store.GetUserSegmentHistory(ctx, userID, year, month)
-	if err != nil {
-		return "", err
-	}
+// Export streams all active user segments to w as NDJSON.
+func (s *UserSegmentationService) Export(ctx context.Context, w io.Writer) error {
+	return s.store.GetAllUserSegmentsViaCopy(ctx, w)
+}
 
-	// Create a directorial for reports, if it is even not.
-	outputDir := "reports"
-	if err = os.MkdirAll(outputDir, 0750); err != nil {
-		return "", err
+// validateModifications checks that every segment to add has a slug
+// and that its expiration time, if set, is in the future.
+func validateModifications(add []db.SegmentModification) error {
+	now := time.Now()
+	for _, mod := range add {
+		if mod.Slug == "" {
+			return service_errors.Validation("invalid_slug", "slug of the segment to add must not be empty")
+		}
+		if mod.ExpirationTime != nil && !mod.ExpirationTime.After(now) {
+			return service_errors.Validation("invalid_expiration_time",
+				fmt.Sprintf("expiration_time of segment %s must be in the future", mod.Slug))
+		}
 	}
+	return nil
+}
 
-	// Form the name of the file: report_{userID}_{year}_{month}.csv
-	filename := fmt.Sprintf("report_%d_%d_%d.csv", userID, year, month)
-	filePath := filepath.Join(outputDir, filename)
-	cleanPath := filepath.Clean(filePath)
-	if !strings.HasPrefix(cleanPath, outputDir) {
-		return "", fmt.Errorf("attempt to access restricted path: %s", cleanPath)
+// validateMeta trims the change metadata, checks its length and sets the default source.
+func validateMeta(meta *models.ChangeMeta) error {
+	meta.Actor = strings.TrimSpace(meta.Actor)
+	meta.Source = strings.TrimSpace(meta.Source)
+	meta.Reason = strings.TrimSpace(meta.Reason)
+	if meta.Source == "" {
+		meta.Source = models.SourceAPI
 	}
-
-	var file *os.File
-	file, err = os.Create(cleanPath)
-	if err != nil {
-		return "", err
-	}
-	defer func(file *os.File) {
-		_ = file.Close()
-	}(file)
-
-	writer := csv.NewWriter(file)
-	writer.Comma = ';'
-	// Record the title
-	header := []string{"user_id", "user_name", "segment_slug", "segment_description", "action", "created_at"}
-	if err = writer.Write(header); err != nil {
-		return "", err
-	}
-
-	// Record the data
-	for _, rec := range records {
-		row := []string{
-			strconv.Itoa(rec.UserID),
-			rec.UserName,
-			rec.SegmentSlug,
-			rec.SegmentDescription,
-			rec.Action,
-			rec.CreatedAt.Format(time.RFC3339),
+	for _, f := range []struct {
+		name, value string
+		max         int
+	}{
+		{"actor", meta.Actor, maxActorLength},
+		{"source", meta.Source, maxSourceLength},
+		{"reason", meta.Reason, maxReasonLength},
+	} {
+		if utf8.RuneCountInString(f.value) > f.max {
+			return service_errors.Validation("invalid_"+f.name, fmt.Sprintf("%s must be at most %d characters long", f.name, f.max))
 		}
-		if err = writer.Write(row); err != nil {
-			return "", err
+	}
+	return nil
+}
+
+// idempotencyKey checks the Idempotency-Key of the request of the owner and returns it
+// with the hash of the payload.
+func (s *UserSegmentationService) idempotencyKey(key, owner string, payload any) (*models.IdempotencyKey, error) {
+	if len(key) > maxIdempotencyKeyLength {
+		return nil, service_errors.Validation("invalid_idempotency_key",
+			fmt.Sprintf("idempotency key must be at most %d characters long", maxIdempotencyKeyLength))
+	}
+	for _, r := range key {
+		if r < '!' || r > '~' {
+			return nil, service_errors.Validation("invalid_idempotency_key",
+				"idempotency key must consist of printable ASCII characters")
 		}
 	}
-	writer.Flush()
-	if err = writer.Error(); err != nil {
-		return "", err
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return nil, err
 	}
-
-	// We assume that static files from the "reports" folder are served by the server at the URL /reports/
-	downloadURL := fmt.Sprintf("reports/%s", filename)
-	return downloadURL, nil
+	hash := sha256.Sum256(data)
+	return &models.IdempotencyKey{Owner: owner, Key: key, RequestHash: hash[:], TTL: s.cfg.IdempotencyTTL}, nil
 }
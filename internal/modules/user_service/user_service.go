@@ -3,19 +3,34 @@ package user_service
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"unicode/utf8"
 
+	"github.com/jackc/pgx/v5"
+
+	"user_segmentation_service/internal/db"
+	"user_segmentation_service/internal/metrics"
 	"user_segmentation_service/internal/models"
+	"user_segmentation_service/internal/modules/service_errors"
 )
 
 // DB defines the required database operations for user management.
 type DB interface {
-	CreateUser(ctx context.Context, user *models.User) error
-	DeleteUser(ctx context.Context, userID int) error
-	UpdateUser(ctx context.Context, user *models.User) error
+	CreateUser(ctx context.Context, user *models.User) (int64, error)
+	EraseUser(ctx context.Context, userID int, ifMatch []int, meta models.ChangeMeta) (*models.ErasureReceipt, error)
+	GetErasureReceipt(ctx context.Context, userID int) (*models.ErasureReceipt, error)
+	UpdateUser(ctx context.Context, user *models.User, ifMatch []int) error
 	GetUserByID(ctx context.Context, userID int) (*models.User, error)
-	GetAllUsers(ctx context.Context) ([]*models.User, error)
+	GetAllUsers(ctx context.Context, p db.ListParams) (*models.Page[*models.User], error)
 }
 
+// entity is the name of the managed entity in domain errors.
+const entity = "user"
+
+// maxNameLength is the maximum length of the user name (users.name VARCHAR(150)).
+const maxNameLength = 150
+
 // UserService handles operations related to users.
 type UserService struct {
 	store DB
@@ -28,25 +43,71 @@ func NewUserService(store DB) *UserService {
 
 // Create adds a new user to the database.
 func (s *UserService) Create(ctx context.Context, user *models.User) error {
-	return s.store.CreateUser(ctx, user)
+	if err := validateName(user.Name); err != nil {
+		return err
+	}
+	enrolled, err := s.store.CreateUser(ctx, user)
+	if err != nil {
+		return service_errors.FromDB(err, entity)
+	}
+	metrics.CountMemberships(models.ActionAdd, models.SourceAutoEnroll, enrolled)
+	return nil
 }
 
-// Delete removes a user by ID.
-func (s *UserService) Delete(ctx context.Context, userID int) error {
-	return s.store.DeleteUser(ctx, userID)
+// Erase erases the personal data of a user by ID and returns the erasure receipt.
+// The user is replaced with a pseudonymous tombstone and the memberships are ended,
+// the history of the user is kept, so aggregate reports do not change.
+// If ifMatch is not nil, the user is erased only if its version is in the list.
+// The ended memberships are recorded in the history with the actor and reason from meta.
+func (s *UserService) Erase(ctx context.Context, userID int, ifMatch []int,
+	meta models.ChangeMeta) (*models.ErasureReceipt, error) {
+	meta.Source = models.SourceUserErasure
+	receipt, err := s.store.EraseUser(ctx, userID, ifMatch, meta)
+	if errors.Is(err, db.ErrUserErased) {
+		svcErr := service_errors.Conflict("user_erased", "user is already erased")
+		svcErr.Err = err
+		return nil, svcErr
+	}
+	if err != nil {
+		return nil, service_errors.FromDB(err, entity)
+	}
+	metrics.CountMemberships(models.ActionRemove, meta.Source, receipt.MembershipsEnded)
+	return receipt, nil
 }
 
-// Update modifies an existing user.
-func (s *UserService) Update(ctx context.Context, user *models.User) error {
-	return s.store.UpdateUser(ctx, user)
+// ErasureReceipt returns the erasure receipt of an erased user.
+func (s *UserService) ErasureReceipt(ctx context.Context, userID int) (*models.ErasureReceipt, error) {
+	receipt, err := s.store.GetErasureReceipt(ctx, userID)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, service_errors.NotFound("erasure_receipt_not_found", "erasure receipt not found")
+	}
+	return receipt, service_errors.FromDB(err, entity)
+}
+
+// Update modifies an existing user. If ifMatch is not nil, the user is updated only if its version is in the list.
+func (s *UserService) Update(ctx context.Context, user *models.User, ifMatch []int) error {
+	if err := validateName(user.Name); err != nil {
+		return err
+	}
+	return service_errors.FromDB(s.store.UpdateUser(ctx, user, ifMatch), entity)
 }
 
 // GetByID retrieves a user by ID.
 func (s *UserService) GetByID(ctx context.Context, userID int) (*models.User, error) {
-	return s.store.GetUserByID(ctx, userID)
+	user, err := s.store.GetUserByID(ctx, userID)
+	return user, service_errors.FromDB(err, entity)
+}
+
+// GetAll returns a page of users filtered by name prefix and creation time, sorted by the given key.
+func (s *UserService) GetAll(ctx context.Context, p db.ListParams) (*models.Page[*models.User], error) {
+	page, err := s.store.GetAllUsers(ctx, p)
+	return page, service_errors.FromDB(err, entity)
 }
 
-// GetAll returns all users from the database.
-func (s *UserService) GetAll(ctx context.Context) ([]*models.User, error) {
-	return s.store.GetAllUsers(ctx)
+// validateName checks that the user name is not empty and fits into the database column.
+func validateName(name string) error {
+	if n := utf8.RuneCountInString(name); n == 0 || n > maxNameLength {
+		return service_errors.Validation("invalid_name", fmt.Sprintf("name must be 1-%d characters long", maxNameLength))
+	}
+	return nil
 }
@@ -0,0 +1,32 @@
+// Package dto for Swagger
+package dto
+
+import "time"
+
+// APIKeyCreateRequest for Swagger
+//
+//	@Description API key information at creation
+type APIKeyCreateRequest struct {
+	// required: true
+	Name string `json:"name" example:"analytics-dashboard"`
+	// required: true
+	Scopes []string `json:"scopes" example:"memberships:read,reports:read"`
+}
+
+// APIKeyResponse for Swagger
+//
+//	@Description API key information, the key itself is returned only on creation
+type APIKeyResponse struct {
+	// read only: true
+	ID     int    `json:"id"`
+	Name   string `json:"name"`
+	Prefix string `json:"prefix" example:"uss_3q2-7wEv"`
+	// read only: true
+	Scopes []string `json:"scopes"`
+	// read only: true
+	CreatedAt time.Time `json:"created_at"`
+	// read only: true
+	RevokedAt *time.Time `json:"revoked_at,omitempty"`
+	// Returned only once, when the key is created
+	Key string `json:"key,omitempty"`
+}
@@ -11,6 +11,8 @@ type SegmentCreateRequest struct {
 	Slug string `json:"slug"`
 	// required: false
 	Description string `json:"description,omitempty"`
+	// required: false
+	AutoPercent *int `json:"auto_percent,omitempty" minimum:"1" maximum:"100"`
 }
 
 // SegmentUpdateRequest for Swagger
@@ -29,6 +31,91 @@ type SegmentResponse struct {
 	ID          int    `json:"id"`
 	Slug        string `json:"slug"`
 	Description string `json:"description"`
+	AutoPercent *int   `json:"auto_percent,omitempty"`
 	// read only: true
 	CreatedAt time.Time `json:"created_at"`
+	// read only: true
+	ArchivedAt *time.Time `json:"archived_at,omitempty"`
+	// Set if the segment was requested by a deprecated slug it had before a rename
+	DeprecatedAlias *SegmentAliasResponse `json:"deprecated_alias,omitempty"`
+}
+
+// SegmentPageResponse for Swagger
+//
+//	@Description A page of segments
+type SegmentPageResponse struct {
+	Items []SegmentResponse `json:"items"`
+	// Cursor of the next page, absent on the last page
+	NextCursor string `json:"next_cursor,omitempty"`
+}
+
+// SegmentMemberResponse for Swagger
+//
+//	@Description A user in the segment
+type SegmentMemberResponse struct {
+	UserID         int        `json:"user_id"`
+	UserName       string     `json:"user_name,omitempty"`
+	ExpirationTime *time.Time `json:"expiration_time,omitempty"`
+	JoinedAt       time.Time  `json:"joined_at"`
+	// The expiration time has passed, but the user is not removed yet (only with include_expired)
+	Expired bool `json:"expired,omitempty"`
+}
+
+// SegmentMemberPageResponse for Swagger
+//
+//	@Description A page of segment members
+type SegmentMemberPageResponse struct {
+	Items []SegmentMemberResponse `json:"items"`
+	// Cursor of the next page, absent on the last page
+	NextCursor string `json:"next_cursor,omitempty"`
+}
+
+// SegmentStatsResponse for Swagger
+//
+//	@Description Size and growth of the segment
+type SegmentStatsResponse struct {
+	Slug          string `json:"slug"`
+	ActiveMembers int64  `json:"active_members"`
+	// Active members whose membership expires within expiring_within_days
+	ExpiringSoon int64               `json:"expiring_soon"`
+	Daily        []DailySegmentStats `json:"daily"`
+}
+
+// DailySegmentStats for Swagger
+//
+//	@Description Changes of the segment during a day
+type DailySegmentStats struct {
+	// YYYY-MM-DD in the requested time zone
+	Date    string `json:"date"`
+	Added   int64  `json:"added"`
+	Removed int64  `json:"removed"`
+	Expired int64  `json:"expired"`
+}
+
+// SegmentRenameRequest for Swagger
+//
+//	@Description New slug of the segment
+type SegmentRenameRequest struct {
+	// required: true
+	Slug string `json:"slug"`
+}
+
+// SegmentRenameResponse for Swagger
+//
+//	@Description Record of the audit trail of segment renames
+type SegmentRenameResponse struct {
+	ID      int    `json:"id"`
+	OldSlug string `json:"old_slug"`
+	NewSlug string `json:"new_slug"`
+	// Until when the old slug resolves to the segment, absent if it was not kept as an alias
+	AliasExpiresAt *time.Time `json:"alias_expires_at,omitempty"`
+	RenamedAt      time.Time  `json:"renamed_at"`
+}
+
+// SegmentAliasResponse for Swagger
+//
+//	@Description Deprecated former slug the segment was requested by
+type SegmentAliasResponse struct {
+	Slug      string    `json:"slug"`
+	ExpiresAt time.Time `json:"expires_at"`
 }
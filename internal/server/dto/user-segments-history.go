@@ -1,6 +1,8 @@
 // Package dto for Swagger
 package dto
 
+import "time"
+
 // USHResponse for Swagger
 //
 //	@Description History information
@@ -8,3 +10,49 @@ type USHResponse struct {
 	// required: true
 	DownURL string `json:"url"`
 }
+
+// HistoryParams for Swagger
+//
+//	@Description Parameters of the history report
+type HistoryParams struct {
+	// Users, all users if empty
+	UserIDs []int `json:"user_ids,omitempty"`
+	// A single user, merged into user_ids
+	UserID int `json:"user_id,omitempty"`
+	// Start of the period, inclusive; set either from/to or year/month
+	From *time.Time `json:"from,omitempty"`
+	// End of the period, exclusive
+	To    *time.Time `json:"to,omitempty"`
+	Year  int        `json:"year,omitempty"`
+	Month int        `json:"month,omitempty"`
+	// IANA time zone of year/month and the report times, UTC by default
+	TimeZone string `json:"tz,omitempty"`
+	// Segment slugs, all segments if empty
+	Slugs []string `json:"slugs,omitempty"`
+	// ADD, REMOVE or EXPIRE, all actions if empty
+	Actions []string `json:"actions,omitempty"`
+	// csv (default), tsv, json or ndjson
+	Format string `json:"format,omitempty"`
+	// Field delimiter of the csv format, ";" by default
+	Delimiter string `json:"delimiter,omitempty"`
+}
+
+// ReportJobResponse for Swagger
+//
+//	@Description State of the report job
+type ReportJobResponse struct {
+	// read only: true
+	ID string `json:"id"`
+	// pending, running, done or failed
+	Status string        `json:"status"`
+	Params HistoryParams `json:"params"`
+	// Reason of the failure
+	Error string `json:"error,omitempty"`
+	// Download link, present when the report is done
+	DownloadURL string `json:"download_url,omitempty"`
+	// The download link is valid until this time
+	ExpiresAt  *time.Time `json:"expires_at,omitempty"`
+	CreatedAt  time.Time  `json:"created_at"`
+	StartedAt  *time.Time `json:"started_at,omitempty"`
+	FinishedAt *time.Time `json:"finished_at,omitempty"`
+}
@@ -29,3 +29,25 @@ type UserResponse struct {
 	// read only: true
 	CreatedAt time.Time `json:"created_at"`
 }
+
+// UserPageResponse for Swagger
+//
+//	@Description A page of users
+type UserPageResponse struct {
+	Items []UserResponse `json:"items"`
+	// Cursor of the next page, absent on the last page
+	NextCursor string `json:"next_cursor,omitempty"`
+}
+
+// ErasureReceiptResponse for Swagger
+//
+//	@Description Confirmation that the personal data of the user has been erased
+type ErasureReceiptResponse struct {
+	ID     string `json:"id"`
+	UserID int    `json:"user_id"`
+	// Name of the tombstone that replaced the user in the history
+	Pseudonym string `json:"pseudonym"`
+	// Number of segment memberships ended by the erasure
+	MembershipsEnded int64     `json:"memberships_ended"`
+	ErasedAt         time.Time `json:"erased_at"`
+}
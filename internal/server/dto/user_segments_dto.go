@@ -0,0 +1,14 @@
+// Package dto for Swagger
+package dto
+
+import "time"
+
+// UserSegmentExport for Swagger
+//
+//	@Description Active membership of a user in a segment (one line of the export)
+type UserSegmentExport struct {
+	UserID         int       `json:"user_id"`
+	Slug           string    `json:"slug"`
+	ExpirationTime time.Time `json:"expiration_time"`
+	CreatedAt      time.Time `json:"created_at"`
+}
@@ -0,0 +1,140 @@
+// Package handlers provide HTTP request handlers for user segments.
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"strconv"
+
+	"user_segmentation_service/internal/models"
+	"user_segmentation_service/internal/server/response"
+)
+
+// apiKeyService defines the methods required for managing API keys.
+type apiKeyService interface {
+	Create(ctx context.Context, key *models.APIKey) error
+	GetAll(ctx context.Context) ([]*models.APIKey, error)
+	Revoke(ctx context.Context, id int) (*models.APIKey, error)
+}
+
+// APIKeyHandlers handles the administrative HTTP requests related to API keys.
+type APIKeyHandlers struct {
+	keys apiKeyService
+	ctx  context.Context
+}
+
+var apiKeyHandler = "api key handler"
+
+// NewAPIKeyHandler initializes and returns a new APIKeyHandlers instance.
+func NewAPIKeyHandler(ctx context.Context, ks apiKeyService) *APIKeyHandlers {
+	return &APIKeyHandlers{
+		keys: ks,
+		ctx:  ctx,
+	}
+}
+
+// CreateHandle handles the request for issuing a new API key.
+//
+//	@Summary        Create API key
+//	@Description    Issues an API key with the given scopes: memberships:read, memberships:write, segments:manage,
+//	@Description    users:manage, reports:read, admin (implies all). The key is returned only once, only its hash is stored.
+//	@Tags           admin
+//	@Accept         json
+//	@Produce        json
+//	@Param          Key     body        dto.APIKeyCreateRequest     true    "Name and scopes of the key"
+//	@Success        201     {object}    dto.APIKeyResponse                  "The key has been issued"
+//	@Failure        400     {object}    response.ErrorResponse    "Invalid request"
+//	@Failure        401     {object}    response.ErrorResponse    "Unauthorized"
+//	@Failure        403     {object}    response.ErrorResponse    "Forbidden"
+//	@Failure        422     {object}    response.ErrorResponse    "Validation failed"
+//	@Failure        500     {object}    response.ErrorResponse    "Internal server error"
+//	@Security       ApiKeyAuth
+//	@Router         /admin/api-keys [post]
+func (kh *APIKeyHandlers) CreateHandle(w http.ResponseWriter, r *http.Request) {
+	const fn = "CreateHandle"
+
+	key := &models.APIKey{}
+	if err := json.NewDecoder(r.Body).Decode(key); err != nil {
+		slog.Error(fn, "handler", apiKeyHandler, "err", err)
+		response.WriteError(w, http.StatusBadRequest, codeInvalidJSON, err.Error(), nil)
+		return
+	}
+	if err := kh.keys.Create(r.Context(), key); err != nil {
+		slog.Error(fn, "handler", apiKeyHandler, "err", err)
+		writeServiceError(w, err)
+		return
+	}
+
+	if err := response.WriteJSON(w, http.StatusCreated, key); err != nil {
+		slog.Error(fn, "handler", apiKeyHandler, "err", err)
+		return
+	}
+	slog.Info(fn, "handler", apiKeyHandler, "id", key.ID, "prefix", key.Prefix, "scopes", key.Scopes)
+}
+
+// GetAllHandle handles the request for listing API keys.
+//
+//	@Summary        List API keys
+//	@Description    Returns all API keys, including the revoked ones, without the keys themselves.
+//	@Tags           admin
+//	@Produce        json
+//	@Success        200     {array}     dto.APIKeyResponse  "The keys were obtained"
+//	@Failure        401     {object}    response.ErrorResponse    "Unauthorized"
+//	@Failure        403     {object}    response.ErrorResponse    "Forbidden"
+//	@Failure        500     {object}    response.ErrorResponse    "Internal server error"
+//	@Security       ApiKeyAuth
+//	@Router         /admin/api-keys [get]
+func (kh *APIKeyHandlers) GetAllHandle(w http.ResponseWriter, r *http.Request) {
+	const fn = "GetAllHandle"
+
+	keys, err := kh.keys.GetAll(r.Context())
+	if err != nil {
+		slog.Error(fn, "handler", apiKeyHandler, "err", err)
+		writeServiceError(w, err)
+		return
+	}
+	if err = response.WriteJSON(w, http.StatusOK, keys); err != nil {
+		slog.Error(fn, "handler", apiKeyHandler, "err", err)
+		return
+	}
+	slog.Info(fn, "handler", apiKeyHandler, "count", len(keys))
+}
+
+// RevokeHandle handles the request for revoking an API key.
+//
+//	@Summary        Revoke API key
+//	@Description    Revokes the API key, it stops authenticating at once. Returns the revoked key.
+//	@Tags           admin
+//	@Produce        json
+//	@Param          id      path        int     true    "API key ID"
+//	@Success        200     {object}    dto.APIKeyResponse  "The key has been revoked"
+//	@Failure        400     {object}    response.ErrorResponse    "Invalid request"
+//	@Failure        401     {object}    response.ErrorResponse    "Unauthorized"
+//	@Failure        403     {object}    response.ErrorResponse    "Forbidden"
+//	@Failure        404     {object}    response.ErrorResponse    "Not found or already revoked"
+//	@Failure        500     {object}    response.ErrorResponse    "Internal server error"
+//	@Security       ApiKeyAuth
+//	@Router         /admin/api-keys/{id} [delete]
+func (kh *APIKeyHandlers) RevokeHandle(w http.ResponseWriter, r *http.Request) {
+	const fn = "RevokeHandle"
+
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		slog.Error(fn, "handler", apiKeyHandler, "err", err)
+		response.WriteError(w, http.StatusBadRequest, codeInvalidParameter, "invalid api key id", nil)
+		return
+	}
+	key, err := kh.keys.Revoke(r.Context(), id)
+	if err != nil {
+		slog.Error(fn, "handler", apiKeyHandler, "err", err)
+		writeServiceError(w, err)
+		return
+	}
+	if err = response.WriteJSON(w, http.StatusOK, key); err != nil {
+		slog.Error(fn, "handler", apiKeyHandler, "err", err)
+		return
+	}
+	slog.Info(fn, "handler", apiKeyHandler, "revoked", key.ID, "prefix", key.Prefix)
+}
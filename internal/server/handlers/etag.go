@@ -0,0 +1,80 @@
+// Package handlers provide HTTP request handlers for user segments.
+package handlers
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// versionETag returns the entity tag of an entity with the given version.
+func versionETag(version int) string {
+	return `"` + strconv.Itoa(version) + `"`
+}
+
+// ifMatchVersions returns the versions listed in the If-Match header of the request,
+// nil if there is no header or it is "*", so the change is unconditional.
+// Weak and unknown tags never match, so the result may be empty but not nil.
+func ifMatchVersions(r *http.Request) []int {
+	tags := etagList(r.Header.Values("If-Match"))
+	if tags == nil || slices.Contains(tags, "*") {
+		return nil
+	}
+	versions := make([]int, 0, len(tags))
+	for _, tag := range tags {
+		if strings.HasPrefix(tag, "W/") || len(tag) < 2 || tag[0] != '"' || tag[len(tag)-1] != '"' {
+			continue
+		}
+		if v, err := strconv.Atoi(tag[1 : len(tag)-1]); err == nil {
+			versions = append(versions, v)
+		}
+	}
+	return versions
+}
+
+// writeJSONWithETag writes v as a 200 JSON response with the entity tag, or 304 Not Modified without a body
+// if the tag matches If-None-Match. If etag is empty, the tag is the hash of the body.
+// Reports whether the response was 304.
+func writeJSONWithETag(w http.ResponseWriter, r *http.Request, etag string, v any) (bool, error) {
+	body, err := json.Marshal(v)
+	if err != nil {
+		return false, err
+	}
+	body = append(body, '\n')
+	if etag == "" {
+		sum := sha256.Sum256(body)
+		etag = `"` + base64.RawURLEncoding.EncodeToString(sum[:16]) + `"`
+	}
+
+	w.Header().Set("ETag", etag)
+	for _, tag := range etagList(r.Header.Values("If-None-Match")) {
+		// If-None-Match uses the weak comparison: W/ prefixes are ignored.
+		if tag == "*" || strings.TrimPrefix(tag, "W/") == etag {
+			w.WriteHeader(http.StatusNotModified)
+			return true, nil
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	_, err = w.Write(body)
+	return false, err
+}
+
+// etagList splits the values of an If-Match or If-None-Match header into entity tags,
+// nil if there are none.
+func etagList(values []string) []string {
+	var tags []string
+	for _, value := range values {
+		for _, tag := range strings.Split(value, ",") {
+			if tag = strings.TrimSpace(tag); tag != "" {
+				tags = append(tags, tag)
+			}
+		}
+	}
+	return tags
+}
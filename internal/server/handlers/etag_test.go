@@ -0,0 +1,163 @@
+package handlers
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+
+	"user_segmentation_service/internal/db/db_errors"
+	"user_segmentation_service/internal/models"
+	"user_segmentation_service/internal/modules/service_errors"
+)
+
+func TestIfMatchVersions(t *testing.T) {
+	tests := []struct {
+		name   string
+		header []string
+		want   []int
+	}{
+		{"no header", nil, nil},
+		{"empty header", []string{""}, nil},
+		{"any", []string{"*"}, nil},
+		{"any in a list", []string{`"1", *`}, nil},
+		{"single tag", []string{`"3"`}, []int{3}},
+		{"list", []string{`"1", "2" ,"3"`}, []int{1, 2, 3}},
+		{"several headers", []string{`"1"`, `"2"`}, []int{1, 2}},
+		{"weak tag", []string{`W/"3"`}, []int{}},
+		{"weak and strong tags", []string{`W/"3", "4"`}, []int{4}},
+		{"unquoted tag", []string{`3`}, []int{}},
+		{"not a version", []string{`"abc"`}, []int{}},
+		{"unterminated tag", []string{`"3`}, []int{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodDelete, "/segments/AVITO_TEST", nil)
+			for _, v := range tt.header {
+				r.Header.Add("If-Match", v)
+			}
+
+			got := ifMatchVersions(r)
+			if (got == nil) != (tt.want == nil) {
+				t.Fatalf("ifMatchVersions() = %#v, want %#v", got, tt.want)
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("ifMatchVersions() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// versionedSegments is a segment service with a single segment of the given version,
+// checking If-Match the same way as the store.
+type versionedSegments struct {
+	segmentService
+	version int
+}
+
+func (s versionedSegments) Delete(_ context.Context, _ string, ifMatch []int, _ models.ChangeMeta) error {
+	if ifMatch != nil && !slices.Contains(ifMatch, s.version) {
+		return service_errors.FromDB(db_errors.ErrVersionMismatch, "segment")
+	}
+	return nil
+}
+
+func TestDeleteHandleIfMatch(t *testing.T) {
+	tests := []struct {
+		name   string
+		header string
+		want   int
+	}{
+		{"no header", "", http.StatusNoContent},
+		{"any", "*", http.StatusNoContent},
+		{"current version", `"3"`, http.StatusNoContent},
+		{"current version in a list", `"2", "3"`, http.StatusNoContent},
+		{"stale version", `"2"`, http.StatusPreconditionFailed},
+		{"weak tag", `W/"3"`, http.StatusPreconditionFailed},
+		{"malformed tag", `3`, http.StatusPreconditionFailed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sh := NewSegmentHandler(context.Background(), versionedSegments{version: 3})
+			r := httptest.NewRequest(http.MethodDelete, "/segments/AVITO_TEST", nil)
+			r.SetPathValue("slug", "AVITO_TEST")
+			if tt.header != "" {
+				r.Header.Set("If-Match", tt.header)
+			}
+			w := httptest.NewRecorder()
+
+			sh.DeleteHandle(w, r)
+			if w.Code != tt.want {
+				t.Errorf("status = %d, want %d", w.Code, tt.want)
+			}
+		})
+	}
+}
+
+func TestWriteJSONWithETag(t *testing.T) {
+	v := map[string]string{"slug": "AVITO_TEST"}
+	hash := hashETag(t, v)
+
+	tests := []struct {
+		name        string
+		etag        string
+		ifNoneMatch []string
+		wantETag    string
+		wantStatus  int
+	}{
+		{"version tag", `"3"`, nil, `"3"`, http.StatusOK},
+		{"hash tag", "", nil, hash, http.StatusOK},
+		{"matching tag", `"3"`, []string{`"3"`}, `"3"`, http.StatusNotModified},
+		{"matching weak tag", `"3"`, []string{`W/"3"`}, `"3"`, http.StatusNotModified},
+		{"matching hash", "", []string{hash}, hash, http.StatusNotModified},
+		{"any", `"3"`, []string{"*"}, `"3"`, http.StatusNotModified},
+		{"matching tag in a list", `"3"`, []string{`"1", "3"`}, `"3"`, http.StatusNotModified},
+		{"matching tag in another header", `"3"`, []string{`"1"`, `"3"`}, `"3"`, http.StatusNotModified},
+		{"other tag", `"3"`, []string{`"2"`}, `"3"`, http.StatusOK},
+		{"malformed tag", `"3"`, []string{`3`}, `"3"`, http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/segments/AVITO_TEST", nil)
+			for _, h := range tt.ifNoneMatch {
+				r.Header.Add("If-None-Match", h)
+			}
+			w := httptest.NewRecorder()
+
+			notModified, err := writeJSONWithETag(w, r, tt.etag, v)
+			if err != nil {
+				t.Fatalf("writeJSONWithETag() error = %v", err)
+			}
+			if notModified != (tt.wantStatus == http.StatusNotModified) {
+				t.Errorf("writeJSONWithETag() = %v, want %v", notModified, !notModified)
+			}
+			if w.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d", w.Code, tt.wantStatus)
+			}
+			if got := w.Header().Get("ETag"); got != tt.wantETag {
+				t.Errorf("ETag = %s, want %s", got, tt.wantETag)
+			}
+			if tt.wantStatus == http.StatusNotModified && w.Body.Len() != 0 {
+				t.Errorf("304 response has a body: %q", w.Body.String())
+			}
+			if tt.wantStatus == http.StatusOK && w.Body.String() != "{\"slug\":\"AVITO_TEST\"}\n" {
+				t.Errorf("body = %q", w.Body.String())
+			}
+		})
+	}
+}
+
+// hashETag returns the tag writeJSONWithETag generates for v without a version.
+func hashETag(t *testing.T, v any) string {
+	t.Helper()
+	w := httptest.NewRecorder()
+	if _, err := writeJSONWithETag(w, httptest.NewRequest(http.MethodGet, "/", nil), "", v); err != nil {
+		t.Fatalf("writeJSONWithETag() error = %v", err)
+	}
+	etag := w.Header().Get("ETag")
+	if len(etag) != 24 || etag[0] != '"' || etag[len(etag)-1] != '"' {
+		t.Fatalf("hash ETag = %s, want a quoted 22-character hash", etag)
+	}
+	return etag
+}
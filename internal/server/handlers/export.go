@@ -0,0 +1,85 @@
+// Package handlers provide HTTP request handlers for user segments.
+package handlers
+
+import (
+	"compress/gzip"
+	"context"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// exportFunc writes the exported data to w.
+type exportFunc func(ctx context.Context, w io.Writer) error
+
+// lazyHeaderWriter sends the response headers on the first write,
+// so that an error occurring before any data is produced can still be reported with a proper status.
+type lazyHeaderWriter struct {
+	w       http.ResponseWriter
+	written bool
+}
+
+// Write implements io.Writer.
+func (lw *lazyHeaderWriter) Write(p []byte) (int, error) {
+	if !lw.written {
+		lw.written = true
+		lw.w.WriteHeader(http.StatusOK)
+	}
+	return lw.w.Write(p)
+}
+
+// acceptsGzip reports whether the client accepts a gzip-encoded response.
+func acceptsGzip(r *http.Request) bool {
+	for _, enc := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		if name, params, _ := strings.Cut(strings.TrimSpace(enc), ";"); name == "gzip" {
+			return strings.ReplaceAll(params, " ", "") != "q=0"
+		}
+	}
+	return false
+}
+
+// streamExport streams the export straight to the response without buffering, as an attachment
+// with the given file name and content type. The response is gzip-compressed if the client accepts it.
+// The server write timeout is lifted, and the export is cancelled when the client goes away.
+// An error before the first byte is reported as usual; after that the connection is aborted,
+// so that the client does not take a truncated export for a complete one.
+func streamExport(w http.ResponseWriter, r *http.Request, contentType, filename string, export exportFunc) error {
+	_ = http.NewResponseController(w).SetWriteDeadline(time.Time{})
+
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", `attachment; filename="`+filename+`"`)
+	w.Header().Add("Vary", "Accept-Encoding")
+
+	lw := &lazyHeaderWriter{w: w}
+	var (
+		out io.Writer = lw
+		gz  *gzip.Writer
+	)
+	if acceptsGzip(r) {
+		w.Header().Set("Content-Encoding", "gzip")
+		gz = gzip.NewWriter(lw)
+		out = gz
+	}
+
+	err := export(r.Context(), out)
+	if err == nil && gz != nil {
+		err = gz.Close()
+	}
+	if err == nil {
+		if !lw.written {
+			w.WriteHeader(http.StatusOK)
+		}
+		return nil
+	}
+
+	if !lw.written {
+		w.Header().Del("Content-Encoding")
+		w.Header().Del("Content-Disposition")
+		writeServiceError(w, err)
+		return err
+	}
+	slog.Error("streamExport", "err", err)
+	panic(http.ErrAbortHandler)
+}
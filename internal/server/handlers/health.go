@@ -0,0 +1,86 @@
+// Package handlers provide HTTP request handlers for user segments.
+package handlers
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"user_segmentation_service/internal/server/response"
+)
+
+// readinessTimeout is the maximum time of the database check of the readiness probe.
+const readinessTimeout = 2 * time.Second
+
+// pinger checks the connection to the database.
+type pinger interface {
+	Ping(ctx context.Context) error
+}
+
+// HealthHandlers handles the liveness and readiness probes.
+type HealthHandlers struct {
+	db    pinger
+	ready func() bool
+}
+
+var healthHandler = "health handler"
+
+// HealthStatus is the body of the probe responses.
+// @Description Probe status
+type HealthStatus struct {
+	Status string `json:"status" example:"ok"`
+}
+
+// NewHealthHandler initializes and returns a new HealthHandlers instance.
+// ready reports whether the server accepts traffic; it turns false once the shutdown starts.
+func NewHealthHandler(db pinger, ready func() bool) *HealthHandlers {
+	return &HealthHandlers{
+		db:    db,
+		ready: ready,
+	}
+}
+
+// LiveHandle handles the liveness probe.
+//
+//	@Summary        Liveness probe
+//	@Description    Reports that the process is running. Does not check the dependencies.
+//	@Tags           health
+//	@Produce        json
+//	@Success        200     {object}    HealthStatus    "The process is alive"
+//	@Router         /healthz [get]
+func (hh *HealthHandlers) LiveHandle(w http.ResponseWriter, _ *http.Request) {
+	const fn = "LiveHandle"
+
+	if err := response.WriteJSON(w, http.StatusOK, HealthStatus{Status: "ok"}); err != nil {
+		slog.Error(fn, "handler", healthHandler, "err", err)
+	}
+}
+
+// ReadyHandle handles the readiness probe.
+//
+//	@Summary        Readiness probe
+//	@Description    Reports whether the instance can serve requests: the database answers and the shutdown has not started.
+//	@Tags           health
+//	@Produce        json
+//	@Success        200     {object}    HealthStatus    "Ready to serve requests"
+//	@Failure        503     {object}    HealthStatus    "Shutting down or the database is unavailable"
+//	@Router         /readyz [get]
+func (hh *HealthHandlers) ReadyHandle(w http.ResponseWriter, r *http.Request) {
+	const fn = "ReadyHandle"
+
+	status, code := "ok", http.StatusOK
+	if !hh.ready() {
+		status, code = "shutting_down", http.StatusServiceUnavailable
+	} else {
+		ctx, cancel := context.WithTimeout(r.Context(), readinessTimeout)
+		defer cancel()
+		if err := hh.db.Ping(ctx); err != nil {
+			slog.Error(fn, "handler", healthHandler, "err", err)
+			status, code = "database_unavailable", http.StatusServiceUnavailable
+		}
+	}
+	if err := response.WriteJSON(w, code, HealthStatus{Status: status}); err != nil {
+		slog.Error(fn, "handler", healthHandler, "err", err)
+	}
+}
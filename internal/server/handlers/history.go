@@ -0,0 +1,136 @@
+// Package handlers provide HTTP request handlers for user segments.
+package handlers
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"user_segmentation_service/internal/models"
+)
+
+// Modes of the history request.
+const (
+	historyModeStream = "stream" // The report is sent in the response.
+	historyModeURL    = "url"    // A report job is created and the download link is returned.
+)
+
+// reportContentTypes - media types of the report formats.
+var reportContentTypes = map[string]string{
+	models.ReportCSV:    "text/csv; charset=utf-8",
+	models.ReportTSV:    "text/tab-separated-values; charset=utf-8",
+	models.ReportJSON:   "application/json",
+	models.ReportNDJSON: "application/x-ndjson",
+}
+
+// reportAcceptTypes - report formats by the media types of the Accept header.
+var reportAcceptTypes = map[string]string{
+	"text/csv":                  models.ReportCSV,
+	"text/tab-separated-values": models.ReportTSV,
+	"application/json":          models.ReportJSON,
+	"application/x-ndjson":      models.ReportNDJSON,
+}
+
+// acceptedReportFormat returns the first report format listed in the Accept header,
+// or an empty string if there is none (the default format is used then).
+func acceptedReportFormat(r *http.Request) string {
+	for _, part := range strings.Split(r.Header.Get("Accept"), ",") {
+		mediaType, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		if strings.ReplaceAll(params, " ", "") == "q=0" {
+			continue
+		}
+		if format, ok := reportAcceptTypes[strings.ToLower(strings.TrimSpace(mediaType))]; ok {
+			return format
+		}
+	}
+	return ""
+}
+
+// queryValues returns all values of a repeatable query parameter, each of which may be a comma-separated list.
+func queryValues(q url.Values, name string) []string {
+	var values []string
+	for _, v := range q[name] {
+		for _, item := range strings.Split(v, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				values = append(values, item)
+			}
+		}
+	}
+	return values
+}
+
+// parseHistoryParams reads the parameters of a history report: the period as year and month
+// or as from and to (RFC 3339 or a date, which is taken in the time zone), tz, and the filters
+// user_id, slug and action, each repeatable or comma-separated, format and delimiter.
+// The parameters are validated by the service.
+func parseHistoryParams(r *http.Request) (models.HistoryParams, error) {
+	q := r.URL.Query()
+	p := models.HistoryParams{
+		TimeZone:  q.Get("tz"),
+		Slugs:     queryValues(q, "slug"),
+		Actions:   queryValues(q, "action"),
+		Format:    q.Get("format"),
+		Delimiter: q.Get("delimiter"),
+	}
+
+	for name, dst := range map[string]*int{"year": &p.Year, "month": &p.Month} {
+		if v := q.Get(name); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil {
+				return p, fmt.Errorf("invalid %s: %q", name, v)
+			}
+			*dst = n
+		}
+	}
+
+	loc := time.UTC
+	if p.TimeZone != "" {
+		var err error
+		if loc, err = time.LoadLocation(p.TimeZone); err != nil {
+			return p, fmt.Errorf("invalid tz: %q", p.TimeZone)
+		}
+	}
+	for name, dst := range map[string]*time.Time{"from": &p.From, "to": &p.To} {
+		v := q.Get(name)
+		if v == "" {
+			continue
+		}
+		t, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			if t, err = time.ParseInLocation(time.DateOnly, v, loc); err != nil {
+				return p, fmt.Errorf("invalid %s: %q, expected RFC 3339 or YYYY-MM-DD", name, v)
+			}
+		}
+		*dst = t
+	}
+
+	for _, v := range queryValues(q, "user_id") {
+		id, err := strconv.Atoi(v)
+		if err != nil {
+			return p, fmt.Errorf("invalid user_id: %q", v)
+		}
+		p.UserIDs = append(p.UserIDs, id)
+	}
+	return p, nil
+}
+
+// reportFileName returns the name the report is downloaded under:
+// history[_{user}]_{from}_{to}.{format}, with the dates in the time zone of the report.
+func reportFileName(p models.HistoryParams) string {
+	loc, err := time.LoadLocation(p.TimeZone)
+	if err != nil {
+		loc = time.UTC
+	}
+	name := "history"
+	if len(p.UserIDs) == 1 {
+		name += "_" + strconv.Itoa(p.UserIDs[0])
+	}
+	format := p.Format
+	if format == "" {
+		format = models.ReportCSV
+	}
+	return name + "_" + p.From.In(loc).Format(time.DateOnly) + "_" + p.To.In(loc).Format(time.DateOnly) + "." + format
+}
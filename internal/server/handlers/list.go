@@ -0,0 +1,42 @@
+// Package handlers provide HTTP request handlers for user segments.
+package handlers
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"user_segmentation_service/internal/db"
+)
+
+// parseListParams reads the pagination, filtering and sorting parameters of a list request:
+// limit, cursor, sort, created_from, created_to (RFC 3339) and the prefix parameter with the given name.
+func parseListParams(r *http.Request, prefixParam string) (db.ListParams, error) {
+	q := r.URL.Query()
+	p := db.ListParams{
+		Prefix: q.Get(prefixParam),
+		Sort:   q.Get("sort"),
+		Cursor: q.Get("cursor"),
+	}
+
+	if v := q.Get("limit"); v != "" {
+		limit, err := strconv.Atoi(v)
+		if err != nil || limit < 1 {
+			return p, fmt.Errorf("invalid limit: %q", v)
+		}
+		p.Limit = limit
+	}
+	for name, dst := range map[string]**time.Time{"created_from": &p.CreatedFrom, "created_to": &p.CreatedTo} {
+		v := q.Get(name)
+		if v == "" {
+			continue
+		}
+		t, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			return p, fmt.Errorf("invalid %s: %q, expected RFC 3339", name, v)
+		}
+		*dst = &t
+	}
+	return p, nil
+}
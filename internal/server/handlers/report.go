@@ -0,0 +1,329 @@
+// Package handlers provide HTTP request handlers for user segments.
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"user_segmentation_service/internal/models"
+	"user_segmentation_service/internal/server/response"
+)
+
+// reportService defines the methods required for managing report jobs.
+type reportService interface {
+	Create(ctx context.Context, p models.HistoryParams) (*models.ReportJob, error)
+	Get(ctx context.Context, id string) (*models.ReportJob, error)
+	Generate(ctx context.Context, p models.HistoryParams) (*models.ReportJob, error)
+	Open(ctx context.Context, token string) (*os.File, *models.ReportJob, error)
+	Validate(p *models.HistoryParams) error
+	Stream(ctx context.Context, w io.Writer, p models.HistoryParams) error
+}
+
+// ReportHandlers handles HTTP requests for history reports.
+type ReportHandlers struct {
+	reports reportService
+	ctx     context.Context
+}
+
+var reportHandler = "report handler"
+
+// NewReportHandler creates a new instance of ReportHandlers.
+func NewReportHandler(ctx context.Context, rs reportService) *ReportHandlers {
+	return &ReportHandlers{
+		reports: rs,
+		ctx:     ctx,
+	}
+}
+
+// withDownloadURL sets the download link of a finished report whose token has not expired.
+func withDownloadURL(r *http.Request, job *models.ReportJob) *models.ReportJob {
+	if job.Status == models.ReportDone && job.Token != "" && job.ExpiresAt != nil && job.ExpiresAt.After(time.Now()) {
+		job.DownloadURL = fmt.Sprintf("http://%s/reports/download/%s", r.Host, job.Token)
+	}
+	return job
+}
+
+// CreateHandle creates a job generating the history report.
+//
+//	@Summary        Create a history report
+//	@Description    Creates a job generating a report (csv, tsv, json or ndjson) on the history of segment changes for the period
+//	@Description    (from/to or year/month in the time zone tz), optionally filtered by users, segment slugs and actions.
+//	@Description    Poll the job by the Location header until it is done and download the report by the link.
+//	@Tags           user-segments-history
+//	@Accept         json
+//	@Produce        json
+//	@Param          Report  body        dto.HistoryParams       true    "Parameters of the report"
+//	@Success        202     {object}    dto.ReportJobResponse           "The job has been created"
+//	@Failure        400     {object}    response.ErrorResponse    "Invalid request"
+//	@Failure        401     {object}    response.ErrorResponse    "Unauthorized"
+//	@Failure        403     {object}    response.ErrorResponse    "Forbidden"
+//	@Failure        422     {object}    response.ErrorResponse    "Validation failed"
+//	@Failure        500     {object}    response.ErrorResponse    "Internal server error"
+//	@Security       ApiKeyAuth
+//	@Router         /reports [post]
+func (rh *ReportHandlers) CreateHandle(w http.ResponseWriter, r *http.Request) {
+	const fn = "CreateHandle"
+
+	var (
+		err    error
+		params models.HistoryParams
+		job    *models.ReportJob
+	)
+
+	if err = json.NewDecoder(r.Body).Decode(&params); err != nil {
+		slog.Error(fn, "handler", reportHandler, "err", err)
+		response.WriteError(w, http.StatusBadRequest, codeInvalidJSON, "invalid request body", nil)
+		return
+	}
+
+	if job, err = rh.reports.Create(r.Context(), params); err != nil {
+		slog.Error(fn, "handler", reportHandler, "err", err)
+		writeServiceError(w, err)
+		return
+	}
+
+	w.Header().Set("Location", "/reports/"+job.ID)
+	if err = response.WriteJSON(w, http.StatusAccepted, job); err != nil {
+		slog.Error(fn, "handler", reportHandler, "err", err)
+		return
+	}
+	slog.Info(fn, "handler", reportHandler, "success", job.ID)
+}
+
+// GetHandle returns the state of the report job.
+//
+//	@Summary        Get a history report job
+//	@Description    Returns the state of the job; a finished job contains the download link while it is valid
+//	@Tags           user-segments-history
+//	@Produce        json
+//	@Param          id      path        string      true    "Job ID"
+//	@Success        200     {object}    dto.ReportJobResponse   "The job was obtained"
+//	@Failure        401     {object}    response.ErrorResponse    "Unauthorized"
+//	@Failure        403     {object}    response.ErrorResponse    "Forbidden"
+//	@Failure        404     {object}    response.ErrorResponse    "Job not found"
+//	@Failure        500     {object}    response.ErrorResponse    "Internal server error"
+//	@Security       ApiKeyAuth
+//	@Router         /reports/{id} [get]
+func (rh *ReportHandlers) GetHandle(w http.ResponseWriter, r *http.Request) {
+	const fn = "GetHandle"
+
+	job, err := rh.reports.Get(r.Context(), r.PathValue("id"))
+	if err != nil {
+		slog.Error(fn, "handler", reportHandler, "err", err)
+		writeServiceError(w, err)
+		return
+	}
+
+	if err = response.WriteJSON(w, http.StatusOK, withDownloadURL(r, job)); err != nil {
+		slog.Error(fn, "handler", reportHandler, "err", err)
+		return
+	}
+	slog.Info(fn, "handler", reportHandler, "success", job.ID, "status", job.Status)
+}
+
+// DownloadHandle sends the finished report by its download token.
+//
+//	@Summary        Download a history report
+//	@Description    Sends the report in the format it was created in; the link stops working when the token expires
+//	@Tags           user-segments-history
+//	@Produce        text/csv,text/tab-separated-values,json,application/x-ndjson
+//	@Param          token   path        string      true    "Download token"
+//	@Success        200     {file}      file        "Report"
+//	@Failure        404     {object}    response.ErrorResponse    "Report not found or the link has expired"
+//	@Failure        500     {object}    response.ErrorResponse    "Internal server error"
+//	@Router         /reports/download/{token} [get]
+func (rh *ReportHandlers) DownloadHandle(w http.ResponseWriter, r *http.Request) {
+	const fn = "DownloadHandle"
+
+	file, job, err := rh.reports.Open(r.Context(), r.PathValue("token"))
+	if err != nil {
+		slog.Error(fn, "handler", reportHandler, "err", err)
+		writeServiceError(w, err)
+		return
+	}
+	defer func() {
+		_ = file.Close()
+	}()
+
+	// A large report may take longer to send than the server write timeout.
+	_ = http.NewResponseController(w).SetWriteDeadline(time.Time{})
+
+	var modTime time.Time
+	if job.FinishedAt != nil {
+		modTime = *job.FinishedAt
+	}
+	contentType, ok := reportContentTypes[job.Params.Format]
+	if !ok {
+		contentType = reportContentTypes[models.ReportCSV]
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", `attachment; filename="`+reportFileName(job.Params)+`"`)
+	w.Header().Set("Cache-Control", "private, no-store")
+	http.ServeContent(w, r, "", modTime, file)
+	slog.Info(fn, "handler", reportHandler, "success", job.ID)
+}
+
+// HistoryHandle sends a report on the history of the user or, in the url mode, returns JSON with the download URL.
+//
+//	@Summary        Get a user history report
+//	@Description    Streams a report on the history of segment changes for the user for the period
+//	@Description    (year and month, or from and to) in the format from ?format= or the Accept header:
+//	@Description    csv (the delimiter is set by ?delimiter=, ";" by default), tsv, json or ndjson.
+//	@Description    With mode=url a report job is created and the download link is returned; if the report
+//	@Description    is not ready in a few seconds, the job is returned with the status 202; poll it by the Location header.
+//	@Tags           user-segments-history
+//	@Produce        text/csv,text/tab-separated-values,json,application/x-ndjson
+//	@Param          id          path        int         true    "User ID"
+//	@Param          year        query       int         false   "Year, e.g. 2025"
+//	@Param          month       query       int         false   "Month, e.g. 02"
+//	@Param          from        query       string      false   "Start of the period, inclusive (RFC 3339 or YYYY-MM-DD)"
+//	@Param          to          query       string      false   "End of the period, exclusive (RFC 3339 or YYYY-MM-DD)"
+//	@Param          tz          query       string      false   "Time zone of the period and the report, e.g. Europe/Moscow (default UTC)"
+//	@Param          slug        query       []string    false   "Segment slugs" collectionFormat(csv)
+//	@Param          action      query       []string    false   "Actions: ADD, REMOVE, EXPIRE" collectionFormat(csv)
+//	@Param          format      query       string      false   "Report format: csv, tsv, json, ndjson (overrides Accept)"
+//	@Param          delimiter   query       string      false   "Field delimiter of the csv format (default ;)"
+//	@Param          mode        query       string      false   "stream (default) or url"
+//	@Success        200     {file}      file            "The report"
+//	@Success        202     {object}    dto.ReportJobResponse   "mode=url: the report is still being generated"
+//	@Failure        400     {object}    response.ErrorResponse    "Invalid request"
+//	@Failure        401     {object}    response.ErrorResponse    "Unauthorized"
+//	@Failure        403     {object}    response.ErrorResponse    "Forbidden"
+//	@Failure        422     {object}    response.ErrorResponse    "Validation failed"
+//	@Failure        500     {object}    response.ErrorResponse    "Internal server error"
+//	@Security       ApiKeyAuth
+//	@Router         /users/{id}/segments/history [get]
+func (rh *ReportHandlers) HistoryHandle(w http.ResponseWriter, r *http.Request) {
+	const fn = "HistoryHandle"
+
+	userID, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		slog.Error(fn, "handler", reportHandler, "err", err)
+		response.WriteError(w, http.StatusBadRequest, codeInvalidParameter, "invalid user id", nil)
+		return
+	}
+	params, err := parseHistoryParams(r)
+	if err != nil {
+		slog.Error(fn, "handler", reportHandler, "err", err)
+		response.WriteError(w, http.StatusBadRequest, codeInvalidParameter, err.Error(), nil)
+		return
+	}
+	params.UserIDs = []int{userID}
+	rh.respond(w, r, fn, params)
+}
+
+// HistoryAllHandle sends a report on the history of many or all users or, in the url mode,
+// returns JSON with the download URL.
+//
+//	@Summary        Get a history report
+//	@Description    Streams a report on the history of segment changes for the period (from and to, or year and month)
+//	@Description    for the given users or all users, optionally filtered by segment slugs and actions,
+//	@Description    in the format from ?format= or the Accept header: csv (the delimiter is set by ?delimiter=,
+//	@Description    ";" by default), tsv, json or ndjson. With mode=url a report job is created and the download link
+//	@Description    is returned; if the report is not ready in a few seconds, the job is returned with the status 202.
+//	@Tags           user-segments-history
+//	@Produce        text/csv,text/tab-separated-values,json,application/x-ndjson
+//	@Param          from        query       string      false   "Start of the period, inclusive (RFC 3339 or YYYY-MM-DD)"
+//	@Param          to          query       string      false   "End of the period, exclusive (RFC 3339 or YYYY-MM-DD)"
+//	@Param          year        query       int         false   "Year, e.g. 2025"
+//	@Param          month       query       int         false   "Month, e.g. 02"
+//	@Param          tz          query       string      false   "Time zone of the period and the report, e.g. Europe/Moscow (default UTC)"
+//	@Param          user_id     query       []int       false   "User IDs, all users if not set" collectionFormat(csv)
+//	@Param          slug        query       []string    false   "Segment slugs" collectionFormat(csv)
+//	@Param          action      query       []string    false   "Actions: ADD, REMOVE, EXPIRE" collectionFormat(csv)
+//	@Param          format      query       string      false   "Report format: csv, tsv, json, ndjson (overrides Accept)"
+//	@Param          delimiter   query       string      false   "Field delimiter of the csv format (default ;)"
+//	@Param          mode        query       string      false   "stream (default) or url"
+//	@Success        200     {file}      file            "The report"
+//	@Success        202     {object}    dto.ReportJobResponse   "mode=url: the report is still being generated"
+//	@Failure        400     {object}    response.ErrorResponse    "Invalid request"
+//	@Failure        401     {object}    response.ErrorResponse    "Unauthorized"
+//	@Failure        403     {object}    response.ErrorResponse    "Forbidden"
+//	@Failure        422     {object}    response.ErrorResponse    "Validation failed"
+//	@Failure        500     {object}    response.ErrorResponse    "Internal server error"
+//	@Security       ApiKeyAuth
+//	@Router         /history [get]
+func (rh *ReportHandlers) HistoryAllHandle(w http.ResponseWriter, r *http.Request) {
+	const fn = "HistoryAllHandle"
+
+	params, err := parseHistoryParams(r)
+	if err != nil {
+		slog.Error(fn, "handler", reportHandler, "err", err)
+		response.WriteError(w, http.StatusBadRequest, codeInvalidParameter, err.Error(), nil)
+		return
+	}
+	rh.respond(w, r, fn, params)
+}
+
+// respond sends the history report in the mode of the request.
+func (rh *ReportHandlers) respond(w http.ResponseWriter, r *http.Request, fn string, params models.HistoryParams) {
+	switch mode := r.URL.Query().Get("mode"); mode {
+	case "", historyModeStream:
+		rh.stream(w, r, fn, params)
+	case historyModeURL:
+		rh.generate(w, r, fn, params)
+	default:
+		slog.Error(fn, "handler", reportHandler, "err", "invalid mode", "mode", mode)
+		response.WriteError(w, http.StatusBadRequest, codeInvalidParameter,
+			fmt.Sprintf("invalid mode: %q, expected %s or %s", mode, historyModeStream, historyModeURL), nil)
+	}
+}
+
+// stream sends the report straight in the response as an attachment.
+// The format is taken from ?format= or, if it is not set, from the Accept header.
+func (rh *ReportHandlers) stream(w http.ResponseWriter, r *http.Request, fn string, params models.HistoryParams) {
+	if params.Format == "" {
+		params.Format = acceptedReportFormat(r)
+	}
+	if err := rh.reports.Validate(&params); err != nil {
+		slog.Error(fn, "handler", reportHandler, "err", err)
+		writeServiceError(w, err)
+		return
+	}
+
+	err := streamExport(w, r, reportContentTypes[params.Format], reportFileName(params),
+		func(ctx context.Context, w io.Writer) error {
+			return rh.reports.Stream(ctx, w, params)
+		})
+	if err != nil {
+		slog.Error(fn, "handler", reportHandler, "err", err)
+		return
+	}
+	slog.Info(fn, "handler", reportHandler, "success", true, "format", params.Format)
+}
+
+// generate creates the report job and responds with the download URL if the report is ready in time,
+// or with the job and the status 202 otherwise.
+func (rh *ReportHandlers) generate(w http.ResponseWriter, r *http.Request, fn string, params models.HistoryParams) {
+	job, err := rh.reports.Generate(r.Context(), params)
+	if err != nil {
+		slog.Error(fn, "handler", reportHandler, "err", err)
+		writeServiceError(w, err)
+		return
+	}
+
+	switch job.Status {
+	case models.ReportDone:
+		dURL := withDownloadURL(r, job).DownloadURL
+		err = response.WriteJSON(w, http.StatusOK, map[string]string{"url": dURL})
+	case models.ReportFailed:
+		slog.Error(fn, "handler", reportHandler, "job", job.ID, "err", job.Error)
+		response.WriteError(w, http.StatusInternalServerError, codeInternal, "report generation failed", nil)
+		return
+	default:
+		w.Header().Set("Location", "/reports/"+job.ID)
+		err = response.WriteJSON(w, http.StatusAccepted, job)
+	}
+	if err != nil {
+		slog.Error(fn, "handler", reportHandler, "err", err)
+		return
+	}
+	slog.Info(fn, "handler", reportHandler, "success", job.ID, "status", job.Status)
+}
@@ -0,0 +1,42 @@
+// Package handlers provide HTTP request handlers for user segments.
+package handlers
+
+import (
+	"errors"
+	"net/http"
+
+	"user_segmentation_service/internal/modules/service_errors"
+	"user_segmentation_service/internal/server/response"
+)
+
+// Machine-readable codes of errors detected by the handlers themselves.
+// Domain errors carry their own codes (see service_errors).
+const (
+	codeInvalidJSON      = "invalid_json"
+	codeInvalidParameter = "invalid_parameter"
+	codeInternal         = "internal_error"
+)
+
+// writeServiceError maps an error returned by a service to the HTTP status:
+// not found - 404, conflict - 409, precondition failed - 412, validation - 422, anything else - 500.
+// Details of unexpected errors are not disclosed to the client.
+func writeServiceError(w http.ResponseWriter, err error) {
+	var svcErr *service_errors.Error
+	if !errors.As(err, &svcErr) {
+		response.WriteError(w, http.StatusInternalServerError, codeInternal, "internal server error", nil)
+		return
+	}
+
+	status := http.StatusInternalServerError
+	switch {
+	case errors.Is(svcErr.Kind, service_errors.ErrNotFound):
+		status = http.StatusNotFound
+	case errors.Is(svcErr.Kind, service_errors.ErrConflict):
+		status = http.StatusConflict
+	case errors.Is(svcErr.Kind, service_errors.ErrPreconditionFailed):
+		status = http.StatusPreconditionFailed
+	case errors.Is(svcErr.Kind, service_errors.ErrValidation):
+		status = http.StatusUnprocessableEntity
+	}
+	response.WriteError(w, status, svcErr.Code, svcErr.Message, svcErr.Details)
+}
@@ -4,19 +4,35 @@ package handlers
 import (
 	"context"
 	"encoding/json"
+	"fmt"
+	"io"
 	"log/slog"
 	"net/http"
+	"net/url"
+	"strconv"
+	"time"
 
+	"user_segmentation_service/internal/db"
 	"user_segmentation_service/internal/models"
+	"user_segmentation_service/internal/server/response"
 )
 
 // segmentService defines the methods for interacting with the segment data.
 type segmentService interface {
 	Create(ctx context.Context, seg *models.Segment) error
-	Delete(ctx context.Context, slug string) error
-	Update(ctx context.Context, seg *models.Segment) error
+	Delete(ctx context.Context, slug string, ifMatch []int, meta models.ChangeMeta) error
+	Update(ctx context.Context, seg *models.Segment, ifMatch []int) error
 	GetBySlug(ctx context.Context, slug string) (*models.Segment, error)
-	GetAll(ctx context.Context) ([]*models.Segment, error)
+	GetAll(ctx context.Context, archived bool, p db.ListParams) (*models.Page[*models.Segment], error)
+	Restore(ctx context.Context, slug string) (*models.Segment, error)
+	Rename(ctx context.Context, slug, newSlug string) (*models.SegmentRename, error)
+	Renames(ctx context.Context, slug string) ([]*models.SegmentRename, error)
+	Purge(ctx context.Context, slug string) error
+	Export(ctx context.Context, w io.Writer) error
+	GetMembers(ctx context.Context, slug string, includeExpired bool, p db.ListParams) (*models.Page[*models.SegmentMember], error)
+	CountMembers(ctx context.Context, slug string, includeExpired bool) (int64, error)
+	Stats(ctx context.Context, slug string, p db.StatsParams) (*models.SegmentStats, error)
+	AllStats(ctx context.Context, p db.StatsParams) ([]*models.SegmentStats, error)
 }
 
 // SegmentHandlers handles HTTP requests related to segments.
@@ -38,37 +54,43 @@ func NewSegmentHandler(ctx context.Context, ss segmentService) *SegmentHandlers
 // CreateHandle handles the request for creating a new segment.
 //
 //	@Summary        Add segment
-//	@Description    Creates a segment in the database and returns the instance
+//	@Description    Creates a segment in the database and returns the instance.
+//	@Description    If auto_percent is set, that share of all users (current and future) is enrolled in the segment.
 //	@Tags           segments
 //	@Accept         json
 //	@Produce        json
 //	@Param          Segment body        dto.SegmentCreateRequest    true    "Information about the segment to be added"
 //	@Success        201     {object}    dto.SegmentResponse                 "The segment has been successfully established"
+//	@Failure        400     {object}    response.ErrorResponse    "Invalid request"
+//	@Failure        401     {object}    response.ErrorResponse    "Unauthorized"
+//	@Failure        403     {object}    response.ErrorResponse    "Forbidden"
+//	@Failure        409     {object}    response.ErrorResponse    "Already exists"
+//	@Failure        422     {object}    response.ErrorResponse    "Validation failed"
+//	@Failure        500     {object}    response.ErrorResponse    "Internal server error"
+//	@Security       ApiKeyAuth
 //	@Router         /segments [post]
 func (sh *SegmentHandlers) CreateHandle(w http.ResponseWriter, r *http.Request) {
 	const fn = "CreateHandle"
 
 	var (
 		err     error
-		segment *models.Segment
+		segment = &models.Segment{}
 	)
 
-	if err = json.NewDecoder(r.Body).Decode(&segment); err != nil {
+	if err = json.NewDecoder(r.Body).Decode(segment); err != nil {
 		slog.Error(fn, "handler", segmentHandler, "err", err)
-		w.WriteHeader(http.StatusBadRequest)
+		response.WriteError(w, http.StatusBadRequest, codeInvalidJSON, err.Error(), nil)
 		return
 	}
-	if err = sh.segments.Create(sh.ctx, segment); err != nil {
+	if err = sh.segments.Create(r.Context(), segment); err != nil {
 		slog.Error(fn, "handler", segmentHandler, "err", err)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeServiceError(w, err)
 		return
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusCreated)
-	if err = json.NewEncoder(w).Encode(segment); err != nil {
+	w.Header().Set("ETag", versionETag(segment.Version))
+	if err = response.WriteJSON(w, http.StatusCreated, segment); err != nil {
 		slog.Error(fn, "handler", segmentHandler, "err", err)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 	slog.Info(fn, "handler", segmentHandler, "success", segment)
@@ -77,12 +99,24 @@ func (sh *SegmentHandlers) CreateHandle(w http.ResponseWriter, r *http.Request)
 // DeleteHandle handles the request for deleting a segment.
 //
 //	@Summary        Delete segment
-//	@Description    Deletes a segment from the database
+//	@Description    Archives a segment: the memberships of all users are ended and recorded in the history as REMOVE,
+//	@Description    the segment disappears from the active lookups, but its history stays reportable.
+//	@Description    The segment can be restored with POST /segments/{slug}/restore.
+//	@Description    With If-Match the segment is archived only if it has not been modified since (412 otherwise).
 //	@Tags           segments
 //	@Accept         json
 //	@Produce        json
 //	@Param          slug    path    string  true    "Segment slug"
-//	@Success        204                             "The segment with this slug has been successfully deleted"
+//	@Param          If-Match    header      string      false   "ETag of the version the change is based on"
+//	@Success        204                             "The segment with this slug has been successfully archived"
+//	@Failure        401     {object}    response.ErrorResponse    "Unauthorized"
+//	@Failure        403     {object}    response.ErrorResponse    "Forbidden"
+//	@Failure        404     {object}    response.ErrorResponse    "Not found"
+//	@Failure        409     {object}    response.ErrorResponse    "Already archived"
+//	@Failure        412     {object}    response.ErrorResponse    "Modified since the ETag in If-Match"
+//	@Failure        428     {object}    response.ErrorResponse    "If-Match is required"
+//	@Failure        500     {object}    response.ErrorResponse    "Internal server error"
+//	@Security       ApiKeyAuth
 //	@Router         /segments/{slug} [delete]
 func (sh *SegmentHandlers) DeleteHandle(w http.ResponseWriter, r *http.Request) {
 	const fn = "DeleteHandle"
@@ -92,9 +126,9 @@ func (sh *SegmentHandlers) DeleteHandle(w http.ResponseWriter, r *http.Request)
 		slug = r.PathValue("slug")
 	)
 
-	if err = sh.segments.Delete(sh.ctx, slug); err != nil {
+	if err = sh.segments.Delete(r.Context(), slug, ifMatchVersions(r), changeMeta(r, "", "", "")); err != nil {
 		slog.Error(fn, "handler", segmentHandler, "err", err)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeServiceError(w, err)
 		return
 	}
 
@@ -106,13 +140,24 @@ func (sh *SegmentHandlers) DeleteHandle(w http.ResponseWriter, r *http.Request)
 // UpdateHandle handles the request for updating an existing segment.
 //
 //	@Summary        Update segment
-//	@Description    Updates a segment in the database and returns an instance of it
+//	@Description    Updates a segment in the database and returns an instance of it with the new ETag.
+//	@Description    With If-Match the segment is updated only if it has not been modified since (412 otherwise).
 //	@Tags           segments
 //	@Accept         json
 //	@Produce        json
 //	@Param          slug    path        string                      true    "Segment slug"
+//	@Param          If-Match    header      string      false   "ETag of the version the change is based on"
 //	@Param          Segment body        dto.SegmentUpdateRequest    true    "Segment change information"
 //	@Success        200     {object}    dto.SegmentResponse                 "The segment with this slogan has been changed"
+//	@Header         200     {string}    ETag                                "Version of the segment"
+//	@Failure        400     {object}    response.ErrorResponse    "Invalid request"
+//	@Failure        401     {object}    response.ErrorResponse    "Unauthorized"
+//	@Failure        403     {object}    response.ErrorResponse    "Forbidden"
+//	@Failure        404     {object}    response.ErrorResponse    "Not found"
+//	@Failure        412     {object}    response.ErrorResponse    "Modified since the ETag in If-Match"
+//	@Failure        428     {object}    response.ErrorResponse    "If-Match is required"
+//	@Failure        500     {object}    response.ErrorResponse    "Internal server error"
+//	@Security       ApiKeyAuth
 //	@Router         /segments/{slug} [put]
 func (sh *SegmentHandlers) UpdateHandle(w http.ResponseWriter, r *http.Request) {
 	const fn = "UpdateHandle"
@@ -120,39 +165,195 @@ func (sh *SegmentHandlers) UpdateHandle(w http.ResponseWriter, r *http.Request)
 	var (
 		err     error
 		slug    = r.PathValue("slug")
-		segment *models.Segment
+		segment = &models.Segment{}
 	)
 
-	if err = json.NewDecoder(r.Body).Decode(&segment); err != nil {
+	if err = json.NewDecoder(r.Body).Decode(segment); err != nil {
 		slog.Error(fn, "handler", segmentHandler, "err", err)
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		response.WriteError(w, http.StatusBadRequest, codeInvalidJSON, err.Error(), nil)
 		return
 	}
 	segment.Slug = slug
-	if err = sh.segments.Update(sh.ctx, segment); err != nil {
+	if err = sh.segments.Update(r.Context(), segment, ifMatchVersions(r)); err != nil {
 		slog.Error(fn, "handler", segmentHandler, "err", err)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeServiceError(w, err)
 		return
 	}
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusOK)
-	if err = json.NewEncoder(w).Encode(segment); err != nil {
+	w.Header().Set("ETag", versionETag(segment.Version))
+	if err = response.WriteJSON(w, http.StatusOK, segment); err != nil {
+		slog.Error(fn, "handler", segmentHandler, "err", err)
+		return
+	}
+	slog.Info(fn, "handler", segmentHandler, "success", segment)
+}
+
+// RestoreHandle handles the request for restoring an archived segment.
+//
+//	@Summary        Restore segment
+//	@Description    Makes an archived segment active again and returns it. The memberships ended by the archiving
+//	@Description    are not restored; if auto_percent is set, that share of all users is enrolled in the segment again.
+//	@Tags           segments
+//	@Produce        json
+//	@Param          slug    path        string      true        "Segment slug"
+//	@Success        200     {object}    dto.SegmentResponse     "The segment has been restored"
+//	@Failure        401     {object}    response.ErrorResponse    "Unauthorized"
+//	@Failure        403     {object}    response.ErrorResponse    "Forbidden"
+//	@Failure        404     {object}    response.ErrorResponse    "Not found"
+//	@Failure        409     {object}    response.ErrorResponse    "Not archived"
+//	@Failure        500     {object}    response.ErrorResponse    "Internal server error"
+//	@Security       ApiKeyAuth
+//	@Router         /segments/{slug}/restore [post]
+func (sh *SegmentHandlers) RestoreHandle(w http.ResponseWriter, r *http.Request) {
+	const fn = "RestoreHandle"
+
+	segment, err := sh.segments.Restore(r.Context(), r.PathValue("slug"))
+	if err != nil {
+		slog.Error(fn, "handler", segmentHandler, "err", err)
+		writeServiceError(w, err)
+		return
+	}
+	w.Header().Set("ETag", versionETag(segment.Version))
+	if err = response.WriteJSON(w, http.StatusOK, segment); err != nil {
 		slog.Error(fn, "handler", segmentHandler, "err", err)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 	slog.Info(fn, "handler", segmentHandler, "success", segment)
 }
 
+// PurgeHandle handles the administrative request for deleting an archived segment for good.
+//
+//	@Summary        Purge segment
+//	@Description    Irreversibly deletes an archived segment together with its whole history.
+//	@Description    Active segments must be archived with DELETE /segments/{slug} first.
+//	@Tags           admin
+//	@Produce        json
+//	@Param          slug    path    string  true    "Segment slug"
+//	@Success        204                             "The segment and its history have been deleted"
+//	@Failure        401     {object}    response.ErrorResponse    "Unauthorized"
+//	@Failure        403     {object}    response.ErrorResponse    "Forbidden"
+//	@Failure        404     {object}    response.ErrorResponse    "Not found"
+//	@Failure        409     {object}    response.ErrorResponse    "Not archived"
+//	@Failure        500     {object}    response.ErrorResponse    "Internal server error"
+//	@Security       ApiKeyAuth
+//	@Router         /admin/segments/{slug} [delete]
+func (sh *SegmentHandlers) PurgeHandle(w http.ResponseWriter, r *http.Request) {
+	const fn = "PurgeHandle"
+
+	slug := r.PathValue("slug")
+	if err := sh.segments.Purge(r.Context(), slug); err != nil {
+		slog.Error(fn, "handler", segmentHandler, "err", err)
+		writeServiceError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusNoContent)
+	slog.Warn(fn, "handler", segmentHandler, "purged", slug)
+}
+
+// setDeprecationHeaders marks the response to a request by a deprecated alias of a renamed segment:
+// the alias is deprecated, stops resolving at Sunset and the segment is available under its current slug.
+func setDeprecationHeaders(w http.ResponseWriter, seg *models.Segment) {
+	w.Header().Set("Deprecation", "true")
+	w.Header().Set("Sunset", seg.Alias.ExpiresAt.UTC().Format(http.TimeFormat))
+	w.Header().Set("Link", "</segments/"+url.PathEscape(seg.Slug)+`>; rel="successor-version"`)
+}
+
+// RenameHandle handles the request for changing the slug of a segment.
+//
+//	@Summary        Rename segment
+//	@Description    Changes the slug of a segment. The history continues under the new slug, the old slug resolves
+//	@Description    to the segment as a deprecated alias for SEGMENTS_ALIAS_TTL. The rename is recorded in the audit trail.
+//	@Tags           segments
+//	@Accept         json
+//	@Produce        json
+//	@Param          slug    path        string                      true    "Segment slug"
+//	@Param          Rename  body        dto.SegmentRenameRequest    true    "New slug"
+//	@Success        200     {object}    dto.SegmentRenameResponse           "The segment has been renamed"
+//	@Failure        400     {object}    response.ErrorResponse    "Invalid request"
+//	@Failure        401     {object}    response.ErrorResponse    "Unauthorized"
+//	@Failure        403     {object}    response.ErrorResponse    "Forbidden"
+//	@Failure        404     {object}    response.ErrorResponse    "Not found"
+//	@Failure        409     {object}    response.ErrorResponse    "The slug is taken"
+//	@Failure        422     {object}    response.ErrorResponse    "Validation failed"
+//	@Failure        500     {object}    response.ErrorResponse    "Internal server error"
+//	@Security       ApiKeyAuth
+//	@Router         /segments/{slug}/rename [post]
+func (sh *SegmentHandlers) RenameHandle(w http.ResponseWriter, r *http.Request) {
+	const fn = "RenameHandle"
+
+	var req struct {
+		Slug string `json:"slug"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		slog.Error(fn, "handler", segmentHandler, "err", err)
+		response.WriteError(w, http.StatusBadRequest, codeInvalidJSON, err.Error(), nil)
+		return
+	}
+	rename, err := sh.segments.Rename(r.Context(), r.PathValue("slug"), req.Slug)
+	if err != nil {
+		slog.Error(fn, "handler", segmentHandler, "err", err)
+		writeServiceError(w, err)
+		return
+	}
+
+	w.Header().Set("Location", "/segments/"+url.PathEscape(rename.NewSlug))
+	if err = response.WriteJSON(w, http.StatusOK, rename); err != nil {
+		slog.Error(fn, "handler", segmentHandler, "err", err)
+		return
+	}
+	slog.Info(fn, "handler", segmentHandler, "success", rename)
+}
+
+// RenamesHandle handles the request for the audit trail of segment renames.
+//
+//	@Summary        Get segment renames
+//	@Description    Returns the renames of the segment, oldest first. The slug may be a deprecated alias.
+//	@Tags           segments
+//	@Produce        json
+//	@Param          slug    path        string      true    "Segment slug"
+//	@Success        200     {array}     dto.SegmentRenameResponse   "The renames of the segment"
+//	@Failure        401     {object}    response.ErrorResponse    "Unauthorized"
+//	@Failure        403     {object}    response.ErrorResponse    "Forbidden"
+//	@Failure        404     {object}    response.ErrorResponse    "Not found"
+//	@Failure        500     {object}    response.ErrorResponse    "Internal server error"
+//	@Security       ApiKeyAuth
+//	@Router         /segments/{slug}/renames [get]
+func (sh *SegmentHandlers) RenamesHandle(w http.ResponseWriter, r *http.Request) {
+	const fn = "RenamesHandle"
+
+	renames, err := sh.segments.Renames(r.Context(), r.PathValue("slug"))
+	if err != nil {
+		slog.Error(fn, "handler", segmentHandler, "err", err)
+		writeServiceError(w, err)
+		return
+	}
+	if err = response.WriteJSON(w, http.StatusOK, renames); err != nil {
+		slog.Error(fn, "handler", segmentHandler, "err", err)
+		return
+	}
+	slog.Info(fn, "handler", segmentHandler, "count", len(renames))
+}
+
 // GetHandle handles the request for retrieving a single segment by its slug.
 //
 //	@Summary        Get segment
-//	@Description    Get segment by slug
+//	@Description    Get segment by slug. A former slug of a renamed segment resolves to it until the alias expires:
+//	@Description    the response then has deprecated_alias set and the Deprecation, Sunset and Link headers.
+//	@Description    The ETag is the version of the segment; with a matching If-None-Match the response is 304.
 //	@Tags           segments
 //	@Accept         json
 //	@Produce        json
-//	@Param          slug    path        string      true        "Segment slug"
+//	@Param          slug            path        string      true        "Segment slug"
+//	@Param          If-None-Match   header      string      false       "ETag of the cached segment"
 //	@Success        200     {object}    dto.SegmentResponse     "A segment with such a slogan was obtained"
+//	@Header         200     {string}    ETag                    "Version of the segment"
+//	@Success        304                                         "The segment has not been modified"
+//	@Failure        401     {object}    response.ErrorResponse    "Unauthorized"
+//	@Failure        403     {object}    response.ErrorResponse    "Forbidden"
+//	@Failure        404     {object}    response.ErrorResponse    "Not found"
+//	@Failure        500     {object}    response.ErrorResponse    "Internal server error"
+//	@Security       ApiKeyAuth
 //	@Router         /segments/{slug} [get]
 func (sh *SegmentHandlers) GetHandle(w http.ResponseWriter, r *http.Request) {
 	const fn = "GetHandle"
@@ -163,50 +364,292 @@ func (sh *SegmentHandlers) GetHandle(w http.ResponseWriter, r *http.Request) {
 		segment *models.Segment
 	)
 
-	if segment, err = sh.segments.GetBySlug(sh.ctx, slug); err != nil {
+	if segment, err = sh.segments.GetBySlug(r.Context(), slug); err != nil {
 		slog.Error(fn, "handler", segmentHandler, "err", err)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeServiceError(w, err)
 		return
 	}
+	if segment.Alias != nil {
+		setDeprecationHeaders(w, segment)
+	}
 
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusOK)
-	if err = json.NewEncoder(w).Encode(segment); err != nil {
+	var notModified bool
+	if notModified, err = writeJSONWithETag(w, r, versionETag(segment.Version), segment); err != nil {
 		slog.Error(fn, "handler", segmentHandler, "err", err)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-	slog.Info(fn, "handler", segmentHandler, "success", segment)
+	slog.Info(fn, "handler", segmentHandler, "success", segment, "not_modified", notModified)
 }
 
 // GetAllHandle handles the request for retrieving all segments.
 //
 //	@Summary        Get All segments
-//	@Description    Get all segments from the database
+//	@Description    Get a page of segments from the database.
+//	@Description    Pagination is keyset-based: pass next_cursor of the previous page as cursor with the same sort.
+//	@Description    The ETag identifies the content of the page; with a matching If-None-Match the response is 304.
 //	@Tags           segments
 //	@Accept         json
 //	@Produce        json
-//	@Success        200     {array}    dto.SegmentResponse     "An array of segments was obtained"
+//	@Param          limit           query       int         false   "Page size (default 100, max 1000)"
+//	@Param          cursor          query       string      false   "Cursor of the next page"
+//	@Param          sort            query       string      false   "Sort key: id, slug, created_at; '-' prefix for descending order"
+//	@Param          slug_prefix     query       string      false   "Filter by slug prefix"
+//	@Param          created_from    query       string      false   "Created at or after (RFC 3339)"
+//	@Param          created_to      query       string      false   "Created before (RFC 3339)"
+//	@Param          archived        query       bool        false   "List archived segments instead of active ones"
+//	@Param          If-None-Match   header      string      false   "ETag of the cached page"
+//	@Success        200             {object}    dto.SegmentPageResponse    "A page of segments was obtained"
+//	@Header         200             {string}    ETag                       "Hash of the page"
+//	@Success        304                                                    "The page has not changed"
+//	@Failure        400     {object}    response.ErrorResponse    "Invalid request"
+//	@Failure        401     {object}    response.ErrorResponse    "Unauthorized"
+//	@Failure        403     {object}    response.ErrorResponse    "Forbidden"
+//	@Failure        422     {object}    response.ErrorResponse    "Validation failed"
+//	@Failure        500     {object}    response.ErrorResponse    "Internal server error"
+//	@Security       ApiKeyAuth
 //	@Router         /segments [get]
-func (sh *SegmentHandlers) GetAllHandle(w http.ResponseWriter, _ *http.Request) {
+func (sh *SegmentHandlers) GetAllHandle(w http.ResponseWriter, r *http.Request) {
 	const fn = "GetAllHandle"
 
 	var (
 		err      error
-		segments []*models.Segment
+		params   db.ListParams
+		page     *models.Page[*models.Segment]
+		archived bool
 	)
 
-	if segments, err = sh.segments.GetAll(sh.ctx); err != nil {
+	if params, err = parseListParams(r, "slug_prefix"); err != nil {
 		slog.Error(fn, "handler", segmentHandler, "err", err)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		response.WriteError(w, http.StatusBadRequest, codeInvalidParameter, err.Error(), nil)
 		return
 	}
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusOK)
-	if err = json.NewEncoder(w).Encode(segments); err != nil {
+	if v := r.URL.Query().Get("archived"); v != "" {
+		if archived, err = strconv.ParseBool(v); err != nil {
+			slog.Error(fn, "handler", segmentHandler, "err", err)
+			response.WriteError(w, http.StatusBadRequest, codeInvalidParameter, "invalid archived: "+strconv.Quote(v), nil)
+			return
+		}
+	}
+	if page, err = sh.segments.GetAll(r.Context(), archived, params); err != nil {
+		slog.Error(fn, "handler", segmentHandler, "err", err)
+		writeServiceError(w, err)
+		return
+	}
+	var notModified bool
+	if notModified, err = writeJSONWithETag(w, r, "", page); err != nil {
+		slog.Error(fn, "handler", segmentHandler, "err", err)
+		return
+	}
+	slog.Info(fn, "handler", segmentHandler, "count", len(page.Items), "next_cursor", page.NextCursor,
+		"not_modified", notModified)
+}
+
+// ExportHandle streams all segments as NDJSON.
+//
+//	@Summary        Export segments
+//	@Description    Streams all segments as NDJSON (one JSON object per line) straight from the database.
+//	@Description    The response is gzip-compressed if the client sends Accept-Encoding: gzip.
+//	@Tags           segments
+//	@Produce        application/x-ndjson
+//	@Success        200     {object}    dto.SegmentResponse     "Segments, one per line"
+//	@Failure        401     {object}    response.ErrorResponse    "Unauthorized"
+//	@Failure        403     {object}    response.ErrorResponse    "Forbidden"
+//	@Failure        500     {object}    response.ErrorResponse    "Internal server error"
+//	@Security       ApiKeyAuth
+//	@Router         /segments/export [get]
+func (sh *SegmentHandlers) ExportHandle(w http.ResponseWriter, r *http.Request) {
+	const fn = "ExportHandle"
+
+	if err := streamExport(w, r, "application/x-ndjson", "segments.ndjson", sh.segments.Export); err != nil {
+		slog.Error(fn, "handler", segmentHandler, "err", err)
+		return
+	}
+	slog.Info(fn, "handler", segmentHandler, "success", true)
+}
+
+// MembersHandle handles the request for retrieving the users in a segment.
+//
+//	@Summary        Get segment members
+//	@Description    Get a page of users in the segment with their join and expiration times,
+//	@Description    or only their number as {"count": 42} with count_only=true.
+//	@Description    Pagination is keyset-based: pass next_cursor of the previous page as cursor with the same sort.
+//	@Tags           segments
+//	@Produce        json
+//	@Param          slug            path        string      true    "Segment slug"
+//	@Param          include_expired query       bool        false   "Include users whose membership has expired but is not removed yet"
+//	@Param          count_only      query       bool        false   "Return only the number of users"
+//	@Param          limit           query       int         false   "Page size (default 100, max 1000)"
+//	@Param          cursor          query       string      false   "Cursor of the next page"
+//	@Param          sort            query       string      false   "Sort key: id, name, joined_at; '-' prefix for descending order"
+//	@Param          name_prefix     query       string      false   "Filter by user name prefix"
+//	@Param          created_from    query       string      false   "Joined at or after (RFC 3339)"
+//	@Param          created_to      query       string      false   "Joined before (RFC 3339)"
+//	@Success        200             {object}    dto.SegmentMemberPageResponse   "A page of segment members was obtained"
+//	@Failure        400     {object}    response.ErrorResponse    "Invalid request"
+//	@Failure        401     {object}    response.ErrorResponse    "Unauthorized"
+//	@Failure        403     {object}    response.ErrorResponse    "Forbidden"
+//	@Failure        404     {object}    response.ErrorResponse    "Segment not found"
+//	@Failure        422     {object}    response.ErrorResponse    "Validation failed"
+//	@Failure        500     {object}    response.ErrorResponse    "Internal server error"
+//	@Security       ApiKeyAuth
+//	@Router         /segments/{slug}/users [get]
+func (sh *SegmentHandlers) MembersHandle(w http.ResponseWriter, r *http.Request) {
+	const fn = "MembersHandle"
+
+	var (
+		err                       error
+		slug                      = r.PathValue("slug")
+		params                    db.ListParams
+		includeExpired, countOnly bool
+	)
+
+	for name, dst := range map[string]*bool{"include_expired": &includeExpired, "count_only": &countOnly} {
+		if v := r.URL.Query().Get(name); v != "" {
+			if *dst, err = strconv.ParseBool(v); err != nil {
+				slog.Error(fn, "handler", segmentHandler, "err", err)
+				response.WriteError(w, http.StatusBadRequest, codeInvalidParameter, "invalid "+name+": "+strconv.Quote(v), nil)
+				return
+			}
+		}
+	}
+
+	if countOnly {
+		var count int64
+		if count, err = sh.segments.CountMembers(r.Context(), slug, includeExpired); err != nil {
+			slog.Error(fn, "handler", segmentHandler, "err", err)
+			writeServiceError(w, err)
+			return
+		}
+		if err = response.WriteJSON(w, http.StatusOK, map[string]int64{"count": count}); err != nil {
+			slog.Error(fn, "handler", segmentHandler, "err", err)
+			return
+		}
+		slog.Info(fn, "handler", segmentHandler, "slug", slug, "count", count)
+		return
+	}
+
+	if params, err = parseListParams(r, "name_prefix"); err != nil {
+		slog.Error(fn, "handler", segmentHandler, "err", err)
+		response.WriteError(w, http.StatusBadRequest, codeInvalidParameter, err.Error(), nil)
+		return
+	}
+	page, err := sh.segments.GetMembers(r.Context(), slug, includeExpired, params)
+	if err != nil {
+		slog.Error(fn, "handler", segmentHandler, "err", err)
+		writeServiceError(w, err)
+		return
+	}
+	if err = response.WriteJSON(w, http.StatusOK, page); err != nil {
+		slog.Error(fn, "handler", segmentHandler, "err", err)
+		return
+	}
+	slog.Info(fn, "handler", segmentHandler, "slug", slug, "count", len(page.Items), "next_cursor", page.NextCursor)
+}
+
+// parseStatsParams reads the parameters of segment statistics: from and to (YYYY-MM-DD, inclusive),
+// tz and expiring_within_days. The parameters are validated by the service.
+func parseStatsParams(r *http.Request) (db.StatsParams, error) {
+	q := r.URL.Query()
+	p := db.StatsParams{TimeZone: q.Get("tz")}
+
+	for name, dst := range map[string]*time.Time{"from": &p.From, "to": &p.To} {
+		if v := q.Get(name); v != "" {
+			t, err := time.Parse(time.DateOnly, v)
+			if err != nil {
+				return p, fmt.Errorf("invalid %s: %q, expected YYYY-MM-DD", name, v)
+			}
+			*dst = t
+		}
+	}
+	if v := q.Get("expiring_within_days"); v != "" {
+		days, err := strconv.Atoi(v)
+		if err != nil {
+			return p, fmt.Errorf("invalid expiring_within_days: %q", v)
+		}
+		p.ExpiringWithin = time.Duration(days) * 24 * time.Hour
+	}
+	return p, nil
+}
+
+// StatsHandle handles the request for the statistics of a segment.
+//
+//	@Summary        Get segment statistics
+//	@Description    Returns the number of active members of the segment, the number of members expiring
+//	@Description    within expiring_within_days and the daily numbers of additions, removals and expirations over the period.
+//	@Tags           segments
+//	@Produce        json
+//	@Param          slug                    path        string      true    "Segment slug"
+//	@Param          from                    query       string      false   "First day of the period, YYYY-MM-DD (default 29 days before to)"
+//	@Param          to                      query       string      false   "Last day of the period, inclusive, YYYY-MM-DD (default today)"
+//	@Param          tz                      query       string      false   "Time zone of the days, e.g. Europe/Moscow (default UTC)"
+//	@Param          expiring_within_days    query       int         false   "Horizon of the members expiring soon (default 7)"
+//	@Success        200     {object}    dto.SegmentStatsResponse    "Statistics of the segment"
+//	@Failure        400     {object}    response.ErrorResponse    "Invalid request"
+//	@Failure        401     {object}    response.ErrorResponse    "Unauthorized"
+//	@Failure        403     {object}    response.ErrorResponse    "Forbidden"
+//	@Failure        404     {object}    response.ErrorResponse    "Segment not found"
+//	@Failure        422     {object}    response.ErrorResponse    "Validation failed"
+//	@Failure        500     {object}    response.ErrorResponse    "Internal server error"
+//	@Security       ApiKeyAuth
+//	@Router         /segments/{slug}/stats [get]
+func (sh *SegmentHandlers) StatsHandle(w http.ResponseWriter, r *http.Request) {
+	const fn = "StatsHandle"
+
+	params, err := parseStatsParams(r)
+	if err != nil {
+		slog.Error(fn, "handler", segmentHandler, "err", err)
+		response.WriteError(w, http.StatusBadRequest, codeInvalidParameter, err.Error(), nil)
+		return
+	}
+	stats, err := sh.segments.Stats(r.Context(), r.PathValue("slug"), params)
+	if err != nil {
+		slog.Error(fn, "handler", segmentHandler, "err", err)
+		writeServiceError(w, err)
+		return
+	}
+	if err = response.WriteJSON(w, http.StatusOK, stats); err != nil {
+		slog.Error(fn, "handler", segmentHandler, "err", err)
+		return
+	}
+	slog.Info(fn, "handler", segmentHandler, "slug", stats.Slug, "active_members", stats.ActiveMembers)
+}
+
+// AllStatsHandle handles the request for the statistics of all segments.
+//
+//	@Summary        Get statistics of all segments
+//	@Description    Returns the statistics of every segment ordered by slug, see /segments/{slug}/stats.
+//	@Tags           segments
+//	@Produce        json
+//	@Param          from                    query       string      false   "First day of the period, YYYY-MM-DD (default 29 days before to)"
+//	@Param          to                      query       string      false   "Last day of the period, inclusive, YYYY-MM-DD (default today)"
+//	@Param          tz                      query       string      false   "Time zone of the days, e.g. Europe/Moscow (default UTC)"
+//	@Param          expiring_within_days    query       int         false   "Horizon of the members expiring soon (default 7)"
+//	@Success        200     {array}     dto.SegmentStatsResponse    "Statistics of the segments"
+//	@Failure        400     {object}    response.ErrorResponse    "Invalid request"
+//	@Failure        401     {object}    response.ErrorResponse    "Unauthorized"
+//	@Failure        403     {object}    response.ErrorResponse    "Forbidden"
+//	@Failure        422     {object}    response.ErrorResponse    "Validation failed"
+//	@Failure        500     {object}    response.ErrorResponse    "Internal server error"
+//	@Security       ApiKeyAuth
+//	@Router         /segments/stats [get]
+func (sh *SegmentHandlers) AllStatsHandle(w http.ResponseWriter, r *http.Request) {
+	const fn = "AllStatsHandle"
+
+	params, err := parseStatsParams(r)
+	if err != nil {
+		slog.Error(fn, "handler", segmentHandler, "err", err)
+		response.WriteError(w, http.StatusBadRequest, codeInvalidParameter, err.Error(), nil)
+		return
+	}
+	stats, err := sh.segments.AllStats(r.Context(), params)
+	if err != nil {
+		slog.Error(fn, "handler", segmentHandler, "err", err)
+		writeServiceError(w, err)
+		return
+	}
+	if err = response.WriteJSON(w, http.StatusOK, stats); err != nil {
 		slog.Error(fn, "handler", segmentHandler, "err", err)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-	slog.Info(fn, "handler", segmentHandler, "success", segments)
+	slog.Info(fn, "handler", segmentHandler, "count", len(stats))
 }
@@ -8,16 +8,19 @@ import (
 	"net/http"
 	"strconv"
 
+	"user_segmentation_service/internal/db"
 	"user_segmentation_service/internal/models"
+	"user_segmentation_service/internal/server/response"
 )
 
 // userService defines the methods required for managing users.
 type userService interface {
 	Create(ctx context.Context, user *models.User) error
-	Delete(ctx context.Context, userID int) error
-	Update(ctx context.Context, user *models.User) error
+	Erase(ctx context.Context, userID int, ifMatch []int, meta models.ChangeMeta) (*models.ErasureReceipt, error)
+	ErasureReceipt(ctx context.Context, userID int) (*models.ErasureReceipt, error)
+	Update(ctx context.Context, user *models.User, ifMatch []int) error
 	GetByID(ctx context.Context, userID int) (*models.User, error)
-	GetAll(ctx context.Context) ([]*models.User, error)
+	GetAll(ctx context.Context, p db.ListParams) (*models.Page[*models.User], error)
 }
 
 // UserHandlers is a structure that contains the user service and context for handling user-related HTTP requests.
@@ -45,80 +48,149 @@ func NewUserHandler(ctx context.Context, us userService) *UserHandlers {
 //	@Produce        json
 //	@Param          User    body        dto.UserCreateRequest    true    "Information about the added user"
 //	@Success        201     {object}    dto.UserResponse                 "The user was successfully created"
+//	@Failure        400     {object}    response.ErrorResponse    "Invalid request"
+//	@Failure        401     {object}    response.ErrorResponse    "Unauthorized"
+//	@Failure        403     {object}    response.ErrorResponse    "Forbidden"
+//	@Failure        422     {object}    response.ErrorResponse    "Validation failed"
+//	@Failure        500     {object}    response.ErrorResponse    "Internal server error"
+//	@Security       ApiKeyAuth
 //	@Router         /users [post]
 func (uh *UserHandlers) CreateHandle(w http.ResponseWriter, r *http.Request) {
 	const fn = "CreateHandle"
 
 	var (
 		err  error
-		user *models.User
+		user = &models.User{}
 	)
 
-	if err = json.NewDecoder(r.Body).Decode(&user); err != nil {
+	if err = json.NewDecoder(r.Body).Decode(user); err != nil {
 		slog.Error(fn, "handler", userHandler, "err", err)
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		response.WriteError(w, http.StatusBadRequest, codeInvalidJSON, err.Error(), nil)
 		return
 	}
-	if err = uh.users.Create(uh.ctx, user); err != nil {
+	if err = uh.users.Create(r.Context(), user); err != nil {
 		slog.Error(fn, "handler", userHandler, "err", err)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeServiceError(w, err)
 		return
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusCreated)
-	if err = json.NewEncoder(w).Encode(user); err != nil {
+	w.Header().Set("ETag", versionETag(user.Version))
+	if err = response.WriteJSON(w, http.StatusCreated, user); err != nil {
 		slog.Error(fn, "handler", userHandler, "err", err)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 	slog.Info(fn, "handler", userHandler, "success", user)
 }
 
-// DeleteHandle handles HTTP DELETE requests for deleting a user by ID.
+// DeleteHandle handles HTTP DELETE requests for erasing a user by ID.
 //
 //	@Summary        Delete user
-//	@Description    Deletes a user from the database
+//	@Description    Erases the personal data of a user: the name is removed and the user is replaced with
+//	@Description    a pseudonymous tombstone, the memberships are ended and recorded in the history as REMOVE.
+//	@Description    The history is kept, so past reports stay correct. Returns the erasure receipt.
+//	@Description    With If-Match the user is erased only if it has not been modified since (412 otherwise).
 //	@Tags           users
 //	@Accept         json
 //	@Produce        json
 //	@Param          id      path        int     true    "User ID"
-//	@Success        204                                 "The user with this id was successfully deleted"
+//	@Param          If-Match    header      string      false   "ETag of the version the change is based on"
+//	@Success        200     {object}    dto.ErasureReceiptResponse  "The user with this id was successfully erased"
+//	@Failure        400     {object}    response.ErrorResponse    "Invalid request"
+//	@Failure        401     {object}    response.ErrorResponse    "Unauthorized"
+//	@Failure        403     {object}    response.ErrorResponse    "Forbidden"
+//	@Failure        404     {object}    response.ErrorResponse    "Not found"
+//	@Failure        409     {object}    response.ErrorResponse    "Already erased"
+//	@Failure        412     {object}    response.ErrorResponse    "Modified since the ETag in If-Match"
+//	@Failure        428     {object}    response.ErrorResponse    "If-Match is required"
+//	@Failure        500     {object}    response.ErrorResponse    "Internal server error"
+//	@Security       ApiKeyAuth
 //	@Router         /users/{id} [delete]
 func (uh *UserHandlers) DeleteHandle(w http.ResponseWriter, r *http.Request) {
 	const fn = "DeleteHandle"
 
 	var (
-		err    error
-		userID int
+		err     error
+		userID  int
+		receipt *models.ErasureReceipt
 	)
 
 	if userID, err = strconv.Atoi(r.PathValue("id")); err != nil {
 		slog.Error(fn, "handler", userHandler, "err", err)
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		response.WriteError(w, http.StatusBadRequest, codeInvalidParameter, "invalid user id", nil)
 		return
 	}
-	if err = uh.users.Delete(uh.ctx, userID); err != nil {
+	if receipt, err = uh.users.Erase(r.Context(), userID, ifMatchVersions(r), changeMeta(r, "", "", "")); err != nil {
 		slog.Error(fn, "handler", userHandler, "err", err)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeServiceError(w, err)
 		return
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusNoContent)
-	slog.Info(fn, "handler", userHandler, "success", userID)
+	if err = response.WriteJSON(w, http.StatusOK, receipt); err != nil {
+		slog.Error(fn, "handler", userHandler, "err", err)
+		return
+	}
+	slog.Info(fn, "handler", userHandler, "erased", userID, "receipt", receipt.ID)
+}
+
+// ErasureHandle handles HTTP GET requests for the erasure receipt of a user.
+//
+//	@Summary        Get erasure receipt
+//	@Description    Returns the receipt of the erasure of the user's personal data
+//	@Tags           users
+//	@Produce        json
+//	@Param          id      path        int     true    "User ID"
+//	@Success        200     {object}    dto.ErasureReceiptResponse  "The erasure receipt was obtained"
+//	@Failure        400     {object}    response.ErrorResponse    "Invalid request"
+//	@Failure        401     {object}    response.ErrorResponse    "Unauthorized"
+//	@Failure        403     {object}    response.ErrorResponse    "Forbidden"
+//	@Failure        404     {object}    response.ErrorResponse    "The user has not been erased"
+//	@Failure        500     {object}    response.ErrorResponse    "Internal server error"
+//	@Security       ApiKeyAuth
+//	@Router         /users/{id}/erasure [get]
+func (uh *UserHandlers) ErasureHandle(w http.ResponseWriter, r *http.Request) {
+	const fn = "ErasureHandle"
+
+	userID, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		slog.Error(fn, "handler", userHandler, "err", err)
+		response.WriteError(w, http.StatusBadRequest, codeInvalidParameter, "invalid user id", nil)
+		return
+	}
+	receipt, err := uh.users.ErasureReceipt(r.Context(), userID)
+	if err != nil {
+		slog.Error(fn, "handler", userHandler, "err", err)
+		writeServiceError(w, err)
+		return
+	}
+	if err = response.WriteJSON(w, http.StatusOK, receipt); err != nil {
+		slog.Error(fn, "handler", userHandler, "err", err)
+		return
+	}
+	slog.Info(fn, "handler", userHandler, "success", receipt)
 }
 
 // UpdateHandle handles HTTP PUT requests for updating a user by ID.
 //
 //	@Summary        Update user
-//	@Description    Updates the user in the database and returns an instance of the user
+//	@Description    Updates the user in the database and returns an instance of the user with the new ETag.
+//	@Description    With If-Match the user is updated only if it has not been modified since (412 otherwise).
 //	@Tags           users
 //	@Accept         json
 //	@Produce        json
 //	@Param          id      path        int                     true    "User ID"
+//	@Param          If-Match    header      string      false   "ETag of the version the change is based on"
 //	@Param          User    body        dto.UserUpdateRequest   true    "User change information"
 //	@Success        200     {object}    dto.UserResponse                "A user with this id has been changed"
+//	@Header         200     {string}    ETag                            "Version of the user"
+//	@Failure        400     {object}    response.ErrorResponse    "Invalid request"
+//	@Failure        401     {object}    response.ErrorResponse    "Unauthorized"
+//	@Failure        403     {object}    response.ErrorResponse    "Forbidden"
+//	@Failure        404     {object}    response.ErrorResponse    "Not found"
+//	@Failure        412     {object}    response.ErrorResponse    "Modified since the ETag in If-Match"
+//	@Failure        428     {object}    response.ErrorResponse    "If-Match is required"
+//	@Failure        422     {object}    response.ErrorResponse    "Validation failed"
+//	@Failure        500     {object}    response.ErrorResponse    "Internal server error"
+//	@Security       ApiKeyAuth
 //	@Router         /users/{id} [put]
 func (uh *UserHandlers) UpdateHandle(w http.ResponseWriter, r *http.Request) {
 	const fn = "UpdateHandle"
@@ -126,30 +198,28 @@ func (uh *UserHandlers) UpdateHandle(w http.ResponseWriter, r *http.Request) {
 	var (
 		err    error
 		userID int
-		user   *models.User
+		user   = &models.User{}
 	)
 
 	if userID, err = strconv.Atoi(r.PathValue("id")); err != nil {
 		slog.Error(fn, "handler", userHandler, "err", err)
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		response.WriteError(w, http.StatusBadRequest, codeInvalidParameter, "invalid user id", nil)
 		return
 	}
-	if err = json.NewDecoder(r.Body).Decode(&user); err != nil {
+	if err = json.NewDecoder(r.Body).Decode(user); err != nil {
 		slog.Error(fn, "handler", userHandler, "err", err)
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		response.WriteError(w, http.StatusBadRequest, codeInvalidJSON, err.Error(), nil)
 		return
 	}
 	user.ID = userID
-	if err = uh.users.Update(uh.ctx, user); err != nil {
+	if err = uh.users.Update(r.Context(), user, ifMatchVersions(r)); err != nil {
 		slog.Error(fn, "handler", userHandler, "err", err)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeServiceError(w, err)
 		return
 	}
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusOK)
-	if err = json.NewEncoder(w).Encode(user); err != nil {
+	w.Header().Set("ETag", versionETag(user.Version))
+	if err = response.WriteJSON(w, http.StatusOK, user); err != nil {
 		slog.Error(fn, "handler", userHandler, "err", err)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 	slog.Info(fn, "handler", userHandler, "success", user)
@@ -158,12 +228,21 @@ func (uh *UserHandlers) UpdateHandle(w http.ResponseWriter, r *http.Request) {
 // GetHandle handles HTTP GET requests for retrieving a user by ID.
 //
 //	@Summary        Get user
-//	@Description    Get user by id
+//	@Description    Get user by id. The ETag is the version of the user; with a matching If-None-Match the response is 304.
 //	@Tags           users
 //	@Accept         json
 //	@Produce        json
-//	@Param          id      path        int                 true    "User ID"
+//	@Param          id              path        int         true    "User ID"
+//	@Param          If-None-Match   header      string      false   "ETag of the cached user"
 //	@Success        200     {object}    dto.UserResponse            "A user with this id was received"
+//	@Header         200     {string}    ETag                        "Version of the user"
+//	@Success        304                                             "The user has not been modified"
+//	@Failure        400     {object}    response.ErrorResponse    "Invalid request"
+//	@Failure        401     {object}    response.ErrorResponse    "Unauthorized"
+//	@Failure        403     {object}    response.ErrorResponse    "Forbidden"
+//	@Failure        404     {object}    response.ErrorResponse    "Not found"
+//	@Failure        500     {object}    response.ErrorResponse    "Internal server error"
+//	@Security       ApiKeyAuth
 //	@Router         /users/{id} [get]
 func (uh *UserHandlers) GetHandle(w http.ResponseWriter, r *http.Request) {
 	const fn = "GetHandle"
@@ -176,52 +255,66 @@ func (uh *UserHandlers) GetHandle(w http.ResponseWriter, r *http.Request) {
 
 	if userID, err = strconv.Atoi(r.PathValue("id")); err != nil {
 		slog.Error(fn, "handler", userHandler, "err", err)
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		response.WriteError(w, http.StatusBadRequest, codeInvalidParameter, "invalid user id", nil)
 		return
 	}
-	if user, err = uh.users.GetByID(uh.ctx, userID); err != nil {
+	if user, err = uh.users.GetByID(r.Context(), userID); err != nil {
 		slog.Error(fn, "handler", userHandler, "err", err)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeServiceError(w, err)
 		return
 	}
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusOK)
-	if err = json.NewEncoder(w).Encode(user); err != nil {
+	var notModified bool
+	if notModified, err = writeJSONWithETag(w, r, versionETag(user.Version), user); err != nil {
 		slog.Error(fn, "handler", userHandler, "err", err)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-	slog.Info(fn, "handler", userHandler, "success", user)
+	slog.Info(fn, "handler", userHandler, "success", user, "not_modified", notModified)
 }
 
 // GetAllHandle handles HTTP GET requests for retrieving all users.
 //
 //	@Summary        Get All users
-//	@Description    Get all users from the database
+//	@Description    Get a page of users from the database.
+//	@Description    Pagination is keyset-based: pass next_cursor of the previous page as cursor with the same sort.
 //	@Tags           users
 //	@Accept         json
 //	@Produce        json
-//	@Success        200     {array}     dto.UserResponse        "An array of users was obtained"
+//	@Param          limit           query       int         false   "Page size (default 100, max 1000)"
+//	@Param          cursor          query       string      false   "Cursor of the next page"
+//	@Param          sort            query       string      false   "Sort key: id, name, created_at; '-' prefix for descending order"
+//	@Param          name_prefix     query       string      false   "Filter by name prefix"
+//	@Param          created_from    query       string      false   "Created at or after (RFC 3339)"
+//	@Param          created_to      query       string      false   "Created before (RFC 3339)"
+//	@Success        200             {object}    dto.UserPageResponse    "A page of users was obtained"
+//	@Failure        400     {object}    response.ErrorResponse    "Invalid request"
+//	@Failure        401     {object}    response.ErrorResponse    "Unauthorized"
+//	@Failure        403     {object}    response.ErrorResponse    "Forbidden"
+//	@Failure        422     {object}    response.ErrorResponse    "Validation failed"
+//	@Failure        500     {object}    response.ErrorResponse    "Internal server error"
+//	@Security       ApiKeyAuth
 //	@Router         /users [get]
-func (uh *UserHandlers) GetAllHandle(w http.ResponseWriter, _ *http.Request) {
+func (uh *UserHandlers) GetAllHandle(w http.ResponseWriter, r *http.Request) {
 	const fn = "GetAllHandle"
 
 	var (
-		err   error
-		users []*models.User
+		err    error
+		params db.ListParams
+		page   *models.Page[*models.User]
 	)
 
-	if users, err = uh.users.GetAll(uh.ctx); err != nil {
+	if params, err = parseListParams(r, "name_prefix"); err != nil {
+		slog.Error(fn, "handler", userHandler, "err", err)
+		response.WriteError(w, http.StatusBadRequest, codeInvalidParameter, err.Error(), nil)
+		return
+	}
+	if page, err = uh.users.GetAll(r.Context(), params); err != nil {
 		slog.Error(fn, "handler", userHandler, "err", err)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeServiceError(w, err)
 		return
 	}
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusOK)
-	if err = json.NewEncoder(w).Encode(users); err != nil {
+	if err = response.WriteJSON(w, http.StatusOK, page); err != nil {
 		slog.Error(fn, "handler", userHandler, "err", err)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-	slog.Info(fn, "handler", userHandler, "success", users)
+	slog.Info(fn, "handler", userHandler, "count", len(page.Items), "next_cursor", page.NextCursor)
 }
@@ -1,22 +1,32 @@
 package handlers
 
 import (
+	"compress/gzip"
 	"context"
 	"encoding/json"
-	"fmt"
+	"io"
 	"log/slog"
+	"mime"
 	"net/http"
 	"strconv"
+	"time"
 
 	"user_segmentation_service/internal/db"
 	"user_segmentation_service/internal/models"
+	"user_segmentation_service/internal/server/middlewares"
+	"user_segmentation_service/internal/server/response"
 )
 
 // userSegmentsService defines methods for managing user segments.
 type userSegmentsService interface {
-	Update(ctx context.Context, userID int, add []db.SegmentModification, remove []string) error
+	Update(ctx context.Context, userID int, add []db.SegmentModification, remove []string,
+		strict bool, meta models.ChangeMeta, idempotencyKey string) (*models.SegmentsUpdateResult, error)
+	BulkUpdate(ctx context.Context, userIDs []int, add []db.SegmentModification, remove []string,
+		meta models.ChangeMeta) ([]db.BulkUserResult, error)
 	GetActive(ctx context.Context, userID int) ([]*models.Segment, error)
-	GetHistoryCSV(ctx context.Context, userID, year, month int) (string, error)
+	Export(ctx context.Context, w io.Writer) error
+	Import(ctx context.Context, r io.Reader, format string, createUsers bool,
+		meta models.ChangeMeta) (*models.ImportResult, error)
 }
 
 // UserSegmentsHandler handles HTTP requests for user segments.
@@ -42,18 +52,67 @@ type SegmentsRequest struct {
 	Add []db.SegmentModification `json:"add,omitempty"`
 	// required: false
 	Remove []string `json:"remove,omitempty"`
+	// required: false
+	Strict bool `json:"strict,omitempty"` // If true, nothing is changed when any slug does not exist
+	// required: false
+	Actor string `json:"actor,omitempty"` // Who makes the change; replaced with the API key of the request
+	// required: false
+	Source string `json:"source,omitempty"` // The service or channel of the change, "api" by default
+	// required: false
+	Reason string `json:"reason,omitempty"` // Why the change is made
+}
+
+// BulkSegmentsRequest represents a request for updating segments of many users at once.
+// @Description List of users and segment lists for adding and deleting segments
+type BulkSegmentsRequest struct {
+	// required: true
+	UserIDs []int `json:"user_ids"`
+	// required: false
+	Add []db.SegmentModification `json:"add,omitempty"`
+	// required: false
+	Remove []string `json:"remove,omitempty"`
+	// required: false
+	Actor string `json:"actor,omitempty"` // Who makes the change; replaced with the API key of the request
+	// required: false
+	Source string `json:"source,omitempty"` // The service or channel of the change, "api" by default
+	// required: false
+	Reason string `json:"reason,omitempty"` // Why the change is made
+}
+
+// BulkSegmentsResponse represents the result of a bulk update of user segments.
+// @Description Outcome of the update for each user and totals by status
+type BulkSegmentsResponse struct {
+	Updated  int                 `json:"updated"`
+	NotFound int                 `json:"not_found"`
+	Failed   int                 `json:"failed"`
+	Results  []db.BulkUserResult `json:"results"`
 }
 
 // UpdateHandle processes user segment updates via HTTP request.
 //
 //	@Summary        Update user segments
-//	@Description    Updates the user in the database and returns an instance of the user
+//	@Description    Adds and removes user segments and reports what happened to each slug:
+//	@Description    added, extended (expiration time updated), removed, unknown or not assigned.
+//	@Description    In strict mode the update is rejected with 422 if any slug does not exist.
+//	@Description    Former slugs of renamed segments resolve to them while the aliases last and are listed in deprecated_slugs.
+//	@Description    The history records the actor (the API key of the request), the source and the reason of the change.
+//	@Description    With an Idempotency-Key a retry of the same request returns the stored result (Idempotent-Replayed: true)
+//	@Description    without changing anything again; the same key with a different request is rejected with 422.
 //	@Tags           user-segments
 //	@Accept         json
 //	@Produce        json
-//	@Param          id          path        int                 true    "User ID"
-//	@Param          Segments    body        SegmentsRequest     true    "User change information"
-//	@Success        200                                                 "User segments have been successfully changed"
+//	@Param          id                  path        int                 true    "User ID"
+//	@Param          Idempotency-Key     header      string              false   "Unique key of the request to retry it safely"
+//	@Param          Segments            body        SegmentsRequest     true    "User change information"
+//	@Success        200         {object}    models.SegmentsUpdateResult         "User segments have been successfully changed"
+//	@Header         200         {string}    Idempotent-Replayed                 "true if the result is replayed"
+//	@Failure        400     {object}    response.ErrorResponse    "Invalid request"
+//	@Failure        401     {object}    response.ErrorResponse    "Unauthorized"
+//	@Failure        403     {object}    response.ErrorResponse    "Forbidden"
+//	@Failure        404     {object}    response.ErrorResponse    "Not found"
+//	@Failure        422     {object}    response.ErrorResponse    "Validation failed"
+//	@Failure        500     {object}    response.ErrorResponse    "Internal server error"
+//	@Security       ApiKeyAuth
 //	@Router         /users/{id}/segments [patch]
 func (uss *UserSegmentsHandler) UpdateHandle(w http.ResponseWriter, r *http.Request) {
 	const fn = "UpdateHandle"
@@ -62,42 +121,54 @@ func (uss *UserSegmentsHandler) UpdateHandle(w http.ResponseWriter, r *http.Requ
 		err    error
 		userID int
 		sr     SegmentsRequest
+		res    *models.SegmentsUpdateResult
 	)
 	if userID, err = strconv.Atoi(r.PathValue("id")); err != nil {
 		slog.Error(fn, "handler", userSegmentsHandler, "err", err)
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		response.WriteError(w, http.StatusBadRequest, codeInvalidParameter, "invalid user id", nil)
 		return
 	}
 	if err = json.NewDecoder(r.Body).Decode(&sr); err != nil {
 		slog.Error(fn, "handler", userSegmentsHandler, "err", err)
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		response.WriteError(w, http.StatusBadRequest, codeInvalidJSON, err.Error(), nil)
 		return
 	}
 
-	if err = uss.userSegments.Update(r.Context(), userID, sr.Add, sr.Remove); err != nil {
+	meta := changeMeta(r, sr.Actor, sr.Source, sr.Reason)
+	key := r.Header.Get("Idempotency-Key")
+	if res, err = uss.userSegments.Update(r.Context(), userID, sr.Add, sr.Remove, sr.Strict, meta, key); err != nil {
 		slog.Error(fn, "handler", userSegmentsHandler, "err", err)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeServiceError(w, err)
 		return
 	}
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusOK)
-	if err = json.NewEncoder(w).Encode("{ok:true}"); err != nil {
+	if res.Replayed {
+		w.Header().Set("Idempotent-Replayed", "true")
+	}
+	if err = response.WriteJSON(w, http.StatusOK, res); err != nil {
 		slog.Error(fn, "handler", userSegmentsHandler, "err", err)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-	slog.Info(fn, "handler", userSegmentsHandler, "success", sr)
+	slog.Info(fn, "handler", userSegmentsHandler, "success", res)
 }
 
 // GetActiveHandle retrieves active segments for a user via HTTP request.
 //
 //	@Summary        Get active user segments
 //	@Description    Gets the active user segments by ID.
+//	@Description    The ETag identifies the list; with a matching If-None-Match the response is 304.
 //	@Tags           user-segments
 //	@Accept         json
 //	@Produce        json
-//	@Param          id      path        int                     true    "User ID"
+//	@Param          id              path        int         true    "User ID"
+//	@Param          If-None-Match   header      string      false   "ETag of the cached list"
 //	@Success        200     {array}     dto.SegmentResponse             "Array with active user segments received"
+//	@Header         200     {string}    ETag                            "Hash of the list"
+//	@Success        304                                                 "The list has not changed"
+//	@Failure        400     {object}    response.ErrorResponse    "Invalid request"
+//	@Failure        401     {object}    response.ErrorResponse    "Unauthorized"
+//	@Failure        403     {object}    response.ErrorResponse    "Forbidden"
+//	@Failure        500     {object}    response.ErrorResponse    "Internal server error"
+//	@Security       ApiKeyAuth
 //	@Router         /users/{id}/segments [get]
 func (uss *UserSegmentsHandler) GetActiveHandle(w http.ResponseWriter, r *http.Request) {
 	const fn = "GetActiveHandle"
@@ -110,90 +181,190 @@ func (uss *UserSegmentsHandler) GetActiveHandle(w http.ResponseWriter, r *http.R
 
 	if userID, err = strconv.Atoi(r.PathValue("id")); err != nil {
 		slog.Error(fn, "handler", userSegmentsHandler, "err", err)
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		response.WriteError(w, http.StatusBadRequest, codeInvalidParameter, "invalid user id", nil)
 		return
 	}
-	if segments, err = uss.userSegments.GetActive(uss.ctx, userID); err != nil {
+	if segments, err = uss.userSegments.GetActive(r.Context(), userID); err != nil {
 		slog.Error(fn, "handler", userSegmentsHandler, "err", err)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeServiceError(w, err)
 		return
 	}
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusOK)
-	if err = json.NewEncoder(w).Encode(segments); err != nil {
+	var notModified bool
+	if notModified, err = writeJSONWithETag(w, r, "", segments); err != nil {
 		slog.Error(fn, "handler", userSegmentsHandler, "err", err)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-	slog.Info(fn, "handler", userSegmentsHandler, "success", segments)
+	slog.Info(fn, "handler", userSegmentsHandler, "success", segments, "not_modified", notModified)
 }
 
-// GetHistoryCSVHandle generates a CSV report and returns JSON with the download URL.
+// BulkUpdateHandle processes segment updates for many users via HTTP request.
 //
-//	@Summary        Update user segments
-//	@Description    Updates the user in the database and returns an instance of the user
-//	@Tags           user-segments-history
+//	@Summary        Bulk update user segments
+//	@Description    Adds and removes the same segments for every user from the list.
+//	@Description    Users are processed in batches, each committed separately, the result is reported for each user.
+//	@Description    Users of a batch that failed or was not processed because the request was cancelled are reported as failed
+//	@Description    and can be retried; the other batches are kept, so the response is 200 even if some users failed.
+//	@Description    The history records the actor (the API key of the request), the source and the reason of the change.
+//	@Tags           user-segments
 //	@Accept         json
 //	@Produce        json
-//	@Param          id      path        int     true    "User ID"
-//	@Param          year    query       int     true    "Year, e.g. 2025"
-//	@Param          month   query       int     true    "Month, e.g. 02"
-//	@Success        200     {object}    dto.USHResponse "CSV-history is ready at the link"
-//	@Router         /users/{id}/segments/history [get]
-func (uss *UserSegmentsHandler) GetHistoryCSVHandle(w http.ResponseWriter, r *http.Request) {
-	const fn = "GetHistoryCSVHandle"
+//	@Param          Segments    body        BulkSegmentsRequest     true    "Users and segment change information"
+//	@Success        200         {object}    BulkSegmentsResponse            "Result of the update for each user"
+//	@Failure        400     {object}    response.ErrorResponse    "Invalid request"
+//	@Failure        401     {object}    response.ErrorResponse    "Unauthorized"
+//	@Failure        403     {object}    response.ErrorResponse    "Forbidden"
+//	@Failure        422     {object}    response.ErrorResponse    "Validation failed"
+//	@Failure        500     {object}    response.ErrorResponse    "Internal server error"
+//	@Security       ApiKeyAuth
+//	@Router         /users/segments/bulk [post]
+func (uss *UserSegmentsHandler) BulkUpdateHandle(w http.ResponseWriter, r *http.Request) {
+	const fn = "BulkUpdateHandle"
 
 	var (
-		err                 error
-		userID, year, month int
-		dURL                string
+		err     error
+		br      BulkSegmentsRequest
+		results []db.BulkUserResult
 	)
-
-	userID, err = strconv.Atoi(r.PathValue("id"))
-	if err != nil {
+	if err = json.NewDecoder(r.Body).Decode(&br); err != nil {
 		slog.Error(fn, "handler", userSegmentsHandler, "err", err)
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		response.WriteError(w, http.StatusBadRequest, codeInvalidJSON, err.Error(), nil)
 		return
 	}
 
-	// Get the parameters of the request of the YEAR and Month
-	yearStr := r.URL.Query().Get("year")
-	monthStr := r.URL.Query().Get("month")
-	if yearStr == "" || monthStr == "" {
-		slog.Error(fn, "handler", userSegmentsHandler, "err", "missing year or month")
-		http.Error(w, "year and month parameters are required", http.StatusBadRequest)
-		return
-	}
-	year, err = strconv.Atoi(yearStr)
-	if err != nil {
+	meta := changeMeta(r, br.Actor, br.Source, br.Reason)
+	if results, err = uss.userSegments.BulkUpdate(r.Context(), br.UserIDs, br.Add, br.Remove, meta); err != nil {
 		slog.Error(fn, "handler", userSegmentsHandler, "err", err)
-		http.Error(w, "invalid year", http.StatusBadRequest)
+		writeServiceError(w, err)
 		return
 	}
-	month, err = strconv.Atoi(monthStr)
-	if err != nil {
+
+	resp := BulkSegmentsResponse{Results: results}
+	for _, res := range results {
+		switch res.Status {
+		case db.BulkStatusUpdated:
+			resp.Updated++
+		case db.BulkStatusNotFound:
+			resp.NotFound++
+		case db.BulkStatusFailed:
+			resp.Failed++
+		}
+	}
+
+	if err = response.WriteJSON(w, http.StatusOK, resp); err != nil {
 		slog.Error(fn, "handler", userSegmentsHandler, "err", err)
-		http.Error(w, "invalid month", http.StatusBadRequest)
 		return
 	}
+	slog.Info(fn, "handler", userSegmentsHandler, "updated", resp.Updated, "not_found", resp.NotFound, "failed", resp.Failed)
+}
 
-	// Calling the method of forming CSV reports.
-	dURL, err = uss.userSegments.GetHistoryCSV(r.Context(), userID, year, month)
-	if err != nil {
+// ExportHandle streams all active user segments as NDJSON.
+//
+//	@Summary        Export user segments
+//	@Description    Streams all active memberships as NDJSON (one JSON object per line) straight from the database.
+//	@Description    The response is gzip-compressed if the client sends Accept-Encoding: gzip.
+//	@Tags           user-segments
+//	@Produce        application/x-ndjson
+//	@Success        200     {object}    dto.UserSegmentExport   "Memberships, one per line"
+//	@Failure        401     {object}    response.ErrorResponse    "Unauthorized"
+//	@Failure        403     {object}    response.ErrorResponse    "Forbidden"
+//	@Failure        500     {object}    response.ErrorResponse    "Internal server error"
+//	@Security       ApiKeyAuth
+//	@Router         /users/segments/export [get]
+func (uss *UserSegmentsHandler) ExportHandle(w http.ResponseWriter, r *http.Request) {
+	const fn = "ExportHandle"
+
+	if err := streamExport(w, r, "application/x-ndjson", "user_segments.ndjson", uss.userSegments.Export); err != nil {
 		slog.Error(fn, "handler", userSegmentsHandler, "err", err)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	slog.Info(fn, "handler", userSegmentsHandler, "success", true)
+}
+
+// ImportHandle imports memberships of users in segments from a CSV or NDJSON file in the request body.
+//
+//	@Summary        Import user segments
+//	@Description    Imports rows user_id,slug,expiration_time (CSV with an optional header, or NDJSON) via COPY FROM.
+//	@Description    New memberships are recorded in the history, existing ones get the new expiration time.
+//	@Description    The format is taken from the format parameter or the Content-Type (text/csv, application/x-ndjson).
+//	@Description    The body may be gzip-compressed (Content-Encoding: gzip).
+//	@Tags           user-segments
+//	@Accept         text/csv,application/x-ndjson
+//	@Produce        json
+//	@Param          format          query       string      false   "csv or ndjson"
+//	@Param          create_users    query       bool        false   "Create users with unknown IDs instead of rejecting the rows"
+//	@Success        200             {object}    models.ImportResult     "Counts of inserted, updated and rejected rows"
+//	@Failure        400     {object}    response.ErrorResponse    "Invalid request"
+//	@Failure        401     {object}    response.ErrorResponse    "Unauthorized"
+//	@Failure        403     {object}    response.ErrorResponse    "Forbidden"
+//	@Failure        422     {object}    response.ErrorResponse    "Validation failed"
+//	@Failure        500     {object}    response.ErrorResponse    "Internal server error"
+//	@Security       ApiKeyAuth
+//	@Router         /users/segments/import [post]
+func (uss *UserSegmentsHandler) ImportHandle(w http.ResponseWriter, r *http.Request) {
+	const fn = "ImportHandle"
+
+	var (
+		err         error
+		body        io.Reader = r.Body
+		format                = r.URL.Query().Get("format")
+		createUsers bool
+		res         *models.ImportResult
+	)
+
+	if v := r.URL.Query().Get("create_users"); v != "" {
+		if createUsers, err = strconv.ParseBool(v); err != nil {
+			slog.Error(fn, "handler", userSegmentsHandler, "err", err)
+			response.WriteError(w, http.StatusBadRequest, codeInvalidParameter, "invalid create_users", nil)
+			return
+		}
+	}
+	if format == "" {
+		format = importFormatFromContentType(r.Header.Get("Content-Type"))
+	}
+	if r.Header.Get("Content-Encoding") == "gzip" {
+		var gz *gzip.Reader
+		if gz, err = gzip.NewReader(r.Body); err != nil {
+			slog.Error(fn, "handler", userSegmentsHandler, "err", err)
+			response.WriteError(w, http.StatusBadRequest, codeInvalidParameter, "invalid gzip body", nil)
+			return
+		}
+		defer gz.Close()
+		body = gz
+	}
 
-	dURL = fmt.Sprintf("http://%s/%s", r.Host, dURL)
+	// Large files take longer than the server timeouts.
+	rc := http.NewResponseController(w)
+	_ = rc.SetReadDeadline(time.Time{})
+	_ = rc.SetWriteDeadline(time.Time{})
 
-	// Return Json from URL to the CSV file.
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusOK)
-	if err = json.NewEncoder(w).Encode(map[string]string{"url": dURL}); err != nil {
+	if res, err = uss.userSegments.Import(r.Context(), body, format, createUsers, changeMeta(r, "", "", "")); err != nil {
+		slog.Error(fn, "handler", userSegmentsHandler, "err", err)
+		writeServiceError(w, err)
+		return
+	}
+	if err = response.WriteJSON(w, http.StatusOK, res); err != nil {
 		slog.Error(fn, "handler", userSegmentsHandler, "err", err)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-	slog.Info(fn, "handler", userSegmentsHandler, "success", dURL)
+	slog.Info(fn, "handler", userSegmentsHandler, "inserted", res.Inserted, "updated", res.Updated, "rejected", res.Rejected)
+}
+
+// importFormatFromContentType returns the import format matching the content type, csv by default.
+func importFormatFromContentType(contentType string) string {
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	switch mediaType {
+	case "application/x-ndjson", "application/ndjson", "application/jsonl":
+		return "ndjson"
+	}
+	return "csv"
+}
+
+// changeMeta returns the metadata of a change of memberships recorded in the history.
+// The actor is the API key the request was authenticated with; the one from the body
+// is used only if the key identifies no one (authentication is disabled).
+func changeMeta(r *http.Request, actor, source, reason string) models.ChangeMeta {
+	if key := middlewares.APIKeyFromContext(r.Context()); key != nil && key.Actor() != "" {
+		actor = key.Actor()
+	}
+	return models.ChangeMeta{Actor: actor, Source: source, Reason: reason}
 }
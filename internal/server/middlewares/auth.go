@@ -0,0 +1,76 @@
+// Package middlewares provides HTTP middleware implementations.
+package middlewares
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strings"
+
+	"user_segmentation_service/internal/models"
+	"user_segmentation_service/internal/modules/apikey_service"
+	"user_segmentation_service/internal/server/response"
+)
+
+// Authenticator authenticates the API key of a request.
+type Authenticator interface {
+	Authenticate(ctx context.Context, key string) (*models.APIKey, error)
+}
+
+// apiKeyContextKey is the key of the authenticated API key in the request context.
+type apiKeyContextKey struct{}
+
+// Auth checks that requests carry an API key granting the scope required by the route.
+// The key is passed in the X-API-Key header or as "Authorization: Bearer <key>".
+type Auth struct {
+	keys Authenticator
+}
+
+// NewAuth creates a new instance of Auth.
+func NewAuth(keys Authenticator) *Auth {
+	return &Auth{keys: keys}
+}
+
+// Require returns a handler that serves next only if the API key of the request grants the scope.
+// Requests without a valid key get 401, requests whose key lacks the scope get 403.
+// The key is available to next through APIKeyFromContext.
+func (a *Auth) Require(scope string, next http.HandlerFunc) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key, err := a.keys.Authenticate(r.Context(), requestKey(r))
+		switch {
+		case errors.Is(err, apikey_service.ErrInvalidKey):
+			w.Header().Set("WWW-Authenticate", `Bearer realm="user_segmentation_service"`)
+			response.WriteError(w, http.StatusUnauthorized, "unauthorized", "a valid API key is required", nil)
+			return
+		case err != nil:
+			slog.Error("Auth", "err", err)
+			response.WriteError(w, http.StatusInternalServerError, "internal_error", "internal server error", nil)
+			return
+		case !key.HasScope(scope):
+			slog.Warn("Auth", "key", key.Prefix, "path", r.URL.Path, "required_scope", scope)
+			response.WriteError(w, http.StatusForbidden, "forbidden", "the API key does not grant the "+scope+" scope",
+				map[string]string{"required_scope": scope})
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), apiKeyContextKey{}, key)))
+	})
+}
+
+// APIKeyFromContext returns the API key the request was authenticated with, nil if there is none.
+func APIKeyFromContext(ctx context.Context) *models.APIKey {
+	key, _ := ctx.Value(apiKeyContextKey{}).(*models.APIKey)
+	return key
+}
+
+// requestKey returns the API key of the request from the X-API-Key or the Authorization header.
+func requestKey(r *http.Request) string {
+	if key := r.Header.Get("X-API-Key"); key != "" {
+		return key
+	}
+	scheme, token, ok := strings.Cut(r.Header.Get("Authorization"), " ")
+	if ok && strings.EqualFold(scheme, "Bearer") {
+		return strings.TrimSpace(token)
+	}
+	return ""
+}
@@ -0,0 +1,22 @@
+// Package middlewares provides HTTP middleware implementations.
+package middlewares
+
+import (
+	"net/http"
+
+	"user_segmentation_service/internal/server/response"
+)
+
+// RequireIfMatch returns a handler that serves next only if the request carries an If-Match header,
+// so that changes based on a stale version are rejected instead of overwriting concurrent ones.
+// Requests without the header get 428.
+func RequireIfMatch(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("If-Match") == "" {
+			response.WriteError(w, http.StatusPreconditionRequired, "precondition_required",
+				"the If-Match header with the ETag of the entity is required", nil)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
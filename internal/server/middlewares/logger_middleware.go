@@ -4,11 +4,18 @@ package middlewares
 import (
 	"log/slog"
 	"net/http"
+	"strings"
 	"time"
+
+	"user_segmentation_service/internal/metrics"
 )
 
+// unmatchedRoute is the route label of requests that matched no pattern.
+const unmatchedRoute = "unmatched"
+
 // Middleware represents an HTTP middleware that wraps around a handler
-// to provide additional functionality, such as logging the request method.
+// to provide additional functionality, such as logging the request method
+// and recording the request metrics.
 type Middleware struct {
 	next http.Handler // The next handler in the chain to be executed.
 }
@@ -18,13 +25,27 @@ type Middleware struct {
 // request to the next handler in the chain.
 func (m *Middleware) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	start := time.Now()
-	m.next.ServeHTTP(w, r)
+	sw := &statusWriter{ResponseWriter: w, status: http.StatusOK}
+	m.next.ServeHTTP(sw, r)
+	since := time.Since(start)
+
+	// The router sets the pattern on the request, the method is a label of its own.
+	route := r.Pattern
+	if _, path, ok := strings.Cut(route, " "); ok {
+		route = path
+	}
+	if route == "" {
+		route = unmatchedRoute
+	}
+	metrics.ObserveRequest(r.Method, route, sw.status, since)
+
 	slog.Info(
 		"Request",
 		slog.String("method", r.Method),
 		slog.String("path", r.URL.Path),
+		slog.Int("status", sw.status),
 		slog.String("remote_addr", r.RemoteAddr),
-		slog.Duration("since", time.Since(start)),
+		slog.Duration("since", since),
 	)
 }
 
@@ -32,3 +53,29 @@ func (m *Middleware) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 func NewMiddleware(next http.Handler) *Middleware {
 	return &Middleware{next: next}
 }
+
+// statusWriter remembers the status code of the response.
+type statusWriter struct {
+	http.ResponseWriter
+	status      int
+	wroteHeader bool
+}
+
+// WriteHeader implements http.ResponseWriter.
+func (w *statusWriter) WriteHeader(status int) {
+	if !w.wroteHeader {
+		w.status, w.wroteHeader = status, true
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+// Write implements http.ResponseWriter.
+func (w *statusWriter) Write(b []byte) (int, error) {
+	w.wroteHeader = true
+	return w.ResponseWriter.Write(b)
+}
+
+// Unwrap returns the original writer, so that http.ResponseController reaches its deadlines and flushing.
+func (w *statusWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
@@ -0,0 +1,37 @@
+// Package response writes the JSON responses shared by the handlers and the middlewares.
+package response
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+)
+
+// ErrorResponse is the JSON envelope of every error response.
+// @Description Error information
+type ErrorResponse struct {
+	Error ErrorBody `json:"error"`
+}
+
+// ErrorBody describes an error.
+// @Description Machine-readable code, human-readable message and optional details
+type ErrorBody struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+	Details any    `json:"details,omitempty"`
+}
+
+// WriteJSON writes v as a JSON response with the given status.
+func WriteJSON(w http.ResponseWriter, status int, v any) error {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	return json.NewEncoder(w).Encode(v)
+}
+
+// WriteError writes an error envelope with the given status.
+func WriteError(w http.ResponseWriter, status int, code, message string, details any) {
+	err := WriteJSON(w, status, ErrorResponse{Error: ErrorBody{Code: code, Message: message, Details: details}})
+	if err != nil {
+		slog.Error("WriteError", "err", err)
+	}
+}
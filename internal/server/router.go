@@ -9,32 +9,77 @@ import (
 
 	_ "user_segmentation_service/api"
 
+	"user_segmentation_service/internal/metrics"
+	"user_segmentation_service/internal/models"
 	"user_segmentation_service/internal/server/handlers"
+	"user_segmentation_service/internal/server/middlewares"
 )
 
 // configureRouter sets up the HTTP route handlers for users and segments.
+// Every route except the Swagger UI, the probes, the metrics and the report download requires an API key
+// with the route's scope.
 func (api *APIServer) configureRouter() {
 	api.router.Handle("/swagger/", httpSwagger.WrapHandler)
+	api.router.Handle("GET /metrics", metrics.Handler())
+
+	healthHandler := handlers.NewHealthHandler(api.db, api.ready.Load)
+	api.router.HandleFunc("GET /healthz", healthHandler.LiveHandle)
+	api.router.HandleFunc("GET /readyz", healthHandler.ReadyHandle)
 
 	userHandler := handlers.NewUserHandler(api.ctx, api.us)
-	api.router.HandleFunc("POST /users", userHandler.CreateHandle)
-	api.router.HandleFunc("DELETE /users/{id}", userHandler.DeleteHandle)
-	api.router.HandleFunc("PUT /users/{id}", userHandler.UpdateHandle)
-	api.router.HandleFunc("GET /users/{id}", userHandler.GetHandle)
-	api.router.HandleFunc("GET /users", userHandler.GetAllHandle)
+	api.handle("POST /users", models.ScopeUsersManage, userHandler.CreateHandle)
+	api.handleConditional("DELETE /users/{id}", models.ScopeUsersManage, userHandler.DeleteHandle)
+	api.handleConditional("PUT /users/{id}", models.ScopeUsersManage, userHandler.UpdateHandle)
+	api.handle("GET /users/{id}", models.ScopeUsersManage, userHandler.GetHandle)
+	api.handle("GET /users", models.ScopeUsersManage, userHandler.GetAllHandle)
+	api.handle("GET /users/{id}/erasure", models.ScopeUsersManage, userHandler.ErasureHandle)
 
 	segmentHandler := handlers.NewSegmentHandler(api.ctx, api.ss)
-	api.router.HandleFunc("POST /segments", segmentHandler.CreateHandle)
-	api.router.HandleFunc("DELETE /segments/{slug}", segmentHandler.DeleteHandle)
-	api.router.HandleFunc("PUT /segments/{slug}", segmentHandler.UpdateHandle)
-	api.router.HandleFunc("GET /segments/{slug}", segmentHandler.GetHandle)
-	api.router.HandleFunc("GET /segments", segmentHandler.GetAllHandle)
+	api.handle("POST /segments", models.ScopeSegmentsManage, segmentHandler.CreateHandle)
+	api.handleConditional("DELETE /segments/{slug}", models.ScopeSegmentsManage, segmentHandler.DeleteHandle)
+	api.handleConditional("PUT /segments/{slug}", models.ScopeSegmentsManage, segmentHandler.UpdateHandle)
+	api.handle("GET /segments/{slug}", models.ScopeMembershipsRead, segmentHandler.GetHandle)
+	api.handle("GET /segments", models.ScopeMembershipsRead, segmentHandler.GetAllHandle)
+	api.handle("GET /segments/export", models.ScopeMembershipsRead, segmentHandler.ExportHandle)
+	api.handle("GET /segments/{slug}/users", models.ScopeMembershipsRead, segmentHandler.MembersHandle)
+	api.handle("GET /segments/{slug}/stats", models.ScopeReportsRead, segmentHandler.StatsHandle)
+	api.handle("GET /segments/stats", models.ScopeReportsRead, segmentHandler.AllStatsHandle)
+	api.handle("POST /segments/{slug}/restore", models.ScopeSegmentsManage, segmentHandler.RestoreHandle)
+	api.handle("POST /segments/{slug}/rename", models.ScopeSegmentsManage, segmentHandler.RenameHandle)
+	api.handle("GET /segments/{slug}/renames", models.ScopeMembershipsRead, segmentHandler.RenamesHandle)
+	api.handle("DELETE /admin/segments/{slug}", models.ScopeAdmin, segmentHandler.PurgeHandle)
 
 	userSegmentsHandler := handlers.NewUserSegmentsHandler(api.ctx, api.uss)
-	api.router.HandleFunc("PATCH /users/{id}/segments", userSegmentsHandler.UpdateHandle)
-	api.router.HandleFunc("GET /users/{id}/segments", userSegmentsHandler.GetActiveHandle)
-	api.router.HandleFunc("GET /users/{id}/segments/history", userSegmentsHandler.GetHistoryCSVHandle)
+	api.handle("PATCH /users/{id}/segments", models.ScopeMembershipsWrite, userSegmentsHandler.UpdateHandle)
+	api.handle("GET /users/{id}/segments", models.ScopeMembershipsRead, userSegmentsHandler.GetActiveHandle)
+	api.handle("POST /users/segments/bulk", models.ScopeMembershipsWrite, userSegmentsHandler.BulkUpdateHandle)
+	api.handle("GET /users/segments/export", models.ScopeMembershipsRead, userSegmentsHandler.ExportHandle)
+	api.handle("POST /users/segments/import", models.ScopeMembershipsWrite, userSegmentsHandler.ImportHandle)
+
+	reportHandler := handlers.NewReportHandler(api.ctx, api.rs)
+	api.handle("GET /users/{id}/segments/history", models.ScopeReportsRead, reportHandler.HistoryHandle)
+	api.handle("GET /history", models.ScopeReportsRead, reportHandler.HistoryAllHandle)
+	api.handle("POST /reports", models.ScopeReportsRead, reportHandler.CreateHandle)
+	api.handle("GET /reports/{id}", models.ScopeReportsRead, reportHandler.GetHandle)
+	// The token of the link is the credential, so the download needs no API key.
+	api.router.HandleFunc("GET /reports/download/{token}", reportHandler.DownloadHandle)
+
+	apiKeyHandler := handlers.NewAPIKeyHandler(api.ctx, api.ks)
+	api.handle("POST /admin/api-keys", models.ScopeAdmin, apiKeyHandler.CreateHandle)
+	api.handle("GET /admin/api-keys", models.ScopeAdmin, apiKeyHandler.GetAllHandle)
+	api.handle("DELETE /admin/api-keys/{id}", models.ScopeAdmin, apiKeyHandler.RevokeHandle)
+}
+
+// handle registers the handler for the pattern, serving only requests whose API key grants the scope.
+func (api *APIServer) handle(pattern, scope string, handler http.HandlerFunc) {
+	api.router.Handle(pattern, api.auth.Require(scope, handler))
+}
 
-	fs := http.FileServer(http.Dir("reports"))
-	api.router.Handle("/reports/", http.StripPrefix("/reports/", fs))
+// handleConditional registers a handler changing a versioned entity like handle,
+// requiring the If-Match header if the server is configured so.
+func (api *APIServer) handleConditional(pattern, scope string, handler http.HandlerFunc) {
+	if api.cfg.RequireIfMatch {
+		handler = middlewares.RequireIfMatch(handler).ServeHTTP
+	}
+	api.handle(pattern, scope, handler)
 }
@@ -4,7 +4,11 @@ package server
 
 import (
 	"context"
+	"errors"
+	"io"
 	"net/http"
+	"os"
+	"sync/atomic"
 	"time"
 
 	"user_segmentation_service/internal/db"
@@ -16,65 +20,152 @@ import (
 type Config struct {
 	Host string `envconfig:"HOST" default:"localhost"`
 	Port string `envconfig:"PORT" default:"8080"`
+	// RequireIfMatch makes If-Match mandatory on PUT and DELETE of users and segments.
+	RequireIfMatch bool `envconfig:"REQUIRE_IF_MATCH" default:"false"`
+	// ShutdownDelay - how long the server keeps serving with the readiness probe failing before it stops
+	// accepting connections, so that the load balancer stops sending requests first.
+	ShutdownDelay time.Duration `envconfig:"SHUTDOWN_DELAY" default:"0s"`
+	// ShutdownTimeout - how long the requests in flight are waited for on shutdown.
+	ShutdownTimeout time.Duration `envconfig:"SHUTDOWN_TIMEOUT" default:"15s"`
+}
+
+// database defines the database checks required by the readiness probe.
+type database interface {
+	Ping(ctx context.Context) error
 }
 
 // userService defines the methods required for managing users.
 type userService interface {
 	Create(ctx context.Context, user *models.User) error
-	Delete(ctx context.Context, userID int) error
-	Update(ctx context.Context, user *models.User) error
+	Erase(ctx context.Context, userID int, ifMatch []int, meta models.ChangeMeta) (*models.ErasureReceipt, error)
+	ErasureReceipt(ctx context.Context, userID int) (*models.ErasureReceipt, error)
+	Update(ctx context.Context, user *models.User, ifMatch []int) error
 	GetByID(ctx context.Context, userID int) (*models.User, error)
-	GetAll(ctx context.Context) ([]*models.User, error)
+	GetAll(ctx context.Context, p db.ListParams) (*models.Page[*models.User], error)
 }
 
 // segmentService defines the methods required for managing segments.
 type segmentService interface {
 	Create(ctx context.Context, seg *models.Segment) error
-	Delete(ctx context.Context, slug string) error
-	Update(ctx context.Context, seg *models.Segment) error
+	Delete(ctx context.Context, slug string, ifMatch []int, meta models.ChangeMeta) error
+	Update(ctx context.Context, seg *models.Segment, ifMatch []int) error
 	GetBySlug(ctx context.Context, slug string) (*models.Segment, error)
-	GetAll(ctx context.Context) ([]*models.Segment, error)
+	GetAll(ctx context.Context, archived bool, p db.ListParams) (*models.Page[*models.Segment], error)
+	Restore(ctx context.Context, slug string) (*models.Segment, error)
+	Rename(ctx context.Context, slug, newSlug string) (*models.SegmentRename, error)
+	Renames(ctx context.Context, slug string) ([]*models.SegmentRename, error)
+	Purge(ctx context.Context, slug string) error
+	Export(ctx context.Context, w io.Writer) error
+	GetMembers(ctx context.Context, slug string, includeExpired bool, p db.ListParams) (*models.Page[*models.SegmentMember], error)
+	CountMembers(ctx context.Context, slug string, includeExpired bool) (int64, error)
+	Stats(ctx context.Context, slug string, p db.StatsParams) (*models.SegmentStats, error)
+	AllStats(ctx context.Context, p db.StatsParams) ([]*models.SegmentStats, error)
 }
 
 type userSegmentsService interface {
-	Update(ctx context.Context, userID int, add []db.SegmentModification, remove []string) error
+	Update(ctx context.Context, userID int, add []db.SegmentModification, remove []string,
+		strict bool, meta models.ChangeMeta, idempotencyKey string) (*models.SegmentsUpdateResult, error)
+	BulkUpdate(ctx context.Context, userIDs []int, add []db.SegmentModification, remove []string,
+		meta models.ChangeMeta) ([]db.BulkUserResult, error)
 	GetActive(ctx context.Context, userID int) ([]*models.Segment, error)
-	GetHistoryCSV(ctx context.Context, userID, year, month int) (string, error)
+	Export(ctx context.Context, w io.Writer) error
+	Import(ctx context.Context, r io.Reader, format string, createUsers bool,
+		meta models.ChangeMeta) (*models.ImportResult, error)
+}
+
+// reportService defines the methods required for managing report jobs.
+type reportService interface {
+	Create(ctx context.Context, p models.HistoryParams) (*models.ReportJob, error)
+	Get(ctx context.Context, id string) (*models.ReportJob, error)
+	Generate(ctx context.Context, p models.HistoryParams) (*models.ReportJob, error)
+	Open(ctx context.Context, token string) (*os.File, *models.ReportJob, error)
+	Validate(p *models.HistoryParams) error
+	Stream(ctx context.Context, w io.Writer, p models.HistoryParams) error
+}
+
+// apiKeyService defines the methods required for managing and authenticating API keys.
+type apiKeyService interface {
+	Create(ctx context.Context, key *models.APIKey) error
+	GetAll(ctx context.Context) ([]*models.APIKey, error)
+	Revoke(ctx context.Context, id int) (*models.APIKey, error)
+	Authenticate(ctx context.Context, key string) (*models.APIKey, error)
 }
 
 // APIServer represents the API server, including configuration, router, and services.
 type APIServer struct {
 	router *http.ServeMux  // HTTP router for handling requests.
+	server *http.Server    // HTTP server serving the router.
 	cfg    Config          // Configuration for server settings.
 	ctx    context.Context // Application context.
 	us     userService     // User service for user-related operations.
 	ss     segmentService  // Segment service for segment-related operations.
 	uss    userSegmentsService
+	rs     reportService // Report service for history reports.
+	ks     apiKeyService // API key service for key management.
+	db     database      // Database checked by the readiness probe.
+	auth   *middlewares.Auth
+	ready  atomic.Bool // Set while the server accepts traffic.
 }
 
 // New creates a new instance of APIServer with the provided context, configuration, and services.
-func New(ctx context.Context, cfg Config, us userService, ss segmentService, uss userSegmentsService) *APIServer {
+func New(ctx context.Context, cfg Config, us userService, ss segmentService, uss userSegmentsService,
+	rs reportService, ks apiKeyService, db database) *APIServer {
 	router := http.NewServeMux()
 
 	return &APIServer{
 		router: router,
-		cfg:    cfg,
-		ctx:    ctx,
-		us:     us,
-		ss:     ss,
-		uss:    uss,
+		server: &http.Server{
+			Addr:         cfg.Host + ":" + cfg.Port,
+			Handler:      middlewares.NewMiddleware(router), // Apply middleware to the router
+			ReadTimeout:  time.Second * 30,                  // Request read timeout
+			WriteTimeout: time.Second * 10,                  // Response Record Timeout
+			IdleTimeout:  time.Second * 60,                  // Keep-alive connections timeout
+		},
+		cfg:  cfg,
+		ctx:  ctx,
+		us:   us,
+		ss:   ss,
+		uss:  uss,
+		rs:   rs,
+		ks:   ks,
+		db:   db,
+		auth: middlewares.NewAuth(ks),
 	}
 }
 
 // Start begins the HTTP server, listening on the configured host and port.
+// It blocks until the server fails or is shut down; after Shutdown it returns nil.
 func (api *APIServer) Start() error {
 	api.configureRouter() // Configure the HTTP routes
-	server := &http.Server{
-		Addr:         api.cfg.Host + ":" + api.cfg.Port,
-		Handler:      middlewares.NewMiddleware(api.router), // Apply middleware to the router
-		ReadTimeout:  time.Second * 30,                      // Request read timeout
-		WriteTimeout: time.Second * 10,                      // Response Record Timeout
-		IdleTimeout:  time.Second * 60,                      // Keep-alive connections timeout
+	api.ready.Store(true)
+	if err := api.server.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+		api.ready.Store(false)
+		return err
+	}
+	return nil
+}
+
+// Shutdown stops the server gracefully: the readiness probe starts failing at once, after ShutdownDelay
+// the server stops accepting connections and waits for the requests in flight at most ShutdownTimeout.
+// The connections still open after that (e.g. long exports without a write deadline) are closed,
+// so that they do not keep database connections.
+func (api *APIServer) Shutdown(ctx context.Context) error {
+	api.ready.Store(false)
+	if api.cfg.ShutdownDelay > 0 {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(api.cfg.ShutdownDelay):
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, api.cfg.ShutdownTimeout)
+	defer cancel()
+	err := api.server.Shutdown(ctx)
+	if errors.Is(err, context.DeadlineExceeded) {
+		if closeErr := api.server.Close(); closeErr != nil {
+			return errors.Join(err, closeErr)
+		}
 	}
-	return server.ListenAndServe() // Start the HTTP server
+	return err
 }